@@ -0,0 +1,320 @@
+// Package app bootstraps the service: it connects the storage backend,
+// builds its indices & wires the routes, returning errors rather than
+// exiting so it can be started from any binary
+package app
+
+import (
+	"time"
+
+	"../auth"
+	"../config"
+	"../controller"
+	"../limiter"
+	"../metrics"
+	"../model"
+	"../tracing"
+	"github.com/facebookgo/grace/gracehttp"
+	"github.com/globalsign/mgo"
+	"github.com/labstack/echo"
+	"github.com/labstack/echo/middleware"
+	"github.com/labstack/gommon/log"
+	"github.com/swaggo/echo-swagger"
+)
+
+// App is the service, wired by New & served by Start
+type App struct {
+	Echo   *echo.Echo
+	Config *config.Config
+
+	// mongo tells whether job ads, orders, credits, api keys, idempotency
+	// keys & the audit log are served, they are kept in mongo only
+	mongo   bool
+	closers []func() error
+	// checks /readyz makes of the storage backend
+	checks map[string]controller.Check
+}
+
+// Build identifies the binary, main sets it before New
+var Build = controller.BuildInfo{Version: "dev", Commit: "unknown"}
+
+// New validates cfg, makes it the settings of every package, connects the
+// storage backend & wires the routes
+func New(cfg *config.Config) (*App, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	config.Use(cfg)
+
+	a := &App{
+		Echo:   echo.New(),
+		Config: cfg,
+		mongo:  cfg.StorageBackend == "mongo",
+		checks: map[string]controller.Check{},
+	}
+	a.Echo.Logger.SetLevel(log.INFO)
+
+	keys, err := auth.LoadKeySet(cfg.JWTKeysFile)
+	if err != nil {
+		return nil, err
+	}
+	shutdown, err := tracing.Setup(cfg.TracingExporter, cfg.TracingEndpoint, cfg.TracingSampleRatio, "jobads-api", Build.Version)
+	if err != nil {
+		return nil, err
+	}
+	// spans still buffered are flushed last, after the storage closed
+	a.closers = append(a.closers, shutdown)
+
+	s, err := a.connect()
+	if err != nil {
+		a.Close()
+		return nil, err
+	}
+
+	a.routes(s, keys)
+	return a, nil
+}
+
+// connect the storage backend, retried while it comes up, & build the
+// server on its repositories
+func (a *App) connect() (*controller.Server, error) {
+	if !a.mongo {
+		a.Echo.Logger.Warn("storage backend " + a.Config.StorageBackend + " keeps products, customers & rules only: job ads, orders, credits, api keys, idempotency keys, the audit log & background jobs need mongo and are off")
+	}
+
+	switch a.Config.StorageBackend {
+	case "memory":
+		store := model.NewMemoryStore()
+		a.closers = append(a.closers, store.Close)
+		return controller.NewServer(store.Products(), store.Customers(), store.Rules()), nil
+	case "bolt":
+		var store *model.Store
+		err := a.retry("bolt", func() (err error) {
+			store, err = model.OpenBoltStore(a.Config.BoltPath)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		a.closers = append(a.closers, store.Close)
+		return controller.NewServer(store.Products(), store.Customers(), store.Rules()), nil
+	case "postgres":
+		var pg *model.Postgres
+		err := a.retry("postgres", func() (err error) {
+			pg, err = model.OpenPostgres(a.Config.PostgresURL)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		a.closers = append(a.closers, pg.Close)
+		a.checks["postgres"] = pg.Ping
+		return controller.NewServer(pg.Products(), pg.Customers(), pg.Rules()), nil
+	}
+
+	info, err := a.dialInfo()
+	if err != nil {
+		return nil, err
+	}
+	err = a.retry("mongo", func() error {
+		return model.Connect(info)
+	})
+	if err != nil {
+		return nil, err
+	}
+	a.closers = append(a.closers, model.Disconnect)
+	a.checks["mongo"] = model.Ping
+	if err = model.Indexing(); err != nil {
+		return nil, err
+	}
+	return controller.NewServer(
+		model.MongoProductRepository{},
+		model.MongoCustomerRepository{},
+		model.MongoPricingRuleRepository{},
+	), nil
+}
+
+// dialInfo of mongo, DbHost is a host or a mongodb:// url the other mongo
+// settings complete
+func (a *App) dialInfo() (*mgo.DialInfo, error) {
+	info, err := mgo.ParseURL(a.Config.DbHost)
+	if err != nil {
+		return nil, err
+	}
+	info.Timeout = a.Config.DbTimeout
+	info.PoolLimit = a.Config.DbPoolSize
+	if a.Config.DbUsername != "" {
+		info.Username = a.Config.DbUsername
+		info.Password = a.Config.DbPassword
+	}
+	if a.Config.DbAuthSource != "" {
+		info.Source = a.Config.DbAuthSource
+	}
+	return info, nil
+}
+
+// retry fn up to ConnectAttempts times, waiting twice as long after each
+// failure, & give the last error
+func (a *App) retry(what string, fn func() error) (err error) {
+	wait := time.Second
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil || attempt == a.Config.ConnectAttempts {
+			return err
+		}
+		a.Echo.Logger.Warn("connecting to " + what + " failed, retrying: " + err.Error())
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// routes wires the middleware & the routes to s
+func (a *App) routes(s *controller.Server, keys *auth.KeySet) {
+	e := a.Echo
+	e.Use(middleware.RequestID())
+	e.Use(controller.Trace())
+	if a.Config.Metrics {
+		e.Use(controller.Metrics())
+	}
+	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{Skipper: controller.IsProbe}))
+	if len(a.Config.CORSOrigins) > 0 {
+		e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
+			AllowOrigins:  a.Config.CORSOrigins,
+			ExposeHeaders: []string{"ETag", "X-Request-ID", "Retry-After", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset"},
+		}))
+	}
+
+	// clients are limited by IP before authenticating, so guessing keys is
+	// throttled, & by principal after
+	var limits limiter.Store = limiter.NewMemory()
+	if a.Config.RateLimitStore == "mongo" {
+		limits = model.RateLimitStore{}
+	}
+	e.Use(controller.RateLimitIP(limits))
+	e.Use(controller.Authenticate(keys))
+	e.Use(controller.RateLimit(limits))
+
+	if a.mongo {
+		e.Use(controller.Idempotent())
+	} else {
+		e.Use(controller.NoIdempotency())
+	}
+
+	// probe routes
+	build := Build
+	build.StartedAt = time.Now()
+	e.GET("/healthz", controller.Healthz)
+	e.GET("/readyz", controller.Readyz(a.checks, a.Config.ReadyTimeout))
+	e.GET("/version", controller.Version(build))
+	if a.Config.Metrics {
+		e.GET("/metrics", echo.WrapHandler(metrics.Handler()))
+	}
+
+	// who may call what, customer principals are further held to their
+	// own customer by the Owns checks
+	admin := controller.Allow(auth.RoleAdmin)
+	staff := controller.Allow(auth.RoleAdmin, auth.RoleSales)
+	anyone := controller.Allow(auth.RoleAdmin, auth.RoleSales, auth.RoleCustomer)
+
+	// product routes
+	e.GET("/products", s.ProductListing, staff)
+	e.POST("/product/create", s.ProductCreate, admin)
+	e.GET("/product/:id", s.ProductSelectByID, staff)
+	e.GET("/product/:id/versions", s.ProductVersions, staff)
+	e.PUT("/product/:id", s.ProductUpdate, admin)
+	e.DELETE("/product/:id", s.ProductDelete, admin)
+	e.POST("/product/:id/restore", s.ProductRestore, admin)
+
+	// customer routes
+	e.GET("/customers", s.CustomerSearch, staff)
+	e.POST("/customer/create", s.CustomerCreate, staff)
+	e.GET("/customer/:id", s.CustomerSelectByID, staff)
+	e.PUT("/customer/:id", s.CustomerUpdate, staff)
+	e.DELETE("/customer/:id", s.CustomerDelete, staff)
+	e.POST("/customer/:id/restore", s.CustomerRestore, staff)
+
+	// rules routes
+	e.GET("/rules", s.PricingRulesListing, staff)
+	e.POST("/rule/create", s.PricingRulesCreate, staff)
+	e.GET("/rule/:id", s.PricingRulesSelectByID, anyone, controller.Owns(s.PricingRulesOwner))
+	e.GET("/rule/:id/versions", s.PricingRulesVersions, staff)
+	e.GET("/rule/customer/:id", s.PricingRulesSelectByCustomerID, anyone, controller.Owns(controller.CustomerParam))
+	e.PUT("/rule/:id", s.PricingRulesUpdate, staff)
+	e.DELETE("/rule/:id", s.PricingRulesDelete, staff)
+	e.POST("/rule/:id/restore", s.PricingRulesRestore, staff)
+
+	// bulk routes
+	e.POST("/import/products", s.ProductImport, admin)
+	e.POST("/import/customers", s.CustomerImport, staff)
+	e.POST("/import/rules", s.PricingRulesImport, staff)
+	e.GET("/export/products", s.ProductExport, staff)
+	e.GET("/export/customers", s.CustomerExport, staff)
+	e.GET("/export/rules", s.PricingRulesExport, staff)
+
+	// calculation routes
+	e.POST("/calculate/batch", s.CalculateBatch, staff)
+	e.POST("/calculate/:id", s.Calculate, anyone, controller.Owns(controller.CustomerParam))
+
+	if a.mongo {
+		// job ads routes
+		e.GET("/jobads", s.JobAdListing, staff)
+		e.GET("/jobads/search", s.JobAdSearch)
+		e.POST("/jobad/create", s.JobAdCreate, anyone, controller.Owns(controller.CustomerForm))
+		e.GET("/jobad/:id", s.JobAdSelectByID, staff)
+		e.PUT("/jobad/:id", s.JobAdUpdate, staff)
+		e.DELETE("/jobad/:id", s.JobAdDelete, staff)
+		e.POST("/jobad/:id/upgrade", s.JobAdUpgrade, anyone, controller.Owns(controller.JobAdOwner))
+
+		// order routes
+		e.GET("/order/:id", s.OrderSelectByID, anyone, controller.Owns(controller.OrderOwner))
+		e.GET("/order/customer/:id", s.OrderSelectByCustomerID, anyone, controller.Owns(controller.CustomerParam))
+		// payments are recorded by staff, a customer marking their own order
+		// paid would get the upgrade for free
+		e.POST("/order/:id/pay", s.OrderPay, staff)
+
+		// credit routes
+		e.POST("/credit/create", s.CreditCreate, staff)
+		e.GET("/credit/customer/:id", s.CreditSelectByCustomerID, staff)
+
+		// api key routes
+		e.GET("/apikeys", s.APIKeyListing, admin)
+		e.POST("/apikey/create", s.APIKeyCreate, admin)
+		e.POST("/apikey/:id/rotate", s.APIKeyRotate, admin)
+		e.DELETE("/apikey/:id", s.APIKeyRevoke, admin)
+
+		// audit routes
+		e.GET("/audit", s.AuditSearch, admin)
+	}
+
+	//Routes for specs
+	if a.Config.Specs {
+		e.GET("/specs/*", echoSwagger.WrapHandler)
+	}
+}
+
+// Start the background jobs & serve until the server is shut down
+func (a *App) Start() error {
+	if a.mongo && a.Config.BackgroundJobs {
+		// expire job ads at the end of their run
+		go model.JobAdExpiry(time.Minute)
+
+		// hard delete documents once deleted past retention
+		go model.DeletedPurge(time.Hour, a.Config.PurgeRetention)
+	}
+
+	a.Echo.Server.Addr = ":" + a.Config.Port
+	a.Echo.Server.ReadTimeout = a.Config.ReadTimeout
+	a.Echo.Server.WriteTimeout = a.Config.WriteTimeout
+	a.Echo.Server.IdleTimeout = a.Config.IdleTimeout
+	return gracehttp.Serve(a.Echo.Server)
+}
+
+// Close the storage backend, in the reverse order it was connected
+func (a *App) Close() error {
+	var err error
+	for i := len(a.closers) - 1; i >= 0; i-- {
+		if cerr := a.closers[i](); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	a.closers = nil
+	return err
+}
@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// ErrInvalidToken for any bearer token that can't be trusted, the reason
+// is kept from the caller
+var ErrInvalidToken = errors.New("Bearer token is invalid")
+
+type (
+	// Key is one verification key, HMAC keys carry the secret & RSA or
+	// ECDSA keys the PEM encoded public key
+	Key struct {
+		ID        string `json:"kid"`
+		Algorithm string `json:"alg"`
+		Secret    string `json:"secret,omitempty"`
+		PublicKey string `json:"public_key,omitempty"`
+
+		verify interface{}
+	}
+
+	// KeySet is the locally configured keys bearer tokens are checked with
+	KeySet struct {
+		Keys     []*Key `json:"keys"`
+		Issuer   string `json:"issuer,omitempty"`
+		Audience string `json:"audience,omitempty"`
+	}
+
+	// Claims carried by bearer tokens
+	Claims struct {
+		jwt.StandardClaims
+		Name       string   `json:"name,omitempty"`
+		CustomerID string   `json:"customer_id,omitempty"`
+		Roles      []string `json:"roles,omitempty"`
+	}
+)
+
+// LoadKeySet reads a key set file, an empty path gives an empty set that
+// rejects every token
+func LoadKeySet(path string) (*KeySet, error) {
+	set := &KeySet{}
+	if path == "" {
+		return set, nil
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(raw, set); err != nil {
+		return nil, errors.New("Key set " + path + " is not valid JSON")
+	}
+
+	for _, key := range set.Keys {
+		if err = key.parse(); err != nil {
+			return nil, err
+		}
+	}
+
+	return set, nil
+}
+
+// parse turns the configured material into the key jwt-go verifies with
+func (key *Key) parse() (err error) {
+	if key.ID == "" {
+		return errors.New("Key set entries need a kid")
+	}
+	method := jwt.GetSigningMethod(key.Algorithm)
+	switch method.(type) {
+	case *jwt.SigningMethodHMAC:
+		if len(key.Secret) < 32 {
+			return errors.New("Key " + key.ID + " secret must be at least 32 bytes")
+		}
+		key.verify = []byte(key.Secret)
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		key.verify, err = jwt.ParseRSAPublicKeyFromPEM([]byte(key.PublicKey))
+	case *jwt.SigningMethodECDSA:
+		key.verify, err = jwt.ParseECPublicKeyFromPEM([]byte(key.PublicKey))
+	default:
+		return errors.New("Key " + key.ID + " has unsupported alg " + key.Algorithm)
+	}
+	if err != nil {
+		return errors.New("Key " + key.ID + " public key is invalid")
+	}
+	return nil
+}
+
+// Verify checks a bearer token against the key set, the token must name
+// its key by kid & be signed with that key's algorithm
+func (set *KeySet) Verify(token string) (*Principal, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		for _, key := range set.Keys {
+			if key.ID == kid && key.Algorithm == t.Method.Alg() {
+				return key.verify, nil
+			}
+		}
+		return nil, ErrInvalidToken
+	})
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	now := time.Now().Unix()
+	if claims.Subject == "" || !claims.VerifyExpiresAt(now, true) {
+		return nil, ErrInvalidToken
+	}
+	if set.Issuer != "" && !claims.VerifyIssuer(set.Issuer, true) {
+		return nil, ErrInvalidToken
+	}
+	if set.Audience != "" && !claims.VerifyAudience(set.Audience, true) {
+		return nil, ErrInvalidToken
+	}
+
+	return &Principal{
+		ID:         claims.Subject,
+		Kind:       KindJWT,
+		Name:       claims.Name,
+		CustomerID: claims.CustomerID,
+		Roles:      claims.Roles,
+	}, nil
+}
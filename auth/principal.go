@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+)
+
+// principal kinds
+const (
+	KindAPIKey = "api_key"
+	KindJWT    = "jwt"
+	KindAdmin  = "admin"
+)
+
+// roles a principal can hold
+const (
+	// RoleAdmin manages everything
+	RoleAdmin = "admin"
+	// RoleSales manages customers & their rules, not the product catalogue
+	RoleSales = "sales"
+	// RoleCustomer is limited to its own customer's pricing & orders
+	RoleCustomer = "customer"
+)
+
+type (
+	// Principal is who an authenticated request acts as
+	Principal struct {
+		ID         string   `json:"id"`
+		Kind       string   `json:"kind"`
+		Name       string   `json:"name"`
+		CustomerID string   `json:"customer_id,omitempty"`
+		Roles      []string `json:"roles"`
+	}
+
+	principalKey struct{}
+)
+
+// String names the principal in logs & the audit trail
+func (p *Principal) String() string {
+	return p.Kind + ":" + p.ID
+}
+
+// HasRole whether the principal holds any of roles
+func (p *Principal) HasRole(roles ...string) bool {
+	for _, held := range p.Roles {
+		for _, role := range roles {
+			if held == role {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WithPrincipal attaches the authenticated principal to a context
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFrom reads the principal back, nil for unauthenticated contexts
+func PrincipalFrom(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// HashKey is how API keys are stored, keys carry enough entropy that a
+// plain digest can't be brute forced
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// SameKey compares two keys in constant time
+func SameKey(a string, b string) bool {
+	ha, hb := sha256.Sum256([]byte(a)), sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
@@ -5,4 +5,14 @@ var (
 	ProductsCollection     = "products"
 	CustomersCollection    = "customers"
 	PricingRulesCollection = "pricingrules"
+	JobAdsCollection       = "jobads"
+	CreditsCollection      = "credits"
+	OrdersCollection       = "orders"
+	AuditCollection        = "audit"
+	APIKeysCollection      = "apikeys"
+	RateLimitsCollection   = "ratelimits"
+	IdempotencyCollection  = "idempotency"
+
+	ProductVersionsCollection      = "productversions"
+	PricingRulesVersionsCollection = "pricingrulesversions"
 )
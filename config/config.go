@@ -1,40 +1,305 @@
 package config
 
 import (
-	"log"
-	"os"
+	"net"
+	"strings"
+	"time"
 )
 
-// var public settings
+type (
+	// RateLimit is a token bucket, Burst requests refilled at Rate per second
+	RateLimit struct {
+		Rate  float64
+		Burst int
+	}
+
+	// Config is every setting of the service, Load layers it from a file,
+	// the environment & flags & Use hands it to the packages
+	Config struct {
+		Env  string
+		Port string
+
+		// server timeouts, zero waits forever
+		ReadTimeout  time.Duration
+		WriteTimeout time.Duration
+		IdleTimeout  time.Duration
+
+		// ReadyTimeout bounds each check /readyz makes
+		ReadyTimeout time.Duration
+
+		// CORSOrigins may call the API from a browser, none turns CORS off
+		CORSOrigins []string
+
+		// TrustedProxies are the networks, in CIDR notation, of the proxies
+		// whose X-Forwarded-For & X-Real-IP are believed, none believes them
+		// from no one
+		TrustedProxies []string
+
+		// mongo, DbPassword is read from DbPasswordFile when that is set
+		DbHost         string
+		DbName         string
+		DbTimeout      time.Duration
+		DbPoolSize     int
+		DbUsername     string
+		DbPassword     string
+		DbPasswordFile string
+		DbAuthSource   string
+
+		// UpgradeProrate charges ad upgrades only for the remaining run time
+		UpgradeProrate bool
+
+		// RequireIfMatch rejects updates & deletes sent without If-Match
+		RequireIfMatch bool
+
+		// Specs serves the swagger specs under /specs
+		Specs bool
+
+		// BackgroundJobs expires job ads & purges deleted documents
+		BackgroundJobs bool
+
+		// Metrics serves the prometheus metrics under /metrics
+		Metrics bool
+
+		// Audit logs every change, the log lives in mongo so the other
+		// backends keep none & must be told to go without
+		Audit bool
+
+		// PurgeRetention is how long deleted documents are kept before purge
+		PurgeRetention time.Duration
+
+		// AdminAPIKey bootstraps access before any API key has been issued
+		AdminAPIKey string
+
+		// JWTKeysFile is the key set bearer tokens are verified against
+		JWTKeysFile string
+
+		// RateLimits per route path, "default" covers routes not listed & a
+		// zero rate turns limiting off
+		RateLimits map[string]RateLimit
+
+		// RateLimitStore is memory, per instance, or mongo, shared by instances
+		RateLimitStore string
+
+		// IdempotencyTTL is how long a stored response answers its key's replays
+		IdempotencyTTL time.Duration
+
+		// StorageBackend keeps products, customers & rules in mongo, memory,
+		// bolt, a single file at BoltPath, or postgres at PostgresURL. the
+		// other collections need mongo
+		StorageBackend string
+		BoltPath       string
+		PostgresURL    string
+
+		// ConnectAttempts to reach the storage backend before giving up
+		ConnectAttempts int
+
+		// TracingExporter sends spans over OTLP/HTTP to TracingEndpoint,
+		// writes them to stdout or, none, drops them. TracingSampleRatio of
+		// new traces are sampled, traces begun upstream follow the caller
+		TracingExporter    string
+		TracingEndpoint    string
+		TracingSampleRatio float64
+
+		// PrintConfig asks for the effective settings to be printed instead
+		// of serving, it is a flag only
+		PrintConfig bool
+
+		// configured are the keys of the settings a layer set, the others
+		// hold their defaults
+		configured map[string]bool
+	}
+
+	// Errors are every problem found with the settings, reported at once
+	Errors []string
+)
+
+// var public settings, the ones of the Config last given to Use. they hold
+// the defaults until then
 var (
-	Env    string
-	DbHost string
-	DbName string
-	Port   string
+	defaults = Default()
+
+	Env             = defaults.Env
+	DbHost          = defaults.DbHost
+	DbName          = defaults.DbName
+	Port            = defaults.Port
+	UpgradeProrate  = defaults.UpgradeProrate
+	RequireIfMatch  = defaults.RequireIfMatch
+	PurgeRetention  = defaults.PurgeRetention
+	AdminAPIKey     = defaults.AdminAPIKey
+	JWTKeysFile     = defaults.JWTKeysFile
+	RateLimits      = defaults.RateLimits
+	RateLimitStore  = defaults.RateLimitStore
+	IdempotencyTTL  = defaults.IdempotencyTTL
+	StorageBackend  = defaults.StorageBackend
+	BoltPath        = defaults.BoltPath
+	PostgresURL     = defaults.PostgresURL
+	ConnectAttempts = defaults.ConnectAttempts
+	Audit           = defaults.Audit
+	TrustedProxies  []*net.IPNet
 )
 
-func init() {
+func (e Errors) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e, "\n  ")
+}
+
+// Default settings, the ones no layer overrides
+func Default() *Config {
+	return &Config{
+		ReadTimeout:    30 * time.Second,
+		IdleTimeout:    2 * time.Minute,
+		ReadyTimeout:   2 * time.Second,
+		DbTimeout:      10 * time.Second,
+		DbPoolSize:     4096,
+		UpgradeProrate: true,
+		Specs:          true,
+		BackgroundJobs: true,
+		Metrics:        true,
+		Audit:          true,
+		PurgeRetention: 30 * 24 * time.Hour,
+		RateLimits: map[string]RateLimit{
+			"default":          {Rate: 20, Burst: 40},
+			"/calculate/:id":   {Rate: 2, Burst: 10},
+			"/calculate/batch": {Rate: 0.2, Burst: 2},
+		},
+		RateLimitStore:  "memory",
+		IdempotencyTTL:  24 * time.Hour,
+		StorageBackend:  "mongo",
+		BoltPath:        "jobads.db",
+		ConnectAttempts: 5,
+
+		TracingExporter:    "none",
+		TracingEndpoint:    "http://localhost:4318",
+		TracingSampleRatio: 1,
+	}
+}
+
+// Validate the settings, every problem found is in the Errors returned
+func (c *Config) Validate() error {
+	var errs Errors
+	required := func(key string, value string) {
+		if value == "" {
+			errs = append(errs, describe(key)+" is required")
+		}
+	}
 
-	Env = os.Getenv("ENV")
-	DbHost = os.Getenv("DB_HOST")
-	DbName = os.Getenv("DB_NAME")
-	Port = os.Getenv("PORT")
+	required("env", c.Env)
+	required("server.port", c.Port)
+	switch c.StorageBackend {
+	case "mongo":
+		required("db.host", c.DbHost)
+		required("db.name", c.DbName)
+	case "postgres":
+		required("storage.postgres_url", c.PostgresURL)
+	case "memory", "bolt":
+	default:
+		errs = append(errs, describe("storage.backend")+" must be mongo, memory, bolt or postgres")
+	}
 
-	if Env == "" {
-		log.Fatal("cannot find ENV from Env")
+	durations := []struct {
+		key string
+		d   time.Duration
+	}{
+		{"server.read_timeout", c.ReadTimeout},
+		{"server.write_timeout", c.WriteTimeout},
+		{"server.idle_timeout", c.IdleTimeout},
+		{"server.ready_timeout", c.ReadyTimeout},
+		{"db.timeout", c.DbTimeout},
+		{"purge.retention", c.PurgeRetention},
+	}
+	for _, duration := range durations {
+		if duration.d < 0 {
+			errs = append(errs, describe(duration.key)+" must not be negative")
+		}
+	}
+	if c.IdempotencyTTL < time.Hour {
+		errs = append(errs, describe("idempotency.ttl")+" must be at least an hour")
 	}
-	if DbHost == "" {
-		log.Fatal("cannot find DB_HOST from Env")
+	if c.DbPoolSize < 1 {
+		errs = append(errs, describe("db.pool_size")+" must be a positive number")
 	}
-	if DbName == "" {
-		log.Fatal("cannot find DB_NAME from Env")
+	if c.ConnectAttempts < 1 {
+		errs = append(errs, describe("storage.connect_attempts")+" must be a positive number")
 	}
-	if Port == "" {
-		log.Fatal("cannot find PORT from Env")
+
+	for _, cidr := range c.TrustedProxies {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			errs = append(errs, describe("server.trusted_proxies")+" "+cidr+" is not a network in CIDR notation, e.g. 10.0.0.0/8")
+		}
+	}
+
+	if c.AdminAPIKey != "" && len(c.AdminAPIKey) < 32 {
+		errs = append(errs, describe("auth.admin_api_key")+" must be at least 32 characters")
+	}
+	for _, route := range routes(c.RateLimits) {
+		if limit := c.RateLimits[route]; limit.Rate < 0 || limit.Burst < 0 {
+			errs = append(errs, describe("rate_limit.routes")+" of "+route+" must not be negative")
+		}
+	}
+	if c.RateLimitStore != "memory" && c.RateLimitStore != "mongo" {
+		errs = append(errs, describe("rate_limit.store")+" must be memory or mongo")
+	}
+	if c.RateLimitStore == "mongo" && c.StorageBackend != "mongo" {
+		errs = append(errs, describe("rate_limit.store")+" mongo needs "+describe("storage.backend")+" mongo")
+	}
+	// changes would go unaudited without anyone having said so
+	if c.StorageBackend != "mongo" && c.Audit {
+		errs = append(errs, describe("features.audit")+" needs "+describe("storage.backend")+" mongo, the other backends keep no audit log: turn it off to run without one")
+	}
+	// other backends go without what these configure rather than ignore
+	// them, turning background jobs off is fine though
+	if c.StorageBackend != "mongo" {
+		for _, key := range mongoOnly {
+			if c.configured[key] && (key != "features.background_jobs" || c.BackgroundJobs) {
+				errs = append(errs, describe(key)+" needs "+describe("storage.backend")+" mongo")
+			}
+		}
+	}
+
+	switch c.TracingExporter {
+	case "otlp":
+		required("tracing.otlp_endpoint", c.TracingEndpoint)
+	case "stdout", "none":
+	default:
+		errs = append(errs, describe("tracing.exporter")+" must be otlp, stdout or none")
+	}
+	if c.TracingSampleRatio < 0 || c.TracingSampleRatio > 1 {
+		errs = append(errs, describe("tracing.sample_ratio")+" must be between 0 and 1")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Use c as the settings the packages read
+func Use(c *Config) {
+	Env = c.Env
+	DbHost = c.DbHost
+	DbName = c.DbName
+	Port = c.Port
+	UpgradeProrate = c.UpgradeProrate
+	RequireIfMatch = c.RequireIfMatch
+	PurgeRetention = c.PurgeRetention
+	AdminAPIKey = c.AdminAPIKey
+	JWTKeysFile = c.JWTKeysFile
+	RateLimits = c.RateLimits
+	RateLimitStore = c.RateLimitStore
+	IdempotencyTTL = c.IdempotencyTTL
+	StorageBackend = c.StorageBackend
+	BoltPath = c.BoltPath
+	PostgresURL = c.PostgresURL
+	ConnectAttempts = c.ConnectAttempts
+	Audit = c.Audit
+	TrustedProxies = nil
+	for _, cidr := range c.TrustedProxies {
+		if _, network, err := net.ParseCIDR(cidr); err == nil {
+			TrustedProxies = append(TrustedProxies, network)
+		}
 	}
 }
 
-//IsProduction to check whether Environment is production
+// IsProduction to check whether Environment is production
 func IsProduction() bool {
 	return Env == "production"
 }
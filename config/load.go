@@ -0,0 +1,513 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// setting is one the layers may set, by its key in a file, its environment
+// variable & its flag, the key with dashes
+type setting struct {
+	key   string
+	env   string
+	usage string
+	// unit of a duration given as a bare number, none needs e.g. 30s
+	unit time.Duration
+	// redact hides the secret parts of a value when printed
+	redact func(string) string
+	// field of the config the setting holds
+	field func(c *Config) interface{}
+}
+
+// settings in the order they are printed
+var settings = []setting{
+	{key: "env", env: "ENV", usage: "environment, production or else",
+		field: func(c *Config) interface{} { return &c.Env }},
+
+	{key: "server.port", env: "PORT", usage: "port to serve on",
+		field: func(c *Config) interface{} { return &c.Port }},
+	{key: "server.read_timeout", env: "SERVER_READ_TIMEOUT", usage: "longest read of a request, 0 for none",
+		field: func(c *Config) interface{} { return &c.ReadTimeout }},
+	{key: "server.write_timeout", env: "SERVER_WRITE_TIMEOUT", usage: "longest write of a response, 0 for none",
+		field: func(c *Config) interface{} { return &c.WriteTimeout }},
+	{key: "server.idle_timeout", env: "SERVER_IDLE_TIMEOUT", usage: "longest wait for the next request on a connection, 0 for none",
+		field: func(c *Config) interface{} { return &c.IdleTimeout }},
+	{key: "server.ready_timeout", env: "SERVER_READY_TIMEOUT", usage: "longest wait for each check of /readyz",
+		field: func(c *Config) interface{} { return &c.ReadyTimeout }},
+	{key: "server.trusted_proxies", env: "TRUSTED_PROXIES", usage: "comma separated CIDRs of the proxies whose forwarding headers are believed",
+		field: func(c *Config) interface{} { return &c.TrustedProxies }},
+	{key: "cors.origins", env: "CORS_ORIGINS", usage: "comma separated origins browsers may call from, none turns CORS off",
+		field: func(c *Config) interface{} { return &c.CORSOrigins }},
+
+	{key: "db.host", env: "DB_HOST", usage: "mongo host or mongodb:// url", redact: redactURL,
+		field: func(c *Config) interface{} { return &c.DbHost }},
+	{key: "db.name", env: "DB_NAME", usage: "mongo database",
+		field: func(c *Config) interface{} { return &c.DbName }},
+	{key: "db.timeout", env: "DB_TIMEOUT", usage: "mongo dial & socket timeout",
+		field: func(c *Config) interface{} { return &c.DbTimeout }},
+	{key: "db.pool_size", env: "DB_POOL_SIZE", usage: "most connections per mongo server",
+		field: func(c *Config) interface{} { return &c.DbPoolSize }},
+	{key: "db.username", env: "DB_USERNAME", usage: "mongo user",
+		field: func(c *Config) interface{} { return &c.DbUsername }},
+	{key: "db.password", env: "DB_PASSWORD", usage: "mongo password", redact: redactSecret,
+		field: func(c *Config) interface{} { return &c.DbPassword }},
+	{key: "db.password_file", env: "DB_PASSWORD_FILE", usage: "file holding the mongo password",
+		field: func(c *Config) interface{} { return &c.DbPasswordFile }},
+	{key: "db.auth_source", env: "DB_AUTH_SOURCE", usage: "mongo database the user is defined in",
+		field: func(c *Config) interface{} { return &c.DbAuthSource }},
+
+	{key: "storage.backend", env: "STORAGE_BACKEND", usage: "mongo, memory, bolt or postgres",
+		field: func(c *Config) interface{} { return &c.StorageBackend }},
+	{key: "storage.bolt_path", env: "BOLT_PATH", usage: "bolt database file",
+		field: func(c *Config) interface{} { return &c.BoltPath }},
+	{key: "storage.postgres_url", env: "POSTGRES_URL", usage: "postgres:// url", redact: redactURL,
+		field: func(c *Config) interface{} { return &c.PostgresURL }},
+	{key: "storage.connect_attempts", env: "CONNECT_ATTEMPTS", usage: "attempts to reach the storage backend at startup",
+		field: func(c *Config) interface{} { return &c.ConnectAttempts }},
+
+	{key: "tracing.exporter", env: "TRACING_EXPORTER", usage: "otlp, stdout or none",
+		field: func(c *Config) interface{} { return &c.TracingExporter }},
+	{key: "tracing.otlp_endpoint", env: "TRACING_OTLP_ENDPOINT", usage: "OTLP/HTTP collector url, http:// ones are sent in the clear",
+		field: func(c *Config) interface{} { return &c.TracingEndpoint }},
+	{key: "tracing.sample_ratio", env: "TRACING_SAMPLE_RATIO", usage: "share of new traces sampled, from 0 to 1",
+		field: func(c *Config) interface{} { return &c.TracingSampleRatio }},
+
+	{key: "auth.admin_api_key", env: "ADMIN_API_KEY", usage: "bootstrap admin key, at least 32 characters", redact: redactSecret,
+		field: func(c *Config) interface{} { return &c.AdminAPIKey }},
+	{key: "auth.jwt_keys_file", env: "JWT_KEYS_FILE", usage: "key set bearer tokens are verified against",
+		field: func(c *Config) interface{} { return &c.JWTKeysFile }},
+
+	{key: "rate_limit.routes", env: "RATE_LIMITS", usage: "route=rate:burst pairs, comma separated",
+		field: func(c *Config) interface{} { return &c.RateLimits }},
+	{key: "rate_limit.store", env: "RATE_LIMIT_STORE", usage: "memory or mongo",
+		field: func(c *Config) interface{} { return &c.RateLimitStore }},
+	{key: "idempotency.ttl", env: "IDEMPOTENCY_TTL_HOURS", usage: "how long idempotency keys are kept, in hours", unit: time.Hour,
+		field: func(c *Config) interface{} { return &c.IdempotencyTTL }},
+	{key: "purge.retention", env: "PURGE_RETENTION_DAYS", usage: "how long deleted documents are kept, in days", unit: 24 * time.Hour,
+		field: func(c *Config) interface{} { return &c.PurgeRetention }},
+
+	{key: "features.upgrade_prorate", env: "UPGRADE_PRORATE", usage: "charge upgrades for the remaining run time only",
+		field: func(c *Config) interface{} { return &c.UpgradeProrate }},
+	{key: "features.require_if_match", env: "REQUIRE_IF_MATCH", usage: "reject updates & deletes without If-Match",
+		field: func(c *Config) interface{} { return &c.RequireIfMatch }},
+	{key: "features.specs", env: "FEATURE_SPECS", usage: "serve the swagger specs",
+		field: func(c *Config) interface{} { return &c.Specs }},
+	{key: "features.background_jobs", env: "FEATURE_BACKGROUND_JOBS", usage: "expire job ads & purge deleted documents",
+		field: func(c *Config) interface{} { return &c.BackgroundJobs }},
+	{key: "features.metrics", env: "FEATURE_METRICS", usage: "serve the prometheus metrics",
+		field: func(c *Config) interface{} { return &c.Metrics }},
+	{key: "features.audit", env: "FEATURE_AUDIT", usage: "log every change, needs the mongo storage backend",
+		field: func(c *Config) interface{} { return &c.Audit }},
+}
+
+// mongoOnly settings configure what is kept in mongo
+var mongoOnly = []string{"features.background_jobs", "purge.retention", "idempotency.ttl"}
+
+// Load the settings, each layer over the one before:
+//
+//  1. the defaults
+//  2. the YAML or TOML file given by -config or CONFIG_FILE
+//  3. the environment
+//  4. the flags
+//
+// every problem found in any layer is in the Errors returned
+func Load(args []string) (*Config, error) {
+	c := Default()
+	var errs Errors
+
+	flags := flag.NewFlagSet("jobads", flag.ContinueOnError)
+	path := flags.String("config", os.Getenv("CONFIG_FILE"), "YAML or TOML file of settings (env CONFIG_FILE)")
+	flags.BoolVar(&c.PrintConfig, "print-config", false, "print the effective settings, secrets redacted, & exit")
+	for _, s := range settings {
+		flags.String(s.flag(), "", s.usage+" (env "+s.env+")")
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *path != "" {
+		values, err := readFile(*path)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s, ok := lookup(key)
+			if !ok {
+				errs = append(errs, *path+": unknown setting "+key)
+				continue
+			}
+			if err = s.set(c, values[key]); err != nil {
+				errs = append(errs, *path+": "+key+" "+err.Error())
+			}
+		}
+	}
+
+	for _, s := range settings {
+		if value := os.Getenv(s.env); value != "" {
+			if err := s.set(c, value); err != nil {
+				errs = append(errs, s.env+" "+err.Error())
+			}
+		}
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag() != f.Name {
+				continue
+			}
+			if err := s.set(c, f.Value.String()); err != nil {
+				errs = append(errs, "-"+f.Name+" "+err.Error())
+			}
+		}
+	})
+
+	if c.DbPasswordFile != "" {
+		raw, err := ioutil.ReadFile(c.DbPasswordFile)
+		switch {
+		case c.DbPassword != "":
+			errs = append(errs, describe("db.password")+" & "+describe("db.password_file")+" can't both be set")
+		case err != nil:
+			errs = append(errs, describe("db.password_file")+" can't be read: "+err.Error())
+		default:
+			c.DbPassword = strings.TrimRight(string(raw), "\r\n")
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		errs = append(errs, err.(Errors)...)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return c, nil
+}
+
+// Print the settings as a TOML file Load reads back. settings holding a
+// secret are commented out, redacted, to be given again through their
+// environment, & so are the mongo only settings on other backends, which
+// refuse them
+func (c *Config) Print(w io.Writer) error {
+	for _, s := range settings {
+		value := s.get(c)
+		redacted := false
+		if s.redact != nil && value != "" {
+			redacted = s.redact(value) != value
+			value = s.redact(value)
+		}
+		line := s.key + " = " + strconv.Quote(value)
+		switch {
+		case redacted:
+			line = "# " + line + " redacted, set " + s.env
+		case c.StorageBackend != "mongo" && isMongoOnly(s.key):
+			line = "# " + line + " needs storage.backend mongo"
+		}
+		if _, err := io.WriteString(w, line+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isMongoOnly whether key is one of the mongoOnly settings
+func isMongoOnly(key string) bool {
+	for _, k := range mongoOnly {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup the setting of key
+func lookup(key string) (setting, bool) {
+	for _, s := range settings {
+		if s.key == key {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
+
+// describe key by the names it is given in a file & the environment
+func describe(key string) string {
+	s, _ := lookup(key)
+	return key + " (" + s.env + ")"
+}
+
+// flag of the setting, e.g. -db-pool-size
+func (s setting) flag() string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(s.key)
+}
+
+// set the setting's field of c from value
+func (s setting) set(c *Config, value string) error {
+	value = strings.TrimSpace(value)
+	switch field := s.field(c).(type) {
+	case *string:
+		*field = value
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("must be true or false")
+		}
+		*field = b
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.New("must be a number")
+		}
+		*field = n
+	case *float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return errors.New("must be a number")
+		}
+		*field = f
+	case *time.Duration:
+		d, err := parseDuration(value, s.unit)
+		if err != nil {
+			return err
+		}
+		*field = d
+	case *[]string:
+		*field = nil
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*field = append(*field, item)
+			}
+		}
+	case *map[string]RateLimit:
+		// routes given override the default ones, the rest stay
+		limits := map[string]RateLimit{}
+		for route, limit := range *field {
+			limits[route] = limit
+		}
+		if err := parseRateLimits(value, limits); err != nil {
+			return err
+		}
+		*field = limits
+	}
+	if c.configured == nil {
+		c.configured = map[string]bool{}
+	}
+	c.configured[s.key] = true
+	return nil
+}
+
+// get the setting's field of c as set reads it
+func (s setting) get(c *Config) string {
+	switch field := s.field(c).(type) {
+	case *string:
+		return *field
+	case *bool:
+		return strconv.FormatBool(*field)
+	case *int:
+		return strconv.Itoa(*field)
+	case *float64:
+		return strconv.FormatFloat(*field, 'f', -1, 64)
+	case *time.Duration:
+		return field.String()
+	case *[]string:
+		return strings.Join(*field, ",")
+	case *map[string]RateLimit:
+		pairs := []string{}
+		for _, route := range routes(*field) {
+			limit := (*field)[route]
+			pairs = append(pairs, route+"="+strconv.FormatFloat(limit.Rate, 'f', -1, 64)+":"+strconv.Itoa(limit.Burst))
+		}
+		return strings.Join(pairs, ",")
+	}
+	return ""
+}
+
+// parseDuration reads a duration like 90s, or a bare number of units when
+// the setting has one
+func parseDuration(value string, unit time.Duration) (time.Duration, error) {
+	if unit != 0 {
+		if n, err := strconv.ParseFloat(value, 64); err == nil {
+			return time.Duration(n * float64(unit)), nil
+		}
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, errors.New("must be a duration, e.g. 90s or 12h")
+	}
+	return d, nil
+}
+
+// parseRateLimits reads route=rate:burst pairs separated by commas into
+// limits, e.g. default=20:40,/calculate/:id=2:10
+func parseRateLimits(list string, limits map[string]RateLimit) error {
+	for _, pair := range strings.Split(list, ",") {
+		pair = strings.TrimSpace(pair)
+		i := strings.LastIndex(pair, "=")
+		if i < 1 {
+			return errors.New("entry " + pair + " must be route=rate:burst")
+		}
+		bucket := strings.SplitN(pair[i+1:], ":", 2)
+		if len(bucket) != 2 {
+			return errors.New("entry " + pair + " must be route=rate:burst")
+		}
+		rate, err := strconv.ParseFloat(bucket[0], 64)
+		if err != nil || rate < 0 {
+			return errors.New("entry " + pair + " has an invalid rate")
+		}
+		burst, err := strconv.Atoi(bucket[1])
+		if err != nil || burst < 0 {
+			return errors.New("entry " + pair + " has an invalid burst")
+		}
+		limits[pair[:i]] = RateLimit{Rate: rate, Burst: burst}
+	}
+	return nil
+}
+
+// routes of limits, sorted
+func routes(limits map[string]RateLimit) []string {
+	list := make([]string, 0, len(limits))
+	for route := range limits {
+		list = append(list, route)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// readFile reads the settings of a YAML or TOML file by their keys, the
+// sections of the file joined to the keys with dots
+func readFile(path string) (map[string]string, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(raw, &doc)
+	case ".toml":
+		err = toml.Unmarshal(raw, &doc)
+	default:
+		return nil, errors.New(path + " must be a .yaml, .yml or .toml file")
+	}
+	if err != nil {
+		return nil, errors.New(path + " can't be parsed: " + err.Error())
+	}
+
+	values := map[string]string{}
+	if err = flatten("", doc, values); err != nil {
+		return nil, errors.New(path + ": " + err.Error())
+	}
+	return values, nil
+}
+
+// flatten the value at key into values, a section of settings into one
+// value per setting, a list or the routes of rate limits into one value
+func flatten(key string, value interface{}, values map[string]string) error {
+	var section map[string]interface{}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		section = v
+	case map[interface{}]interface{}:
+		section = map[string]interface{}{}
+		for k, item := range v {
+			name, ok := k.(string)
+			if !ok {
+				return errors.New("keys of " + key + " must be strings")
+			}
+			section[name] = item
+		}
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := scalar(key, item)
+			if err != nil {
+				return err
+			}
+			items[i] = s
+		}
+		values[key] = strings.Join(items, ",")
+		return nil
+	default:
+		s, err := scalar(key, v)
+		if err != nil {
+			return err
+		}
+		values[key] = s
+		return nil
+	}
+
+	if _, ok := lookup(key); ok {
+		// a map setting, route: rate:burst
+		pairs := []string{}
+		for route, item := range section {
+			s, err := scalar(key+"."+route, item)
+			if err != nil {
+				return err
+			}
+			pairs = append(pairs, route+"="+s)
+		}
+		sort.Strings(pairs)
+		values[key] = strings.Join(pairs, ",")
+		return nil
+	}
+	for name, item := range section {
+		if key != "" {
+			name = key + "." + name
+		}
+		if err := flatten(name, item, values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scalar value of key as text
+func scalar(key string, value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	}
+	return "", errors.New(key + " must be a string, number, boolean or list of them")
+}
+
+// redactSecret hides all of a secret
+func redactSecret(string) string {
+	return "[redacted]"
+}
+
+// redactURL hides the password of a url
+func redactURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil {
+		return redactSecret(value)
+	}
+	if _, ok := u.User.Password(); !ok {
+		return value
+	}
+	u.User = url.UserPassword(u.User.Username(), "redacted")
+	return u.String()
+}
@@ -0,0 +1,127 @@
+package controller
+
+import (
+	"net/http"
+
+	"../auth"
+	"../model"
+	"github.com/asaskevich/govalidator"
+	"github.com/globalsign/mgo/bson"
+	"github.com/labstack/echo"
+)
+
+// APIKeyCreate godocs
+// ----------------------------------------------------------------------
+// @tags APIKey
+// @Summary Issue API Key
+// @Description Issue a new API key, the key is only shown in this response
+// @Accept  json
+// @Produce  json
+// @Param Body body model.APIKey true " "
+// @Param Idempotency-Key header string false "retries with the same key are refused with 410, the key is never shown twice"
+// @Success 200 {object} model.APIKey
+// @Failure 400 {object} echo.HTTPError
+// @Router /apikey/create [post]
+// ----------------------------------------------------------------------
+func (s *Server) APIKeyCreate(c echo.Context) (err error) {
+	key := &model.APIKey{
+		ID: bson.NewObjectId(),
+	}
+	if err = c.Bind(key); err != nil {
+		return err
+	}
+
+	_, err = govalidator.ValidateStruct(key)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if key.CustomerID != "" && !bson.IsObjectIdHex(key.CustomerID) {
+		return echo.NewHTTPError(http.StatusBadRequest, "customer_id is an invalid ObjectID")
+	}
+	if key.Role == auth.RoleCustomer && key.CustomerID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "customer keys need a customer_id")
+	}
+
+	if err = model.CreateAPIKey(auditContext(c), key); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, key)
+}
+
+// APIKeyListing godocs
+// ----------------------------------------------------------------------
+// @tags APIKey
+// @Summary List API Keys
+// @Description List issued API keys, revoked ones included, without secrets
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} model.APIKey
+// @Failure 400 {object} echo.HTTPError
+// @Router /apikeys [get]
+// ----------------------------------------------------------------------
+func (s *Server) APIKeyListing(c echo.Context) (err error) {
+	var results []*model.APIKey
+	results, err = model.ListAPIKey(c.Request().Context())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, results)
+}
+
+// APIKeyRotate godocs
+// ----------------------------------------------------------------------
+// @tags APIKey
+// @Summary Rotate API Key by ID
+// @Description Issue a replacement key & revoke the selected one
+// @Accept  json
+// @Produce  json
+// @Param Idempotency-Key header string false "retries with the same key are refused with 410, the key is never shown twice"
+// @Success 200 {object} model.APIKey
+// @Failure 400 {object} echo.HTTPError
+// @Router /apikey/{id}/rotate [post]
+// ----------------------------------------------------------------------
+func (s *Server) APIKeyRotate(c echo.Context) (err error) {
+	if !bson.IsObjectIdHex(c.Param("id")) {
+		return echo.NewHTTPError(http.StatusBadRequest, "ID is an invalid ObjectID")
+	}
+	id := bson.ObjectIdHex(c.Param("id"))
+
+	var result *model.APIKey
+	result, err = model.RotateAPIKey(auditContext(c), id)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
+
+// APIKeyRevoke godocs
+// ----------------------------------------------------------------------
+// @tags APIKey
+// @Summary Revoke API Key by ID
+// @Description Revoke specific API key, it stops working immediately
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} model.APIKey
+// @Failure 400 {object} echo.HTTPError
+// @Router /apikey/{id} [delete]
+// ----------------------------------------------------------------------
+func (s *Server) APIKeyRevoke(c echo.Context) (err error) {
+	if !bson.IsObjectIdHex(c.Param("id")) {
+		return echo.NewHTTPError(http.StatusBadRequest, "ID is an invalid ObjectID")
+	}
+	id := bson.ObjectIdHex(c.Param("id"))
+
+	if err = model.RevokeAPIKey(auditContext(c), id); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	msg := map[string]string{
+		"status":  "success",
+		"message": "Selected API key has been revoked",
+	}
+
+	return c.JSON(http.StatusOK, msg)
+}
@@ -0,0 +1,54 @@
+package controller
+
+import (
+	"net/http"
+
+	"../model"
+	"github.com/labstack/echo"
+)
+
+// AuditSearch godocs
+// ----------------------------------------------------------------------
+// @tags Audit
+// @Summary Search audit log
+// @Description List recorded changes, newest first
+// @Accept  json
+// @Produce  json
+// @Param entity query string false "collection, eg. products, customers, pricingrules"
+// @Param entity_id query string false "ID of the changed document"
+// @Param actor query string false "who made the change"
+// @Param from query string false "RFC3339 time or YYYY-MM-DD"
+// @Param to query string false "RFC3339 time or YYYY-MM-DD"
+// @Param limit query int false "max entries, up to 1000"
+// @Success 200 {object} model.AuditLog
+// @Failure 400 {object} echo.HTTPError
+// @Router /audit [get]
+// ----------------------------------------------------------------------
+func (s *Server) AuditSearch(c echo.Context) (err error) {
+	search := &model.AuditSearch{
+		Entity:   c.QueryParam("entity"),
+		EntityID: c.QueryParam("entity_id"),
+		Actor:    c.QueryParam("actor"),
+	}
+
+	if search.From, err = queryTime(c, "from"); err != nil {
+		return err
+	}
+	if search.To, err = queryTime(c, "to"); err != nil {
+		return err
+	}
+	if search.Limit, err = queryInt(c, "limit", 100); err != nil {
+		return err
+	}
+	if search.Limit < 1 || search.Limit > 1000 {
+		return echo.NewHTTPError(http.StatusBadRequest, "limit must be between 1 and 1000")
+	}
+
+	var results []*model.AuditLog
+	results, err = model.SearchAudit(c.Request().Context(), search)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, results)
+}
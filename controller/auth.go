@@ -0,0 +1,92 @@
+package controller
+
+import (
+	"net/http"
+	"strings"
+
+	"../auth"
+	"../config"
+	"../model"
+	"github.com/globalsign/mgo"
+	"github.com/labstack/echo"
+)
+
+// headers credentials are read from
+const (
+	headerAPIKey          = "X-API-Key"
+	headerWWWAuthenticate = "WWW-Authenticate"
+	bearerPrefix          = "Bearer "
+)
+
+// public routes anyone may call without credentials, besides the api spec
+// & the probes
+var public = map[string]bool{
+	"/jobads/search": true,
+}
+
+// Authenticate middleware, every request must carry an API key or a bearer
+// token, the principal it resolves to is attached to the request context
+func Authenticate(keys *auth.KeySet) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			// the api spec, the probes & the public routes stay public
+			if strings.HasPrefix(c.Path(), "/specs/") || IsProbe(c) || public[c.Path()] {
+				return next(c)
+			}
+
+			p, err := authenticate(c, keys)
+			if err != nil {
+				c.Response().Header().Set(headerWWWAuthenticate, `Bearer realm="jobads"`)
+				return err
+			}
+
+			req := c.Request()
+			c.SetRequest(req.WithContext(auth.WithPrincipal(req.Context(), p)))
+
+			return next(c)
+		}
+	}
+}
+
+// authenticate resolves the request's credentials to a principal
+func authenticate(c echo.Context, keys *auth.KeySet) (*auth.Principal, error) {
+	if key := c.Request().Header.Get(headerAPIKey); key != "" {
+		if config.AdminAPIKey != "" && auth.SameKey(key, config.AdminAPIKey) {
+			return &auth.Principal{
+				ID:    "admin",
+				Kind:  auth.KindAdmin,
+				Name:  "bootstrap admin",
+				Roles: []string{auth.RoleAdmin},
+			}, nil
+		}
+		if model.DB == nil {
+			return nil, echo.NewHTTPError(http.StatusUnauthorized, "API keys need the mongo storage backend")
+		}
+		apiKey, err := model.SelectAPIKeyByKey(c.Request().Context(), key)
+		if err == mgo.ErrNotFound {
+			return nil, echo.NewHTTPError(http.StatusUnauthorized, "API key is invalid")
+		}
+		if err != nil {
+			return nil, err
+		}
+		return apiKey.Principal(), nil
+	}
+
+	if header := c.Request().Header.Get(echo.HeaderAuthorization); header != "" {
+		if !strings.HasPrefix(header, bearerPrefix) {
+			return nil, echo.NewHTTPError(http.StatusUnauthorized, "Authorization must be a Bearer token")
+		}
+		p, err := keys.Verify(strings.TrimPrefix(header, bearerPrefix))
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+		}
+		return p, nil
+	}
+
+	return nil, echo.NewHTTPError(http.StatusUnauthorized, "Authentication required")
+}
+
+// principal of the request, nil on routes that skip authentication
+func principal(c echo.Context) *auth.Principal {
+	return auth.PrincipalFrom(c.Request().Context())
+}
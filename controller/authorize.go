@@ -0,0 +1,106 @@
+package controller
+
+import (
+	"net/http"
+
+	"../auth"
+	"../model"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/labstack/echo"
+)
+
+// errForbidden is the single answer to any denied request, it never says
+// whether the resource asked for exists
+var errForbidden = echo.NewHTTPError(http.StatusForbidden, "Forbidden")
+
+// OwnerFunc finds the customer the target of a request belongs to, an
+// empty ID when there is no such target
+type OwnerFunc func(c echo.Context) (customerID string, err error)
+
+// Allow middleware, only principals holding one of roles get through
+func Allow(roles ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			p := principal(c)
+			if p == nil || !p.HasRole(roles...) {
+				return errForbidden
+			}
+			return next(c)
+		}
+	}
+}
+
+// Owns middleware, limits customer principals to their own customer's
+// resources, staff roles are let through untouched
+func Owns(owner OwnerFunc) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			p := principal(c)
+			if p == nil {
+				return errForbidden
+			}
+			if p.HasRole(auth.RoleAdmin, auth.RoleSales) {
+				return next(c)
+			}
+
+			customerID, err := owner(c)
+			if err != nil {
+				return err
+			}
+			if customerID == "" || p.CustomerID == "" || customerID != p.CustomerID {
+				return errForbidden
+			}
+			return next(c)
+		}
+	}
+}
+
+// CustomerParam owner, the route's :id is the customer ID
+func CustomerParam(c echo.Context) (string, error) {
+	return c.Param("id"), nil
+}
+
+// CustomerForm owner, the customer_id sent in the body
+func CustomerForm(c echo.Context) (string, error) {
+	return c.FormValue("customer_id"), nil
+}
+
+// JobAdOwner owner, the customer who posted the :id job ad
+func JobAdOwner(c echo.Context) (string, error) {
+	if !bson.IsObjectIdHex(c.Param("id")) {
+		return "", nil
+	}
+	ad, err := model.SelectJobAdByID(c.Request().Context(), bson.ObjectIdHex(c.Param("id")))
+	return owned(err, func() string { return ad.CustomerID })
+}
+
+// OrderOwner owner, the customer who placed the :id order
+func OrderOwner(c echo.Context) (string, error) {
+	if !bson.IsObjectIdHex(c.Param("id")) {
+		return "", nil
+	}
+	order, err := model.SelectOrderByID(c.Request().Context(), bson.ObjectIdHex(c.Param("id")))
+	return owned(err, func() string { return order.CustomerID })
+}
+
+// PricingRulesOwner owner, the customer the :id rule applies to
+func (s *Server) PricingRulesOwner(c echo.Context) (string, error) {
+	if !bson.IsObjectIdHex(c.Param("id")) {
+		return "", nil
+	}
+	rules, err := s.Rules.SelectByID(c.Request().Context(), bson.ObjectIdHex(c.Param("id")))
+	return owned(err, func() string { return rules.CustomerID })
+}
+
+// owned reads the owner off a looked up document, a missing document has
+// no owner so it is denied exactly like someone else's
+func owned(err error, customerID func() string) (string, error) {
+	if err == mgo.ErrNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return customerID(), nil
+}
@@ -0,0 +1,129 @@
+package controller
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"../auth"
+	"github.com/labstack/echo"
+)
+
+var (
+	customerA = "5b1fd4ab1d41c8d3a1a1a1a1"
+	customerB = "5b1fd4ab1d41c8d3b2b2b2b2"
+)
+
+// guarded runs next behind middleware for a request made as p, nil for
+// an unauthenticated one, & answers the status it got
+func guarded(t *testing.T, p *auth.Principal, middleware echo.MiddlewareFunc, prepare func(c echo.Context)) int {
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if p != nil {
+		req = req.WithContext(auth.WithPrincipal(req.Context(), p))
+	}
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	if prepare != nil {
+		prepare(c)
+	}
+
+	err := middleware(func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})(c)
+	if err != nil {
+		he, ok := err.(*echo.HTTPError)
+		if !ok {
+			t.Fatal(err)
+		}
+		return he.Code
+	}
+	return rec.Code
+}
+
+func customerParam(id string) func(c echo.Context) {
+	return func(c echo.Context) {
+		c.SetParamNames("id")
+		c.SetParamValues(id)
+	}
+}
+
+func TestOwns(t *testing.T) {
+	customer := &auth.Principal{ID: "k1", Kind: auth.KindAPIKey, CustomerID: customerA, Roles: []string{auth.RoleCustomer}}
+	unbound := &auth.Principal{ID: "k2", Kind: auth.KindAPIKey, Roles: []string{auth.RoleCustomer}}
+	sales := &auth.Principal{ID: "k3", Kind: auth.KindAPIKey, Roles: []string{auth.RoleSales}}
+
+	cases := []struct {
+		name string
+		p    *auth.Principal
+		id   string
+		want int
+	}{
+		{"own customer", customer, customerA, http.StatusOK},
+		{"other customer", customer, customerB, http.StatusForbidden},
+		{"no target", customer, "", http.StatusForbidden},
+		{"customer key bound to none", unbound, "", http.StatusForbidden},
+		{"staff", sales, customerB, http.StatusOK},
+		{"unauthenticated", nil, customerA, http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		if got := guarded(t, tc.p, Owns(CustomerParam), customerParam(tc.id)); got != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestAllowStaffOnly(t *testing.T) {
+	// orders are marked paid by staff only
+	staff := Allow(auth.RoleAdmin, auth.RoleSales)
+	cases := []struct {
+		role string
+		want int
+	}{
+		{auth.RoleAdmin, http.StatusOK},
+		{auth.RoleSales, http.StatusOK},
+		{auth.RoleCustomer, http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		p := &auth.Principal{ID: "k", Kind: auth.KindAPIKey, CustomerID: customerA, Roles: []string{tc.role}}
+		if got := guarded(t, p, staff, nil); got != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.role, got, tc.want)
+		}
+	}
+	if got := guarded(t, nil, staff, nil); got != http.StatusForbidden {
+		t.Errorf("unauthenticated: status %d, want %d", got, http.StatusForbidden)
+	}
+}
+
+func TestJobAdCreateOtherCustomer(t *testing.T) {
+	// Owns checked customer_id of the form, the body must not name another
+	e := echo.New()
+	body := `{"customer_id":"` + customerB + `","product_code":"classic","title":"t","description":"d"}`
+	req := httptest.NewRequest(http.MethodPost, "/jobad/create?customer_id="+customerA, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	c := e.NewContext(req, httptest.NewRecorder())
+
+	err := new(Server).JobAdCreate(c)
+	he, ok := err.(*echo.HTTPError)
+	if !ok || he.Code != http.StatusBadRequest || he.Message != "customer_id of the body differs from the one given" {
+		t.Fatalf("got %v, want the body's customer_id refused", err)
+	}
+}
+
+func TestAuthenticatePublicRoutes(t *testing.T) {
+	cases := []struct {
+		path string
+		want int
+	}{
+		{"/jobads/search", http.StatusOK},
+		{"/jobads", http.StatusUnauthorized},
+		{"/order/:id/pay", http.StatusUnauthorized},
+	}
+	for _, tc := range cases {
+		got := guarded(t, nil, Authenticate(nil), func(c echo.Context) { c.SetPath(tc.path) })
+		if got != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.path, got, tc.want)
+		}
+	}
+}
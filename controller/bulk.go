@@ -0,0 +1,534 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"../model"
+	"github.com/labstack/echo"
+)
+
+// bulk formats
+const (
+	formatCSV   = "csv"
+	formatJSONL = "jsonl"
+
+	mimeCSV   = "text/csv"
+	mimeJSONL = "application/x-ndjson"
+)
+
+// maxImportRows bounds a single import
+const maxImportRows = 10000
+
+// csvSkipped are never exported, they hold nothing for a live document
+var csvSkipped = map[string]bool{"deleted_at": true, "score": true}
+
+// importFunc runs one entity's import
+type importFunc func(ctx context.Context, rows []*model.ImportRow, opts model.ImportOptions) (*model.ImportReport, error)
+
+// ProductImport godocs
+// ----------------------------------------------------------------------
+// @tags Bulk
+// @Summary Import products
+// @Description Upsert products by code from CSV or JSON Lines
+// @Accept  text/csv
+// @Produce  json
+// @Param format query string false "csv or jsonl, defaults to the Content-Type"
+// @Param dry_run query bool false "validate & plan without writing"
+// @Param mode query string false "atomic (default) or best_effort"
+// @Success 200 {object} model.ImportReport
+// @Failure 400 {object} echo.HTTPError
+// @Failure 422 {object} model.ImportReport
+// @Router /import/products [post]
+// ----------------------------------------------------------------------
+func (s *Server) ProductImport(c echo.Context) (err error) {
+	return bulkImport(c, reflect.TypeOf(model.Product{}), func(ctx context.Context, rows []*model.ImportRow, opts model.ImportOptions) (*model.ImportReport, error) {
+		return model.ImportProducts(ctx, s.Products, rows, opts)
+	})
+}
+
+// CustomerImport godocs
+// ----------------------------------------------------------------------
+// @tags Bulk
+// @Summary Import customers
+// @Description Upsert customers by external reference or name from CSV or JSON Lines
+// @Accept  text/csv
+// @Produce  json
+// @Param format query string false "csv or jsonl, defaults to the Content-Type"
+// @Param dry_run query bool false "validate & plan without writing"
+// @Param mode query string false "atomic (default) or best_effort"
+// @Success 200 {object} model.ImportReport
+// @Failure 400 {object} echo.HTTPError
+// @Failure 422 {object} model.ImportReport
+// @Router /import/customers [post]
+// ----------------------------------------------------------------------
+func (s *Server) CustomerImport(c echo.Context) (err error) {
+	return bulkImport(c, reflect.TypeOf(model.Customer{}), func(ctx context.Context, rows []*model.ImportRow, opts model.ImportOptions) (*model.ImportReport, error) {
+		return model.ImportCustomers(ctx, s.Customers, rows, opts)
+	})
+}
+
+// PricingRulesImport godocs
+// ----------------------------------------------------------------------
+// @tags Bulk
+// @Summary Import rules
+// @Description Upsert rules by customer & product code from CSV or JSON Lines, customers are given by customer_id, customer_external_ref or customer_name
+// @Accept  text/csv
+// @Produce  json
+// @Param format query string false "csv or jsonl, defaults to the Content-Type"
+// @Param dry_run query bool false "validate & plan without writing"
+// @Param mode query string false "atomic (default) or best_effort"
+// @Success 200 {object} model.ImportReport
+// @Failure 400 {object} echo.HTTPError
+// @Failure 422 {object} model.ImportReport
+// @Router /import/rules [post]
+// ----------------------------------------------------------------------
+func (s *Server) PricingRulesImport(c echo.Context) (err error) {
+	return bulkImport(c, reflect.TypeOf(model.PricingRulesRow{}), func(ctx context.Context, rows []*model.ImportRow, opts model.ImportOptions) (*model.ImportReport, error) {
+		return model.ImportPricingRules(ctx, s.Rules, s.Customers, s.Products, rows, opts)
+	})
+}
+
+// ProductExport godocs
+// ----------------------------------------------------------------------
+// @tags Bulk
+// @Summary Export products
+// @Description Every live product as CSV or JSON Lines, in the import format
+// @Produce  text/csv
+// @Param format query string false "csv or jsonl (default)"
+// @Success 200 {object} model.Product
+// @Failure 400 {object} echo.HTTPError
+// @Router /export/products [get]
+// ----------------------------------------------------------------------
+func (s *Server) ProductExport(c echo.Context) (err error) {
+	results, err := s.Products.List(c.Request().Context())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return bulkExport(c, "products", reflect.TypeOf(model.Product{}), results)
+}
+
+// CustomerExport godocs
+// ----------------------------------------------------------------------
+// @tags Bulk
+// @Summary Export customers
+// @Description Every live customer as CSV or JSON Lines, in the import format
+// @Produce  text/csv
+// @Param format query string false "csv or jsonl (default)"
+// @Success 200 {object} model.Customer
+// @Failure 400 {object} echo.HTTPError
+// @Router /export/customers [get]
+// ----------------------------------------------------------------------
+func (s *Server) CustomerExport(c echo.Context) (err error) {
+	results, err := s.Customers.List(c.Request().Context())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return bulkExport(c, "customers", reflect.TypeOf(model.Customer{}), results)
+}
+
+// PricingRulesExport godocs
+// ----------------------------------------------------------------------
+// @tags Bulk
+// @Summary Export rules
+// @Description Every live rule as CSV or JSON Lines, in the import format
+// @Produce  text/csv
+// @Param format query string false "csv or jsonl (default)"
+// @Success 200 {object} model.PricingRules
+// @Failure 400 {object} echo.HTTPError
+// @Router /export/rules [get]
+// ----------------------------------------------------------------------
+func (s *Server) PricingRulesExport(c echo.Context) (err error) {
+	results, err := s.Rules.Export(c.Request().Context())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return bulkExport(c, "rules", reflect.TypeOf(model.PricingRules{}), results)
+}
+
+// bulkImport reads the rows of an import body & runs them
+func bulkImport(c echo.Context, t reflect.Type, run importFunc) (err error) {
+	opts := model.ImportOptions{Atomic: true}
+	if opts.DryRun, err = queryBool(c, "dry_run"); err != nil {
+		return err
+	}
+	switch c.QueryParam("mode") {
+	case "", "atomic":
+	case "best_effort":
+		opts.Atomic = false
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "mode must be one of atomic, best_effort")
+	}
+
+	format := c.QueryParam("format")
+	if format == "" {
+		format = formatCSV
+		if !strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), mimeCSV) {
+			format = formatJSONL
+		}
+	}
+
+	var rows []*model.ImportRow
+	switch format {
+	case formatCSV:
+		rows, err = readCSV(c.Request().Body, t)
+	case formatJSONL:
+		rows, err = readJSONL(c.Request().Body)
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "format must be one of csv, jsonl")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if len(rows) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Import has no rows")
+	}
+	if len(rows) > maxImportRows {
+		return echo.NewHTTPError(http.StatusBadRequest, "Import is limited to "+strconv.Itoa(maxImportRows)+" rows")
+	}
+
+	report, err := run(auditContext(c), rows, opts)
+	if err != nil {
+		return err
+	}
+
+	// an atomic import that wrote nothing was rejected
+	if !report.DryRun && !report.Applied {
+		return c.JSON(http.StatusUnprocessableEntity, report)
+	}
+	return c.JSON(http.StatusOK, report)
+}
+
+// readJSONL gives every non blank line as a row
+func readJSONL(body io.Reader) (rows []*model.ImportRow, err error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		row := &model.ImportRow{Line: line, Data: append(json.RawMessage{}, data...)}
+		if !json.Valid(data) {
+			row.Error = "Row is not valid JSON"
+		}
+		rows = append(rows, row)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// readCSV turns every record into a JSON row using the header as field
+// names, dotted for nested fields like billing_address.city. empty cells
+// are left out so updates keep the current value
+func readCSV(body io.Reader, t reflect.Type) (rows []*model.ImportRow, err error) {
+	reader := csv.NewReader(body)
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make([]reflect.Type, len(header))
+	for i, column := range header {
+		if fields[i], err = csvField(t, strings.Split(column, ".")); err != nil {
+			return nil, err
+		}
+	}
+
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		row := &model.ImportRow{Line: line}
+		rows = append(rows, row)
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); !ok {
+				return nil, err
+			}
+			row.Error = err.Error()
+			continue
+		}
+
+		obj := map[string]interface{}{}
+		for i, cell := range record {
+			if cell == "" {
+				continue
+			}
+			v, err := csvValue(fields[i], cell)
+			if err != nil {
+				row.Error = header[i] + ": " + err.Error()
+				break
+			}
+			setPath(obj, strings.Split(header[i], "."), v)
+		}
+		if row.Failed() {
+			continue
+		}
+		if row.Data, err = json.Marshal(obj); err != nil {
+			return nil, err
+		}
+	}
+
+	return rows, nil
+}
+
+// csvField finds the type a column is read as
+func csvField(t reflect.Type, path []string) (reflect.Type, error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if len(path) == 0 {
+		return t, nil
+	}
+	switch {
+	case t.Kind() == reflect.Map:
+		return csvField(t.Elem(), path[1:])
+	case t.Kind() == reflect.Struct && t != reflect.TypeOf(time.Time{}):
+		if f, ok := jsonField(t, path[0]); ok {
+			return csvField(f.Type, path[1:])
+		}
+	}
+	return nil, errors.New("Unknown column " + strings.Join(path, "."))
+}
+
+// jsonField finds a struct field by its json name, embedded ones included
+func jsonField(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous {
+			if inner, ok := jsonField(f.Type, name); ok {
+				return inner, true
+			}
+			continue
+		}
+		if jsonName(f) == name {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// jsonName of a field, empty when it is never encoded
+func jsonName(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	if name == "-" || f.PkgPath != "" {
+		return ""
+	}
+	if name == "" {
+		return f.Name
+	}
+	return name
+}
+
+// csvValue reads a cell as the field's type, lists are separated by | &
+// anything more complex is given as JSON
+func csvValue(t reflect.Type, cell string) (interface{}, error) {
+	switch t.Kind() {
+	case reflect.String:
+		return cell, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(cell, 10, 64)
+		if err != nil {
+			return nil, errors.New("must be a whole number")
+		}
+		return n, nil
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(cell, 64)
+		if err != nil {
+			return nil, errors.New("must be a number")
+		}
+		return n, nil
+	case reflect.Bool:
+		b, err := strconv.ParseBool(cell)
+		if err != nil {
+			return nil, errors.New("must be true or false")
+		}
+		return b, nil
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.String {
+			return strings.Split(cell, "|"), nil
+		}
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return cell, nil
+	}
+	if !json.Valid([]byte(cell)) {
+		return nil, errors.New("must be JSON")
+	}
+	return json.RawMessage(cell), nil
+}
+
+// setPath sets obj[a][b]... = v for a dotted column
+func setPath(obj map[string]interface{}, path []string, v interface{}) {
+	for _, key := range path[:len(path)-1] {
+		inner, ok := obj[key].(map[string]interface{})
+		if !ok {
+			inner = map[string]interface{}{}
+			obj[key] = inner
+		}
+		obj = inner
+	}
+	obj[path[len(path)-1]] = v
+}
+
+// bulkExport writes docs in the format asked for
+func bulkExport(c echo.Context, entity string, t reflect.Type, docs interface{}) (err error) {
+	format := c.QueryParam("format")
+	if format == "" {
+		format = formatJSONL
+	}
+	if format != formatCSV && format != formatJSONL {
+		return echo.NewHTTPError(http.StatusBadRequest, "format must be one of csv, jsonl")
+	}
+
+	// every document as a plain map, as the import reads it back
+	var objs []map[string]interface{}
+	raw, err := json.Marshal(docs)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(raw, &objs); err != nil {
+		return err
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentDisposition, `attachment; filename="`+entity+"."+format+`"`)
+
+	if format == formatJSONL {
+		res.Header().Set(echo.HeaderContentType, mimeJSONL)
+		res.WriteHeader(http.StatusOK)
+		encoder := json.NewEncoder(res)
+		for _, obj := range objs {
+			if err = encoder.Encode(obj); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	columns := csvColumns(t, nil, objs)
+	res.Header().Set(echo.HeaderContentType, mimeCSV+"; charset=UTF-8")
+	res.WriteHeader(http.StatusOK)
+	writer := csv.NewWriter(res)
+	if err = writer.Write(columns); err != nil {
+		return err
+	}
+	for _, obj := range objs {
+		record := make([]string, len(columns))
+		for i, column := range columns {
+			record[i] = csvCell(lookupPath(obj, strings.Split(column, ".")))
+		}
+		if err = writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// csvColumns lists the columns of t in field order, nested structs are
+// flattened & maps get a column per key found in objs
+func csvColumns(t reflect.Type, prefix []string, objs []map[string]interface{}) (columns []string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous {
+			columns = append(columns, csvColumns(f.Type, prefix, objs)...)
+			continue
+		}
+		name := jsonName(f)
+		if name == "" || (len(prefix) == 0 && csvSkipped[name]) {
+			continue
+		}
+		path := append(append([]string{}, prefix...), name)
+
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		switch {
+		case ft.Kind() == reflect.Struct && ft != reflect.TypeOf(time.Time{}):
+			columns = append(columns, csvColumns(ft, path, objs)...)
+		case ft.Kind() == reflect.Map:
+			keys := map[string]bool{}
+			for _, obj := range objs {
+				if m, ok := lookupPath(obj, path).(map[string]interface{}); ok {
+					for k := range m {
+						keys[k] = true
+					}
+				}
+			}
+			var sorted []string
+			for k := range keys {
+				sorted = append(sorted, strings.Join(path, ".")+"."+k)
+			}
+			sort.Strings(sorted)
+			columns = append(columns, sorted...)
+		default:
+			columns = append(columns, strings.Join(path, "."))
+		}
+	}
+	return columns
+}
+
+// lookupPath reads obj[a][b]... for a dotted column
+func lookupPath(obj map[string]interface{}, path []string) interface{} {
+	var v interface{} = obj
+	for _, key := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+	return v
+}
+
+// csvCell writes a value the way csvValue reads it back
+func csvCell(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case []interface{}:
+		strs := make([]string, len(v))
+		for i, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				raw, _ := json.Marshal(v)
+				return string(raw)
+			}
+			strs[i] = s
+		}
+		return strings.Join(strs, "|")
+	}
+	raw, _ := json.Marshal(v)
+	return string(raw)
+}
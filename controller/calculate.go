@@ -1,27 +1,52 @@
 package controller
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 
+	"../config"
+	"../metrics"
 	"../model"
+	"../tracing"
 	"github.com/asaskevich/govalidator"
 	"github.com/globalsign/mgo/bson"
 	"github.com/labstack/echo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// batch calculation bounds
+const (
+	maxBatchItems = 10000
+	batchWorkers  = 8
+)
+
+// errNotSold is pricing a product with no price at the time priced, one
+// created later or never
+var errNotSold = errors.New("Product was not sold at that time")
+
 // Calculate godocs
 // ----------------------------------------------------------------------
 // @tags Product
 // @Summary Calculate purchase
-// @Description Calculate purchase
+// @Description Calculate purchase, against prices & rules as they were at as_of when given
 // @Accept  json
 // @Produce  json
+// @Param as_of query string false "RFC3339 time or YYYY-MM-DD"
 // @Param Body body model.Product true " "
+// @Param Idempotency-Key header string false "retries with the same key replay the first response"
 // @Success 200 {object} model.Product
 // @Failure 400 {object} echo.HTTPError
+// @Failure 404 {object} echo.HTTPError
 // @Router /calculate/{customer_id} [post]
 // ----------------------------------------------------------------------
-func Calculate(c echo.Context) (err error) {
+func (s *Server) Calculate(c echo.Context) (err error) {
 	headers := c.Response().Header()
 	headers.Set("Access-Control-Allow-Origin", "*")
 	headers.Set("Access-Control-Allow-Headers", "Authorization")
@@ -44,70 +69,332 @@ func Calculate(c echo.Context) (err error) {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
+	// price against a historical snapshot when asked
+	at, err := queryTime(c, "as_of")
+	if err != nil {
+		return err
+	}
+
+	// deleted customers can't buy
+	ctx := c.Request().Context()
+	var tier string
+	if at.IsZero() {
+		customer, err := s.Customers.SelectByID(ctx, id)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Customer does not exist")
+		}
+		tier = customer.Metadata["tier"]
+	}
+
+	p, err := s.loadPricing(ctx, []string{id.Hex()}, at)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	purchase.Total, err = p.price(ctx, purchase)
+	if err == errNotSold {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	metrics.Calculation(tier)
+
+	return c.JSON(http.StatusOK, purchase)
+}
+
+// CalculateBatch godocs
+// ----------------------------------------------------------------------
+// @tags Product
+// @Summary Calculate many purchases
+// @Description Price items each for their own customer, or one basket for every customer listed, streamed back as NDJSON in completion order with per item errors
+// @Accept  json
+// @Produce  application/x-ndjson
+// @Param as_of query string false "RFC3339 time or YYYY-MM-DD"
+// @Param Body body model.BatchPurchase true " "
+// @Success 200 {object} model.PurchaseResult
+// @Failure 400 {object} echo.HTTPError
+// @Router /calculate/batch [post]
+// ----------------------------------------------------------------------
+func (s *Server) CalculateBatch(c echo.Context) (err error) {
+	batch := new(model.BatchPurchase)
+	if err = c.Bind(batch); err != nil {
+		return err
+	}
+
+	at, err := queryTime(c, "as_of")
+	if err != nil {
+		return err
+	}
+
+	// one basket for many customers becomes an item per customer
+	results := make([]*model.PurchaseResult, 0, len(batch.Items)+len(batch.CustomerIDs))
+	for _, item := range batch.Items {
+		if item == nil {
+			item = &model.Purchase{}
+		}
+		results = append(results, &model.PurchaseResult{Purchase: item})
+	}
+	if len(batch.CustomerIDs) > 0 && batch.Basket == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "customer_ids need a basket")
+	}
+	for _, customerID := range batch.CustomerIDs {
+		item := *batch.Basket
+		result := &model.PurchaseResult{Purchase: &item}
+		if bson.IsObjectIdHex(customerID) {
+			item.CustomerID = bson.ObjectIdHex(customerID)
+		} else {
+			result.Error = "customer_id " + customerID + " is an invalid ObjectID"
+		}
+		results = append(results, result)
+	}
+	if len(results) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Batch has no items")
+	}
+	if len(results) > maxBatchItems {
+		return echo.NewHTTPError(http.StatusBadRequest, "Batch is limited to "+strconv.Itoa(maxBatchItems)+" items")
+	}
+
+	var customerIDs []string
+	var objectIDs []bson.ObjectId
+	seen := map[bson.ObjectId]bool{}
+	for i, result := range results {
+		result.Index = i
+		if result.Error != "" {
+			continue
+		}
+		if _, err = govalidator.ValidateStruct(result.Purchase); err != nil {
+			result.Error = err.Error()
+			continue
+		}
+		if !result.CustomerID.Valid() {
+			result.Error = "customer_id is required"
+			continue
+		}
+		if !seen[result.CustomerID] {
+			seen[result.CustomerID] = true
+			customerIDs = append(customerIDs, result.CustomerID.Hex())
+			objectIDs = append(objectIDs, result.CustomerID)
+		}
+	}
+
+	// deleted customers can't buy
+	tiers := map[bson.ObjectId]string{}
+	if at.IsZero() && len(objectIDs) > 0 {
+		customers, err := s.Customers.SelectByIDs(c.Request().Context(), objectIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		for _, customer := range customers {
+			tiers[customer.ID] = customer.Metadata["tier"]
+		}
+		for _, result := range results {
+			if _, alive := tiers[result.CustomerID]; result.Error == "" && !alive {
+				result.Error = "Customer does not exist"
+			}
+		}
+	}
+
+	// catalog & every customer's rules are read once for the whole batch
+	p, err := s.loadPricing(c.Request().Context(), customerIDs, at)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	// one span for the whole batch, items would each be too many
+	_, span := tracing.Tracer().Start(c.Request().Context(), "pricing.batch",
+		trace.WithAttributes(attribute.Int("pricing.items", len(results))))
+
+	jobs := make(chan *model.PurchaseResult)
+	priced := make(chan *model.PurchaseResult)
+	var wg sync.WaitGroup
+	for w := 0; w < batchWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for result := range jobs {
+				if result.Error == "" {
+					total, err := p.safeTotal(result.Purchase, c.Logger())
+					if err != nil {
+						result.Error = err.Error()
+					} else {
+						metrics.Calculation(tiers[result.CustomerID])
+					}
+					result.Total = total
+				}
+				priced <- result
+			}
+		}()
+	}
+	go func() {
+		for _, result := range results {
+			jobs <- result
+		}
+		close(jobs)
+		wg.Wait()
+		span.End()
+		close(priced)
+	}()
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, mimeJSONL)
+	res.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(res)
+	for result := range priced {
+		// keep draining after the client went away so no worker is left blocked
+		if err != nil {
+			continue
+		}
+		if err = encoder.Encode(result); err == nil {
+			res.Flush()
+		}
+	}
+	if err != nil {
+		c.Logger().Error(err)
+	}
+
+	return nil
+}
+
+// pricing is the catalog & customer rules purchases are priced against,
+// read only once loaded so it is safe to share between goroutines
+type pricing struct {
+	basePrices map[string]int
+	retired    map[string]bool
+	// rules by customer ID then product code
+	rules map[string]map[string]*model.PricingRules
+}
+
+// loadPricing reads the catalog & the rules of customerIDs, as they were
+// at at when it is set
+func (s *Server) loadPricing(ctx context.Context, customerIDs []string, at time.Time) (p *pricing, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "pricing.load", trace.WithAttributes(
+		attribute.Int("pricing.customers", len(customerIDs)),
+		attribute.Bool("pricing.as_of", !at.IsZero()),
+	))
+	defer func() {
+		if err != nil {
+			tracing.Fail(span, err)
+		}
+		span.End()
+	}()
+
+	p = &pricing{
+		basePrices: map[string]int{},
+		retired:    map[string]bool{},
+		rules:      map[string]map[string]*model.PricingRules{},
+	}
+
 	// get customer rules
 	var rules []*model.PricingRules
-	rules, err = model.SelectPricingRulesByCustomerID(id.Hex())
+	if len(customerIDs) == 1 && at.IsZero() {
+		rules, err = s.Rules.SelectByCustomerID(ctx, customerIDs[0])
+	} else if len(customerIDs) == 1 {
+		rules, err = s.Rules.SelectByCustomerIDAsOf(ctx, customerIDs[0], at)
+	} else if at.IsZero() {
+		rules, err = s.Rules.SelectByCustomerIDs(ctx, customerIDs)
+	} else {
+		rules, err = s.Rules.SelectByCustomerIDsAsOf(ctx, customerIDs, at)
+	}
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		return nil, err
 	}
-	eligiblities := map[string]*model.PricingRules{}
 	for _, r := range rules {
-		eligiblities[r.ProductCode] = r
+		if p.rules[r.CustomerID] == nil {
+			p.rules[r.CustomerID] = map[string]*model.PricingRules{}
+		}
+		p.rules[r.CustomerID][r.ProductCode] = r
 	}
 
 	// get product lists
 	var products []*model.Product
-	products, err = model.ListProduct()
+	if at.IsZero() {
+		products, err = s.Products.List(ctx)
+	} else {
+		products, err = s.Products.ListAsOf(ctx, at)
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
-	basePrices := map[string]int{}
-	for _, p := range products {
-		basePrices[p.Code] = p.Price
+	for _, product := range products {
+		p.basePrices[product.Code] = product.Price
+		p.retired[product.Code] = product.IsRetired()
 	}
 
-	total := 0
-	// classic ads
-	if purchase.Classic > 0 {
-		eg := eligiblities["classic"]
-		if eg != nil {
-			total += eligiblity(eg, purchase.Classic, basePrices["classic"])
-		} else {
-			// normal pricing
-			total += purchase.Classic * basePrices["classic"]
-		}
+	return p, nil
+}
+
+// price a purchase like total does, in a span of its own
+func (p *pricing) price(ctx context.Context, purchase *model.Purchase) (total int, err error) {
+	_, span := tracing.Tracer().Start(ctx, "pricing.total",
+		trace.WithAttributes(attribute.String("pricing.customer_id", purchase.CustomerID.Hex())))
+	defer span.End()
+
+	if total, err = p.total(purchase); err != nil {
+		tracing.Fail(span, err)
+		return 0, err
 	}
+	span.SetAttributes(attribute.Int("pricing.total", total))
+	return total, nil
+}
 
-	// standout ads
-	if purchase.Standout > 0 {
-		eg := eligiblities["standout"]
-		if eg != nil {
-			total += eligiblity(eg, purchase.Standout, basePrices["standout"])
-		} else {
-			// normal pricing
-			total += purchase.Standout * basePrices["standout"]
+// total prices a purchase under its customer's rules
+func (p *pricing) total(purchase *model.Purchase) (total int, err error) {
+	eligiblities := p.rules[purchase.CustomerID.Hex()]
+
+	// retired products can't be bought anymore
+	quantities := map[string]int{
+		"classic":  purchase.Classic,
+		"standout": purchase.Standout,
+		"premium":  purchase.Premium,
+	}
+	for code, qty := range quantities {
+		if qty <= 0 {
+			continue
+		}
+		if _, ok := p.basePrices[code]; !ok {
+			return 0, errNotSold
+		}
+		if p.retired[code] {
+			return 0, errors.New(code + " is retired and can no longer be bought")
 		}
 	}
 
-	// premium ads
-	if purchase.Premium > 0 {
-		eg := eligiblities["premium"]
-		if eg != nil {
-			total += eligiblity(eg, purchase.Premium, basePrices["premium"])
+	for _, code := range []string{"classic", "standout", "premium"} {
+		qty := quantities[code]
+		if qty <= 0 {
+			continue
+		}
+		if eg := eligiblities[code]; eg != nil {
+			price := eligiblity(eg, qty, p.basePrices[code])
+			if discount := qty*p.basePrices[code] - price; discount > 0 {
+				metrics.RuleApplied(eg.Type, discount)
+			}
+			total += price
 		} else {
 			// normal pricing
-			total += purchase.Premium * basePrices["premium"]
+			total += qty * p.basePrices[code]
 		}
 	}
 
-	purchase.Total = total
-	// log.Println(total)
-	return c.JSON(http.StatusOK, purchase)
+	return total, nil
+}
+
+// safeTotal is total for the batch workers, echo's recover doesn't reach
+// their goroutines so a panic pricing one item only fails that item
+func (p *pricing) safeTotal(purchase *model.Purchase, logger echo.Logger) (total int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			total, err = 0, errors.New("Purchase could not be priced")
+			logger.Error(r)
+		}
+	}()
+	return p.total(purchase)
 }
 
 func eligiblity(eg *model.PricingRules, buy int, basePrice int) (total int) {
-	// if rule type=deal
-	if eg.Type == "deal" {
+	// if rule type=deal, rules stored before deal_buy was checked may lack it
+	if eg.Type == "deal" && eg.DealBuy > 0 {
 		whole := buy / eg.DealBuy
 		residue := buy % eg.DealBuy
 		total = (whole * eg.DealPriceOf * basePrice) + (residue * basePrice)
@@ -120,3 +407,36 @@ func eligiblity(eg *model.PricingRules, buy int, basePrice int) (total int) {
 	}
 	return total
 }
+
+// upgradeAmount prices moving one ad to another tier as the difference of
+// both tiers' unit price under the customer rules
+func upgradeAmount(ad *model.JobAd, to string, rules []*model.PricingRules, basePrices map[string]int, now time.Time) (amount int) {
+	eligiblities := map[string]*model.PricingRules{}
+	for _, r := range rules {
+		eligiblities[r.ProductCode] = r
+	}
+	unitPrice := func(code string) int {
+		if eg := eligiblities[code]; eg != nil {
+			return eligiblity(eg, 1, basePrices[code])
+		}
+		return basePrices[code]
+	}
+
+	amount = unitPrice(to) - unitPrice(ad.ProductCode)
+	if amount < 0 {
+		amount = 0
+	}
+
+	// only charge for the part of the run that is left
+	if config.UpgradeProrate {
+		run := ad.ExpiresAt.Sub(ad.PostedAt)
+		remaining := ad.ExpiresAt.Sub(now)
+		if remaining < 0 {
+			remaining = 0
+		}
+		if run > 0 && remaining < run {
+			amount = int(math.Round(float64(amount) * remaining.Seconds() / run.Seconds()))
+		}
+	}
+	return amount
+}
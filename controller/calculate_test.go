@@ -0,0 +1,133 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"../model"
+	"github.com/globalsign/mgo/bson"
+	"github.com/labstack/echo"
+)
+
+// calculate prices purchase for customerID as of at, now when at is zero
+func calculate(t *testing.T, s *Server, customerID bson.ObjectId, purchase string, at time.Time) (int, *model.Purchase) {
+	target := "/calculate/" + customerID.Hex()
+	if !at.IsZero() {
+		target += "?as_of=" + url.QueryEscape(at.UTC().Format(time.RFC3339Nano))
+	}
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(purchase))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.SetParamNames("id")
+	c.SetParamValues(customerID.Hex())
+
+	if err := s.Calculate(c); err != nil {
+		he, ok := err.(*echo.HTTPError)
+		if !ok {
+			t.Fatal(err)
+		}
+		return he.Code, nil
+	}
+	result := new(model.Purchase)
+	if err := json.Unmarshal(rec.Body.Bytes(), result); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, result
+}
+
+func TestCalculateAsOf(t *testing.T) {
+	ctx := context.Background()
+	store := model.NewMemoryStore()
+	defer store.Close()
+	s := NewServer(store.Products(), store.Customers(), store.Rules())
+
+	beforeCatalog := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	classic := &model.Product{ID: bson.NewObjectId(), Code: "classic", Name: "Classic Ad", Price: 26999, Status: model.ProductActive}
+	if err := s.Products.Create(ctx, classic); err != nil {
+		t.Fatal(err)
+	}
+	customer := &model.Customer{ID: bson.NewObjectId(), Name: "Unilever Asia"}
+	if err := s.Customers.Create(ctx, customer); err != nil {
+		t.Fatal(err)
+	}
+	deal := &model.PricingRules{ID: bson.NewObjectId(), CustomerID: customer.ID.Hex(), ProductCode: "classic", Type: "deal", DealBuy: 3, DealPriceOf: 2}
+	if err := s.Rules.Create(ctx, deal); err != nil {
+		t.Fatal(err)
+	}
+	then := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	update := *classic
+	update.Price = 30000
+	if _, err := s.Products.Update(ctx, classic.ID, &update, model.AnyRevision); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Rules.Delete(ctx, deal.ID, model.AnyRevision); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		at     time.Time
+		status int
+		total  int
+	}{
+		{"now", time.Time{}, http.StatusOK, 3 * 30000},
+		{"old price & rule", then, http.StatusOK, 2 * 26999},
+		{"before the product", beforeCatalog, http.StatusNotFound, 0},
+	}
+	for _, tc := range cases {
+		status, result := calculate(t, s, customer.ID, `{"classic":3}`, tc.at)
+		if status != tc.status {
+			t.Errorf("%s: status %d, want %d", tc.name, status, tc.status)
+			continue
+		}
+		if result != nil && result.Total != tc.total {
+			t.Errorf("%s: total %d, want %d", tc.name, result.Total, tc.total)
+		}
+	}
+}
+
+func TestTotalNotSold(t *testing.T) {
+	p := &pricing{
+		basePrices: map[string]int{"classic": 26999},
+		retired:    map[string]bool{},
+		rules:      map[string]map[string]*model.PricingRules{},
+	}
+	purchase := &model.Purchase{CustomerID: bson.NewObjectId(), Classic: 1, Premium: 1}
+	if _, err := p.total(purchase); err != errNotSold {
+		t.Errorf("got %v, want %v", err, errNotSold)
+	}
+
+	// a product left out of the purchase needs no price
+	purchase.Premium = 0
+	if total, err := p.total(purchase); err != nil || total != 26999 {
+		t.Errorf("got %d %v, want 26999", total, err)
+	}
+}
+
+func TestSafeTotalRecovers(t *testing.T) {
+	// a pricing that can't be read panics in total
+	var p *pricing
+	purchase := &model.Purchase{CustomerID: bson.NewObjectId(), Classic: 1}
+	if _, err := p.safeTotal(purchase, echo.New().Logger); err == nil {
+		t.Error("got no error pricing with a broken pricing")
+	}
+}
+
+func TestEligiblityDealOfZero(t *testing.T) {
+	// stored before deal_buy was checked, priced like no rule
+	eg := &model.PricingRules{Type: "deal", DealPriceOf: 2}
+	if total := eligiblity(eg, 3, 100); total != 300 {
+		t.Errorf("total %d, want 300", total)
+	}
+}
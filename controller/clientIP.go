@@ -0,0 +1,53 @@
+package controller
+
+import (
+	"net"
+	"strings"
+
+	"../config"
+	"github.com/labstack/echo"
+)
+
+// clientIP of the request. the forwarding headers are believed only when
+// sent by a trusted proxy: X-Forwarded-For is read right to left past the
+// trusted proxies, the first address not one of them is the client
+func clientIP(c echo.Context) string {
+	req := c.Request()
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	if !trustedProxy(ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(strings.Join(req.Header[echo.HeaderXForwardedFor], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if hop == "" {
+			continue
+		}
+		if !trustedProxy(hop) {
+			return hop
+		}
+		ip = hop
+	}
+	if real := strings.TrimSpace(req.Header.Get(echo.HeaderXRealIP)); real != "" && len(req.Header[echo.HeaderXForwardedFor]) == 0 {
+		return real
+	}
+	return ip
+}
+
+// trustedProxy whether ip is in one of the trusted proxy networks
+func trustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range config.TrustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package controller
+
+import (
+	"net/http"
+
+	"../model"
+	"github.com/asaskevich/govalidator"
+	"github.com/globalsign/mgo/bson"
+	"github.com/labstack/echo"
+)
+
+// CreditCreate godocs
+// ----------------------------------------------------------------------
+// @tags Credit
+// @Summary Top up credit
+// @Description add job ad credits of a product to customer
+// @Accept  json
+// @Produce  json
+// @Param Body body model.Credit true " "
+// @Param Idempotency-Key header string false "retries with the same key replay the first response"
+// @Success 200 {object} model.Credit
+// @Failure 400 {object} echo.HTTPError
+// @Router /credit/create [post]
+// ----------------------------------------------------------------------
+func (s *Server) CreditCreate(c echo.Context) (err error) {
+	if !bson.IsObjectIdHex(c.FormValue("customer_id")) {
+		return echo.NewHTTPError(http.StatusBadRequest, "customer_id is an invalid ObjectID")
+	}
+	customerID := c.FormValue("customer_id")
+
+	credit := &model.Credit{
+		CustomerID: customerID,
+	}
+	if err = c.Bind(credit); err != nil {
+		return err
+	}
+
+	_, err = govalidator.ValidateStruct(credit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	var result *model.Credit
+	result, err = model.AddCredit(auditContext(c), credit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
+
+// CreditSelectByCustomerID godocs
+// ----------------------------------------------------------------------
+// @tags Credit
+// @Summary Select Credit by Customer ID
+// @Description Show remaining credits based on selected Customer ID
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} model.Credit
+// @Failure 400 {object} echo.HTTPError
+// @Router /credit/customer/{customer_id} [get]
+// ----------------------------------------------------------------------
+func (s *Server) CreditSelectByCustomerID(c echo.Context) (err error) {
+	if !bson.IsObjectIdHex(c.Param("id")) {
+		return echo.NewHTTPError(http.StatusBadRequest, "ID is an invalid ObjectID")
+	}
+	id := c.Param("id")
+
+	var results []*model.Credit
+	results, err = model.SelectCreditByCustomerID(c.Request().Context(), id)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, results)
+}
@@ -2,6 +2,7 @@ package controller
 
 import (
 	"net/http"
+	"regexp"
 	"strings"
 
 	"../model"
@@ -18,11 +19,12 @@ import (
 // @Accept  json
 // @Produce  json
 // @Param Body body model.Customer true " "
+// @Param Idempotency-Key header string false "retries with the same key replay the first response"
 // @Success 200 {object} model.Customer
 // @Failure 400 {object} echo.HTTPError
 // @Router /customer/create [post]
 // ----------------------------------------------------------------------
-func CustomerCreate(c echo.Context) (err error) {
+func (s *Server) CustomerCreate(c echo.Context) (err error) {
 	customer := &model.Customer{
 		ID: bson.NewObjectId(),
 	}
@@ -35,7 +37,7 @@ func CustomerCreate(c echo.Context) (err error) {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
-	if err = model.CreateCustomer(customer); err != nil {
+	if err = s.Customers.Create(auditContext(c), customer); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
@@ -49,24 +51,86 @@ func CustomerCreate(c echo.Context) (err error) {
 // @Description Show specific customer based on search
 // @Accept  json
 // @Produce  json
+// @Param name query string false "customer name, case insensitive"
+// @Param match query string false "contains (default) or prefix"
+// @Param fuzzy query bool false "tolerate typos in name of 2 to 64 characters, closest first"
+// @Param email query string false "exact email"
+// @Param external_ref query string false "exact external reference"
+// @Param q query string false "full text over name, email & external reference, best match first"
+// @Param include_deleted query bool false "also list deleted customers"
+// @Param sort query string false "name, prefix - for descending"
+// @Param limit query int false "page size"
+// @Param cursor query string false "next page cursor from Link header"
+// @Param count query bool false "return X-Total-Count"
 // @Success 200 {object} model.Customer
 // @Failure 400 {object} echo.HTTPError
 // @Router /customers [get]
 // ----------------------------------------------------------------------
-func CustomerSearch(c echo.Context) (err error) {
-	var filter = map[string]bson.M{}
-	qName := strings.ToLower(c.QueryParam("name"))
+func (s *Server) CustomerSearch(c echo.Context) (err error) {
+	includeDeleted, err := queryBool(c, "include_deleted")
+	if err != nil {
+		return err
+	}
+
+	q, err := listQuery(c, []string{"name"}, "name")
+	if err != nil {
+		return err
+	}
+
+	qName := strings.ToLower(strings.TrimSpace(c.QueryParam("name")))
+
+	fuzzy, err := queryBool(c, "fuzzy")
+	if err != nil {
+		return err
+	}
+	if fuzzy {
+		if qName == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "fuzzy needs a name")
+		}
+		if c.QueryParam("sort") != "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "fuzzy matches are sorted closest first")
+		}
+		q.Sort = model.SortDistance
+		results, page, err := s.Customers.FuzzySearch(c.Request().Context(), q, qName, includeDeleted)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		return pageJSON(c, results, page)
+	}
+
 	if qName != "" {
-		filter["name"] = bson.M{"$regex": bson.RegEx{Pattern: qName, Options: "i"}}
+		// user input is matched literally, never as a pattern
+		pattern := regexp.QuoteMeta(qName)
+		switch c.QueryParam("match") {
+		case "", "contains":
+		case "prefix":
+			pattern = "^" + pattern
+		default:
+			return echo.NewHTTPError(http.StatusBadRequest, "match must be one of contains, prefix")
+		}
+		q.Filter["name_lower"] = bson.RegEx{Pattern: pattern}
+	}
+	if qEmail := c.QueryParam("email"); qEmail != "" {
+		q.Filter["email"] = strings.ToLower(strings.TrimSpace(qEmail))
+	}
+	if qRef := c.QueryParam("external_ref"); qRef != "" {
+		q.Filter["external_ref"] = qRef
+	}
+	if qText := c.QueryParam("q"); qText != "" {
+		q.Filter["$text"] = bson.M{"$search": qText}
+		if c.QueryParam("sort") == "" {
+			q.Sort = model.SortRelevance
+		}
 	}
 
 	var results []*model.Customer
-	results, err = model.SearchCustomer(filter)
+	var page *model.Page
+	results, page, err = s.Customers.Search(c.Request().Context(), q, includeDeleted)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
-	return c.JSON(http.StatusOK, results)
+	return pageJSON(c, results, page)
 }
 
 // CustomerSelectByID godocs
@@ -80,19 +144,19 @@ func CustomerSearch(c echo.Context) (err error) {
 // @Failure 400 {object} echo.HTTPError
 // @Router /customer/{id} [get]
 // ----------------------------------------------------------------------
-func CustomerSelectByID(c echo.Context) (err error) {
+func (s *Server) CustomerSelectByID(c echo.Context) (err error) {
 	if !bson.IsObjectIdHex(c.Param("id")) {
 		return echo.NewHTTPError(http.StatusBadRequest, "ID is an invalid ObjectID")
 	}
 	id := bson.ObjectIdHex(c.Param("id"))
 
 	var result *model.Customer
-	result, err = model.SelectCustomerByID(id)
+	result, err = s.Customers.SelectByID(c.Request().Context(), id)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
-	return c.JSON(http.StatusOK, result)
+	return documentJSON(c, result.Revision, result)
 }
 
 // CustomerUpdate godocs
@@ -102,17 +166,24 @@ func CustomerSelectByID(c echo.Context) (err error) {
 // @Description Update specific customer based on selected ID
 // @Accept  json
 // @Produce  json
+// @Param If-Match header string false "ETag of the revision being changed"
 // @Param Body body model.Customer true " "
 // @Success 200 {object} model.Customer
 // @Failure 400 {object} echo.HTTPError
+// @Failure 412 {object} echo.HTTPError
 // @Router /customer/{id} [put]
 // ----------------------------------------------------------------------
-func CustomerUpdate(c echo.Context) (err error) {
+func (s *Server) CustomerUpdate(c echo.Context) (err error) {
 	if !bson.IsObjectIdHex(c.Param("id")) {
 		return echo.NewHTTPError(http.StatusBadRequest, "ID is an invalid ObjectID")
 	}
 	id := bson.ObjectIdHex(c.Param("id"))
 
+	revision, err := ifMatch(c)
+	if err != nil {
+		return err
+	}
+
 	customer := new(model.Customer)
 	if err = c.Bind(customer); err != nil {
 		return err
@@ -124,12 +195,12 @@ func CustomerUpdate(c echo.Context) (err error) {
 	}
 
 	var result *model.Customer
-	result, err = model.UpdateCustomer(id, customer)
+	result, err = s.Customers.Update(auditContext(c), id, customer, revision)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		return revisionError(err)
 	}
 
-	return c.JSON(http.StatusOK, result)
+	return documentJSON(c, result.Revision, result)
 }
 
 // CustomerDelete godocs
@@ -139,19 +210,26 @@ func CustomerUpdate(c echo.Context) (err error) {
 // @Description Remove specific customer based on selected ID
 // @Accept  json
 // @Produce  json
+// @Param If-Match header string false "ETag of the revision being changed"
 // @Success 200 {object} model.Customer
 // @Failure 400 {object} echo.HTTPError
+// @Failure 412 {object} echo.HTTPError
 // @Router /customer/{id} [delete]
 // ----------------------------------------------------------------------
-func CustomerDelete(c echo.Context) (err error) {
+func (s *Server) CustomerDelete(c echo.Context) (err error) {
 	if !bson.IsObjectIdHex(c.Param("id")) {
 		return echo.NewHTTPError(http.StatusBadRequest, "ID is an invalid ObjectID")
 	}
 	id := bson.ObjectIdHex(c.Param("id"))
 
-	err = model.DeleteCustomer(id)
+	revision, err := ifMatch(c)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		return err
+	}
+
+	err = s.Customers.Delete(auditContext(c), id, revision)
+	if err != nil {
+		return revisionError(err)
 	}
 
 	msg := map[string]string{
@@ -161,3 +239,30 @@ func CustomerDelete(c echo.Context) (err error) {
 
 	return c.JSON(http.StatusOK, msg)
 }
+
+// CustomerRestore godocs
+// ----------------------------------------------------------------------
+// @tags Customer
+// @Summary Restore Customer by ID
+// @Description Bring back specific deleted customer based on selected ID
+// @Accept  json
+// @Produce  json
+// @Param Idempotency-Key header string false "retries with the same key replay the first response"
+// @Success 200 {object} model.Customer
+// @Failure 400 {object} echo.HTTPError
+// @Router /customer/{id}/restore [post]
+// ----------------------------------------------------------------------
+func (s *Server) CustomerRestore(c echo.Context) (err error) {
+	if !bson.IsObjectIdHex(c.Param("id")) {
+		return echo.NewHTTPError(http.StatusBadRequest, "ID is an invalid ObjectID")
+	}
+	id := bson.ObjectIdHex(c.Param("id"))
+
+	var result *model.Customer
+	result, err = s.Customers.Restore(auditContext(c), id)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
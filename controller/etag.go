@@ -0,0 +1,93 @@
+package controller
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"../config"
+	"../model"
+	"github.com/labstack/echo"
+)
+
+// conditional request headers
+const (
+	headerETag        = "ETag"
+	headerIfMatch     = "If-Match"
+	headerIfNoneMatch = "If-None-Match"
+)
+
+// revisionETag is the ETag of a single document at a revision
+func revisionETag(revision int) string {
+	return `"` + strconv.Itoa(revision) + `"`
+}
+
+// etagMatches tells whether etag is listed in an If-None-Match header
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// ifMatch reads the revision a client is writing over from If-Match
+func ifMatch(c echo.Context) (int, error) {
+	v := strings.TrimSpace(c.Request().Header.Get(headerIfMatch))
+	if v == "" {
+		if config.RequireIfMatch {
+			return 0, echo.NewHTTPError(http.StatusPreconditionRequired, "If-Match header is required")
+		}
+		return model.AnyRevision, nil
+	}
+	if v == "*" {
+		return model.AnyRevision, nil
+	}
+
+	revision, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(v, "W/"), `"`))
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusPreconditionFailed, model.ErrRevisionMismatch.Error())
+	}
+	return revision, nil
+}
+
+// revisionError answers 412 when the document changed under the client
+func revisionError(err error) error {
+	if err == model.ErrRevisionMismatch {
+		return echo.NewHTTPError(http.StatusPreconditionFailed, err.Error())
+	}
+	return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+}
+
+// documentJSON writes a single document tagged with its revision, or 304
+// when the client's copy is still current
+func documentJSON(c echo.Context, revision int, doc interface{}) error {
+	etag := revisionETag(revision)
+	c.Response().Header().Set(headerETag, etag)
+	if etagMatches(c.Request().Header.Get(headerIfNoneMatch), etag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return c.JSON(http.StatusOK, doc)
+}
+
+// listingJSON writes a listing tagged with a hash of its content, or 304
+// when the client's copy is still current
+func listingJSON(c echo.Context, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	sum := sha1.Sum(body)
+	etag := `W/"` + hex.EncodeToString(sum[:]) + `"`
+
+	c.Response().Header().Set(headerETag, etag)
+	if etagMatches(c.Request().Header.Get(headerIfNoneMatch), etag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return c.JSONBlob(http.StatusOK, body)
+}
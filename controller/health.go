@@ -0,0 +1,118 @@
+package controller
+
+import (
+	"net/http"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+type (
+	// Check tells whether a dependency is ready, giving up after timeout
+	Check func(timeout time.Duration) error
+
+	// BuildInfo identifies the running binary
+	BuildInfo struct {
+		Version   string    `json:"version"`
+		Commit    string    `json:"commit"`
+		BuiltAt   string    `json:"built_at"`
+		GoVersion string    `json:"go_version"`
+		StartedAt time.Time `json:"started_at"`
+	}
+
+	// VersionInfo is the build & how long it has been up
+	VersionInfo struct {
+		BuildInfo
+		Uptime        string `json:"uptime"`
+		UptimeSeconds int64  `json:"uptime_seconds"`
+	}
+
+	// Readiness of the service & of each dependency it checked
+	Readiness struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}
+)
+
+// probes answer the orchestrator & the metrics scraper, they are public &
+// kept out of the request log
+var probes = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+	"/version": true,
+	"/metrics": true,
+}
+
+// IsProbe tells whether the request is one of the probes
+func IsProbe(c echo.Context) bool {
+	return probes[c.Path()]
+}
+
+// Healthz godocs
+// ----------------------------------------------------------------------
+// @tags Health
+// @Summary Liveness
+// @Description Answers as long as the process serves requests
+// @Produce  json
+// @Success 200 {object} controller.Readiness
+// @Router /healthz [get]
+// ----------------------------------------------------------------------
+func Healthz(c echo.Context) error {
+	return c.JSON(http.StatusOK, &Readiness{Status: "ok", Checks: map[string]string{}})
+}
+
+// Readyz godocs
+// ----------------------------------------------------------------------
+// @tags Health
+// @Summary Readiness
+// @Description Checks the storage backend answers & is set up, 503 until it is
+// @Produce  json
+// @Success 200 {object} controller.Readiness
+// @Failure 503 {object} controller.Readiness
+// @Router /readyz [get]
+// ----------------------------------------------------------------------
+func Readyz(checks map[string]Check, timeout time.Duration) echo.HandlerFunc {
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return func(c echo.Context) error {
+		readiness := &Readiness{Status: "ready", Checks: map[string]string{}}
+		status := http.StatusOK
+		for _, name := range names {
+			if err := checks[name](timeout); err != nil {
+				readiness.Status = "unavailable"
+				readiness.Checks[name] = err.Error()
+				status = http.StatusServiceUnavailable
+				continue
+			}
+			readiness.Checks[name] = "ok"
+		}
+		return c.JSON(status, readiness)
+	}
+}
+
+// Version godocs
+// ----------------------------------------------------------------------
+// @tags Health
+// @Summary Build information
+// @Description Version, git commit & uptime of the running binary
+// @Produce  json
+// @Success 200 {object} controller.VersionInfo
+// @Router /version [get]
+// ----------------------------------------------------------------------
+func Version(build BuildInfo) echo.HandlerFunc {
+	build.GoVersion = runtime.Version()
+	return func(c echo.Context) error {
+		uptime := time.Since(build.StartedAt)
+		return c.JSON(http.StatusOK, &VersionInfo{
+			BuildInfo:     build,
+			Uptime:        uptime.Truncate(time.Second).String(),
+			UptimeSeconds: int64(uptime / time.Second),
+		})
+	}
+}
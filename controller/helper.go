@@ -0,0 +1,68 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"../model"
+	"github.com/labstack/echo"
+)
+
+// dateLayout is the date format accepted in query params
+const dateLayout = "2006-01-02"
+
+// queryInt reads an integer query param, falls back to def when empty
+func queryInt(c echo.Context, name string, def int) (int, error) {
+	v := c.QueryParam(name)
+	if v == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, name+" must be a number")
+	}
+	return i, nil
+}
+
+// queryBool reads a true/false query param, false when empty
+func queryBool(c echo.Context, name string) (bool, error) {
+	v := c.QueryParam(name)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, echo.NewHTTPError(http.StatusBadRequest, name+" must be true or false")
+	}
+	return b, nil
+}
+
+// queryTime reads a RFC3339 or YYYY-MM-DD query param, zero when empty
+func queryTime(c echo.Context, name string) (time.Time, error) {
+	v := c.QueryParam(name)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(dateLayout, v)
+	if err != nil {
+		return time.Time{}, echo.NewHTTPError(http.StatusBadRequest, name+" must be formatted as RFC3339 or YYYY-MM-DD")
+	}
+	return t, nil
+}
+
+// auditContext tells the model who is making changes for the audit log
+func auditContext(c echo.Context) context.Context {
+	actor := "anonymous"
+	if p := principal(c); p != nil {
+		actor = p.String()
+	}
+	return model.WithAuditor(c.Request().Context(), model.Auditor{
+		Actor:     actor,
+		RequestID: c.Response().Header().Get(echo.HeaderXRequestID),
+	})
+}
@@ -0,0 +1,188 @@
+package controller
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"../model"
+	"github.com/labstack/echo"
+)
+
+// idempotency headers
+const (
+	headerIdempotencyKey     = "Idempotency-Key"
+	headerIdempotentReplayed = "Idempotent-Replayed"
+)
+
+// idempotency bounds
+const (
+	// maxIdempotencyKey bounds the key length clients may send
+	maxIdempotencyKey = 255
+	// maxIdempotentRequest bounds the request bodies read to fingerprint
+	maxIdempotentRequest = 1 << 20
+	// maxIdempotentResponse bounds the response bodies stored for replay,
+	// larger ones keep their digest only
+	maxIdempotentResponse = 1 << 20
+)
+
+// streamed routes take & answer NDJSON streams too large to hold, they
+// don't take an Idempotency-Key
+var streamed = map[string]bool{
+	"/calculate/batch":  true,
+	"/import/products":  true,
+	"/import/customers": true,
+	"/import/rules":     true,
+}
+
+// secret routes answer with a secret shown only once, their response is
+// never stored so replays are refused
+var secret = map[string]bool{
+	"/apikey/create":     true,
+	"/apikey/:id/rotate": true,
+}
+
+// responseRecorder keeps a copy of what is written to the client, up to
+// maxIdempotentResponse, & the digest of all of it
+type responseRecorder struct {
+	http.ResponseWriter
+	body     bytes.Buffer
+	digest   hash.Hash
+	overflow bool
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.digest.Write(b)
+	if !r.overflow {
+		if r.body.Len()+len(b) > maxIdempotentResponse {
+			r.overflow = true
+			r.body.Reset()
+		} else {
+			r.body.Write(b)
+		}
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush keeps streamed responses streaming
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// NoIdempotency middleware, for storage backends that can't keep keys: a
+// request sent with an Idempotency-Key is refused rather than done without
+// the guarantee the client asked for
+func NoIdempotency() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if c.Request().Header.Get(headerIdempotencyKey) != "" {
+				return echo.NewHTTPError(http.StatusNotImplemented, "Idempotency-Key needs the mongo storage backend")
+			}
+			return next(c)
+		}
+	}
+}
+
+// Idempotent middleware, a POST sent with an Idempotency-Key is answered
+// once, retries with the same key & request get the stored response back
+func Idempotent() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			key := req.Header.Get(headerIdempotencyKey)
+			if req.Method != http.MethodPost || key == "" {
+				return next(c)
+			}
+			if len(key) > maxIdempotencyKey {
+				return echo.NewHTTPError(http.StatusBadRequest, "Idempotency-Key is too long")
+			}
+			if streamed[c.Path()] {
+				return echo.NewHTTPError(http.StatusBadRequest, "Idempotency-Key is not supported by streamed routes")
+			}
+
+			body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxIdempotentRequest+1))
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "Request body could not be read")
+			}
+			if len(body) > maxIdempotentRequest {
+				return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "Request body is too large for an Idempotency-Key")
+			}
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+			sum := sha256.Sum256(append([]byte(req.Method+" "+req.URL.RequestURI()+"\n"), body...))
+			fingerprint := hex.EncodeToString(sum[:])
+
+			// keys are per client, one client can't replay another's response
+			scope := "anonymous"
+			if p := principal(c); p != nil {
+				scope = p.String()
+			}
+			scoped := scope + " " + key
+
+			existing, err := model.BeginIdempotent(c.Request().Context(), scoped, fingerprint)
+			switch err {
+			case nil:
+			case model.ErrIdempotencyMismatch:
+				return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+			case model.ErrIdempotencyInFlight:
+				return echo.NewHTTPError(http.StatusConflict, err.Error())
+			default:
+				return err
+			}
+			if existing != nil {
+				if existing.Withheld != "" {
+					return echo.NewHTTPError(http.StatusGone, "The response to this Idempotency-Key is not kept, the request was already done")
+				}
+				c.Response().Header().Set(headerIdempotentReplayed, "true")
+				return c.Blob(existing.Status, existing.ContentType, existing.Body)
+			}
+
+			defer func() {
+				if r := recover(); r != nil {
+					model.AbandonIdempotent(c.Request().Context(), scoped)
+					panic(r)
+				}
+			}()
+
+			res := c.Response()
+			recorder := &responseRecorder{ResponseWriter: res.Writer, digest: sha256.New()}
+			res.Writer = recorder
+
+			// errors are rendered here so their response is stored too
+			if err = next(c); err != nil {
+				c.Error(err)
+			}
+
+			// server errors may not repeat, the client is free to retry
+			if res.Status >= http.StatusInternalServerError {
+				err = model.AbandonIdempotent(c.Request().Context(), scoped)
+			} else {
+				response := &model.IdempotencyRecord{
+					Status:      res.Status,
+					ContentType: res.Header().Get(echo.HeaderContentType),
+					Body:        recorder.body.Bytes(),
+				}
+				if secret[c.Path()] {
+					response.Body = nil
+					response.Withheld = model.WithheldSecret
+				} else if recorder.overflow {
+					response.Body = nil
+					response.Withheld = model.WithheldSize
+					response.Digest = hex.EncodeToString(recorder.digest.Sum(nil))
+				}
+				err = model.FinishIdempotent(c.Request().Context(), scoped, response)
+			}
+			if err != nil {
+				c.Logger().Error(err)
+			}
+
+			return nil
+		}
+	}
+}
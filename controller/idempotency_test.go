@@ -0,0 +1,143 @@
+package controller
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"../config"
+	"../model"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/labstack/echo"
+)
+
+// idempotentServer routes path to handler behind Idempotent, counting the
+// times handler really ran
+func idempotentServer(path string, handler echo.HandlerFunc) (*echo.Echo, *int) {
+	calls := new(int)
+	e := echo.New()
+	e.Use(Idempotent())
+	e.POST(path, func(c echo.Context) error {
+		*calls++
+		return handler(c)
+	})
+	return e, calls
+}
+
+func post(e *echo.Echo, path string, key string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	if key != "" {
+		req.Header.Set(headerIdempotencyKey, key)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func created(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]string{"id": bson.NewObjectId().Hex()})
+}
+
+func TestIdempotentRefusals(t *testing.T) {
+	e, calls := idempotentServer("/import/customers", created)
+	e.POST("/order/:id/pay", created)
+
+	if rec := post(e, "/import/customers", "k", "{}"); rec.Code != http.StatusBadRequest {
+		t.Errorf("streamed route: status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if rec := post(e, "/order/1/pay", strings.Repeat("k", maxIdempotencyKey+1), "{}"); rec.Code != http.StatusBadRequest {
+		t.Errorf("long key: status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if *calls != 0 {
+		t.Errorf("handler ran %d times, want 0", *calls)
+	}
+}
+
+func TestNoIdempotency(t *testing.T) {
+	e := echo.New()
+	e.Use(NoIdempotency())
+	e.POST("/order/:id/pay", created)
+
+	if rec := post(e, "/order/1/pay", "k", "{}"); rec.Code != http.StatusNotImplemented {
+		t.Errorf("with a key: status %d, want %d", rec.Code, http.StatusNotImplemented)
+	}
+	if rec := post(e, "/order/1/pay", "", "{}"); rec.Code != http.StatusOK {
+		t.Errorf("without a key: status %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+// TEST_MONGO_URL is a mongo server, the replays are stored in a database
+// of their own that is dropped at the end
+func TestIdempotentReplay(t *testing.T) {
+	url := os.Getenv("TEST_MONGO_URL")
+	if url == "" {
+		t.Skip("TEST_MONGO_URL is not set")
+	}
+	info, err := mgo.ParseURL(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = model.Connect(info); err != nil {
+		t.Fatal(err)
+	}
+	defer model.Disconnect()
+	config.DbName = "jobads_test_" + bson.NewObjectId().Hex()
+	defer model.DB.DB(config.DbName).DropDatabase()
+	if err = model.IdempotencyIndexing(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("replays the first response", func(t *testing.T) {
+		e, calls := idempotentServer("/customer/create", created)
+		first := post(e, "/customer/create", "replay", `{"name":"a"}`)
+		again := post(e, "/customer/create", "replay", `{"name":"a"}`)
+		if *calls != 1 {
+			t.Errorf("handler ran %d times, want 1", *calls)
+		}
+		if again.Code != first.Code || again.Body.String() != first.Body.String() {
+			t.Errorf("replayed %d %s, want %d %s", again.Code, again.Body, first.Code, first.Body)
+		}
+		if again.Header().Get(headerIdempotentReplayed) != "true" {
+			t.Errorf("replay is not marked %s", headerIdempotentReplayed)
+		}
+	})
+
+	t.Run("refuses another request", func(t *testing.T) {
+		e, calls := idempotentServer("/customer/create", created)
+		post(e, "/customer/create", "other", `{"name":"a"}`)
+		if rec := post(e, "/customer/create", "other", `{"name":"b"}`); rec.Code != http.StatusUnprocessableEntity {
+			t.Errorf("status %d, want %d", rec.Code, http.StatusUnprocessableEntity)
+		}
+		if *calls != 1 {
+			t.Errorf("handler ran %d times, want 1", *calls)
+		}
+	})
+
+	t.Run("never stores secrets", func(t *testing.T) {
+		e, calls := idempotentServer("/apikey/create", created)
+		post(e, "/apikey/create", "secret", `{}`)
+		rec := post(e, "/apikey/create", "secret", `{}`)
+		if rec.Code != http.StatusGone || strings.Contains(rec.Body.String(), `"id"`) {
+			t.Errorf("replayed %d %s, want %d", rec.Code, rec.Body, http.StatusGone)
+		}
+		if *calls != 1 {
+			t.Errorf("handler ran %d times, want 1", *calls)
+		}
+	})
+
+	t.Run("retries server errors", func(t *testing.T) {
+		failed := func(c echo.Context) error {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "down")
+		}
+		e, calls := idempotentServer("/customer/create", failed)
+		post(e, "/customer/create", "retry", `{}`)
+		post(e, "/customer/create", "retry", `{}`)
+		if *calls != 2 {
+			t.Errorf("handler ran %d times, want 2", *calls)
+		}
+	})
+}
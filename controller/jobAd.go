@@ -0,0 +1,365 @@
+package controller
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"../model"
+	"github.com/asaskevich/govalidator"
+	"github.com/globalsign/mgo/bson"
+	"github.com/labstack/echo"
+)
+
+// JobAdCreate godocs
+// ----------------------------------------------------------------------
+// @tags JobAd
+// @Summary Create job ad
+// @Description post new job ad, consumes one credit of the chosen product
+// @Accept  json
+// @Produce  json
+// @Param Body body model.JobAd true " "
+// @Param Idempotency-Key header string false "retries with the same key replay the first response"
+// @Success 200 {object} model.JobAd
+// @Failure 400 {object} echo.HTTPError
+// @Router /jobad/create [post]
+// ----------------------------------------------------------------------
+func (s *Server) JobAdCreate(c echo.Context) (err error) {
+	if !bson.IsObjectIdHex(c.FormValue("customer_id")) {
+		return echo.NewHTTPError(http.StatusBadRequest, "customer_id is an invalid ObjectID")
+	}
+	customerID := c.FormValue("customer_id")
+
+	ad := &model.JobAd{
+		ID:         bson.NewObjectId(),
+		CustomerID: customerID,
+	}
+	if err = c.Bind(ad); err != nil {
+		return err
+	}
+	// the owner was checked against customer_id, a body naming another
+	// customer would post on their account
+	if ad.CustomerID != customerID {
+		return echo.NewHTTPError(http.StatusBadRequest, "customer_id of the body differs from the one given")
+	}
+
+	_, err = govalidator.ValidateStruct(ad)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if err = model.CreateJobAd(auditContext(c), ad); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, ad)
+}
+
+// JobAdListing godocs
+// ----------------------------------------------------------------------
+// @tags JobAd
+// @Summary JobAd listings
+// @Description List job ads, optionally by customer_id & status
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} model.JobAd
+// @Failure 400 {object} echo.HTTPError
+// @Router /jobads [get]
+// ----------------------------------------------------------------------
+func (s *Server) JobAdListing(c echo.Context) (err error) {
+	var filter = bson.M{}
+	if qCustomer := c.QueryParam("customer_id"); qCustomer != "" {
+		filter["customer_id"] = qCustomer
+	}
+	if qStatus := c.QueryParam("status"); qStatus != "" {
+		filter["status"] = qStatus
+	}
+
+	var results []*model.JobAd
+	results, err = model.ListJobAd(c.Request().Context(), filter)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, results)
+}
+
+// JobAdSearch godocs
+// ----------------------------------------------------------------------
+// @tags JobAd
+// @Summary Search job ads
+// @Description Public search over active job ads, premium ads ranked first
+// @Accept  json
+// @Produce  json
+// @Param q query string false "keyword over title & description"
+// @Param location query string false "location"
+// @Param category query string false "category"
+// @Param salary_min query int false "minimum salary"
+// @Param salary_max query int false "maximum salary"
+// @Param posted_from query string false "posted on or after, YYYY-MM-DD"
+// @Param posted_to query string false "posted on or before, YYYY-MM-DD"
+// @Param page query int false "page number, starts at 1"
+// @Param limit query int false "results per page, max 100"
+// @Success 200 {object} model.JobAd
+// @Failure 400 {object} echo.HTTPError
+// @Router /jobads/search [get]
+// ----------------------------------------------------------------------
+func (s *Server) JobAdSearch(c echo.Context) (err error) {
+	search := &model.JobAdSearch{
+		Keyword:  strings.TrimSpace(c.QueryParam("q")),
+		Location: strings.TrimSpace(c.QueryParam("location")),
+		Category: strings.TrimSpace(c.QueryParam("category")),
+		Page:     1,
+		Limit:    20,
+	}
+
+	if search.SalaryMin, err = queryInt(c, "salary_min", 0); err != nil {
+		return err
+	}
+	if search.SalaryMax, err = queryInt(c, "salary_max", 0); err != nil {
+		return err
+	}
+	if search.Page, err = queryInt(c, "page", search.Page); err != nil {
+		return err
+	}
+	if search.Limit, err = queryInt(c, "limit", search.Limit); err != nil {
+		return err
+	}
+	if search.Page < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "page must be greater than 0")
+	}
+	if search.Limit < 1 || search.Limit > 100 {
+		return echo.NewHTTPError(http.StatusBadRequest, "limit must be between 1 and 100")
+	}
+
+	if qFrom := c.QueryParam("posted_from"); qFrom != "" {
+		if search.PostedFrom, err = time.Parse(dateLayout, qFrom); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "posted_from must be formatted as YYYY-MM-DD")
+		}
+	}
+	if qTo := c.QueryParam("posted_to"); qTo != "" {
+		if search.PostedTo, err = time.Parse(dateLayout, qTo); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "posted_to must be formatted as YYYY-MM-DD")
+		}
+		// include the whole day
+		search.PostedTo = search.PostedTo.Add(24*time.Hour - time.Nanosecond)
+	}
+
+	results, total, err := model.SearchJobAd(c.Request().Context(), search)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if results == nil {
+		results = []*model.JobAd{}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"total":   total,
+		"page":    search.Page,
+		"limit":   search.Limit,
+		"results": results,
+	})
+}
+
+// JobAdSelectByID godocs
+// ----------------------------------------------------------------------
+// @tags JobAd
+// @Summary Select JobAd by ID
+// @Description Show specific job ad based on selected ID
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} model.JobAd
+// @Failure 400 {object} echo.HTTPError
+// @Router /jobad/{id} [get]
+// ----------------------------------------------------------------------
+func (s *Server) JobAdSelectByID(c echo.Context) (err error) {
+	if !bson.IsObjectIdHex(c.Param("id")) {
+		return echo.NewHTTPError(http.StatusBadRequest, "ID is an invalid ObjectID")
+	}
+	id := bson.ObjectIdHex(c.Param("id"))
+
+	var result *model.JobAd
+	result, err = model.SelectJobAdByID(c.Request().Context(), id)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return documentJSON(c, result.Revision, result)
+}
+
+// JobAdUpdate godocs
+// ----------------------------------------------------------------------
+// @tags JobAd
+// @Summary Update JobAd by ID
+// @Description Update content of specific job ad based on selected ID
+// @Accept  json
+// @Produce  json
+// @Param If-Match header string false "ETag of the revision being changed"
+// @Param Body body model.JobAd true " "
+// @Success 200 {object} model.JobAd
+// @Failure 400 {object} echo.HTTPError
+// @Failure 412 {object} echo.HTTPError
+// @Router /jobad/{id} [put]
+// ----------------------------------------------------------------------
+func (s *Server) JobAdUpdate(c echo.Context) (err error) {
+	if !bson.IsObjectIdHex(c.Param("id")) {
+		return echo.NewHTTPError(http.StatusBadRequest, "ID is an invalid ObjectID")
+	}
+	id := bson.ObjectIdHex(c.Param("id"))
+
+	revision, err := ifMatch(c)
+	if err != nil {
+		return err
+	}
+
+	var current *model.JobAd
+	current, err = model.SelectJobAdByID(c.Request().Context(), id)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	// tier & owner are fixed once posted
+	ad := &model.JobAd{
+		CustomerID:  current.CustomerID,
+		ProductCode: current.ProductCode,
+	}
+	if err = c.Bind(ad); err != nil {
+		return err
+	}
+	ad.CustomerID = current.CustomerID
+	ad.ProductCode = current.ProductCode
+
+	_, err = govalidator.ValidateStruct(ad)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	var result *model.JobAd
+	result, err = model.UpdateJobAd(auditContext(c), id, ad, revision)
+	if err != nil {
+		return revisionError(err)
+	}
+
+	return documentJSON(c, result.Revision, result)
+}
+
+// JobAdUpgrade godocs
+// ----------------------------------------------------------------------
+// @tags JobAd
+// @Summary Upgrade JobAd by ID
+// @Description Create an order to move a live job ad to a higher tier, the ad is switched once the order is paid
+// @Accept  json
+// @Produce  json
+// @Param Body body model.Upgrade true " "
+// @Param Idempotency-Key header string false "retries with the same key replay the first response"
+// @Success 200 {object} model.Order
+// @Failure 400 {object} echo.HTTPError
+// @Router /jobad/{id}/upgrade [post]
+// ----------------------------------------------------------------------
+func (s *Server) JobAdUpgrade(c echo.Context) (err error) {
+	if !bson.IsObjectIdHex(c.Param("id")) {
+		return echo.NewHTTPError(http.StatusBadRequest, "ID is an invalid ObjectID")
+	}
+	id := bson.ObjectIdHex(c.Param("id"))
+
+	upgrade := new(model.Upgrade)
+	if err = c.Bind(upgrade); err != nil {
+		return err
+	}
+
+	_, err = govalidator.ValidateStruct(upgrade)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	var ad *model.JobAd
+	ad, err = model.SelectJobAdByID(c.Request().Context(), id)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if ad.Status != model.JobAdActive {
+		return echo.NewHTTPError(http.StatusBadRequest, "Only active job ads can be upgraded")
+	}
+
+	// price under the customer's current rules
+	var rules []*model.PricingRules
+	rules, err = s.Rules.SelectByCustomerID(c.Request().Context(), ad.CustomerID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	var products []*model.Product
+	products, err = s.Products.List(c.Request().Context())
+	if err != nil {
+		return err
+	}
+	basePrices := map[string]int{}
+	catalog := map[string]*model.Product{}
+	for _, p := range products {
+		basePrices[p.Code] = p.Price
+		catalog[p.Code] = p
+	}
+
+	from, to := catalog[ad.ProductCode], catalog[upgrade.ProductCode]
+	if from == nil || to == nil || to.DurationDays <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Product Code cannot be used for job ads")
+	}
+	if to.IsRetired() {
+		return echo.NewHTTPError(http.StatusBadRequest, "Product is retired and can no longer be bought")
+	}
+	if to.AdRank() <= from.AdRank() {
+		return echo.NewHTTPError(http.StatusBadRequest, "Job ads can only be upgraded to a higher tier")
+	}
+
+	order := &model.Order{
+		ID:          bson.NewObjectId(),
+		CustomerID:  ad.CustomerID,
+		Type:        model.OrderUpgrade,
+		JobAdID:     ad.ID.Hex(),
+		FromProduct: ad.ProductCode,
+		ToProduct:   upgrade.ProductCode,
+		Amount:      upgradeAmount(ad, upgrade.ProductCode, rules, basePrices, time.Now()),
+	}
+	if err = model.CreateOrder(auditContext(c), order); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, order)
+}
+
+// JobAdDelete godocs
+// ----------------------------------------------------------------------
+// @tags JobAd
+// @Summary Delete JobAd by ID
+// @Description Remove specific job ad based on selected ID
+// @Accept  json
+// @Produce  json
+// @Param If-Match header string false "ETag of the revision being changed"
+// @Success 200 {object} model.JobAd
+// @Failure 400 {object} echo.HTTPError
+// @Failure 412 {object} echo.HTTPError
+// @Router /jobad/{id} [delete]
+// ----------------------------------------------------------------------
+func (s *Server) JobAdDelete(c echo.Context) (err error) {
+	if !bson.IsObjectIdHex(c.Param("id")) {
+		return echo.NewHTTPError(http.StatusBadRequest, "ID is an invalid ObjectID")
+	}
+	id := bson.ObjectIdHex(c.Param("id"))
+
+	revision, err := ifMatch(c)
+	if err != nil {
+		return err
+	}
+
+	err = model.DeleteJobAd(auditContext(c), id, revision)
+	if err != nil {
+		return revisionError(err)
+	}
+
+	msg := map[string]string{
+		"status":  "success",
+		"message": "Selected job ad has been deleted",
+	}
+
+	return c.JSON(http.StatusOK, msg)
+}
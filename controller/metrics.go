@@ -0,0 +1,52 @@
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"../metrics"
+	"github.com/labstack/echo"
+)
+
+// routeTemplates tells the route template a request matched. echo gives
+// unmatched requests their raw path, only the registered templates are
+// kept, read once every route is in
+type routeTemplates struct {
+	once      sync.Once
+	templates map[string]bool
+}
+
+// of the request, "" when it matched none
+func (r *routeTemplates) of(c echo.Context) string {
+	r.once.Do(func() {
+		r.templates = map[string]bool{}
+		for _, route := range c.Echo().Routes() {
+			r.templates[route.Path] = true
+		}
+	})
+	if route := c.Path(); r.templates[route] {
+		return route
+	}
+	return ""
+}
+
+// Metrics middleware, counts & times every request by the route template
+// it matched so ids in paths don't each become a series
+func Metrics() echo.MiddlewareFunc {
+	routes := &routeTemplates{}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			if IsProbe(c) {
+				return next(c)
+			}
+
+			start := time.Now()
+			if err = next(c); err != nil {
+				// write the error now, the status is only known once it is
+				c.Error(err)
+			}
+			metrics.Request(c.Request().Method, routes.of(c), c.Response().Status, time.Since(start))
+			return err
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package controller
+
+import (
+	"net/http"
+
+	"../model"
+	"github.com/globalsign/mgo/bson"
+	"github.com/labstack/echo"
+)
+
+// OrderSelectByID godocs
+// ----------------------------------------------------------------------
+// @tags Order
+// @Summary Select Order by ID
+// @Description Show specific order based on selected ID
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} model.Order
+// @Failure 400 {object} echo.HTTPError
+// @Router /order/{id} [get]
+// ----------------------------------------------------------------------
+func (s *Server) OrderSelectByID(c echo.Context) (err error) {
+	if !bson.IsObjectIdHex(c.Param("id")) {
+		return echo.NewHTTPError(http.StatusBadRequest, "ID is an invalid ObjectID")
+	}
+	id := bson.ObjectIdHex(c.Param("id"))
+
+	var result *model.Order
+	result, err = model.SelectOrderByID(c.Request().Context(), id)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
+
+// OrderSelectByCustomerID godocs
+// ----------------------------------------------------------------------
+// @tags Order
+// @Summary Select Order by Customer ID
+// @Description Show orders based on selected Customer ID
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} model.Order
+// @Failure 400 {object} echo.HTTPError
+// @Router /order/customer/{customer_id} [get]
+// ----------------------------------------------------------------------
+func (s *Server) OrderSelectByCustomerID(c echo.Context) (err error) {
+	if !bson.IsObjectIdHex(c.Param("id")) {
+		return echo.NewHTTPError(http.StatusBadRequest, "ID is an invalid ObjectID")
+	}
+	id := c.Param("id")
+
+	var results []*model.Order
+	results, err = model.SelectOrderByCustomerID(c.Request().Context(), id)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, results)
+}
+
+// OrderPay godocs
+// ----------------------------------------------------------------------
+// @tags Order
+// @Summary Pay Order by ID
+// @Description Record the payment of an order & apply it, staff only
+// @Accept  json
+// @Produce  json
+// @Param Idempotency-Key header string false "retries with the same key replay the first response"
+// @Success 200 {object} model.Order
+// @Failure 400 {object} echo.HTTPError
+// @Router /order/{id}/pay [post]
+// ----------------------------------------------------------------------
+func (s *Server) OrderPay(c echo.Context) (err error) {
+	if !bson.IsObjectIdHex(c.Param("id")) {
+		return echo.NewHTTPError(http.StatusBadRequest, "ID is an invalid ObjectID")
+	}
+	id := bson.ObjectIdHex(c.Param("id"))
+
+	var result *model.Order
+	result, err = model.PayOrder(auditContext(c), id)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
@@ -5,6 +5,7 @@ import (
 
 	"../model"
 	"github.com/asaskevich/govalidator"
+	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 	"github.com/labstack/echo"
 )
@@ -17,11 +18,12 @@ import (
 // @Accept  json
 // @Produce  json
 // @Param Body body model.PricingRules true " "
+// @Param Idempotency-Key header string false "retries with the same key replay the first response"
 // @Success 200 {object} model.PricingRules
 // @Failure 400 {object} echo.HTTPError
 // @Router /rule/create [post]
 // ----------------------------------------------------------------------
-func PricingRulesCreate(c echo.Context) (err error) {
+func (s *Server) PricingRulesCreate(c echo.Context) (err error) {
 	if !bson.IsObjectIdHex(c.FormValue("customer_id")) {
 		return echo.NewHTTPError(http.StatusBadRequest, "customer_id is an invalid ObjectID")
 	}
@@ -40,7 +42,7 @@ func PricingRulesCreate(c echo.Context) (err error) {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
-	if err = model.CreatePricingRules(rule); err != nil {
+	if err = s.Rules.Create(auditContext(c), rule); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
@@ -54,65 +56,142 @@ func PricingRulesCreate(c echo.Context) (err error) {
 // @Description List all rules
 // @Accept  json
 // @Produce  json
+// @Param include_deleted query bool false "also list deleted rules"
+// @Param customer_id query string false "customer ID"
+// @Param product_code query string false "product code"
+// @Param type query string false "deal or discount"
+// @Param sort query string false "customer_id, product_code or type, prefix - for descending"
+// @Param limit query int false "page size"
+// @Param cursor query string false "next page cursor from Link header"
+// @Param count query bool false "return X-Total-Count"
 // @Success 200 {object} model.PricingRules
 // @Failure 400 {object} echo.HTTPError
 // @Router /rules [get]
 // ----------------------------------------------------------------------
-func PricingRulesListing(c echo.Context) (err error) {
+func (s *Server) PricingRulesListing(c echo.Context) (err error) {
+	includeDeleted, err := queryBool(c, "include_deleted")
+	if err != nil {
+		return err
+	}
+
+	q, err := listQuery(c, []string{"customer_id", "product_code", "type"}, "")
+	if err != nil {
+		return err
+	}
+	for _, field := range []string{"customer_id", "product_code", "type"} {
+		if v := c.QueryParam(field); v != "" {
+			q.Filter[field] = v
+		}
+	}
+
 	var results []*model.PricingRules
-	results, err = model.ListPricingRules()
+	var page *model.Page
+	results, page, err = s.Rules.List(c.Request().Context(), q, includeDeleted)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
-	return c.JSON(http.StatusOK, results)
+	return pageJSON(c, results, page)
 }
 
 // PricingRulesSelectByID godocs
 // ----------------------------------------------------------------------
 // @tags PricingRules
 // @Summary Select PricingRules by ID
-// @Description Show specific rule based on selected ID
+// @Description Show specific rule based on selected ID, as it was at as_of when given
 // @Accept  json
 // @Produce  json
+// @Param as_of query string false "RFC3339 time or YYYY-MM-DD"
 // @Success 200 {object} model.PricingRules
 // @Failure 400 {object} echo.HTTPError
+// @Failure 404 {object} echo.HTTPError
 // @Router /rule/{id} [get]
 // ----------------------------------------------------------------------
-func PricingRulesSelectByID(c echo.Context) (err error) {
+func (s *Server) PricingRulesSelectByID(c echo.Context) (err error) {
 	if !bson.IsObjectIdHex(c.Param("id")) {
 		return echo.NewHTTPError(http.StatusBadRequest, "ID is an invalid ObjectID")
 	}
 	id := bson.ObjectIdHex(c.Param("id"))
 
+	at, err := queryTime(c, "as_of")
+	if err != nil {
+		return err
+	}
+
 	var result *model.PricingRules
-	result, err = model.SelectPricingRulesByID(id)
+	if at.IsZero() {
+		result, err = s.Rules.SelectByID(c.Request().Context(), id)
+	} else {
+		result, err = s.Rules.SelectAsOf(c.Request().Context(), id, at)
+	}
+	if err == mgo.ErrNotFound && !at.IsZero() {
+		return echo.NewHTTPError(http.StatusNotFound, "Pricing rule did not exist at that time")
+	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
-	return c.JSON(http.StatusOK, result)
+	if !at.IsZero() {
+		return c.JSON(http.StatusOK, result)
+	}
+	return documentJSON(c, result.Revision, result)
+}
+
+// PricingRulesVersions godocs
+// ----------------------------------------------------------------------
+// @tags PricingRules
+// @Summary List PricingRules versions by ID
+// @Description Show every version of specific rule based on selected ID
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} model.PricingRulesVersion
+// @Failure 400 {object} echo.HTTPError
+// @Router /rule/{id}/versions [get]
+// ----------------------------------------------------------------------
+func (s *Server) PricingRulesVersions(c echo.Context) (err error) {
+	if !bson.IsObjectIdHex(c.Param("id")) {
+		return echo.NewHTTPError(http.StatusBadRequest, "ID is an invalid ObjectID")
+	}
+	id := bson.ObjectIdHex(c.Param("id"))
+
+	var results []*model.PricingRulesVersion
+	results, err = s.Rules.ListVersions(c.Request().Context(), id)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, results)
 }
 
 // PricingRulesSelectByCustomerID godocs
 // ----------------------------------------------------------------------
 // @tags PricingRules
 // @Summary Select PricingRules by Customer ID
-// @Description Show created rules based on selected Customer ID
+// @Description Show created rules based on selected Customer ID, as they were at as_of when given
 // @Accept  json
 // @Produce  json
+// @Param as_of query string false "RFC3339 time or YYYY-MM-DD"
 // @Success 200 {object} model.PricingRules
 // @Failure 400 {object} echo.HTTPError
 // @Router /rule/customer/{customer_id} [get]
 // ----------------------------------------------------------------------
-func PricingRulesSelectByCustomerID(c echo.Context) (err error) {
+func (s *Server) PricingRulesSelectByCustomerID(c echo.Context) (err error) {
 	if !bson.IsObjectIdHex(c.Param("id")) {
 		return echo.NewHTTPError(http.StatusBadRequest, "ID is an invalid ObjectID")
 	}
 	id := c.Param("id")
 
+	at, err := queryTime(c, "as_of")
+	if err != nil {
+		return err
+	}
+
 	var results []*model.PricingRules
-	results, err = model.SelectPricingRulesByCustomerID(id)
+	if at.IsZero() {
+		results, err = s.Rules.SelectByCustomerID(c.Request().Context(), id)
+	} else {
+		results, err = s.Rules.SelectByCustomerIDAsOf(c.Request().Context(), id, at)
+	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
@@ -127,17 +206,24 @@ func PricingRulesSelectByCustomerID(c echo.Context) (err error) {
 // @Description Update specific rule based on selected ID
 // @Accept  json
 // @Produce  json
+// @Param If-Match header string false "ETag of the revision being changed"
 // @Param Body body model.PricingRules true " "
 // @Success 200 {object} model.PricingRules
 // @Failure 400 {object} echo.HTTPError
+// @Failure 412 {object} echo.HTTPError
 // @Router /rule/{id} [put]
 // ----------------------------------------------------------------------
-func PricingRulesUpdate(c echo.Context) (err error) {
+func (s *Server) PricingRulesUpdate(c echo.Context) (err error) {
 	if !bson.IsObjectIdHex(c.Param("id")) {
 		return echo.NewHTTPError(http.StatusBadRequest, "ID is an invalid ObjectID")
 	}
 	id := bson.ObjectIdHex(c.Param("id"))
 
+	revision, err := ifMatch(c)
+	if err != nil {
+		return err
+	}
+
 	rule := new(model.PricingRules)
 	if err = c.Bind(rule); err != nil {
 		return err
@@ -149,12 +235,12 @@ func PricingRulesUpdate(c echo.Context) (err error) {
 	}
 
 	var result *model.PricingRules
-	result, err = model.UpdatePricingRules(id, rule)
+	result, err = s.Rules.Update(auditContext(c), id, rule, revision)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		return revisionError(err)
 	}
 
-	return c.JSON(http.StatusOK, result)
+	return documentJSON(c, result.Revision, result)
 }
 
 // PricingRulesDelete godocs
@@ -164,19 +250,26 @@ func PricingRulesUpdate(c echo.Context) (err error) {
 // @Description Remove specific rule based on selected ID
 // @Accept  json
 // @Produce  json
+// @Param If-Match header string false "ETag of the revision being changed"
 // @Success 200 {object} model.PricingRules
 // @Failure 400 {object} echo.HTTPError
+// @Failure 412 {object} echo.HTTPError
 // @Router /rule/{id} [delete]
 // ----------------------------------------------------------------------
-func PricingRulesDelete(c echo.Context) (err error) {
+func (s *Server) PricingRulesDelete(c echo.Context) (err error) {
 	if !bson.IsObjectIdHex(c.Param("id")) {
 		return echo.NewHTTPError(http.StatusBadRequest, "ID is an invalid ObjectID")
 	}
 	id := bson.ObjectIdHex(c.Param("id"))
 
-	err = model.DeletePricingRules(id)
+	revision, err := ifMatch(c)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		return err
+	}
+
+	err = s.Rules.Delete(auditContext(c), id, revision)
+	if err != nil {
+		return revisionError(err)
 	}
 
 	msg := map[string]string{
@@ -186,3 +279,30 @@ func PricingRulesDelete(c echo.Context) (err error) {
 
 	return c.JSON(http.StatusOK, msg)
 }
+
+// PricingRulesRestore godocs
+// ----------------------------------------------------------------------
+// @tags PricingRules
+// @Summary Restore PricingRules by ID
+// @Description Bring back specific deleted rule based on selected ID
+// @Accept  json
+// @Produce  json
+// @Param Idempotency-Key header string false "retries with the same key replay the first response"
+// @Success 200 {object} model.PricingRules
+// @Failure 400 {object} echo.HTTPError
+// @Router /rule/{id}/restore [post]
+// ----------------------------------------------------------------------
+func (s *Server) PricingRulesRestore(c echo.Context) (err error) {
+	if !bson.IsObjectIdHex(c.Param("id")) {
+		return echo.NewHTTPError(http.StatusBadRequest, "ID is an invalid ObjectID")
+	}
+	id := bson.ObjectIdHex(c.Param("id"))
+
+	var result *model.PricingRules
+	result, err = s.Rules.Restore(auditContext(c), id)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
@@ -5,6 +5,7 @@ import (
 
 	"../model"
 	"github.com/asaskevich/govalidator"
+	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 	"github.com/labstack/echo"
 )
@@ -17,13 +18,15 @@ import (
 // @Accept  json
 // @Produce  json
 // @Param Body body model.Product true " "
+// @Param Idempotency-Key header string false "retries with the same key replay the first response"
 // @Success 200 {object} model.Product
 // @Failure 400 {object} echo.HTTPError
 // @Router /product/create [post]
 // ----------------------------------------------------------------------
-func ProductCreate(c echo.Context) (err error) {
+func (s *Server) ProductCreate(c echo.Context) (err error) {
 	product := &model.Product{
-		ID: bson.NewObjectId(),
+		ID:     bson.NewObjectId(),
+		Status: model.ProductActive,
 	}
 	if err = c.Bind(product); err != nil {
 		return err
@@ -34,7 +37,7 @@ func ProductCreate(c echo.Context) (err error) {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
-	if err = model.CreateProduct(product); err != nil {
+	if err = s.Products.Create(auditContext(c), product); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
@@ -45,47 +48,139 @@ func ProductCreate(c echo.Context) (err error) {
 // ----------------------------------------------------------------------
 // @tags Product
 // @Summary Products listings
-// @Description List all products
+// @Description List all products, optionally only active or retired ones & by tag
 // @Accept  json
 // @Produce  json
+// @Param status query string false "active or retired"
+// @Param tag query string false "tag"
+// @Param include_deleted query bool false "also list deleted products"
+// @Param price_min query int false "minimum price"
+// @Param price_max query int false "maximum price"
+// @Param sort query string false "display_order, code, name or price, prefix - for descending"
+// @Param limit query int false "page size"
+// @Param cursor query string false "next page cursor from Link header"
+// @Param count query bool false "return X-Total-Count"
 // @Success 200 {object} model.Product
 // @Failure 400 {object} echo.HTTPError
 // @Router /products [get]
 // ----------------------------------------------------------------------
-func ProductListing(c echo.Context) (err error) {
+func (s *Server) ProductListing(c echo.Context) (err error) {
+	includeDeleted, err := queryBool(c, "include_deleted")
+	if err != nil {
+		return err
+	}
+
+	q, err := listQuery(c, []string{"display_order", "code", "name", "price"}, "display_order")
+	if err != nil {
+		return err
+	}
+
+	filter := q.Filter
+	switch c.QueryParam("status") {
+	case "":
+	case model.ProductActive:
+		// products created before statuses existed are active
+		filter["status"] = bson.M{"$ne": model.ProductRetired}
+	case model.ProductRetired:
+		filter["status"] = model.ProductRetired
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "status must be active or retired")
+	}
+	if qTag := c.QueryParam("tag"); qTag != "" {
+		filter["tags"] = qTag
+	}
+	price := bson.M{}
+	if qMin := c.QueryParam("price_min"); qMin != "" {
+		if price["$gte"], err = queryInt(c, "price_min", 0); err != nil {
+			return err
+		}
+	}
+	if qMax := c.QueryParam("price_max"); qMax != "" {
+		if price["$lte"], err = queryInt(c, "price_max", 0); err != nil {
+			return err
+		}
+	}
+	if len(price) > 0 {
+		filter["price"] = price
+	}
+
 	var results []*model.Product
-	results, err = model.ListProduct()
+	var page *model.Page
+	results, page, err = s.Products.Search(c.Request().Context(), q, includeDeleted)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
-	return c.JSON(http.StatusOK, results)
+	return pageJSON(c, results, page)
 }
 
 // ProductSelectByID godocs
 // ----------------------------------------------------------------------
 // @tags Product
 // @Summary Select Product by ID
-// @Description Show specific product based on selected ID
+// @Description Show specific product based on selected ID, as it was at as_of when given
 // @Accept  json
 // @Produce  json
+// @Param as_of query string false "RFC3339 time or YYYY-MM-DD"
 // @Success 200 {object} model.Product
 // @Failure 400 {object} echo.HTTPError
+// @Failure 404 {object} echo.HTTPError
 // @Router /product/{id} [get]
 // ----------------------------------------------------------------------
-func ProductSelectByID(c echo.Context) (err error) {
+func (s *Server) ProductSelectByID(c echo.Context) (err error) {
 	if !bson.IsObjectIdHex(c.Param("id")) {
 		return echo.NewHTTPError(http.StatusBadRequest, "ID is an invalid ObjectID")
 	}
 	id := bson.ObjectIdHex(c.Param("id"))
 
+	at, err := queryTime(c, "as_of")
+	if err != nil {
+		return err
+	}
+
 	var result *model.Product
-	result, err = model.SelectProductByID(id)
+	if at.IsZero() {
+		result, err = s.Products.SelectByID(c.Request().Context(), id)
+	} else {
+		result, err = s.Products.SelectAsOf(c.Request().Context(), id, at)
+	}
+	if err == mgo.ErrNotFound && !at.IsZero() {
+		return echo.NewHTTPError(http.StatusNotFound, "Product did not exist at that time")
+	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
-	return c.JSON(http.StatusOK, result)
+	if !at.IsZero() {
+		return c.JSON(http.StatusOK, result)
+	}
+	return documentJSON(c, result.Revision, result)
+}
+
+// ProductVersions godocs
+// ----------------------------------------------------------------------
+// @tags Product
+// @Summary List Product versions by ID
+// @Description Show every version of specific product based on selected ID
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} model.ProductVersion
+// @Failure 400 {object} echo.HTTPError
+// @Router /product/{id}/versions [get]
+// ----------------------------------------------------------------------
+func (s *Server) ProductVersions(c echo.Context) (err error) {
+	if !bson.IsObjectIdHex(c.Param("id")) {
+		return echo.NewHTTPError(http.StatusBadRequest, "ID is an invalid ObjectID")
+	}
+	id := bson.ObjectIdHex(c.Param("id"))
+
+	var results []*model.ProductVersion
+	results, err = s.Products.ListVersions(c.Request().Context(), id)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, results)
 }
 
 // ProductUpdate godocs
@@ -95,18 +190,39 @@ func ProductSelectByID(c echo.Context) (err error) {
 // @Description Update specific product based on selected ID
 // @Accept  json
 // @Produce  json
+// @Param If-Match header string false "ETag of the revision being changed"
 // @Param Body body model.Product true " "
 // @Success 200 {object} model.Product
 // @Failure 400 {object} echo.HTTPError
+// @Failure 412 {object} echo.HTTPError
 // @Router /product/{id} [put]
 // ----------------------------------------------------------------------
-func ProductUpdate(c echo.Context) (err error) {
+func (s *Server) ProductUpdate(c echo.Context) (err error) {
 	if !bson.IsObjectIdHex(c.Param("id")) {
 		return echo.NewHTTPError(http.StatusBadRequest, "ID is an invalid ObjectID")
 	}
 	id := bson.ObjectIdHex(c.Param("id"))
 
-	product := new(model.Product)
+	revision, err := ifMatch(c)
+	if err != nil {
+		return err
+	}
+
+	// fields left out of the body keep their stored values: a retired
+	// product stays retired until it is said otherwise & clients that
+	// predate the job ad fields don't wipe them
+	stored, err := s.Products.SelectByID(c.Request().Context(), id)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	product := &model.Product{
+		Description:  stored.Description,
+		DurationDays: stored.DurationDays,
+		Features:     stored.Features,
+		Status:       stored.Status,
+		DisplayOrder: stored.DisplayOrder,
+		Tags:         stored.Tags,
+	}
 	if err = c.Bind(product); err != nil {
 		return err
 	}
@@ -117,12 +233,12 @@ func ProductUpdate(c echo.Context) (err error) {
 	}
 
 	var result *model.Product
-	result, err = model.UpdateProduct(id, product)
+	result, err = s.Products.Update(auditContext(c), id, product, revision)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		return revisionError(err)
 	}
 
-	return c.JSON(http.StatusOK, result)
+	return documentJSON(c, result.Revision, result)
 }
 
 // ProductDelete godocs
@@ -132,19 +248,26 @@ func ProductUpdate(c echo.Context) (err error) {
 // @Description Remove specific product based on selected ID
 // @Accept  json
 // @Produce  json
+// @Param If-Match header string false "ETag of the revision being changed"
 // @Success 200 {object} model.Product
 // @Failure 400 {object} echo.HTTPError
+// @Failure 412 {object} echo.HTTPError
 // @Router /product/{id} [delete]
 // ----------------------------------------------------------------------
-func ProductDelete(c echo.Context) (err error) {
+func (s *Server) ProductDelete(c echo.Context) (err error) {
 	if !bson.IsObjectIdHex(c.Param("id")) {
 		return echo.NewHTTPError(http.StatusBadRequest, "ID is an invalid ObjectID")
 	}
 	id := bson.ObjectIdHex(c.Param("id"))
 
-	err = model.DeleteProduct(id)
+	revision, err := ifMatch(c)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		return err
+	}
+
+	err = s.Products.Delete(auditContext(c), id, revision)
+	if err != nil {
+		return revisionError(err)
 	}
 
 	msg := map[string]string{
@@ -154,3 +277,30 @@ func ProductDelete(c echo.Context) (err error) {
 
 	return c.JSON(http.StatusOK, msg)
 }
+
+// ProductRestore godocs
+// ----------------------------------------------------------------------
+// @tags Product
+// @Summary Restore Product by ID
+// @Description Bring back specific deleted product based on selected ID
+// @Accept  json
+// @Produce  json
+// @Param Idempotency-Key header string false "retries with the same key replay the first response"
+// @Success 200 {object} model.Product
+// @Failure 400 {object} echo.HTTPError
+// @Router /product/{id}/restore [post]
+// ----------------------------------------------------------------------
+func (s *Server) ProductRestore(c echo.Context) (err error) {
+	if !bson.IsObjectIdHex(c.Param("id")) {
+		return echo.NewHTTPError(http.StatusBadRequest, "ID is an invalid ObjectID")
+	}
+	id := bson.ObjectIdHex(c.Param("id"))
+
+	var result *model.Product
+	result, err = s.Products.Restore(auditContext(c), id)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
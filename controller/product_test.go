@@ -0,0 +1,61 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"../model"
+	"github.com/globalsign/mgo/bson"
+	"github.com/labstack/echo"
+)
+
+func TestProductUpdateKeepsOmittedFields(t *testing.T) {
+	ctx := context.Background()
+	store := model.NewMemoryStore()
+	defer store.Close()
+	s := NewServer(store.Products(), store.Customers(), store.Rules())
+
+	premium := &model.Product{
+		ID:           bson.NewObjectId(),
+		Code:         "premium",
+		Name:         "Premium Ad",
+		Description:  "Top of the listings",
+		Price:        39499,
+		DurationDays: 30,
+		Features:     []string{"logo", "highlight", "top_placement"},
+		Status:       model.ProductRetired,
+		DisplayOrder: 3,
+		Tags:         []string{"ads"},
+	}
+	if err := s.Products.Create(ctx, premium); err != nil {
+		t.Fatal(err)
+	}
+
+	// a client from before the job ad fields sends what it knows of
+	body := `{"code":"premium","name":"Premium","price":40000}`
+	req := httptest.NewRequest(http.MethodPut, "/product/"+premium.ID.Hex(), strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	c := echo.New().NewContext(req, httptest.NewRecorder())
+	c.SetParamNames("id")
+	c.SetParamValues(premium.ID.Hex())
+	if err := s.ProductUpdate(c); err != nil {
+		t.Fatal(err)
+	}
+
+	updated, err := s.Products.SelectByID(ctx, premium.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Name != "Premium" || updated.Price != 40000 {
+		t.Errorf("name & price %s %d, want Premium 40000", updated.Name, updated.Price)
+	}
+	want := *premium
+	want.Name, want.Price, want.Revision = updated.Name, updated.Price, updated.Revision
+	if !reflect.DeepEqual(updated, &want) {
+		t.Errorf("got %+v, want %+v", updated, &want)
+	}
+}
@@ -0,0 +1,76 @@
+package controller
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"../model"
+	"github.com/globalsign/mgo/bson"
+	"github.com/labstack/echo"
+)
+
+// listing page size bounds
+const (
+	defaultLimit = 50
+	maxLimit     = 500
+)
+
+// headerLink & headerTotalCount are set on paginated listings
+const (
+	headerLink       = "Link"
+	headerTotalCount = "X-Total-Count"
+)
+
+// listQuery reads the limit, cursor, sort & count params every listing
+// shares, sort must be one of sortable with an optional "-" prefix
+func listQuery(c echo.Context, sortable []string, defaultSort string) (q *model.Query, err error) {
+	q = &model.Query{
+		Filter: bson.M{},
+		Sort:   defaultSort,
+		Cursor: c.QueryParam("cursor"),
+	}
+
+	if q.Limit, err = queryInt(c, "limit", defaultLimit); err != nil {
+		return nil, err
+	}
+	if q.Limit < 1 || q.Limit > maxLimit {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxLimit))
+	}
+
+	if qSort := c.QueryParam("sort"); qSort != "" {
+		allowed := false
+		for _, field := range sortable {
+			if strings.TrimPrefix(qSort, "-") == field {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "sort must be one of "+strings.Join(sortable, ", "))
+		}
+		q.Sort = qSort
+	}
+
+	if q.WithTotal, err = queryBool(c, "count"); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// pageJSON writes one page of a listing, linking to the next page & giving
+// the total count when it was asked for
+func pageJSON(c echo.Context, results interface{}, page *model.Page) error {
+	headers := c.Response().Header()
+	if page.NextCursor != "" {
+		next := *c.Request().URL
+		params := next.Query()
+		params.Set("cursor", page.NextCursor)
+		next.RawQuery = params.Encode()
+		headers.Set(headerLink, "<"+next.RequestURI()+`>; rel="next"`)
+	}
+	if page.Total >= 0 {
+		headers.Set(headerTotalCount, strconv.Itoa(page.Total))
+	}
+	return listingJSON(c, results)
+}
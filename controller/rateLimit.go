@@ -0,0 +1,82 @@
+package controller
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+
+	"../config"
+	"../limiter"
+	"github.com/labstack/echo"
+)
+
+// rate limit headers
+const (
+	headerRetryAfter         = "Retry-After"
+	headerRateLimitLimit     = "X-RateLimit-Limit"
+	headerRateLimitRemaining = "X-RateLimit-Remaining"
+	headerRateLimitReset     = "X-RateLimit-Reset"
+)
+
+// RateLimitIP middleware, every client IP gets a token bucket per route.
+// it runs before authentication so guessing credentials is throttled too
+func RateLimitIP(store limiter.Store) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if IsProbe(c) {
+				return next(c)
+			}
+			if err := take(c, store, "ip:"+clientIP(c)); err != nil {
+				return err
+			}
+			return next(c)
+		}
+	}
+}
+
+// RateLimit middleware, every authenticated principal gets a token bucket
+// per route on top of the one of its IP
+func RateLimit(store limiter.Store) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if IsProbe(c) {
+				return next(c)
+			}
+			if p := principal(c); p != nil {
+				if err := take(c, store, p.String()); err != nil {
+					return err
+				}
+			}
+			return next(c)
+		}
+	}
+}
+
+// take a token from the bucket of client for the route, failing with 429
+// when it is empty
+func take(c echo.Context, store limiter.Store, client string) error {
+	limit, ok := config.RateLimits[c.Path()]
+	if !ok {
+		limit = config.RateLimits["default"]
+	}
+	if limit.Rate <= 0 || limit.Burst <= 0 {
+		return nil
+	}
+
+	result, err := store.Take(c.Request().Context(), c.Path()+" "+client, limiter.Limit{Rate: limit.Rate, Burst: limit.Burst})
+	if err != nil {
+		// a broken limiter must not take the api down with it
+		c.Logger().Error(err)
+		return nil
+	}
+
+	headers := c.Response().Header()
+	headers.Set(headerRateLimitLimit, strconv.Itoa(result.Limit))
+	headers.Set(headerRateLimitRemaining, strconv.Itoa(result.Remaining))
+	headers.Set(headerRateLimitReset, strconv.FormatInt(result.Reset.Unix(), 10))
+	if !result.Allowed {
+		headers.Set(headerRetryAfter, strconv.Itoa(int(math.Ceil(result.RetryAfter.Seconds()))))
+		return echo.NewHTTPError(http.StatusTooManyRequests, "Rate limit exceeded, retry later")
+	}
+	return nil
+}
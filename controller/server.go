@@ -0,0 +1,21 @@
+package controller
+
+import (
+	"../model"
+)
+
+// Server is what the handlers depend on, built once at start up
+type Server struct {
+	Products  model.ProductRepository
+	Customers model.CustomerRepository
+	Rules     model.PricingRuleRepository
+}
+
+// NewServer to create the handlers over the given repositories
+func NewServer(products model.ProductRepository, customers model.CustomerRepository, rules model.PricingRuleRepository) *Server {
+	return &Server{
+		Products:  products,
+		Customers: customers,
+		Rules:     rules,
+	}
+}
@@ -0,0 +1,65 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+
+	"../tracing"
+	"github.com/labstack/echo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Trace middleware, a server span per request, continuing the trace of the
+// caller when it sent a W3C traceparent. the span is in the request context
+// so the storage & pricing spans nest under it
+func Trace() echo.MiddlewareFunc {
+	routes := &routeTemplates{}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			if IsProbe(c) {
+				return next(c)
+			}
+
+			req := c.Request()
+			ctx := tracing.Propagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+
+			// named by route template, by method alone when none matched
+			name := req.Method
+			attributes := []attribute.KeyValue{
+				attribute.String("http.request.method", req.Method),
+				attribute.String("url.path", req.URL.Path),
+				attribute.String("client.address", clientIP(c)),
+				attribute.String("user_agent.original", req.UserAgent()),
+				attribute.String("http.request_id", c.Response().Header().Get(echo.HeaderXRequestID)),
+			}
+			if route := routes.of(c); route != "" {
+				name += " " + route
+				attributes = append(attributes, attribute.String("http.route", route))
+			}
+
+			ctx, span := tracing.Tracer().Start(ctx, name,
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(attributes...))
+			defer span.End()
+			c.SetRequest(req.WithContext(ctx))
+
+			if err = next(c); err != nil {
+				// write the error now, the status is only known once it is
+				c.Error(err)
+			}
+			status := c.Response().Status
+			span.SetAttributes(attribute.Int("http.response.status_code", status))
+			// client errors are the client's, only server ones fail the span
+			if status >= http.StatusInternalServerError {
+				failure := err
+				if failure == nil {
+					failure = errors.New(http.StatusText(status))
+				}
+				tracing.Fail(span, failure)
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package limiter
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+type (
+	// Limit is a token bucket, Burst tokens refilled at Rate per second
+	Limit struct {
+		Rate  float64
+		Burst int
+	}
+
+	// Result of taking a token
+	Result struct {
+		Allowed    bool
+		Limit      int
+		Remaining  int
+		RetryAfter time.Duration
+		Reset      time.Time
+	}
+
+	// Store keeps buckets by key, each Take spends one token when there is
+	// one. ctx is the request's, for stores that go over the network
+	Store interface {
+		Take(ctx context.Context, key string, limit Limit) (*Result, error)
+	}
+
+	// Bucket state, shared by every store
+	Bucket struct {
+		Tokens    float64   `bson:"tokens"`
+		UpdatedAt time.Time `bson:"updated_at"`
+	}
+)
+
+// Take refills the bucket for the time elapsed since it was last used,
+// then spends a token if a whole one is left
+func (b *Bucket) Take(limit Limit, now time.Time) *Result {
+	burst := float64(limit.Burst)
+	if b.UpdatedAt.IsZero() {
+		b.Tokens = burst
+	} else if elapsed := now.Sub(b.UpdatedAt).Seconds(); elapsed > 0 {
+		b.Tokens = math.Min(burst, b.Tokens+elapsed*limit.Rate)
+	}
+	b.UpdatedAt = now
+
+	result := &Result{Limit: limit.Burst}
+	if b.Tokens >= 1 {
+		b.Tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = seconds((1 - b.Tokens) / limit.Rate)
+	}
+	result.Remaining = int(b.Tokens)
+	result.Reset = now.Add(seconds((burst - b.Tokens) / limit.Rate))
+
+	return result
+}
+
+// Full whether the bucket has refilled completely by now, so forgetting
+// it changes nothing
+func (b *Bucket) Full(limit Limit, now time.Time) bool {
+	return b.Tokens+now.Sub(b.UpdatedAt).Seconds()*limit.Rate >= float64(limit.Burst)
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,57 @@
+package limiter
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sweepEvery is how many takes pass between dropping refilled buckets
+const sweepEvery = 1000
+
+// Memory store, limits hold per instance only
+type Memory struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+	takes   int
+}
+
+type memoryBucket struct {
+	Bucket
+	limit Limit
+}
+
+// NewMemory to create an empty in process store
+func NewMemory() *Memory {
+	return &Memory{buckets: map[string]*memoryBucket{}}
+}
+
+// Take a token from key's bucket
+func (m *Memory) Take(ctx context.Context, key string, limit Limit) (*Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.takes++
+	if m.takes%sweepEvery == 0 {
+		m.sweep(now)
+	}
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &memoryBucket{}
+		m.buckets[key] = b
+	}
+	b.limit = limit
+
+	return b.Take(limit, now), nil
+}
+
+// sweep forgets buckets that are full again, so idle clients cost nothing
+func (m *Memory) sweep(now time.Time) {
+	for key, b := range m.buckets {
+		if b.Full(b.limit, now) {
+			delete(m.buckets, key)
+		}
+	}
+}
@@ -1,15 +1,13 @@
 package main
 
 import (
-	config "./config"
+	"flag"
+	"log"
+	"os"
 
-	"./controller"
+	"./app"
+	config "./config"
 	_ "./docs"
-	"github.com/facebookgo/grace/gracehttp"
-	"github.com/labstack/echo"
-	"github.com/labstack/echo/middleware"
-	"github.com/labstack/gommon/log"
-	"github.com/swaggo/echo-swagger"
 )
 
 // @title Job Ads Checkout System
@@ -23,40 +21,37 @@ import (
 // @host https://kayrules.com/
 // @BasePath /
 
+// identify the build, set with
+// -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.builtAt=$(date -u +%FT%TZ)"
+var (
+	version = "dev"
+	commit  = "unknown"
+	builtAt = ""
+)
+
 func main() {
-	e := echo.New()
-	e.Logger.SetLevel(log.INFO)
-	e.Use(middleware.Logger())
-
-	// product routes
-	e.GET("/products", controller.ProductListing)
-	e.POST("/product/create", controller.ProductCreate)
-	e.GET("/product/:id", controller.ProductSelectByID)
-	e.PUT("/product/:id", controller.ProductUpdate)
-	e.DELETE("/product/:id", controller.ProductDelete)
-
-	// customer routes
-	e.GET("/customers", controller.CustomerSearch)
-	e.POST("/customer/create", controller.CustomerCreate)
-	e.GET("/customer/:id", controller.CustomerSelectByID)
-	e.PUT("/customer/:id", controller.CustomerUpdate)
-	e.DELETE("/customer/:id", controller.CustomerDelete)
-
-	// rules routes
-	e.GET("/rules", controller.PricingRulesListing)
-	e.POST("/rule/create", controller.PricingRulesCreate)
-	e.GET("/rule/:id", controller.PricingRulesSelectByID)
-	e.GET("/rule/customer/:id", controller.PricingRulesSelectByCustomerID)
-	e.PUT("/rule/:id", controller.PricingRulesUpdate)
-	e.DELETE("/rule/:id", controller.PricingRulesDelete)
-
-	// calculation routes
-	e.POST("/calculate/:id", controller.Calculate)
-
-	//Routes for specs
-	e.GET("/specs/*", echoSwagger.WrapHandler)
-
-	// Start server
-	e.Server.Addr = ":" + config.Port
-	e.Logger.Fatal(gracehttp.Serve(e.Server))
+	cfg, err := config.Load(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.PrintConfig {
+		cfg.Print(os.Stdout)
+		return
+	}
+
+	app.Build.Version = version
+	app.Build.Commit = commit
+	app.Build.BuiltAt = builtAt
+	a, err := app.New(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer a.Close()
+
+	if err = a.Start(); err != nil {
+		log.Println(err)
+	}
 }
@@ -0,0 +1,169 @@
+// Package metrics keeps the prometheus collectors of the service & serves
+// them for scraping
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "jobads"
+
+// maxTiers bounds the customer tiers counted apart, customers set their
+// tier in free form metadata so further ones are counted as "other"
+const maxTiers = 20
+
+var (
+	requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "HTTP requests by method, route template & status.",
+	}, []string{"method", "route", "status"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "HTTP request latencies by method, route template & status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	mongoDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "mongo",
+		Name:      "operation_duration_seconds",
+		Help:      "Mongo operation latencies by collection & operation.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"collection", "operation"})
+
+	calculations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "pricing",
+		Name:      "calculations_total",
+		Help:      "Purchases priced by customer tier.",
+	}, []string{"tier"})
+
+	rulesApplied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "pricing",
+		Name:      "rules_applied_total",
+		Help:      "Pricing rules that lowered a purchase, by rule type.",
+	}, []string{"type"})
+
+	discounts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "pricing",
+		Name:      "discount_amount_total",
+		Help:      "Amount granted off base prices by pricing rules, in cents, by rule type.",
+	}, []string{"type"})
+
+	auditFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "audit",
+		Name:      "write_failures_total",
+		Help:      "Committed changes whose audit entry could not be written, by collection.",
+	}, []string{"collection"})
+)
+
+// Registry holds every collector of the service, along with the go runtime
+// & process ones
+var Registry = newRegistry()
+
+func newRegistry() *prometheus.Registry {
+	r := prometheus.NewRegistry()
+	r.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		requests,
+		requestDuration,
+		mongoDuration,
+		calculations,
+		rulesApplied,
+		discounts,
+		auditFailures,
+	)
+	return r
+}
+
+// Handler serves the registry in the prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// methods counted apart, anything else is "OTHER" so a client can't mint
+// label values
+var methods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+}
+
+// Request records a served request, route is the template it matched
+// (/product/:id, not /product/5b...) & "unmatched" when none did
+func Request(method string, route string, status int, took time.Duration) {
+	if !methods[method] {
+		method = "OTHER"
+	}
+	if route == "" {
+		route = "unmatched"
+	}
+	code := strconv.Itoa(status)
+	requests.WithLabelValues(method, route, code).Inc()
+	requestDuration.WithLabelValues(method, route, code).Observe(took.Seconds())
+}
+
+// MongoOperation records an operation on collection begun at start, meant
+// to be deferred when the operation begins
+func MongoOperation(collection string, operation string, start time.Time) {
+	mongoDuration.WithLabelValues(collection, operation).Observe(time.Since(start).Seconds())
+}
+
+// AuditFailure records a change to collection committed without its audit
+// entry
+func AuditFailure(collection string) {
+	auditFailures.WithLabelValues(collection).Inc()
+}
+
+// tiers counted apart so far
+var (
+	tiersMu sync.Mutex
+	tiers   = map[string]bool{}
+)
+
+// Calculation records a purchase priced for a customer of tier, "" when
+// the customer has none
+func Calculation(tier string) {
+	calculations.WithLabelValues(tierLabel(tier)).Inc()
+}
+
+func tierLabel(tier string) string {
+	if tier == "" {
+		return "none"
+	}
+	tiersMu.Lock()
+	defer tiersMu.Unlock()
+	if !tiers[tier] {
+		if len(tiers) >= maxTiers {
+			return "other"
+		}
+		tiers[tier] = true
+	}
+	return tier
+}
+
+// RuleApplied records a pricing rule of ruleType taking discount cents off
+// the base price of a purchase
+func RuleApplied(ruleType string, discount int) {
+	rulesApplied.WithLabelValues(ruleType).Inc()
+	discounts.WithLabelValues(ruleType).Add(float64(discount))
+}
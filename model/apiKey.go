@@ -0,0 +1,214 @@
+package model
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"../auth"
+	"../config"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// apiKeyPrefix marks generated keys so they are easy to spot in leaks
+const apiKeyPrefix = "jak_"
+
+type (
+	// APIKey struct, the key itself is only ever returned when issued
+	APIKey struct {
+		ID         bson.ObjectId `json:"id,omitempty" bson:"_id,omitempty"`
+		Name       string        `json:"name" bson:"name" valid:"required"`
+		Role       string        `json:"role" bson:"role" valid:"required,in(admin|sales|customer)"`
+		CustomerID string        `json:"customer_id,omitempty" bson:"customer_id,omitempty" valid:"-"`
+		Prefix     string        `json:"prefix" bson:"prefix" valid:"-"`
+		Hash       string        `json:"-" bson:"hash" valid:"-"`
+		Key        string        `json:"key,omitempty" bson:"-" valid:"-"`
+		CreatedAt  time.Time     `json:"created_at" bson:"created_at" valid:"-"`
+		RevokedAt  *time.Time    `json:"revoked_at,omitempty" bson:"revoked_at,omitempty" valid:"-"`
+		ReplacedBy string        `json:"replaced_by,omitempty" bson:"replaced_by,omitempty" valid:"-"`
+	}
+)
+
+// Principal the key authenticates as
+func (key *APIKey) Principal() *auth.Principal {
+	p := &auth.Principal{
+		ID:         key.ID.Hex(),
+		Kind:       auth.KindAPIKey,
+		Name:       key.Name,
+		CustomerID: key.CustomerID,
+	}
+	// keys issued before roles existed authorize nothing
+	if key.Role != "" {
+		p.Roles = []string{key.Role}
+	}
+	return p
+}
+
+// APIKeyIndexing to create indices
+// ----------------------------------------------------------------------
+func APIKeyIndexing() error {
+	c := DB.Copy().DB(config.DbName).C(config.APIKeysCollection)
+	err := c.EnsureIndex(mgo.Index{
+		Key:    []string{"hash"},
+		Unique: true,
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// issue generates a fresh secret for the key, only its hash is stored
+func (key *APIKey) issue() error {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	key.Key = apiKeyPrefix + hex.EncodeToString(secret)
+	key.Prefix = key.Key[:len(apiKeyPrefix)+8]
+	key.Hash = auth.HashKey(key.Key)
+	key.CreatedAt = time.Now()
+	key.RevokedAt = nil
+	key.ReplacedBy = ""
+	return nil
+}
+
+// CreateAPIKey Crud
+// ----------------------------------------------------------------------
+func CreateAPIKey(ctx context.Context, key *APIKey) (err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.APIKeysCollection, "CreateAPIKey")(&err)
+	c := db.DB(config.DbName).C(config.APIKeysCollection)
+
+	if err = key.issue(); err != nil {
+		return err
+	}
+	if err = c.Insert(key); err != nil {
+		return errors.New("Creating API Key failed")
+	}
+
+	writeAudit(ctx, db, config.APIKeysCollection, AuditCreate, key.ID, nil, key)
+
+	return nil
+}
+
+// ListAPIKey cRud
+// ----------------------------------------------------------------------
+func ListAPIKey(ctx context.Context) (results []*APIKey, err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.APIKeysCollection, "ListAPIKey")(&err)
+	c := db.DB(config.DbName).C(config.APIKeysCollection)
+
+	err = c.Find(nil).Sort("-created_at").All(&results)
+	if err != nil {
+		return nil, err
+	}
+
+	return results, err
+}
+
+// SelectAPIKeyByID cRud
+// ----------------------------------------------------------------------
+func SelectAPIKeyByID(ctx context.Context, id bson.ObjectId) (result *APIKey, err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.APIKeysCollection, "SelectAPIKeyByID")(&err)
+	c := db.DB(config.DbName).C(config.APIKeysCollection)
+
+	err = c.FindId(id).One(&result)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, err
+}
+
+// SelectAPIKeyByKey cRud
+// looks a presented key up by its hash, revoked keys are never found
+// ----------------------------------------------------------------------
+func SelectAPIKeyByKey(ctx context.Context, key string) (result *APIKey, err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.APIKeysCollection, "SelectAPIKeyByKey")(&err)
+	c := db.DB(config.DbName).C(config.APIKeysCollection)
+
+	err = c.Find(bson.M{"hash": auth.HashKey(key), "revoked_at": nil}).One(&result)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, err
+}
+
+// RotateAPIKey crUd
+// issues a replacement with the same name & owner, then revokes the old key
+// ----------------------------------------------------------------------
+func RotateAPIKey(ctx context.Context, id bson.ObjectId) (result *APIKey, err error) {
+	current, err := SelectAPIKeyByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if current.RevokedAt != nil {
+		return nil, errors.New("API Key is already revoked")
+	}
+
+	result = &APIKey{
+		ID:         bson.NewObjectId(),
+		Name:       current.Name,
+		Role:       current.Role,
+		CustomerID: current.CustomerID,
+	}
+	if err = CreateAPIKey(ctx, result); err != nil {
+		return nil, err
+	}
+
+	if err = revokeAPIKey(ctx, id, result.ID.Hex()); err != nil {
+		return nil, err
+	}
+
+	return result, err
+}
+
+// RevokeAPIKey cruD
+// keys are kept once revoked so the audit trail still resolves them
+// ----------------------------------------------------------------------
+func RevokeAPIKey(ctx context.Context, id bson.ObjectId) (err error) {
+	return revokeAPIKey(ctx, id, "")
+}
+
+func revokeAPIKey(ctx context.Context, id bson.ObjectId, replacedBy string) (err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.APIKeysCollection, "revokeAPIKey")(&err)
+	c := db.DB(config.DbName).C(config.APIKeysCollection)
+
+	set := bson.M{"revoked_at": time.Now()}
+	if replacedBy != "" {
+		set["replaced_by"] = replacedBy
+	}
+
+	var before, after *APIKey
+	_, err = c.Find(bson.M{"_id": id, "revoked_at": nil}).Apply(mgo.Change{
+		Update: bson.M{"$set": set},
+	}, &before)
+	if err == mgo.ErrNotFound {
+		return errors.New("API Key does not exist or is already revoked")
+	}
+	if err != nil {
+		return err
+	}
+
+	err = c.FindId(id).One(&after)
+	if err != nil {
+		return err
+	}
+
+	writeAudit(ctx, db, config.APIKeysCollection, AuditDelete, id, before, after)
+
+	return nil
+}
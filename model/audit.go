@@ -0,0 +1,202 @@
+package model
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"time"
+
+	"../config"
+	"../metrics"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// audited operations
+const (
+	AuditCreate  = "create"
+	AuditUpdate  = "update"
+	AuditDelete  = "delete"
+	AuditRestore = "restore"
+	AuditPurge   = "purge"
+)
+
+type (
+	// Auditor struct, who is making changes & in which request
+	Auditor struct {
+		Actor     string
+		RequestID string
+	}
+
+	// AuditLog struct
+	AuditLog struct {
+		ID        bson.ObjectId          `json:"id,omitempty" bson:"_id,omitempty"`
+		Actor     string                 `json:"actor" bson:"actor"`
+		RequestID string                 `json:"request_id" bson:"request_id"`
+		Entity    string                 `json:"entity" bson:"entity"`
+		EntityID  string                 `json:"entity_id" bson:"entity_id"`
+		Operation string                 `json:"operation" bson:"operation"`
+		Before    bson.M                 `json:"before,omitempty" bson:"before,omitempty"`
+		After     bson.M                 `json:"after,omitempty" bson:"after,omitempty"`
+		Diff      map[string]AuditChange `json:"diff,omitempty" bson:"diff,omitempty"`
+		CreatedAt time.Time              `json:"created_at" bson:"created_at"`
+	}
+
+	// AuditChange struct
+	AuditChange struct {
+		From interface{} `json:"from" bson:"from"`
+		To   interface{} `json:"to" bson:"to"`
+	}
+
+	// AuditSearch struct
+	AuditSearch struct {
+		Entity   string
+		EntityID string
+		Actor    string
+		From     time.Time
+		To       time.Time
+		Limit    int
+	}
+)
+
+type auditorKey struct{}
+
+// WithAuditor attaches who is making changes to ctx
+func WithAuditor(ctx context.Context, auditor Auditor) context.Context {
+	return context.WithValue(ctx, auditorKey{}, auditor)
+}
+
+// auditorFrom reads who is making changes from ctx
+func auditorFrom(ctx context.Context) Auditor {
+	if auditor, ok := ctx.Value(auditorKey{}).(Auditor); ok {
+		return auditor
+	}
+	return Auditor{Actor: "system"}
+}
+
+// AuditIndexing to create indices
+// ----------------------------------------------------------------------
+func AuditIndexing() error {
+	c := DB.Copy().DB(config.DbName).C(config.AuditCollection)
+	indices := [][]string{
+		{"entity", "entity_id", "-created_at"},
+		{"actor", "-created_at"},
+		{"-created_at"},
+	}
+	for _, key := range indices {
+		err := c.EnsureIndex(mgo.Index{
+			Key:    key,
+			Unique: false,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeAudit appends a log entry of a change, before is nil on create &
+// after is nil on delete. there is no way to update or remove entries.
+// the change is committed by then, so an entry that cannot be written is
+// logged & counted rather than failing it
+func writeAudit(ctx context.Context, db *mgo.Session, entity string, operation string, id bson.ObjectId, before interface{}, after interface{}) {
+	if !config.Audit {
+		return
+	}
+	if err := insertAudit(ctx, db, entity, operation, id, before, after); err != nil {
+		log.Println("audit of " + operation + " " + entity + " " + id.Hex() + " not written: " + err.Error())
+		metrics.AuditFailure(entity)
+	}
+}
+
+// insertAudit stores the log entry of a change
+func insertAudit(ctx context.Context, db *mgo.Session, entity string, operation string, id bson.ObjectId, before interface{}, after interface{}) (err error) {
+	c := db.DB(config.DbName).C(config.AuditCollection)
+
+	auditor := auditorFrom(ctx)
+	entry := &AuditLog{
+		ID:        bson.NewObjectId(),
+		Actor:     auditor.Actor,
+		RequestID: auditor.RequestID,
+		Entity:    entity,
+		EntityID:  id.Hex(),
+		Operation: operation,
+		CreatedAt: time.Now(),
+	}
+	if entry.Before, err = toM(before); err != nil {
+		return err
+	}
+	if entry.After, err = toM(after); err != nil {
+		return err
+	}
+	entry.Diff = diff(entry.Before, entry.After)
+
+	return c.Insert(entry)
+}
+
+// toM to store any document as plain map
+func toM(doc interface{}) (m bson.M, err error) {
+	v := reflect.ValueOf(doc)
+	if doc == nil || (v.Kind() == reflect.Ptr && v.IsNil()) {
+		return nil, nil
+	}
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	err = bson.Unmarshal(raw, &m)
+	return m, err
+}
+
+// diff lists every field that differs between before & after
+func diff(before bson.M, after bson.M) map[string]AuditChange {
+	changes := map[string]AuditChange{}
+	for k, v := range before {
+		if !reflect.DeepEqual(v, after[k]) {
+			changes[k] = AuditChange{From: v, To: after[k]}
+		}
+	}
+	for k, v := range after {
+		if _, ok := before[k]; !ok {
+			changes[k] = AuditChange{From: nil, To: v}
+		}
+	}
+	return changes
+}
+
+// SearchAudit cRud
+// ----------------------------------------------------------------------
+func SearchAudit(ctx context.Context, search *AuditSearch) (results []*AuditLog, err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.AuditCollection, "SearchAudit")(&err)
+	c := db.DB(config.DbName).C(config.AuditCollection)
+
+	filter := bson.M{}
+	if search.Entity != "" {
+		filter["entity"] = search.Entity
+	}
+	if search.EntityID != "" {
+		filter["entity_id"] = search.EntityID
+	}
+	if search.Actor != "" {
+		filter["actor"] = search.Actor
+	}
+	created := bson.M{}
+	if !search.From.IsZero() {
+		created["$gte"] = search.From
+	}
+	if !search.To.IsZero() {
+		created["$lte"] = search.To
+	}
+	if len(created) > 0 {
+		filter["created_at"] = created
+	}
+
+	err = c.Find(filter).Sort("-created_at").Limit(search.Limit).All(&results)
+	if err != nil {
+		return nil, err
+	}
+
+	return results, err
+}
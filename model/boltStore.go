@@ -0,0 +1,91 @@
+package model
+
+import (
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	bolt "go.etcd.io/bbolt"
+)
+
+type (
+	// boltStore keeps documents in a single file, a bucket per collection
+	// keyed by id
+	boltStore struct {
+		db *bolt.DB
+	}
+
+	boltTx struct {
+		tx *bolt.Tx
+	}
+)
+
+// OpenBoltStore a store kept in the file at path, created when missing.
+// only one process can have the file open at a time
+func OpenBoltStore(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &Store{kv: &boltStore{db: db}}, nil
+}
+
+func (s *boltStore) view(fn func(tx kvTx) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (s *boltStore) update(fn func(tx kvTx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (s *boltStore) close() error {
+	return s.db.Close()
+}
+
+// get copies the document out, bolt's memory is only valid within tx
+func (b boltTx) get(collection string, id bson.ObjectId) ([]byte, error) {
+	bucket := b.tx.Bucket([]byte(collection))
+	if bucket == nil {
+		return nil, nil
+	}
+	doc := bucket.Get([]byte(id))
+	if doc == nil {
+		return nil, nil
+	}
+	return append([]byte(nil), doc...), nil
+}
+
+func (b boltTx) put(collection string, id bson.ObjectId, doc []byte) error {
+	if !b.tx.Writable() {
+		return errReadOnly
+	}
+	bucket, err := b.tx.CreateBucketIfNotExists([]byte(collection))
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(id), doc)
+}
+
+func (b boltTx) remove(collection string, id bson.ObjectId) error {
+	if !b.tx.Writable() {
+		return errReadOnly
+	}
+	bucket := b.tx.Bucket([]byte(collection))
+	if bucket == nil {
+		return nil
+	}
+	return bucket.Delete([]byte(id))
+}
+
+func (b boltTx) each(collection string, fn func(doc []byte) error) error {
+	bucket := b.tx.Bucket([]byte(collection))
+	if bucket == nil {
+		return nil
+	}
+	return bucket.ForEach(func(_, doc []byte) error {
+		return fn(append([]byte(nil), doc...))
+	})
+}
@@ -0,0 +1,27 @@
+package model_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"../model"
+	"./repotest"
+)
+
+func TestBoltStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jobads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := model.OpenBoltStore(filepath.Join(dir, "jobads.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	repotest.Run(t, store.Products(), store.Customers(), store.Rules())
+}
@@ -0,0 +1,324 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"../config"
+	"github.com/asaskevich/govalidator"
+	"github.com/globalsign/mgo/bson"
+)
+
+// import row actions
+const (
+	ImportCreate    = "create"
+	ImportUpdate    = "update"
+	ImportUnchanged = "unchanged"
+)
+
+type (
+	// ImportOptions struct, how an import is run
+	ImportOptions struct {
+		// DryRun validates & plans every row without writing anything
+		DryRun bool
+		// Atomic writes nothing unless every row is valid, & undoes the rows
+		// already written if one fails, in one transaction where the
+		// backend has them, otherwise valid rows are written
+		Atomic bool
+	}
+
+	// ImportRow struct, one input row & its outcome
+	ImportRow struct {
+		Line   int             `json:"line"`
+		Key    string          `json:"key,omitempty"`
+		Action string          `json:"action,omitempty"`
+		Error  string          `json:"error,omitempty"`
+		Data   json.RawMessage `json:"-"`
+
+		doc     interface{}
+		current interface{}
+		applied bool
+		// written is the revision the import gave the document
+		written int
+	}
+
+	// ImportReport struct
+	ImportReport struct {
+		Entity    string       `json:"entity"`
+		DryRun    bool         `json:"dry_run"`
+		Atomic    bool         `json:"atomic"`
+		Applied   bool         `json:"applied"`
+		Created   int          `json:"created"`
+		Updated   int          `json:"updated"`
+		Unchanged int          `json:"unchanged"`
+		Failed    int          `json:"failed"`
+		Rows      []*ImportRow `json:"rows"`
+	}
+
+	// importable is an entity the bulk import can upsert by natural key
+	importable interface {
+		// decode reads a row into a new document, or over a copy of the
+		// current one when onto is set so absent fields keep their value
+		decode(ctx context.Context, data []byte, onto interface{}) (doc interface{}, err error)
+		key(doc interface{}) string
+		// find the live document holding doc's natural key, nil when new
+		find(ctx context.Context, doc interface{}) (current interface{}, err error)
+		check(ctx context.Context, doc interface{}) error
+		// create & update give the revision they wrote
+		create(ctx context.Context, doc interface{}) (revision int, err error)
+		update(ctx context.Context, current interface{}, doc interface{}) (revision int, err error)
+		// revert & discard undo an update & a create, if the document is
+		// still at the revision written
+		revert(ctx context.Context, current interface{}, revision int) error
+		discard(ctx context.Context, doc interface{}, revision int) error
+	}
+
+	// transactional repositories run the writes of an atomic import in one
+	// transaction, those made with the ctx fn is given
+	transactional interface {
+		transaction(ctx context.Context, fn func(ctx context.Context) error) error
+	}
+)
+
+// errRowFailed stops writing an atomic import at its first failed row
+var errRowFailed = errors.New("Row failed")
+
+// Failed whether the row can't be written
+func (row *ImportRow) Failed() bool {
+	return row.Error != ""
+}
+
+// runImport plans every row, then writes them unless it is a dry run or an
+// atomic import with invalid rows
+func runImport(ctx context.Context, entity string, kind importable, tx transactional, rows []*ImportRow, opts ImportOptions) (report *ImportReport, err error) {
+	report = &ImportReport{
+		Entity: entity,
+		DryRun: opts.DryRun,
+		Atomic: opts.Atomic,
+		Rows:   rows,
+	}
+
+	seen := map[string]int{}
+	for _, row := range rows {
+		if row.Failed() {
+			continue
+		}
+		if err = planRow(ctx, kind, row, seen); err != nil {
+			row.Error = err.Error()
+		}
+	}
+
+	for _, row := range rows {
+		if row.Failed() {
+			report.Failed++
+		}
+	}
+	if opts.DryRun || (opts.Atomic && report.Failed > 0) {
+		report.count()
+		return report, nil
+	}
+
+	write := func(ctx context.Context) error {
+		for _, row := range rows {
+			if row.Failed() || row.Action == ImportUnchanged {
+				continue
+			}
+			var err error
+			if row.Action == ImportCreate {
+				row.written, err = kind.create(ctx, row.doc)
+			} else {
+				row.written, err = kind.update(ctx, row.current, row.doc)
+			}
+			if err != nil {
+				row.Error = err.Error()
+				report.Failed++
+				if opts.Atomic {
+					return errRowFailed
+				}
+				continue
+			}
+			row.applied = true
+		}
+		return nil
+	}
+
+	if opts.Atomic && tx != nil {
+		if err = tx.transaction(ctx, write); err == errRowFailed {
+			rolledBack(rows)
+		}
+	} else if err = write(ctx); err == errRowFailed {
+		if err = undoImport(ctx, kind, rows); err != nil {
+			return nil, err
+		}
+		err = errRowFailed
+	}
+	if err == errRowFailed {
+		report.count()
+		return report, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	report.Applied = true
+	report.count()
+	return report, nil
+}
+
+// planRow decodes & validates a row, deciding whether it creates or updates
+func planRow(ctx context.Context, kind importable, row *ImportRow, seen map[string]int) (err error) {
+	doc, err := kind.decode(ctx, row.Data, nil)
+	if err != nil {
+		return err
+	}
+	row.Key = kind.key(doc)
+	if line, ok := seen[row.Key]; ok {
+		return errors.New("Duplicate of line " + strconv.Itoa(line))
+	}
+	seen[row.Key] = row.Line
+
+	row.current, err = kind.find(ctx, doc)
+	if err != nil {
+		return err
+	}
+	row.Action = ImportCreate
+	if row.current != nil {
+		if doc, err = kind.decode(ctx, row.Data, row.current); err != nil {
+			return err
+		}
+		row.Action = ImportUpdate
+	}
+
+	if _, err = govalidator.ValidateStruct(doc); err != nil {
+		return err
+	}
+	if err = kind.check(ctx, doc); err != nil {
+		return err
+	}
+	row.doc = doc
+
+	if row.current != nil {
+		before, err := toM(row.current)
+		if err != nil {
+			return err
+		}
+		after, err := toM(doc)
+		if err != nil {
+			return err
+		}
+		if len(diff(before, after)) == 0 {
+			row.Action = ImportUnchanged
+		}
+	}
+
+	return nil
+}
+
+// undoImport puts back every row an atomic import already wrote, newest
+// first. a document changed since it was written is left as it is & its
+// row tells of the conflict
+func undoImport(ctx context.Context, kind importable, rows []*ImportRow) (err error) {
+	for i := len(rows) - 1; i >= 0; i-- {
+		row := rows[i]
+		if !row.applied {
+			continue
+		}
+		if row.Action == ImportCreate {
+			err = kind.discard(ctx, row.doc, row.written)
+		} else {
+			err = kind.revert(ctx, row.current, row.written)
+		}
+		if err == ErrRevisionMismatch {
+			row.Error = "Not rolled back, changed since it was written"
+			continue
+		}
+		if err != nil {
+			return errors.New("Undoing line " + strconv.Itoa(row.Line) + " failed: " + err.Error())
+		}
+		row.applied = false
+		row.Error = "Rolled back"
+	}
+	return nil
+}
+
+// rolledBack marks the rows written in a transaction that was rolled back
+func rolledBack(rows []*ImportRow) {
+	for _, row := range rows {
+		if row.applied {
+			row.applied = false
+			row.Error = "Rolled back"
+		}
+	}
+}
+
+// count tallies the rows by outcome, planned ones on a dry run
+func (report *ImportReport) count() {
+	report.Created, report.Updated, report.Unchanged = 0, 0, 0
+	if !report.DryRun && !report.Applied {
+		return
+	}
+	for _, row := range report.Rows {
+		if row.Failed() {
+			continue
+		}
+		switch row.Action {
+		case ImportCreate:
+			report.Created++
+		case ImportUpdate:
+			report.Updated++
+		case ImportUnchanged:
+			report.Unchanged++
+		}
+	}
+}
+
+// copyDoc deep copies src into dst, so decoding over dst leaves src intact
+func copyDoc(src interface{}, dst interface{}) error {
+	raw, err := json.Marshal(src)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, dst)
+}
+
+// decodeOnto reads data into fresh, over a deep copy of onto when set
+func decodeOnto(data []byte, onto interface{}, fresh interface{}) (interface{}, error) {
+	if onto != nil {
+		if err := copyDoc(onto, fresh); err != nil {
+			return nil, err
+		}
+	}
+	if err := json.Unmarshal(data, fresh); err != nil {
+		return nil, errors.New("Row is not valid: " + err.Error())
+	}
+	return fresh, nil
+}
+
+// purgeDocument removes a document for good with its history, eg. one an
+// import created & then undid, so its natural key is free again
+func purgeDocument(ctx context.Context, collection string, versions string, id bson.ObjectId) (err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, collection, "purgeDocument")(&err)
+	c := db.DB(config.DbName).C(collection)
+
+	var doc bson.M
+	err = c.FindId(id).One(&doc)
+	if err != nil {
+		return err
+	}
+	if err = c.RemoveId(id); err != nil {
+		return err
+	}
+	if versions != "" {
+		_, err = db.DB(config.DbName).C(versions).RemoveAll(bson.M{"entity_id": id})
+		if err != nil {
+			return err
+		}
+	}
+
+	writeAudit(ctx, db, collection, AuditPurge, id, doc, nil)
+	return nil
+}
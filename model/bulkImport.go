@@ -0,0 +1,270 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"../config"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+type (
+	productImport struct {
+		products ProductRepository
+	}
+
+	customerImport struct {
+		customers CustomerRepository
+	}
+
+	pricingRulesImport struct {
+		rules     PricingRuleRepository
+		customers CustomerRepository
+		products  ProductRepository
+	}
+
+	// PricingRulesRow struct, an imported rule may name its customer by
+	// external reference or name instead of ID
+	PricingRulesRow struct {
+		PricingRules
+		CustomerName        string `json:"customer_name" valid:"-"`
+		CustomerExternalRef string `json:"customer_external_ref" valid:"-"`
+	}
+)
+
+// ImportProducts upserts products by code
+// ----------------------------------------------------------------------
+func ImportProducts(ctx context.Context, products ProductRepository, rows []*ImportRow, opts ImportOptions) (report *ImportReport, err error) {
+	tx, _ := products.(transactional)
+	return runImport(ctx, config.ProductsCollection, productImport{products}, tx, rows, opts)
+}
+
+func (kind productImport) decode(ctx context.Context, data []byte, onto interface{}) (interface{}, error) {
+	product := &Product{ID: bson.NewObjectId(), Status: ProductActive}
+	if onto != nil {
+		product = &Product{}
+	}
+	doc, err := decodeOnto(data, onto, product)
+	if err != nil {
+		return nil, err
+	}
+	if onto != nil {
+		product.ID = onto.(*Product).ID
+		product.Revision = onto.(*Product).Revision
+	}
+	product.DeletedAt = nil
+	return doc, nil
+}
+
+func (kind productImport) key(doc interface{}) string {
+	return doc.(*Product).Code
+}
+
+func (kind productImport) find(ctx context.Context, doc interface{}) (interface{}, error) {
+	current, err := kind.products.SelectByCode(ctx, doc.(*Product).Code)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	return current, err
+}
+
+func (kind productImport) check(ctx context.Context, doc interface{}) error {
+	return validateFeatures(doc.(*Product).Features)
+}
+
+func (kind productImport) create(ctx context.Context, doc interface{}) (int, error) {
+	err := kind.products.Create(ctx, doc.(*Product))
+	return doc.(*Product).Revision, err
+}
+
+func (kind productImport) update(ctx context.Context, current interface{}, doc interface{}) (int, error) {
+	updated, err := kind.products.Update(ctx, doc.(*Product).ID, doc.(*Product), current.(*Product).Revision)
+	if err != nil {
+		return 0, err
+	}
+	return updated.Revision, nil
+}
+
+func (kind productImport) revert(ctx context.Context, current interface{}, revision int) error {
+	_, err := kind.products.Update(ctx, current.(*Product).ID, current.(*Product), revision)
+	return err
+}
+
+func (kind productImport) discard(ctx context.Context, doc interface{}, revision int) error {
+	if err := kind.products.Delete(ctx, doc.(*Product).ID, revision); err != nil {
+		return err
+	}
+	return kind.products.Purge(ctx, doc.(*Product).ID)
+}
+
+// ImportCustomers upserts customers by external reference, or by name
+// for customers without one
+// ----------------------------------------------------------------------
+func ImportCustomers(ctx context.Context, customers CustomerRepository, rows []*ImportRow, opts ImportOptions) (report *ImportReport, err error) {
+	tx, _ := customers.(transactional)
+	return runImport(ctx, config.CustomersCollection, customerImport{customers}, tx, rows, opts)
+}
+
+func (kind customerImport) decode(ctx context.Context, data []byte, onto interface{}) (interface{}, error) {
+	customer := &Customer{ID: bson.NewObjectId()}
+	if onto != nil {
+		customer = &Customer{}
+	}
+	doc, err := decodeOnto(data, onto, customer)
+	if err != nil {
+		return nil, err
+	}
+	if onto != nil {
+		customer.ID = onto.(*Customer).ID
+		customer.NameLower = onto.(*Customer).NameLower
+		customer.Revision = onto.(*Customer).Revision
+	}
+	customer.DeletedAt = nil
+	return doc, nil
+}
+
+func (kind customerImport) key(doc interface{}) string {
+	customer := doc.(*Customer)
+	if customer.ExternalRef != "" {
+		return "external_ref:" + customer.ExternalRef
+	}
+	return "name:" + customer.Name
+}
+
+func (kind customerImport) find(ctx context.Context, doc interface{}) (interface{}, error) {
+	customer := doc.(*Customer)
+	current, err := kind.customers.SelectByNaturalKey(ctx, customer.ExternalRef, customer.Name)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	return current, err
+}
+
+func (kind customerImport) check(ctx context.Context, doc interface{}) error {
+	return doc.(*Customer).validateProfile()
+}
+
+func (kind customerImport) create(ctx context.Context, doc interface{}) (int, error) {
+	err := kind.customers.Create(ctx, doc.(*Customer))
+	return doc.(*Customer).Revision, err
+}
+
+func (kind customerImport) update(ctx context.Context, current interface{}, doc interface{}) (int, error) {
+	updated, err := kind.customers.Update(ctx, doc.(*Customer).ID, doc.(*Customer), current.(*Customer).Revision)
+	if err != nil {
+		return 0, err
+	}
+	return updated.Revision, nil
+}
+
+func (kind customerImport) revert(ctx context.Context, current interface{}, revision int) error {
+	_, err := kind.customers.Update(ctx, current.(*Customer).ID, current.(*Customer), revision)
+	return err
+}
+
+func (kind customerImport) discard(ctx context.Context, doc interface{}, revision int) error {
+	if err := kind.customers.Delete(ctx, doc.(*Customer).ID, revision); err != nil {
+		return err
+	}
+	return kind.customers.Purge(ctx, doc.(*Customer).ID)
+}
+
+// ImportPricingRules upserts rules by customer & product code
+// ----------------------------------------------------------------------
+func ImportPricingRules(ctx context.Context, rules PricingRuleRepository, customers CustomerRepository, products ProductRepository, rows []*ImportRow, opts ImportOptions) (report *ImportReport, err error) {
+	tx, _ := rules.(transactional)
+	return runImport(ctx, config.PricingRulesCollection, pricingRulesImport{rules, customers, products}, tx, rows, opts)
+}
+
+func (kind pricingRulesImport) decode(ctx context.Context, data []byte, onto interface{}) (interface{}, error) {
+	row := &PricingRulesRow{PricingRules: PricingRules{ID: bson.NewObjectId()}}
+	if onto != nil {
+		row = &PricingRulesRow{}
+		if err := copyDoc(onto, &row.PricingRules); err != nil {
+			return nil, err
+		}
+	}
+	if err := json.Unmarshal(data, row); err != nil {
+		return nil, errors.New("Row is not valid: " + err.Error())
+	}
+
+	rules := &row.PricingRules
+	if onto != nil {
+		rules.ID = onto.(*PricingRules).ID
+		rules.Revision = onto.(*PricingRules).Revision
+	}
+	rules.DeletedAt = nil
+
+	if rules.CustomerID == "" && (row.CustomerExternalRef != "" || row.CustomerName != "") {
+		customer, err := kind.customers.SelectByNaturalKey(ctx, row.CustomerExternalRef, row.CustomerName)
+		if err != nil {
+			return nil, errors.New("Customer does not exist")
+		}
+		rules.CustomerID = customer.ID.Hex()
+	}
+
+	return rules, nil
+}
+
+func (kind pricingRulesImport) key(doc interface{}) string {
+	rules := doc.(*PricingRules)
+	return rules.CustomerID + "/" + rules.ProductCode
+}
+
+func (kind pricingRulesImport) find(ctx context.Context, doc interface{}) (interface{}, error) {
+	rules := doc.(*PricingRules)
+	existing, err := kind.rules.SelectByCustomerID(ctx, rules.CustomerID)
+	if err != nil {
+		return nil, err
+	}
+	for _, current := range existing {
+		if current.ProductCode == rules.ProductCode {
+			return current, nil
+		}
+	}
+	return nil, nil
+}
+
+func (kind pricingRulesImport) check(ctx context.Context, doc interface{}) error {
+	rules := doc.(*PricingRules)
+	if err := rules.validateTerms(); err != nil {
+		return err
+	}
+	if !bson.IsObjectIdHex(rules.CustomerID) {
+		return errors.New("customer_id is an invalid ObjectID")
+	}
+	if _, err := kind.customers.SelectByID(ctx, bson.ObjectIdHex(rules.CustomerID)); err != nil {
+		return errors.New("Customer does not exist")
+	}
+	if _, err := kind.products.SelectByCode(ctx, rules.ProductCode); err != nil {
+		return errors.New("Product Code does not exist")
+	}
+	return nil
+}
+
+func (kind pricingRulesImport) create(ctx context.Context, doc interface{}) (int, error) {
+	err := kind.rules.Create(ctx, doc.(*PricingRules))
+	return doc.(*PricingRules).Revision, err
+}
+
+func (kind pricingRulesImport) update(ctx context.Context, current interface{}, doc interface{}) (int, error) {
+	updated, err := kind.rules.Update(ctx, doc.(*PricingRules).ID, doc.(*PricingRules), current.(*PricingRules).Revision)
+	if err != nil {
+		return 0, err
+	}
+	return updated.Revision, nil
+}
+
+func (kind pricingRulesImport) revert(ctx context.Context, current interface{}, revision int) error {
+	_, err := kind.rules.Update(ctx, current.(*PricingRules).ID, current.(*PricingRules), revision)
+	return err
+}
+
+func (kind pricingRulesImport) discard(ctx context.Context, doc interface{}, revision int) error {
+	if err := kind.rules.Delete(ctx, doc.(*PricingRules).ID, revision); err != nil {
+		return err
+	}
+	return kind.rules.Purge(ctx, doc.(*PricingRules).ID)
+}
@@ -0,0 +1,120 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+)
+
+// fakeImport writes rows keyed by their data, failing the ones in fail &
+// refusing to undo the ones in changed as if edited since
+type fakeImport struct {
+	fail    map[string]bool
+	changed map[string]bool
+	undone  []string
+}
+
+// fakeDoc is what fakeImport writes
+type fakeDoc struct {
+	Key string `valid:"required"`
+}
+
+func (kind *fakeImport) decode(ctx context.Context, data []byte, onto interface{}) (interface{}, error) {
+	return &fakeDoc{Key: string(data)}, nil
+}
+func (kind *fakeImport) key(doc interface{}) string { return doc.(*fakeDoc).Key }
+func (kind *fakeImport) find(ctx context.Context, doc interface{}) (interface{}, error) {
+	return nil, nil
+}
+func (kind *fakeImport) check(ctx context.Context, doc interface{}) error { return nil }
+func (kind *fakeImport) create(ctx context.Context, doc interface{}) (int, error) {
+	if kind.fail[doc.(*fakeDoc).Key] {
+		return 0, errors.New("write failed")
+	}
+	return 1, nil
+}
+func (kind *fakeImport) update(ctx context.Context, current interface{}, doc interface{}) (int, error) {
+	return 2, nil
+}
+func (kind *fakeImport) revert(ctx context.Context, current interface{}, revision int) error {
+	return nil
+}
+func (kind *fakeImport) discard(ctx context.Context, doc interface{}, revision int) error {
+	if revision != 1 {
+		return errors.New("discarded at revision " + strconv.Itoa(revision))
+	}
+	if kind.changed[doc.(*fakeDoc).Key] {
+		return ErrRevisionMismatch
+	}
+	kind.undone = append(kind.undone, doc.(*fakeDoc).Key)
+	return nil
+}
+
+func importRows(keys ...string) []*ImportRow {
+	rows := make([]*ImportRow, len(keys))
+	for i, key := range keys {
+		rows[i] = &ImportRow{Line: i + 1, Data: []byte(key)}
+	}
+	return rows
+}
+
+func TestAtomicImportUndoesWrittenRows(t *testing.T) {
+	kind := &fakeImport{fail: map[string]bool{"c": true}}
+	report, err := runImport(context.Background(), "fakes", kind, nil, importRows("a", "b", "c"), ImportOptions{Atomic: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Applied || report.Failed != 1 {
+		t.Fatalf("applied %v with %d failed, want not applied with 1", report.Applied, report.Failed)
+	}
+	if len(kind.undone) != 2 || kind.undone[0] != "b" || kind.undone[1] != "a" {
+		t.Fatalf("undone %v, want [b a]", kind.undone)
+	}
+	for _, row := range report.Rows[:2] {
+		if row.Error != "Rolled back" {
+			t.Fatalf("line %d: %q, want Rolled back", row.Line, row.Error)
+		}
+	}
+}
+
+func TestAtomicImportLeavesChangedRows(t *testing.T) {
+	kind := &fakeImport{fail: map[string]bool{"c": true}, changed: map[string]bool{"a": true}}
+	report, err := runImport(context.Background(), "fakes", kind, nil, importRows("a", "b", "c"), ImportOptions{Atomic: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kind.undone) != 1 || kind.undone[0] != "b" {
+		t.Fatalf("undone %v, want [b]", kind.undone)
+	}
+	if row := report.Rows[0]; !row.applied || row.Error != "Not rolled back, changed since it was written" {
+		t.Fatalf("changed row applied %v: %q", row.applied, row.Error)
+	}
+}
+
+// fakeTx runs the writes like a transaction would, keeping nothing when
+// they fail
+type fakeTx struct {
+	rolledBack bool
+}
+
+func (tx *fakeTx) transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	err := fn(ctx)
+	tx.rolledBack = err != nil
+	return err
+}
+
+func TestAtomicImportRollsBackTransaction(t *testing.T) {
+	kind := &fakeImport{fail: map[string]bool{"b": true}}
+	tx := &fakeTx{}
+	report, err := runImport(context.Background(), "fakes", kind, tx, importRows("a", "b"), ImportOptions{Atomic: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tx.rolledBack || len(kind.undone) != 0 {
+		t.Fatalf("rolled back %v, undone %v: want the transaction rolled back & nothing undone", tx.rolledBack, kind.undone)
+	}
+	if row := report.Rows[0]; row.applied || row.Error != "Rolled back" {
+		t.Fatalf("line 1 applied %v: %q", row.applied, row.Error)
+	}
+}
@@ -0,0 +1,147 @@
+package model
+
+import (
+	"context"
+	"errors"
+
+	"../config"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+type (
+	// Credit struct
+	Credit struct {
+		ID          bson.ObjectId `json:"id,omitempty" form:"id,omitempty" bson:"_id,omitempty"`
+		CustomerID  string        `json:"customer_id" form:"customer_id" bson:"customer_id" valid:"required"`
+		ProductCode string        `json:"product_code" form:"product_code" bson:"product_code" valid:"required"`
+		Balance     int           `json:"balance" form:"balance" bson:"balance" valid:"-"`
+	}
+)
+
+// CreditIndexing to create indices
+// ----------------------------------------------------------------------
+func CreditIndexing() error {
+	c := DB.Copy().DB(config.DbName).C(config.CreditsCollection)
+	err := c.EnsureIndex(mgo.Index{
+		Key:    []string{"customer_id", "product_code"},
+		Unique: true,
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// AddCredit Crud
+// ----------------------------------------------------------------------
+func AddCredit(ctx context.Context, credit *Credit) (result *Credit, err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.CreditsCollection, "AddCredit")(&err)
+	c := db.DB(config.DbName).C(config.CreditsCollection)
+
+	if credit.Balance <= 0 {
+		return nil, errors.New("balance must be greater than 0")
+	}
+	// credits of a customer that doesn't exist could never be spent
+	if err = customerCanOrder(ctx, credit.CustomerID); err != nil {
+		return nil, err
+	}
+
+	product, err := SelectProductByCode(ctx, credit.ProductCode)
+	if err != nil {
+		return nil, errors.New("Product Code does not exist")
+	}
+	if product.IsRetired() {
+		return nil, errors.New("Product is retired and can no longer be bought")
+	}
+
+	selector := bson.M{
+		"customer_id":  credit.CustomerID,
+		"product_code": credit.ProductCode,
+	}
+	var before *Credit
+	_, err = c.Find(selector).Apply(mgo.Change{
+		Update: bson.M{"$inc": bson.M{"balance": credit.Balance}},
+		Upsert: true,
+	}, &before)
+	if err != nil {
+		return nil, errors.New("Adding Credit failed")
+	}
+
+	err = c.Find(selector).One(&result)
+	if err != nil {
+		return nil, err
+	}
+
+	operation := AuditUpdate
+	if before == nil {
+		operation = AuditCreate
+	}
+	writeAudit(ctx, db, config.CreditsCollection, operation, result.ID, before, result)
+
+	return result, nil
+}
+
+// SelectCreditByCustomerID cRud
+// ----------------------------------------------------------------------
+func SelectCreditByCustomerID(ctx context.Context, id string) (results []*Credit, err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.CreditsCollection, "SelectCreditByCustomerID")(&err)
+	c := db.DB(config.DbName).C(config.CreditsCollection)
+
+	err = c.Find(bson.M{"customer_id": id}).All(&results)
+	if err != nil {
+		return nil, err
+	}
+	return results, err
+}
+
+// ConsumeCredit crUd
+// the balance check & decrement happen in a single update so two
+// concurrent postings can never spend the same credit
+// ----------------------------------------------------------------------
+func ConsumeCredit(ctx context.Context, customerID string, productCode string) (err error) {
+	return changeCredit(ctx, customerID, productCode, -1)
+}
+
+// RefundCredit crUd
+// ----------------------------------------------------------------------
+func RefundCredit(ctx context.Context, customerID string, productCode string) (err error) {
+	return changeCredit(ctx, customerID, productCode, 1)
+}
+
+// changeCredit moves the balance by delta, never below zero
+func changeCredit(ctx context.Context, customerID string, productCode string, delta int) (err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.CreditsCollection, "changeCredit")(&err)
+	c := db.DB(config.DbName).C(config.CreditsCollection)
+
+	selector := bson.M{
+		"customer_id":  customerID,
+		"product_code": productCode,
+	}
+	if delta < 0 {
+		selector["balance"] = bson.M{"$gte": -delta}
+	}
+
+	var before *Credit
+	_, err = c.Find(selector).Apply(mgo.Change{
+		Update: bson.M{"$inc": bson.M{"balance": delta}},
+	}, &before)
+	if err == mgo.ErrNotFound && delta < 0 {
+		return errors.New("Not enough credit for " + productCode + " ads")
+	}
+	if err != nil {
+		return err
+	}
+
+	after := *before
+	after.Balance += delta
+
+	writeAudit(ctx, db, config.CreditsCollection, AuditUpdate, before.ID, before, &after)
+	return nil
+}
@@ -1,65 +1,227 @@
 package model
 
 import (
+	"context"
 	"errors"
-	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"../config"
+	"github.com/asaskevich/govalidator"
 	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 )
 
+// customer account statuses
+const (
+	CustomerActive    = "active"
+	CustomerSuspended = "suspended"
+	CustomerClosed    = "closed"
+)
+
+// fuzzy search name bounds, in characters
+const (
+	minFuzzyName = 2
+	maxFuzzyName = 64
+)
+
 type (
 	// Customer struct
 	Customer struct {
-		ID   bson.ObjectId `json:"id,omitempty" bson:"_id,omitempty"`
-		Name string        `json:"name" bson:"name" valid:"required"`
+		ID             bson.ObjectId     `json:"id,omitempty" bson:"_id,omitempty"`
+		Name           string            `json:"name" bson:"name" valid:"required"`
+		Email          string            `json:"email" bson:"email" valid:"email"`
+		ExternalRef    string            `json:"external_ref" bson:"external_ref" valid:"-"`
+		Status         string            `json:"status" bson:"status" valid:"in(active|suspended|closed)"`
+		BillingEmail   string            `json:"billing_email" bson:"billing_email" valid:"email"`
+		BillingAddress *Address          `json:"billing_address,omitempty" bson:"billing_address" valid:"-"`
+		TaxID          string            `json:"tax_id" bson:"tax_id" valid:"-"`
+		Currency       string            `json:"currency" bson:"currency" valid:"ISO4217"`
+		Contacts       []Contact         `json:"contacts" bson:"contacts" valid:"-"`
+		Metadata       map[string]string `json:"metadata,omitempty" bson:"metadata" valid:"-"`
+		NameLower      string            `json:"-" bson:"name_lower" valid:"-"`
+		NameGrams      []string          `json:"-" bson:"name_grams,omitempty" valid:"-"`
+		Score          float64           `json:"score,omitempty" bson:"score,omitempty" valid:"-"`
+		Revision       int               `json:"revision" bson:"revision" valid:"-"`
+		DeletedAt      *time.Time        `json:"deleted_at,omitempty" bson:"deleted_at,omitempty" valid:"-"`
+	}
+
+	// Address struct
+	Address struct {
+		Line1      string `json:"line1" bson:"line1" valid:"required"`
+		Line2      string `json:"line2" bson:"line2" valid:"-"`
+		City       string `json:"city" bson:"city" valid:"required"`
+		Region     string `json:"region" bson:"region" valid:"-"`
+		PostalCode string `json:"postal_code" bson:"postal_code" valid:"-"`
+		Country    string `json:"country" bson:"country" valid:"required,ISO3166Alpha2"`
+	}
+
+	// Contact struct, a named person at the customer
+	Contact struct {
+		Name  string `json:"name" bson:"name" valid:"required"`
+		Role  string `json:"role" bson:"role" valid:"-"`
+		Email string `json:"email" bson:"email" valid:"email"`
+		Phone string `json:"phone" bson:"phone" valid:"-"`
 	}
 )
 
+// CanOrder tells why a customer may not place orders, nil when it can
+func (customer *Customer) CanOrder() error {
+	switch customer.Status {
+	case CustomerSuspended:
+		return errors.New("Customer account is suspended")
+	case CustomerClosed:
+		return errors.New("Customer account is closed")
+	}
+	return nil
+}
+
+// validateProfile checks what the struct tags can't reach
+func (customer *Customer) validateProfile() error {
+	if customer.BillingAddress != nil {
+		if _, err := govalidator.ValidateStruct(customer.BillingAddress); err != nil {
+			return errors.New("billing_address: " + err.Error())
+		}
+	}
+	for i := range customer.Contacts {
+		if _, err := govalidator.ValidateStruct(&customer.Contacts[i]); err != nil {
+			return errors.New("contacts: " + err.Error())
+		}
+	}
+	for key := range customer.Metadata {
+		// stored as document keys, so mongo's operator & path rules apply
+		if key == "" || strings.HasPrefix(key, "$") || strings.Contains(key, ".") {
+			return errors.New("Invalid metadata key " + key)
+		}
+	}
+	return nil
+}
+
+// customerCanOrder looks up the customer placing an order & checks its account
+func customerCanOrder(ctx context.Context, customerID string) error {
+	if !bson.IsObjectIdHex(customerID) {
+		return errors.New("Customer does not exist")
+	}
+	customer, err := SelectCustomerByID(ctx, bson.ObjectIdHex(customerID))
+	if err != nil {
+		return errors.New("Customer does not exist")
+	}
+	return customer.CanOrder()
+}
+
+// normalize keeps the searchable forms of name & emails
+func (customer *Customer) normalize() {
+	customer.NameLower = strings.ToLower(strings.TrimSpace(customer.Name))
+	customer.NameGrams = nameGrams(customer.NameLower)
+	customer.Email = strings.ToLower(strings.TrimSpace(customer.Email))
+	customer.BillingEmail = strings.ToLower(strings.TrimSpace(customer.BillingEmail))
+	customer.Score = 0
+}
+
 // CustomerIndexing to create indices
 // ----------------------------------------------------------------------
-func CustomerIndexing() {
+func CustomerIndexing() error {
 	c := DB.Copy().DB(config.DbName).C(config.CustomersCollection)
 	err := c.EnsureIndex(mgo.Index{
 		Key:    []string{"name"},
 		Unique: true,
 	})
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	for _, key := range []string{"name_lower", "name_grams", "email", "external_ref", "status"} {
+		err = c.EnsureIndex(mgo.Index{
+			Key:    []string{key},
+			Unique: false,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	err = c.EnsureIndex(mgo.Index{
+		Key:     []string{"$text:name", "$text:email", "$text:external_ref"},
+		Weights: map[string]int{"name": 10, "email": 2, "external_ref": 2},
+		Name:    "customers_text",
+	})
+	if err != nil {
+		return err
+	}
+
+	// customers created before name_lower, name_grams & status existed
+	_, err = c.UpdateAll(bson.M{"status": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"status": CustomerActive}})
+	if err != nil {
+		return err
 	}
+	var customer *Customer
+	iter := c.Find(bson.M{"$or": []bson.M{
+		{"name_lower": bson.M{"$exists": false}},
+		{"name_grams": bson.M{"$exists": false}},
+	}}).Iter()
+	for iter.Next(&customer) {
+		customer.normalize()
+		err = c.UpdateId(customer.ID, bson.M{"$set": bson.M{
+			"name_lower": customer.NameLower,
+			"name_grams": customer.NameGrams,
+		}})
+		if err != nil {
+			return err
+		}
+	}
+	if err = iter.Close(); err != nil {
+		return err
+	}
+	return nil
 }
 
 // CreateCustomer Crud
 // ----------------------------------------------------------------------
-func CreateCustomer(customer *Customer) (err error) {
+func CreateCustomer(ctx context.Context, customer *Customer) (err error) {
 	db := DB.Clone()
 	defer db.Close()
+	defer operation(ctx, config.CustomersCollection, "CreateCustomer")(&err)
 	c := db.DB(config.DbName).C(config.CustomersCollection)
 
-	numRows, err := c.Find(bson.M{"name": customer.Name}).Count()
-	if err != nil {
+	if err = customer.validateProfile(); err != nil {
+		return err
+	}
+	customer.normalize()
+	if customer.Status == "" {
+		customer.Status = CustomerActive
+	}
+
+	var existing *Customer
+	err = c.Find(bson.M{"name": customer.Name}).One(&existing)
+	if err != nil && err != mgo.ErrNotFound {
 		return err
 	}
-	if numRows > 0 {
+	if existing != nil && existing.DeletedAt != nil {
+		return errors.New("Customer belongs to a deleted customer, restore it instead")
+	}
+	if existing != nil {
 		return errors.New("Customer already exists")
 	}
 
+	customer.Revision = 1
 	if err = c.Insert(customer); err != nil {
 		return errors.New("Creating Customer failed")
 	}
 
-	return err
+	writeAudit(ctx, db, config.CustomersCollection, AuditCreate, customer.ID, nil, customer)
+
+	return nil
 }
 
 // ListCustomer cRud
 // ----------------------------------------------------------------------
-func ListCustomer() (results []*Customer, err error) {
+func ListCustomer(ctx context.Context) (results []*Customer, err error) {
 	db := DB.Clone()
 	defer db.Close()
+	defer operation(ctx, config.CustomersCollection, "ListCustomer")(&err)
 	c := db.DB(config.DbName).C(config.CustomersCollection)
 
-	err = c.Find(nil).All(&results)
+	err = c.Find(bson.M{"deleted_at": nil}).All(&results)
 	if err != nil {
 		return nil, err
 	}
@@ -69,12 +231,13 @@ func ListCustomer() (results []*Customer, err error) {
 
 // SelectCustomerByID cRud
 // ----------------------------------------------------------------------
-func SelectCustomerByID(id bson.ObjectId) (result *Customer, err error) {
+func SelectCustomerByID(ctx context.Context, id bson.ObjectId) (result *Customer, err error) {
 	db := DB.Clone()
 	defer db.Close()
+	defer operation(ctx, config.CustomersCollection, "SelectCustomerByID")(&err)
 	c := db.DB(config.DbName).C(config.CustomersCollection)
 
-	err = c.FindId(id).One(&result)
+	err = c.Find(alive(id)).One(&result)
 	if err != nil {
 		return nil, err
 	}
@@ -82,31 +245,309 @@ func SelectCustomerByID(id bson.ObjectId) (result *Customer, err error) {
 	return result, err
 }
 
-// SearchCustomer cRud
+// SelectCustomersByIDs cRud
+// the live customers among ids, in one read
 // ----------------------------------------------------------------------
-func SearchCustomer(params map[string]bson.M) (results []*Customer, err error) {
+func SelectCustomersByIDs(ctx context.Context, ids []bson.ObjectId) (results []*Customer, err error) {
 	db := DB.Clone()
 	defer db.Close()
+	defer operation(ctx, config.CustomersCollection, "SelectCustomersByIDs")(&err)
 	c := db.DB(config.DbName).C(config.CustomersCollection)
 
-	err = c.Find(params).All(&results)
+	err = c.Find(bson.M{"_id": bson.M{"$in": ids}, "deleted_at": nil}).All(&results)
 	if err != nil {
 		return nil, err
 	}
 
-	log.Println(results)
-
 	return results, err
 }
 
+// SelectCustomerByNaturalKey cRud
+// customers are known by their external reference, an unknown reference
+// falls back to the name of a customer that has none yet
+// ----------------------------------------------------------------------
+func SelectCustomerByNaturalKey(ctx context.Context, externalRef string, name string) (result *Customer, err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.CustomersCollection, "SelectCustomerByNaturalKey")(&err)
+	c := db.DB(config.DbName).C(config.CustomersCollection)
+
+	filter := bson.M{"name": name, "deleted_at": nil}
+	if externalRef != "" {
+		err = c.Find(bson.M{"external_ref": externalRef, "deleted_at": nil}).One(&result)
+		if err != mgo.ErrNotFound || name == "" {
+			return result, err
+		}
+		filter["external_ref"] = bson.M{"$in": []interface{}{"", nil}}
+	}
+	err = c.Find(filter).One(&result)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, err
+}
+
+// SearchCustomer cRud
+// ----------------------------------------------------------------------
+func SearchCustomer(ctx context.Context, q *Query, includeDeleted bool) (results []*Customer, page *Page, err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.CustomersCollection, "SearchCustomer")(&err)
+	c := db.DB(config.DbName).C(config.CustomersCollection)
+
+	q.Filter = withDeleted(q.Filter, includeDeleted)
+	page, err = paginate(c, q, &results)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return results, page, err
+}
+
+// FuzzySearchCustomer cRud
+// tolerates typos by matching names within an edit distance, closest first.
+// only names sharing enough trigrams with the query can be that close, mongo
+// narrows to those before distances are counted
+// ----------------------------------------------------------------------
+func FuzzySearchCustomer(ctx context.Context, q *Query, name string, includeDeleted bool) (results []*Customer, page *Page, err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.CustomersCollection, "FuzzySearchCustomer")(&err)
+	c := db.DB(config.DbName).C(config.CustomersCollection)
+
+	query, maxDistance, err := fuzzyName(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// an edit breaks at most 3 trigrams
+	grams := nameGrams(query)
+	shared := len(grams) - 3*maxDistance
+	if shared < 1 {
+		shared = 1
+	}
+	pipeline := []bson.M{
+		{"$match": withDeleted(bson.M{"name_grams": bson.M{"$in": grams}}, includeDeleted)},
+		{"$project": bson.M{
+			"name_lower": 1,
+			"shared":     bson.M{"$size": bson.M{"$setIntersection": []interface{}{"$name_grams", grams}}},
+		}},
+		{"$match": bson.M{"shared": bson.M{"$gte": shared}}},
+	}
+
+	var matches []fuzzyMatch
+	var doc struct {
+		ID        bson.ObjectId `bson:"_id"`
+		NameLower string        `bson:"name_lower"`
+	}
+	iter := c.Pipe(pipeline).Iter()
+	for iter.Next(&doc) {
+		if d := nameDistance(query, doc.NameLower); d <= maxDistance {
+			matches = append(matches, fuzzyMatch{id: doc.ID, distance: d})
+		}
+	}
+	if err = iter.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	matches, page, err = pageMatches(matches, q)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ids := make([]bson.ObjectId, len(matches))
+	for i, m := range matches {
+		ids[i] = m.id
+	}
+	var found []*Customer
+	err = c.Find(bson.M{"_id": bson.M{"$in": ids}}).All(&found)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return scoreMatches(matches, found), page, err
+}
+
+// fuzzyMatch is a customer within edit distance of a fuzzy search
+type fuzzyMatch struct {
+	id       bson.ObjectId
+	distance int
+}
+
+// fuzzyName checks a fuzzy search name & tells the edit distance it
+// tolerates, a quarter of its length. every candidate is measured against
+// it so its length is bounded
+func fuzzyName(name string) (query string, maxDistance int, err error) {
+	query = strings.ToLower(strings.TrimSpace(name))
+	length := len([]rune(query))
+	if length < minFuzzyName || length > maxFuzzyName {
+		return "", 0, errors.New("fuzzy name must be between " + strconv.Itoa(minFuzzyName) + " and " + strconv.Itoa(maxFuzzyName) + " characters")
+	}
+	maxDistance = length / 4
+	if maxDistance < 1 {
+		maxDistance = 1
+	}
+	return query, maxDistance, nil
+}
+
+// nameGrams are the distinct trigrams of the words of name, padded so the
+// start & end of words count
+func nameGrams(name string) []string {
+	grams := []string{}
+	seen := map[string]bool{}
+	for _, word := range strings.Fields(name) {
+		runes := []rune("  " + word + " ")
+		for i := 0; i+3 <= len(runes); i++ {
+			if gram := string(runes[i : i+3]); !seen[gram] {
+				seen[gram] = true
+				grams = append(grams, gram)
+			}
+		}
+	}
+	return grams
+}
+
+// pageMatches orders matches closest first, ties by id, & keeps the page
+// of q. its cursor holds the distance & id of the last match
+func pageMatches(matches []fuzzyMatch, q *Query) ([]fuzzyMatch, *Page, error) {
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].distance != matches[j].distance {
+			return matches[i].distance < matches[j].distance
+		}
+		return matches[i].id < matches[j].id
+	})
+
+	page := &Page{Total: -1}
+	if q.WithTotal {
+		page.Total = len(matches)
+	}
+
+	if q.Cursor != "" {
+		cur, err := decodeCursor(q.Cursor, q.Sort)
+		if err != nil {
+			return nil, nil, err
+		}
+		var distance int
+		switch v := cur.Value.(type) {
+		case int:
+			distance = v
+		case int64:
+			distance = int(v)
+		default:
+			return nil, nil, ErrInvalidCursor
+		}
+		matches = matches[sort.Search(len(matches), func(i int) bool {
+			m := matches[i]
+			return m.distance > distance || m.distance == distance && m.id > cur.ID
+		}):]
+	}
+
+	if len(matches) > q.Limit {
+		matches = matches[:q.Limit]
+		last := matches[len(matches)-1]
+		next, err := encodeCursor(q.Sort, last.distance, last.id)
+		if err != nil {
+			return nil, nil, err
+		}
+		page.NextCursor = next
+	}
+	return matches, page, nil
+}
+
+// scoreMatches puts the customers found in the order of matches, scored
+// by closeness
+func scoreMatches(matches []fuzzyMatch, found []*Customer) []*Customer {
+	byID := map[bson.ObjectId]*Customer{}
+	for _, customer := range found {
+		byID[customer.ID] = customer
+	}
+	results := []*Customer{}
+	for _, m := range matches {
+		if customer, ok := byID[m.id]; ok {
+			customer.Score = 1 / float64(1+m.distance)
+			results = append(results, customer)
+		}
+	}
+	return results
+}
+
+// nameDistance is the edit distance of query to the whole name or to its
+// closest word, so "unilevr" still finds "Unilever Asia"
+func nameDistance(query string, name string) int {
+	best := levenshtein(query, name)
+	for _, word := range strings.Fields(name) {
+		if d := levenshtein(query, word); d < best {
+			best = d
+		}
+	}
+	return best
+}
+
+// levenshtein counts single rune edits turning a into b
+func levenshtein(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min3(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+func min3(a int, b int, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
 // UpdateCustomer crUd
 // ----------------------------------------------------------------------
-func UpdateCustomer(id bson.ObjectId, update *Customer) (result *Customer, err error) {
+func UpdateCustomer(ctx context.Context, id bson.ObjectId, update *Customer, revision int) (result *Customer, err error) {
 	db := DB.Clone()
 	defer db.Close()
+	defer operation(ctx, config.CustomersCollection, "UpdateCustomer")(&err)
 	c := db.DB(config.DbName).C(config.CustomersCollection)
 
-	err = c.UpdateId(id, bson.M{"$set": update})
+	var current *Customer
+	err = c.Find(alive(id)).One(&current)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkRevision(revision, current.Revision); err != nil {
+		return nil, err
+	}
+
+	if err = update.validateProfile(); err != nil {
+		return nil, err
+	}
+
+	// only write over the revision that was checked
+	update.normalize()
+	if update.Status == "" {
+		update.Status = current.Status
+	}
+	update.Revision = current.Revision + 1
+	update.DeletedAt = nil
+	err = c.Update(atRevision(id, current.Revision), bson.M{"$set": update})
+	if err == mgo.ErrNotFound {
+		return nil, ErrRevisionMismatch
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -116,20 +557,70 @@ func UpdateCustomer(id bson.ObjectId, update *Customer) (result *Customer, err e
 		return nil, err
 	}
 
-	return result, err
+	writeAudit(ctx, db, config.CustomersCollection, AuditUpdate, id, current, result)
+
+	return result, nil
 }
 
 // DeleteCustomer cruD
 // ----------------------------------------------------------------------
-func DeleteCustomer(id bson.ObjectId) (err error) {
+func DeleteCustomer(ctx context.Context, id bson.ObjectId, revision int) (err error) {
 	db := DB.Clone()
 	defer db.Close()
+	defer operation(ctx, config.CustomersCollection, "DeleteCustomer")(&err)
 	c := db.DB(config.DbName).C(config.CustomersCollection)
 
-	err = c.RemoveId(id)
+	var current *Customer
+	err = c.Find(alive(id)).One(&current)
+	if err != nil {
+		return err
+	}
+	if err = checkRevision(revision, current.Revision); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	err = markDeleted(c, id, current.Revision, now)
 	if err != nil {
 		return err
 	}
 
-	return err
+	deleted := *current
+	deleted.Revision++
+	deleted.DeletedAt = &now
+	writeAudit(ctx, db, config.CustomersCollection, AuditDelete, id, current, &deleted)
+
+	return nil
+}
+
+// RestoreCustomer crUd
+// ----------------------------------------------------------------------
+func RestoreCustomer(ctx context.Context, id bson.ObjectId) (result *Customer, err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.CustomersCollection, "RestoreCustomer")(&err)
+	c := db.DB(config.DbName).C(config.CustomersCollection)
+
+	var current *Customer
+	err = c.FindId(id).One(&current)
+	if err != nil {
+		return nil, err
+	}
+	if current.DeletedAt == nil {
+		return nil, errors.New("Customer is not deleted")
+	}
+
+	err = unmarkDeleted(c, id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.FindId(id).One(&result)
+	if err != nil {
+		return nil, err
+	}
+
+	writeAudit(ctx, db, config.CustomersCollection, AuditRestore, id, current, result)
+
+	return result, nil
 }
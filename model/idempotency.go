@@ -0,0 +1,149 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"../config"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// ErrIdempotencyInFlight when a key is reused before its first request
+// has finished
+var ErrIdempotencyInFlight = errors.New("A request with this Idempotency-Key is still in progress")
+
+// ErrIdempotencyMismatch when a key is reused for a different request
+var ErrIdempotencyMismatch = errors.New("Idempotency-Key was already used for a different request")
+
+type (
+	// IdempotencyRecord struct, the stored outcome of the first request
+	// sent with a key, Status stays 0 while that request is in flight
+	IdempotencyRecord struct {
+		ID          string `json:"id" bson:"_id"`
+		Fingerprint string `json:"fingerprint" bson:"fingerprint"`
+		Status      int    `json:"status" bson:"status"`
+		ContentType string `json:"content_type" bson:"content_type"`
+		Body        []byte `json:"body" bson:"body"`
+		// Withheld says why Body wasn't kept when it wasn't, the response
+		// can't be replayed then, Digest is the sha256 of the body left out
+		Withheld  string    `json:"withheld,omitempty" bson:"withheld,omitempty"`
+		Digest    string    `json:"digest,omitempty" bson:"digest,omitempty"`
+		CreatedAt time.Time `json:"created_at" bson:"created_at"`
+	}
+)
+
+// reasons a response body is withheld
+const (
+	// WithheldSecret responses show a secret once, it is never stored
+	WithheldSecret = "secret"
+	// WithheldSize responses are too large for a document
+	WithheldSize = "size"
+)
+
+// Done whether the first request has stored its response
+func (record *IdempotencyRecord) Done() bool {
+	return record.Status != 0
+}
+
+// IdempotencyIndexing to create indices
+// ----------------------------------------------------------------------
+func IdempotencyIndexing() error {
+	c := DB.Copy().DB(config.DbName).C(config.IdempotencyCollection)
+	index := mgo.Index{
+		Key:         []string{"created_at"},
+		ExpireAfter: config.IdempotencyTTL,
+	}
+	err := c.EnsureIndex(index)
+	if err != nil {
+		// the ttl was changed since the index was built
+		if err = c.DropIndex("created_at"); err != nil {
+			return err
+		}
+		err = c.EnsureIndex(index)
+	}
+	return err
+}
+
+// BeginIdempotent claims key for the request fingerprinted, when the key
+// was claimed before the earlier record is returned instead
+// ----------------------------------------------------------------------
+func BeginIdempotent(ctx context.Context, key string, fingerprint string) (existing *IdempotencyRecord, err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.IdempotencyCollection, "BeginIdempotent")(&err)
+	c := db.DB(config.DbName).C(config.IdempotencyCollection)
+
+	record := &IdempotencyRecord{
+		ID:          key,
+		Fingerprint: fingerprint,
+		CreatedAt:   time.Now(),
+	}
+	// a second attempt follows a record that expired in between
+	for attempt := 0; attempt < 2; attempt++ {
+		err = c.Insert(record)
+		if !mgo.IsDup(err) {
+			return nil, err
+		}
+
+		existing = nil
+		err = c.FindId(key).One(&existing)
+		if err == mgo.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if time.Since(existing.CreatedAt) >= config.IdempotencyTTL {
+			// outlived its ttl but mongo hasn't reaped it yet
+			err = c.Remove(bson.M{"_id": key, "created_at": existing.CreatedAt})
+			if err != nil && err != mgo.ErrNotFound {
+				return nil, err
+			}
+			continue
+		}
+
+		if existing.Fingerprint != fingerprint {
+			return nil, ErrIdempotencyMismatch
+		}
+		if !existing.Done() {
+			return nil, ErrIdempotencyInFlight
+		}
+		return existing, nil
+	}
+
+	return nil, ErrIdempotencyInFlight
+}
+
+// FinishIdempotent stores the response of the request that claimed key
+// ----------------------------------------------------------------------
+func FinishIdempotent(ctx context.Context, key string, response *IdempotencyRecord) (err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.IdempotencyCollection, "FinishIdempotent")(&err)
+	c := db.DB(config.DbName).C(config.IdempotencyCollection)
+
+	return c.UpdateId(key, bson.M{"$set": bson.M{
+		"status":       response.Status,
+		"content_type": response.ContentType,
+		"body":         response.Body,
+		"withheld":     response.Withheld,
+		"digest":       response.Digest,
+	}})
+}
+
+// AbandonIdempotent releases key so the request can be retried
+// ----------------------------------------------------------------------
+func AbandonIdempotent(ctx context.Context, key string) (err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.IdempotencyCollection, "AbandonIdempotent")(&err)
+	c := db.DB(config.DbName).C(config.IdempotencyCollection)
+
+	err = c.RemoveId(key)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,415 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"log"
+	"regexp"
+	"time"
+
+	"../config"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// job ad statuses
+const (
+	JobAdActive  = "active"
+	JobAdExpired = "expired"
+)
+
+type (
+	// JobAd struct
+	JobAd struct {
+		ID          bson.ObjectId `json:"id,omitempty" form:"id,omitempty" bson:"_id,omitempty"`
+		CustomerID  string        `json:"customer_id" form:"customer_id" bson:"customer_id" valid:"required"`
+		ProductCode string        `json:"product_code" form:"product_code" bson:"product_code" valid:"required"`
+		Title       string        `json:"title" form:"title" bson:"title" valid:"required"`
+		Description string        `json:"description" form:"description" bson:"description" valid:"required"`
+		Location    string        `json:"location" form:"location" bson:"location" valid:"-"`
+		Category    string        `json:"category" form:"category" bson:"category" valid:"-"`
+		SalaryMin   int           `json:"salary_min" form:"salary_min" bson:"salary_min" valid:"-"`
+		SalaryMax   int           `json:"salary_max" form:"salary_max" bson:"salary_max" valid:"-"`
+		Features    []string      `json:"features" form:"-" bson:"features" valid:"-"`
+		Status      string        `json:"status" form:"-" bson:"status" valid:"-"`
+		PostedAt    time.Time     `json:"posted_at" form:"-" bson:"posted_at" valid:"-"`
+		ExpiresAt   time.Time     `json:"expires_at" form:"-" bson:"expires_at" valid:"-"`
+		Rank        int           `json:"rank" form:"-" bson:"rank" valid:"-"`
+		Score       float64       `json:"score,omitempty" form:"-" bson:"score,omitempty" valid:"-"`
+		Revision    int           `json:"revision" form:"-" bson:"revision" valid:"-"`
+
+		// UpgradeOrders applied to the ad, so paying one twice upgrades once
+		UpgradeOrders []string `json:"-" form:"-" bson:"upgrade_orders,omitempty" valid:"-"`
+	}
+
+	// JobAdSearch struct
+	JobAdSearch struct {
+		Keyword    string
+		Location   string
+		Category   string
+		SalaryMin  int
+		SalaryMax  int
+		PostedFrom time.Time
+		PostedTo   time.Time
+		Page       int
+		Limit      int
+	}
+)
+
+// JobAdIndexing to create indices
+// ----------------------------------------------------------------------
+func JobAdIndexing() error {
+	c := DB.Copy().DB(config.DbName).C(config.JobAdsCollection)
+	err := c.EnsureIndex(mgo.Index{
+		Key:    []string{"customer_id", "status"},
+		Unique: false,
+	})
+	if err != nil {
+		return err
+	}
+	err = c.EnsureIndex(mgo.Index{
+		Key:    []string{"status", "expires_at"},
+		Unique: false,
+	})
+	if err != nil {
+		return err
+	}
+	err = c.EnsureIndex(mgo.Index{
+		Key:     []string{"$text:title", "$text:description"},
+		Weights: map[string]int{"title": 5, "description": 1},
+		Name:    "jobads_text",
+	})
+	if err != nil {
+		return err
+	}
+	err = c.EnsureIndex(mgo.Index{
+		Key:    []string{"status", "-rank", "-posted_at"},
+		Unique: false,
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// validateSalary checks the salary range the struct tags can't reach
+func (ad *JobAd) validateSalary() error {
+	if ad.SalaryMin < 0 || ad.SalaryMax < 0 {
+		return errors.New("salary_min & salary_max cannot be negative")
+	}
+	if ad.SalaryMax > 0 && ad.SalaryMin > ad.SalaryMax {
+		return errors.New("salary_min cannot be greater than salary_max")
+	}
+	return nil
+}
+
+// CreateJobAd Crud
+// ----------------------------------------------------------------------
+func CreateJobAd(ctx context.Context, ad *JobAd) (err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.JobAdsCollection, "CreateJobAd")(&err)
+	c := db.DB(config.DbName).C(config.JobAdsCollection)
+
+	if err = ad.validateSalary(); err != nil {
+		return err
+	}
+	if err = customerCanOrder(ctx, ad.CustomerID); err != nil {
+		return err
+	}
+
+	product, err := SelectProductByCode(ctx, ad.ProductCode)
+	if err != nil {
+		return errors.New("Product Code does not exist")
+	}
+	if product.IsRetired() {
+		return errors.New("Product is retired and can no longer be bought")
+	}
+	if product.DurationDays <= 0 {
+		return errors.New("Product Code cannot be used for job ads")
+	}
+
+	if err = ConsumeCredit(ctx, ad.CustomerID, ad.ProductCode); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	ad.Features = product.Features
+	ad.Rank = product.AdRank()
+	ad.Status = JobAdActive
+	ad.PostedAt = now
+	ad.ExpiresAt = now.AddDate(0, 0, product.DurationDays)
+	ad.Revision = 1
+
+	if err = c.Insert(ad); err != nil {
+		// give the credit back, the ad was never posted
+		if rErr := RefundCredit(ctx, ad.CustomerID, ad.ProductCode); rErr != nil {
+			log.Println(rErr)
+		}
+		return errors.New("Creating Job Ad failed")
+	}
+
+	writeAudit(ctx, db, config.JobAdsCollection, AuditCreate, ad.ID, nil, ad)
+
+	return nil
+}
+
+// ListJobAd cRud
+// ----------------------------------------------------------------------
+func ListJobAd(ctx context.Context, params bson.M) (results []*JobAd, err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.JobAdsCollection, "ListJobAd")(&err)
+	c := db.DB(config.DbName).C(config.JobAdsCollection)
+
+	err = c.Find(params).Sort("-posted_at").All(&results)
+	if err != nil {
+		return nil, err
+	}
+
+	return results, err
+}
+
+// SearchJobAd cRud
+// only active ads are searchable, ordered by paid tier first so premium
+// ads are boosted above standout & classic, then by relevance & recency
+// ----------------------------------------------------------------------
+func SearchJobAd(ctx context.Context, search *JobAdSearch) (results []*JobAd, total int, err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.JobAdsCollection, "SearchJobAd")(&err)
+	c := db.DB(config.DbName).C(config.JobAdsCollection)
+
+	filter := bson.M{"status": JobAdActive}
+	if search.Keyword != "" {
+		filter["$text"] = bson.M{"$search": search.Keyword}
+	}
+	if search.Location != "" {
+		filter["location"] = bson.RegEx{Pattern: "^" + regexp.QuoteMeta(search.Location) + "$", Options: "i"}
+	}
+	if search.Category != "" {
+		filter["category"] = bson.RegEx{Pattern: "^" + regexp.QuoteMeta(search.Category) + "$", Options: "i"}
+	}
+	// salary range matches any ad whose range overlaps the requested one
+	if search.SalaryMin > 0 {
+		filter["salary_max"] = bson.M{"$gte": search.SalaryMin}
+	}
+	if search.SalaryMax > 0 {
+		filter["salary_min"] = bson.M{"$lte": search.SalaryMax}
+	}
+	posted := bson.M{}
+	if !search.PostedFrom.IsZero() {
+		posted["$gte"] = search.PostedFrom
+	}
+	if !search.PostedTo.IsZero() {
+		posted["$lte"] = search.PostedTo
+	}
+	if len(posted) > 0 {
+		filter["posted_at"] = posted
+	}
+
+	query := c.Find(filter)
+	total, err = query.Count()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if search.Keyword != "" {
+		query = query.Select(bson.M{"score": bson.M{"$meta": "textScore"}}).
+			Sort("-rank", "$textScore:score", "-posted_at")
+	} else {
+		query = query.Sort("-rank", "-posted_at")
+	}
+
+	err = query.Skip((search.Page - 1) * search.Limit).Limit(search.Limit).All(&results)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return results, total, err
+}
+
+// SelectJobAdByID cRud
+// ----------------------------------------------------------------------
+func SelectJobAdByID(ctx context.Context, id bson.ObjectId) (result *JobAd, err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.JobAdsCollection, "SelectJobAdByID")(&err)
+	c := db.DB(config.DbName).C(config.JobAdsCollection)
+
+	err = c.FindId(id).One(&result)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, err
+}
+
+// UpdateJobAd crUd
+// only the advert content is editable, tier & run dates are not
+// ----------------------------------------------------------------------
+func UpdateJobAd(ctx context.Context, id bson.ObjectId, update *JobAd, revision int) (result *JobAd, err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.JobAdsCollection, "UpdateJobAd")(&err)
+	c := db.DB(config.DbName).C(config.JobAdsCollection)
+
+	if err = update.validateSalary(); err != nil {
+		return nil, err
+	}
+
+	var current *JobAd
+	err = c.FindId(id).One(&current)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkRevision(revision, current.Revision); err != nil {
+		return nil, err
+	}
+
+	err = c.Update(atRevision(id, current.Revision), bson.M{"$set": bson.M{
+		"title":       update.Title,
+		"description": update.Description,
+		"location":    update.Location,
+		"category":    update.Category,
+		"salary_min":  update.SalaryMin,
+		"salary_max":  update.SalaryMax,
+		"revision":    current.Revision + 1,
+	}})
+	if err == mgo.ErrNotFound {
+		return nil, ErrRevisionMismatch
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.FindId(id).One(&result)
+	if err != nil {
+		return nil, err
+	}
+
+	writeAudit(ctx, db, config.JobAdsCollection, AuditUpdate, id, current, result)
+
+	return result, nil
+}
+
+// UpgradeJobAd crUd
+// switches a live ad to a higher tier for an order, keeping its run dates.
+// an order already applied to the ad is not applied again
+// ----------------------------------------------------------------------
+func UpgradeJobAd(ctx context.Context, id bson.ObjectId, from string, to string, orderID string) (err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.JobAdsCollection, "UpgradeJobAd")(&err)
+	c := db.DB(config.DbName).C(config.JobAdsCollection)
+
+	product, err := SelectProductByCode(ctx, to)
+	if err != nil {
+		return errors.New("Product Code does not exist")
+	}
+	if product.IsRetired() {
+		return errors.New("Product is retired and can no longer be bought")
+	}
+
+	var before, after *JobAd
+	_, err = c.Find(bson.M{
+		"_id":            id,
+		"product_code":   from,
+		"status":         JobAdActive,
+		"upgrade_orders": bson.M{"$ne": orderID},
+	}).Apply(mgo.Change{Update: bson.M{
+		"$set": bson.M{
+			"product_code": to,
+			"features":     product.Features,
+			"rank":         product.AdRank(),
+		},
+		"$addToSet": bson.M{"upgrade_orders": orderID},
+		"$inc":      bson.M{"revision": 1},
+	}}, &before)
+	if err == mgo.ErrNotFound {
+		n, cErr := c.Find(bson.M{"_id": id, "upgrade_orders": orderID}).Count()
+		if cErr == nil && n > 0 {
+			return nil
+		}
+		return errors.New("Job Ad is no longer active on " + from + " tier")
+	}
+	if err != nil {
+		return err
+	}
+
+	err = c.FindId(id).One(&after)
+	if err != nil {
+		return err
+	}
+
+	writeAudit(ctx, db, config.JobAdsCollection, AuditUpdate, id, before, after)
+
+	return nil
+}
+
+// DeleteJobAd cruD
+// ----------------------------------------------------------------------
+func DeleteJobAd(ctx context.Context, id bson.ObjectId, revision int) (err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.JobAdsCollection, "DeleteJobAd")(&err)
+	c := db.DB(config.DbName).C(config.JobAdsCollection)
+
+	var current *JobAd
+	err = c.FindId(id).One(&current)
+	if err != nil {
+		return err
+	}
+	if err = checkRevision(revision, current.Revision); err != nil {
+		return err
+	}
+
+	err = c.Remove(atRevision(id, current.Revision))
+	if err == mgo.ErrNotFound {
+		return ErrRevisionMismatch
+	}
+	if err != nil {
+		return err
+	}
+
+	writeAudit(ctx, db, config.JobAdsCollection, AuditDelete, id, current, nil)
+
+	return nil
+}
+
+// ExpireJobAds to close every active ad whose run has ended
+// ----------------------------------------------------------------------
+func ExpireJobAds(ctx context.Context) (expired int, err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.JobAdsCollection, "ExpireJobAds")(&err)
+	c := db.DB(config.DbName).C(config.JobAdsCollection)
+
+	info, err := c.UpdateAll(bson.M{
+		"status":     JobAdActive,
+		"expires_at": bson.M{"$lte": time.Now()},
+	}, bson.M{"$set": bson.M{"status": JobAdExpired}})
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Updated, err
+}
+
+// JobAdExpiry runs ExpireJobAds on every tick, meant to run as goroutine
+// ----------------------------------------------------------------------
+func JobAdExpiry(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		expired, err := ExpireJobAds(context.Background())
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if expired > 0 {
+			log.Printf("%d job ads expired", expired)
+		}
+	}
+}
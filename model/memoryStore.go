@@ -0,0 +1,118 @@
+package model
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+type (
+	// memoryStore keeps documents in maps, for tests & trying the api out
+	memoryStore struct {
+		mu   sync.RWMutex
+		docs map[string]map[bson.ObjectId][]byte
+	}
+
+	// memoryTx buffers the writes of an update until it commits, nil
+	// marking a removed document
+	memoryTx struct {
+		store  *memoryStore
+		writes map[string]map[bson.ObjectId][]byte
+	}
+)
+
+// NewMemoryStore a store that lives as long as the process
+func NewMemoryStore() *Store {
+	return &Store{kv: &memoryStore{docs: map[string]map[bson.ObjectId][]byte{}}}
+}
+
+func (s *memoryStore) view(fn func(tx kvTx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return fn(&memoryTx{store: s})
+}
+
+func (s *memoryStore) update(fn func(tx kvTx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := &memoryTx{store: s, writes: map[string]map[bson.ObjectId][]byte{}}
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	for collection, writes := range tx.writes {
+		docs, ok := s.docs[collection]
+		if !ok {
+			docs = map[bson.ObjectId][]byte{}
+			s.docs[collection] = docs
+		}
+		for id, doc := range writes {
+			if doc == nil {
+				delete(docs, id)
+			} else {
+				docs[id] = doc
+			}
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) close() error {
+	return nil
+}
+
+func (tx *memoryTx) get(collection string, id bson.ObjectId) ([]byte, error) {
+	if doc, ok := tx.writes[collection][id]; ok {
+		return doc, nil
+	}
+	return tx.store.docs[collection][id], nil
+}
+
+func (tx *memoryTx) put(collection string, id bson.ObjectId, doc []byte) error {
+	return tx.write(collection, id, doc)
+}
+
+func (tx *memoryTx) remove(collection string, id bson.ObjectId) error {
+	return tx.write(collection, id, nil)
+}
+
+func (tx *memoryTx) write(collection string, id bson.ObjectId, doc []byte) error {
+	if tx.writes == nil {
+		return errReadOnly
+	}
+	writes, ok := tx.writes[collection]
+	if !ok {
+		writes = map[bson.ObjectId][]byte{}
+		tx.writes[collection] = writes
+	}
+	writes[id] = doc
+	return nil
+}
+
+func (tx *memoryTx) each(collection string, fn func(doc []byte) error) error {
+	var ids []bson.ObjectId
+	for id := range tx.store.docs[collection] {
+		if _, ok := tx.writes[collection][id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	for id := range tx.writes[collection] {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	for _, id := range ids {
+		doc, _ := tx.get(collection, id)
+		if doc == nil {
+			continue
+		}
+		if err := fn(doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+package model_test
+
+import (
+	"testing"
+
+	"../model"
+	"./repotest"
+)
+
+func TestMemoryStore(t *testing.T) {
+	store := model.NewMemoryStore()
+	defer store.Close()
+
+	repotest.Run(t, store.Products(), store.Customers(), store.Rules())
+}
@@ -0,0 +1,214 @@
+package model
+
+import (
+	"context"
+	"time"
+
+	"../config"
+	"github.com/globalsign/mgo/bson"
+)
+
+type (
+	// MongoProductRepository keeps products in mongo
+	MongoProductRepository struct{}
+
+	// MongoCustomerRepository keeps customers in mongo
+	MongoCustomerRepository struct{}
+
+	// MongoPricingRuleRepository keeps pricing rules in mongo
+	MongoPricingRuleRepository struct{}
+)
+
+// Create a product
+func (MongoProductRepository) Create(ctx context.Context, product *Product) error {
+	return CreateProduct(ctx, product)
+}
+
+// List live products
+func (MongoProductRepository) List(ctx context.Context) ([]*Product, error) {
+	return ListProduct(ctx)
+}
+
+// Search a page of products
+func (MongoProductRepository) Search(ctx context.Context, q *Query, includeDeleted bool) ([]*Product, *Page, error) {
+	return SearchProduct(ctx, q, includeDeleted)
+}
+
+// SelectByID a live product
+func (MongoProductRepository) SelectByID(ctx context.Context, id bson.ObjectId) (*Product, error) {
+	return SelectProductByID(ctx, id)
+}
+
+// SelectByCode a live product
+func (MongoProductRepository) SelectByCode(ctx context.Context, code string) (*Product, error) {
+	return SelectProductByCode(ctx, code)
+}
+
+// Update a product at revision
+func (MongoProductRepository) Update(ctx context.Context, id bson.ObjectId, update *Product, revision int) (*Product, error) {
+	return UpdateProduct(ctx, id, update, revision)
+}
+
+// Delete a product at revision
+func (MongoProductRepository) Delete(ctx context.Context, id bson.ObjectId, revision int) error {
+	return DeleteProduct(ctx, id, revision)
+}
+
+// Restore a deleted product
+func (MongoProductRepository) Restore(ctx context.Context, id bson.ObjectId) (*Product, error) {
+	return RestoreProduct(ctx, id)
+}
+
+// Purge a product & its versions
+func (MongoProductRepository) Purge(ctx context.Context, id bson.ObjectId) error {
+	return purgeDocument(ctx, config.ProductsCollection, config.ProductVersionsCollection, id)
+}
+
+// ListVersions of a product
+func (MongoProductRepository) ListVersions(ctx context.Context, id bson.ObjectId) ([]*ProductVersion, error) {
+	return ListProductVersions(ctx, id)
+}
+
+// SelectAsOf a product as it was at
+func (MongoProductRepository) SelectAsOf(ctx context.Context, id bson.ObjectId, at time.Time) (*Product, error) {
+	return SelectProductAsOf(ctx, id, at)
+}
+
+// ListAsOf the products as they were at
+func (MongoProductRepository) ListAsOf(ctx context.Context, at time.Time) ([]*Product, error) {
+	return ListProductAsOf(ctx, at)
+}
+
+// Create a customer
+func (MongoCustomerRepository) Create(ctx context.Context, customer *Customer) error {
+	return CreateCustomer(ctx, customer)
+}
+
+// List live customers
+func (MongoCustomerRepository) List(ctx context.Context) ([]*Customer, error) {
+	return ListCustomer(ctx)
+}
+
+// Search a page of customers
+func (MongoCustomerRepository) Search(ctx context.Context, q *Query, includeDeleted bool) ([]*Customer, *Page, error) {
+	return SearchCustomer(ctx, q, includeDeleted)
+}
+
+// FuzzySearch a page of customers by a misspelt name
+func (MongoCustomerRepository) FuzzySearch(ctx context.Context, q *Query, name string, includeDeleted bool) ([]*Customer, *Page, error) {
+	return FuzzySearchCustomer(ctx, q, name, includeDeleted)
+}
+
+// SelectByID a live customer
+func (MongoCustomerRepository) SelectByID(ctx context.Context, id bson.ObjectId) (*Customer, error) {
+	return SelectCustomerByID(ctx, id)
+}
+
+// SelectByIDs the live customers among ids
+func (MongoCustomerRepository) SelectByIDs(ctx context.Context, ids []bson.ObjectId) ([]*Customer, error) {
+	return SelectCustomersByIDs(ctx, ids)
+}
+
+// SelectByNaturalKey a live customer by external reference or name
+func (MongoCustomerRepository) SelectByNaturalKey(ctx context.Context, externalRef string, name string) (*Customer, error) {
+	return SelectCustomerByNaturalKey(ctx, externalRef, name)
+}
+
+// Update a customer at revision
+func (MongoCustomerRepository) Update(ctx context.Context, id bson.ObjectId, update *Customer, revision int) (*Customer, error) {
+	return UpdateCustomer(ctx, id, update, revision)
+}
+
+// Delete a customer at revision
+func (MongoCustomerRepository) Delete(ctx context.Context, id bson.ObjectId, revision int) error {
+	return DeleteCustomer(ctx, id, revision)
+}
+
+// Restore a deleted customer
+func (MongoCustomerRepository) Restore(ctx context.Context, id bson.ObjectId) (*Customer, error) {
+	return RestoreCustomer(ctx, id)
+}
+
+// Purge a customer, its rules & their versions go first
+func (MongoCustomerRepository) Purge(ctx context.Context, id bson.ObjectId) error {
+	ruleIDs, err := SelectPricingRulesIDsByCustomerID(ctx, id.Hex())
+	if err != nil {
+		return err
+	}
+	for _, ruleID := range ruleIDs {
+		if err = purgeDocument(ctx, config.PricingRulesCollection, config.PricingRulesVersionsCollection, ruleID); err != nil {
+			return err
+		}
+	}
+	return purgeDocument(ctx, config.CustomersCollection, "", id)
+}
+
+// Create a rule
+func (MongoPricingRuleRepository) Create(ctx context.Context, rules *PricingRules) error {
+	return CreatePricingRules(ctx, rules)
+}
+
+// List a page of rules
+func (MongoPricingRuleRepository) List(ctx context.Context, q *Query, includeDeleted bool) ([]*PricingRules, *Page, error) {
+	return ListPricingRules(ctx, q, includeDeleted)
+}
+
+// Export every live rule
+func (MongoPricingRuleRepository) Export(ctx context.Context) ([]*PricingRules, error) {
+	return ExportPricingRules(ctx)
+}
+
+// SelectByID a live rule
+func (MongoPricingRuleRepository) SelectByID(ctx context.Context, id bson.ObjectId) (*PricingRules, error) {
+	return SelectPricingRulesByID(ctx, id)
+}
+
+// SelectByCustomerID the live rules of a customer
+func (MongoPricingRuleRepository) SelectByCustomerID(ctx context.Context, id string) ([]*PricingRules, error) {
+	return SelectPricingRulesByCustomerID(ctx, id)
+}
+
+// SelectByCustomerIDs the live rules of many customers
+func (MongoPricingRuleRepository) SelectByCustomerIDs(ctx context.Context, ids []string) ([]*PricingRules, error) {
+	return SelectPricingRulesByCustomerIDs(ctx, ids)
+}
+
+// Update a rule at revision
+func (MongoPricingRuleRepository) Update(ctx context.Context, id bson.ObjectId, update *PricingRules, revision int) (*PricingRules, error) {
+	return UpdatePricingRules(ctx, id, update, revision)
+}
+
+// Delete a rule at revision
+func (MongoPricingRuleRepository) Delete(ctx context.Context, id bson.ObjectId, revision int) error {
+	return DeletePricingRules(ctx, id, revision)
+}
+
+// Restore a deleted rule
+func (MongoPricingRuleRepository) Restore(ctx context.Context, id bson.ObjectId) (*PricingRules, error) {
+	return RestorePricingRules(ctx, id)
+}
+
+// Purge a rule & its versions
+func (MongoPricingRuleRepository) Purge(ctx context.Context, id bson.ObjectId) error {
+	return purgeDocument(ctx, config.PricingRulesCollection, config.PricingRulesVersionsCollection, id)
+}
+
+// ListVersions of a rule
+func (MongoPricingRuleRepository) ListVersions(ctx context.Context, id bson.ObjectId) ([]*PricingRulesVersion, error) {
+	return ListPricingRulesVersions(ctx, id)
+}
+
+// SelectAsOf a rule as it was at
+func (MongoPricingRuleRepository) SelectAsOf(ctx context.Context, id bson.ObjectId, at time.Time) (*PricingRules, error) {
+	return SelectPricingRulesAsOf(ctx, id, at)
+}
+
+// SelectByCustomerIDAsOf a customer's rules as they were at
+func (MongoPricingRuleRepository) SelectByCustomerIDAsOf(ctx context.Context, id string, at time.Time) ([]*PricingRules, error) {
+	return SelectPricingRulesByCustomerIDAsOf(ctx, id, at)
+}
+
+// SelectByCustomerIDsAsOf many customers' rules as they were at
+func (MongoPricingRuleRepository) SelectByCustomerIDsAsOf(ctx context.Context, ids []string, at time.Time) ([]*PricingRules, error) {
+	return SelectPricingRulesByCustomerIDsAsOf(ctx, ids, at)
+}
@@ -0,0 +1,38 @@
+package model_test
+
+import (
+	"os"
+	"testing"
+
+	"../config"
+	"../model"
+	"./repotest"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// TEST_MONGO_URL is a mongo server, the test works in a database of its
+// own that it drops at the end
+func TestMongo(t *testing.T) {
+	url := os.Getenv("TEST_MONGO_URL")
+	if url == "" {
+		t.Skip("TEST_MONGO_URL is not set")
+	}
+
+	info, err := mgo.ParseURL(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = model.Connect(info); err != nil {
+		t.Fatal(err)
+	}
+	defer model.Disconnect()
+
+	config.DbName = "jobads_test_" + bson.NewObjectId().Hex()
+	defer model.DB.DB(config.DbName).DropDatabase()
+	if err = model.Indexing(); err != nil {
+		t.Fatal(err)
+	}
+
+	repotest.Run(t, model.MongoProductRepository{}, model.MongoCustomerRepository{}, model.MongoPricingRuleRepository{})
+}
@@ -0,0 +1,166 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"../config"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// order types
+const (
+	OrderUpgrade = "upgrade"
+)
+
+// order statuses
+const (
+	OrderPending = "pending"
+	OrderPaid    = "paid"
+)
+
+type (
+	// Order struct
+	Order struct {
+		ID          bson.ObjectId `json:"id,omitempty" bson:"_id,omitempty"`
+		CustomerID  string        `json:"customer_id" bson:"customer_id"`
+		Type        string        `json:"type" bson:"type"`
+		JobAdID     string        `json:"jobad_id" bson:"jobad_id"`
+		FromProduct string        `json:"from_product" bson:"from_product"`
+		ToProduct   string        `json:"to_product" bson:"to_product"`
+		Amount      int           `json:"amount" bson:"amount"`
+		Status      string        `json:"status" bson:"status"`
+		CreatedAt   time.Time     `json:"created_at" bson:"created_at"`
+		PaidAt      *time.Time    `json:"paid_at,omitempty" bson:"paid_at,omitempty"`
+	}
+
+	// Upgrade struct
+	Upgrade struct {
+		ProductCode string `json:"product_code" form:"product_code" valid:"required"`
+	}
+)
+
+// OrderIndexing to create indices
+// ----------------------------------------------------------------------
+func OrderIndexing() error {
+	c := DB.Copy().DB(config.DbName).C(config.OrdersCollection)
+	err := c.EnsureIndex(mgo.Index{
+		Key:    []string{"customer_id", "-created_at"},
+		Unique: false,
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// CreateOrder Crud
+// ----------------------------------------------------------------------
+func CreateOrder(ctx context.Context, order *Order) (err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.OrdersCollection, "CreateOrder")(&err)
+	c := db.DB(config.DbName).C(config.OrdersCollection)
+
+	if err = customerCanOrder(ctx, order.CustomerID); err != nil {
+		return err
+	}
+
+	order.Status = OrderPending
+	order.CreatedAt = time.Now()
+
+	if err = c.Insert(order); err != nil {
+		return errors.New("Creating Order failed")
+	}
+
+	writeAudit(ctx, db, config.OrdersCollection, AuditCreate, order.ID, nil, order)
+
+	return nil
+}
+
+// SelectOrderByID cRud
+// ----------------------------------------------------------------------
+func SelectOrderByID(ctx context.Context, id bson.ObjectId) (result *Order, err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.OrdersCollection, "SelectOrderByID")(&err)
+	c := db.DB(config.DbName).C(config.OrdersCollection)
+
+	err = c.FindId(id).One(&result)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, err
+}
+
+// SelectOrderByCustomerID cRud
+// ----------------------------------------------------------------------
+func SelectOrderByCustomerID(ctx context.Context, id string) (results []*Order, err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.OrdersCollection, "SelectOrderByCustomerID")(&err)
+	c := db.DB(config.DbName).C(config.OrdersCollection)
+
+	err = c.Find(bson.M{"customer_id": id}).Sort("-created_at").All(&results)
+	if err != nil {
+		return nil, err
+	}
+	return results, err
+}
+
+// PayOrder crUd
+// marks a pending order as paid & applies what was bought, the order goes
+// back to pending when it cannot be applied. paying a paid order again
+// only finishes applying it
+// ----------------------------------------------------------------------
+func PayOrder(ctx context.Context, id bson.ObjectId) (result *Order, err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.OrdersCollection, "PayOrder")(&err)
+	c := db.DB(config.DbName).C(config.OrdersCollection)
+
+	var before *Order
+	_, err = c.Find(bson.M{"_id": id, "status": OrderPending}).Apply(mgo.Change{
+		Update: bson.M{"$set": bson.M{
+			"status":  OrderPaid,
+			"paid_at": time.Now(),
+		}},
+	}, &before)
+	if err != nil && err != mgo.ErrNotFound {
+		return nil, err
+	}
+	paid := err == nil
+
+	err = c.FindId(id).One(&result)
+	if err == mgo.ErrNotFound || (err == nil && result.Status != OrderPaid) {
+		return nil, errors.New("Order does not exist or could not be paid")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Type == OrderUpgrade {
+		if err = UpgradeJobAd(ctx, bson.ObjectIdHex(result.JobAdID), result.FromProduct, result.ToProduct, id.Hex()); err != nil {
+			rErr := c.Update(bson.M{"_id": id, "status": OrderPaid}, bson.M{
+				"$set":   bson.M{"status": OrderPending},
+				"$unset": bson.M{"paid_at": ""},
+			})
+			if rErr != nil && rErr != mgo.ErrNotFound {
+				log.Println(rErr)
+			}
+			return nil, err
+		}
+	}
+
+	if !paid {
+		return result, nil
+	}
+
+	writeAudit(ctx, db, config.OrdersCollection, AuditUpdate, id, before, result)
+
+	return result, nil
+}
@@ -0,0 +1,260 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/lib/pq"
+)
+
+// migrationLock is the advisory lock instances take to migrate one at a time
+const migrationLock = 7241901
+
+// migrations to the postgres schema, applied in order by migrate. a
+// released migration is never edited, changes go in a new one
+var migrations = []string{
+	// 1 products, customers, pricing rules & their versions
+	`
+	CREATE TABLE products (
+		id            TEXT PRIMARY KEY,
+		code          TEXT NOT NULL CONSTRAINT products_code_key UNIQUE,
+		name          TEXT NOT NULL,
+		description   TEXT NOT NULL DEFAULT '',
+		price         INTEGER NOT NULL,
+		duration_days INTEGER NOT NULL DEFAULT 0,
+		features      TEXT[],
+		status        TEXT NOT NULL,
+		display_order INTEGER NOT NULL DEFAULT 0,
+		tags          TEXT[],
+		revision      INTEGER NOT NULL,
+		deleted_at    TIMESTAMPTZ
+	);
+	CREATE INDEX products_status_display_order ON products (status, display_order);
+
+	CREATE TABLE customers (
+		id              TEXT PRIMARY KEY,
+		name            TEXT NOT NULL CONSTRAINT customers_name_key UNIQUE,
+		name_lower      TEXT NOT NULL,
+		email           TEXT NOT NULL DEFAULT '',
+		external_ref    TEXT NOT NULL DEFAULT '',
+		status          TEXT NOT NULL,
+		billing_email   TEXT NOT NULL DEFAULT '',
+		billing_address JSONB,
+		tax_id          TEXT NOT NULL DEFAULT '',
+		currency        TEXT NOT NULL DEFAULT '',
+		contacts        JSONB,
+		metadata        JSONB,
+		revision        INTEGER NOT NULL,
+		deleted_at      TIMESTAMPTZ
+	);
+	CREATE INDEX customers_name_lower ON customers (name_lower);
+	CREATE INDEX customers_email ON customers (email);
+	CREATE INDEX customers_external_ref ON customers (external_ref);
+	CREATE INDEX customers_status ON customers (status);
+	CREATE INDEX customers_text ON customers USING GIN ((` + customerSearchVector + `));
+
+	CREATE TABLE pricing_rules (
+		id             TEXT PRIMARY KEY,
+		customer_id    TEXT NOT NULL CONSTRAINT pricing_rules_customer_id_fkey REFERENCES customers (id),
+		product_code   TEXT NOT NULL,
+		type           TEXT NOT NULL,
+		deal_buy       INTEGER NOT NULL DEFAULT 0,
+		deal_priceof   INTEGER NOT NULL DEFAULT 0,
+		discount_buy   INTEGER NOT NULL DEFAULT 0,
+		discount_price INTEGER NOT NULL DEFAULT 0,
+		revision       INTEGER NOT NULL,
+		deleted_at     TIMESTAMPTZ
+	);
+	CREATE INDEX pricing_rules_customer_product_type ON pricing_rules (customer_id, product_code, type);
+	CREATE UNIQUE INDEX pricing_rules_live_key ON pricing_rules (customer_id, product_code) WHERE deleted_at IS NULL;
+
+	CREATE TABLE product_versions (
+		id             TEXT PRIMARY KEY,
+		entity_id      TEXT NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+		version        INTEGER NOT NULL,
+		effective_from TIMESTAMPTZ NOT NULL,
+		effective_to   TIMESTAMPTZ,
+		document       JSONB NOT NULL,
+		UNIQUE (entity_id, version)
+	);
+	CREATE INDEX product_versions_effective ON product_versions (effective_from, effective_to);
+
+	CREATE TABLE pricing_rules_versions (
+		id             TEXT PRIMARY KEY,
+		entity_id      TEXT NOT NULL REFERENCES pricing_rules (id) ON DELETE CASCADE,
+		version        INTEGER NOT NULL,
+		effective_from TIMESTAMPTZ NOT NULL,
+		effective_to   TIMESTAMPTZ,
+		document       JSONB NOT NULL,
+		UNIQUE (entity_id, version)
+	);
+	CREATE INDEX pricing_rules_versions_effective ON pricing_rules_versions (effective_from, effective_to);
+	CREATE INDEX pricing_rules_versions_customer ON pricing_rules_versions ((document ->> 'customer_id'), effective_from);
+	`,
+
+	// 2 purging a customer takes its pricing rules along
+	`
+	ALTER TABLE pricing_rules DROP CONSTRAINT pricing_rules_customer_id_fkey;
+	ALTER TABLE pricing_rules ADD CONSTRAINT pricing_rules_customer_id_fkey
+		FOREIGN KEY (customer_id) REFERENCES customers (id) ON DELETE CASCADE;
+	`,
+}
+
+// constraintErrors are what the mongo backend answers for the same conflicts
+var constraintErrors = map[string]string{
+	"products_code_key":              "Product Code already exists",
+	"customers_name_key":             "Customer already exists",
+	"pricing_rules_live_key":         "Rules already exists for the same customer & product_code",
+	"pricing_rules_customer_id_fkey": "Customer does not exist",
+}
+
+// Postgres keeps products, customers & rules in postgres tables, with the
+// unique keys & the rule to customer reference as constraints & each change
+// made in one transaction. like Store it doesn't write the audit log, that
+// lives in mongo
+type Postgres struct {
+	db *sql.DB
+}
+
+// OpenPostgres connects to the database at url & migrates its schema
+func OpenPostgres(url string) (*Postgres, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err = migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Postgres{db: db}, nil
+}
+
+// Close the connections to the database
+func (p *Postgres) Close() error {
+	return p.db.Close()
+}
+
+// Ping the database, giving up after timeout
+func (p *Postgres) Ping(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return p.db.PingContext(ctx)
+}
+
+// Products kept in postgres
+func (p *Postgres) Products() ProductRepository {
+	return postgresProductRepository{p.db}
+}
+
+// Customers kept in postgres
+func (p *Postgres) Customers() CustomerRepository {
+	return postgresCustomerRepository{p.db}
+}
+
+// Rules kept in postgres
+func (p *Postgres) Rules() PricingRuleRepository {
+	return postgresPricingRuleRepository{p.db}
+}
+
+// migrate applies the migrations the database hasn't had yet, each in its
+// own transaction & under a lock so instances starting together don't race
+func migrate(db *sql.DB) error {
+	ctx := context.Background()
+	for i, migration := range migrations {
+		version := i + 1
+		err := inTx(ctx, db, func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, migrationLock); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+				version    INTEGER PRIMARY KEY,
+				applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+			)`)
+			if err != nil {
+				return err
+			}
+
+			var applied bool
+			err = tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`, version).Scan(&applied)
+			if err != nil || applied {
+				return err
+			}
+			if _, err = tx.ExecContext(ctx, migration); err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, version)
+			return err
+		})
+		if err != nil {
+			return errors.New("Migration " + strconv.Itoa(version) + " failed: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// inTx runs fn in a transaction, committed only when fn succeeds, or in
+// the one of ctx when pgTransaction began one
+func inTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	if tx, ok := ctx.Value(pgTxKey{}).(*sql.Tx); ok {
+		return pgError(fn(tx))
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return pgError(err)
+	}
+	return pgError(tx.Commit())
+}
+
+// pgTxKey holds the transaction of pgTransaction in a context
+type pgTxKey struct{}
+
+// pgTransaction runs fn in one transaction, committed only when fn
+// succeeds. the repositories called with the ctx fn is given read & write
+// in it
+func pgTransaction(ctx context.Context, db *sql.DB, fn func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(pgTxKey{}).(*sql.Tx); ok {
+		return fn(ctx)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err = fn(context.WithValue(ctx, pgTxKey{}, tx)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return pgError(tx.Commit())
+}
+
+// pgConn is the transaction of ctx if any, db otherwise
+func pgConn(ctx context.Context, db *sql.DB) querier {
+	if tx, ok := ctx.Value(pgTxKey{}).(*sql.Tx); ok {
+		return tx
+	}
+	return db
+}
+
+// pgError translates database errors to the ones the mongo backend gives
+func pgError(err error) error {
+	if err == sql.ErrNoRows {
+		return mgo.ErrNotFound
+	}
+	if pqErr, ok := err.(*pq.Error); ok {
+		if message, ok := constraintErrors[pqErr.Constraint]; ok {
+			return errors.New(message)
+		}
+	}
+	return err
+}
@@ -0,0 +1,426 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/lib/pq"
+)
+
+// kinds of postgres columns, they take different sql for the same filter
+const (
+	pgScalar = iota
+	pgArray
+	pgJSON
+)
+
+type (
+	// pgTable maps the bson fields of a collection to the columns of its
+	// table, so the filters built for mongo can be run as sql
+	pgTable struct {
+		name    string
+		columns map[string]int
+		// text is the tsvector $text searches, empty when there is none
+		text string
+	}
+
+	// pgQuery builds a where clause, numbering its args
+	pgQuery struct {
+		table *pgTable
+		args  []interface{}
+	}
+
+	// pgPage is the sql reading one page of a listing
+	pgPage struct {
+		sql       string
+		args      []interface{}
+		count     string
+		countArgs []interface{}
+		field     string
+		offset    int
+		relevance bool
+	}
+)
+
+// arg adds v as the next argument & returns its placeholder
+func (q *pgQuery) arg(v interface{}) string {
+	if id, ok := v.(bson.ObjectId); ok {
+		v = id.Hex()
+	}
+	q.args = append(q.args, v)
+	return "$" + strconv.Itoa(len(q.args))
+}
+
+// where translates filter, the part of mongo's query language matcher
+// evaluates, into a sql condition
+func (q *pgQuery) where(filter bson.M) (string, error) {
+	keys := make([]string, 0, len(filter))
+	for key := range filter {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var conds []string
+	for _, key := range keys {
+		var cond string
+		var err error
+		switch key {
+		case "$and", "$or":
+			cond, err = q.logical(key, filter[key])
+		case "$text":
+			cond, err = q.text(filter[key])
+		default:
+			if strings.HasPrefix(key, "$") {
+				return "", errors.New("Unsupported query operator " + key)
+			}
+			cond, err = q.condition(key, filter[key])
+		}
+		if err != nil {
+			return "", err
+		}
+		conds = append(conds, cond)
+	}
+
+	if len(conds) == 0 {
+		return "TRUE", nil
+	}
+	return strings.Join(conds, " AND "), nil
+}
+
+// logical translates the filters of an $and or an $or
+func (q *pgQuery) logical(op string, cond interface{}) (string, error) {
+	var filters []bson.M
+	switch list := cond.(type) {
+	case []bson.M:
+		filters = list
+	case []interface{}:
+		for _, item := range list {
+			filter, ok := item.(bson.M)
+			if !ok {
+				return "", errors.New(op + " needs a list of filters")
+			}
+			filters = append(filters, filter)
+		}
+	default:
+		return "", errors.New(op + " needs a list of filters")
+	}
+
+	join := " AND "
+	if op == "$or" {
+		join = " OR "
+	}
+	var conds []string
+	for _, filter := range filters {
+		cond, err := q.where(filter)
+		if err != nil {
+			return "", err
+		}
+		conds = append(conds, "("+cond+")")
+	}
+	if len(conds) == 0 {
+		return strconv.FormatBool(op == "$and"), nil
+	}
+	return "(" + strings.Join(conds, join) + ")", nil
+}
+
+// text translates a $text search, "-term" excludes like it does in mongo
+func (q *pgQuery) text(cond interface{}) (string, error) {
+	if q.table.text == "" {
+		return "", errors.New("text index required for $text query")
+	}
+	search, ok := cond.(bson.M)
+	if !ok {
+		return "", errors.New("$text needs a $search")
+	}
+	terms, ok := search["$search"].(string)
+	if !ok {
+		return "", errors.New("$text needs a $search")
+	}
+	return q.table.text + " @@ websearch_to_tsquery('simple', " + q.arg(terms) + ")", nil
+}
+
+// column is the sql expression of a field & its kind, a dotted path
+// reads into a json column as text
+func (q *pgQuery) column(field string) (expr string, kind int, err error) {
+	if field == "_id" {
+		return "id", pgScalar, nil
+	}
+	name := field
+	path := ""
+	if i := strings.Index(field, "."); i > 0 {
+		name, path = field[:i], field[i+1:]
+	}
+	kind, ok := q.table.columns[name]
+	if !ok || (path != "" && kind != pgJSON) {
+		return "", 0, errors.New("Unknown field " + field)
+	}
+	if path == "" {
+		return name, kind, nil
+	}
+	expr = name
+	for _, key := range strings.Split(path, ".") {
+		expr += " -> " + q.arg(key) + "::text"
+	}
+	// the last step reads text
+	i := strings.LastIndex(expr, " -> ")
+	return expr[:i] + " ->> " + expr[i+4:], pgScalar, nil
+}
+
+// condition translates the condition on one field
+func (q *pgQuery) condition(field string, cond interface{}) (string, error) {
+	expr, kind, err := q.column(field)
+	if err != nil {
+		return "", err
+	}
+
+	switch c := cond.(type) {
+	case bson.RegEx:
+		return q.regex(expr, kind, c), nil
+	case bson.M:
+		if operators(c) {
+			ops := make([]string, 0, len(c))
+			for op := range c {
+				ops = append(ops, op)
+			}
+			sort.Strings(ops)
+
+			var conds []string
+			for _, op := range ops {
+				cond, err := q.operator(expr, kind, op, c[op])
+				if err != nil {
+					return "", err
+				}
+				conds = append(conds, cond)
+			}
+			return strings.Join(conds, " AND "), nil
+		}
+	}
+	return q.operator(expr, kind, "$eq", cond)
+}
+
+// operator translates a single query operator on a column
+func (q *pgQuery) operator(expr string, kind int, op string, arg interface{}) (string, error) {
+	if kind == pgJSON && op != "$exists" && arg != nil {
+		return "", errors.New("Unsupported query operator " + op + " on " + expr)
+	}
+
+	switch op {
+	case "$eq":
+		if arg == nil {
+			return expr + " IS NULL", nil
+		}
+		if kind == pgArray {
+			return q.arg(arg) + " = ANY(" + expr + ")", nil
+		}
+		return expr + " = " + q.arg(arg), nil
+	case "$ne":
+		eq, err := q.operator(expr, kind, "$eq", arg)
+		if err != nil {
+			return "", err
+		}
+		return "NOT COALESCE(" + eq + ", FALSE)", nil
+	case "$in", "$nin":
+		in, err := q.in(expr, kind, op, arg)
+		if err != nil || op == "$in" {
+			return in, err
+		}
+		return "NOT COALESCE(" + in + ", FALSE)", nil
+	case "$exists":
+		if want, _ := arg.(bool); want {
+			return expr + " IS NOT NULL", nil
+		}
+		return expr + " IS NULL", nil
+	case "$gt", "$gte", "$lt", "$lte":
+		if kind != pgScalar {
+			return "", errors.New("Unsupported query operator " + op + " on " + expr)
+		}
+		compare := map[string]string{"$gt": " > ", "$gte": " >= ", "$lt": " < ", "$lte": " <= "}[op]
+		return expr + compare + q.arg(arg), nil
+	}
+	return "", errors.New("Unsupported query operator " + op)
+}
+
+// in translates an $in list, where nil matches a missing value
+func (q *pgQuery) in(expr string, kind int, op string, arg interface{}) (string, error) {
+	if !isSlice(arg) {
+		return "", errors.New(op + " needs a list of values")
+	}
+
+	list := reflect.ValueOf(arg)
+	var conds, values []string
+	for i := 0; i < list.Len(); i++ {
+		v := list.Index(i).Interface()
+		switch {
+		case v == nil:
+			conds = append(conds, expr+" IS NULL")
+		case kind == pgArray:
+			conds = append(conds, q.arg(v)+" = ANY("+expr+")")
+		default:
+			values = append(values, q.arg(v))
+		}
+	}
+	if len(values) > 0 {
+		conds = append(conds, expr+" IN ("+strings.Join(values, ", ")+")")
+	}
+	if len(conds) == 0 {
+		return "FALSE", nil
+	}
+	return "(" + strings.Join(conds, " OR ") + ")", nil
+}
+
+// regex translates a regular expression, matching any element of a list
+func (q *pgQuery) regex(expr string, kind int, re bson.RegEx) string {
+	flags := ""
+	for _, option := range re.Options {
+		switch option {
+		case 'i':
+			flags += "i"
+		case 'm':
+			flags += "n"
+		}
+	}
+	pattern := re.Pattern
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+
+	if kind == pgArray {
+		return "EXISTS (SELECT 1 FROM unnest(" + expr + ") AS v WHERE v ~ " + q.arg(pattern) + ")"
+	}
+	return expr + " ~ " + q.arg(pattern)
+}
+
+// pgPageQuery builds the sql reading one page of q from table, keyset
+// paginated the same way paginate reads a mongo collection, columns are
+// the ones selected
+func pgPageQuery(table *pgTable, columns string, q *Query) (page *pgPage, err error) {
+	field, desc := sortField(q.Sort)
+	page = &pgPage{field: field, relevance: q.Sort == SortRelevance}
+
+	count := &pgQuery{table: table}
+	where, err := count.where(q.Filter)
+	if err != nil {
+		return nil, err
+	}
+	page.count = "SELECT COUNT(*) FROM " + table.name + " WHERE " + where
+	page.countArgs = count.args
+
+	filter := q.Filter
+	var cur *cursor
+	if q.Cursor != "" {
+		if cur, err = decodeCursor(q.Cursor, q.Sort); err != nil {
+			return nil, err
+		}
+	}
+
+	if page.relevance {
+		if cur != nil {
+			switch v := cur.Value.(type) {
+			case int:
+				page.offset = v
+			case int64:
+				page.offset = int(v)
+			default:
+				return nil, ErrInvalidCursor
+			}
+		}
+		query := &pgQuery{table: table}
+		if where, err = query.where(filter); err != nil {
+			return nil, err
+		}
+		search, _ := filter["$text"].(bson.M)
+		terms, _ := search["$search"].(string)
+		rank := "ts_rank(" + table.text + ", websearch_to_tsquery('simple', " + query.arg(terms) + "))"
+		page.sql = "SELECT " + columns + ", " + rank + " AS score FROM " + table.name +
+			" WHERE " + where + " ORDER BY score DESC, id" +
+			" LIMIT " + strconv.Itoa(q.Limit+1) + " OFFSET " + strconv.Itoa(page.offset)
+		page.args = query.args
+		return page, nil
+	}
+
+	if cur != nil {
+		filter = bson.M{"$and": []bson.M{q.Filter, after(field, desc, cur)}}
+	}
+	query := &pgQuery{table: table}
+	if where, err = query.where(filter); err != nil {
+		return nil, err
+	}
+	expr, kind, err := query.column(field)
+	if err != nil || kind != pgScalar {
+		return nil, errors.New("Cannot sort by " + field)
+	}
+
+	// mongo sorts missing values first
+	order := expr + " ASC NULLS FIRST, id ASC"
+	if desc {
+		order = expr + " DESC NULLS LAST, id DESC"
+	}
+	page.sql = "SELECT " + columns + " FROM " + table.name + " WHERE " + where +
+		" ORDER BY " + order + " LIMIT " + strconv.Itoa(q.Limit+1)
+	page.args = query.args
+	return page, nil
+}
+
+// read runs the page, scan decodes the current row & returns the document,
+// relevance asks it to scan the score too
+func (p *pgPage) read(ctx context.Context, db querier, q *Query, scan func(rows *sql.Rows, relevance bool) (interface{}, error)) (page *Page, err error) {
+	page = &Page{Total: -1}
+	if q.WithTotal {
+		if err = db.QueryRowContext(ctx, p.count, p.countArgs...).Scan(&page.Total); err != nil {
+			return nil, pgError(err)
+		}
+	}
+
+	rows, err := db.QueryContext(ctx, p.sql, p.args...)
+	if err != nil {
+		return nil, pgError(err)
+	}
+	defer rows.Close()
+
+	var last interface{}
+	for n := 0; rows.Next(); n++ {
+		if n == q.Limit {
+			// the extra row, there's a next page
+			if page.NextCursor, err = p.next(q, last); err != nil {
+				return nil, err
+			}
+			break
+		}
+		if last, err = scan(rows, p.relevance); err != nil {
+			return nil, err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, pgError(err)
+	}
+
+	return page, nil
+}
+
+// next is the cursor of the page after last
+func (p *pgPage) next(q *Query, last interface{}) (string, error) {
+	doc, err := toM(last)
+	if err != nil {
+		return "", err
+	}
+	id, _ := doc["_id"].(bson.ObjectId)
+	if p.relevance {
+		return encodeCursor(q.Sort, p.offset+q.Limit, id)
+	}
+	return encodeCursor(q.Sort, doc[p.field], id)
+}
+
+// pgStrings of ids, as their columns hold them
+func pgStrings(ids []bson.ObjectId) interface{} {
+	hexes := make([]string, len(ids))
+	for i, id := range ids {
+		hexes[i] = id.Hex()
+	}
+	return pq.Array(hexes)
+}
@@ -0,0 +1,917 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/lib/pq"
+)
+
+// customerSearchVector is what $text searches on customers, weighted like
+// the customers_text index of mongo
+const customerSearchVector = `setweight(to_tsvector('simple', name), 'A') || ` +
+	`setweight(to_tsvector('simple', email), 'B') || ` +
+	`setweight(to_tsvector('simple', external_ref), 'B')`
+
+// columns selected for each document, in the order their scan reads them
+const (
+	productColumns      = `id, code, name, description, price, duration_days, features, status, display_order, tags, revision, deleted_at`
+	customerColumns     = `id, name, name_lower, email, external_ref, status, billing_email, billing_address, tax_id, currency, contacts, metadata, revision, deleted_at`
+	pricingRulesColumns = `id, customer_id, product_code, type, deal_buy, deal_priceof, discount_buy, discount_price, revision, deleted_at`
+	versionColumns      = `id, entity_id, version, effective_from, effective_to, document`
+)
+
+// tables the listings filter, by bson field
+var (
+	productsTable = &pgTable{name: "products", columns: map[string]int{
+		"code": pgScalar, "name": pgScalar, "description": pgScalar, "price": pgScalar,
+		"duration_days": pgScalar, "features": pgArray, "status": pgScalar,
+		"display_order": pgScalar, "tags": pgArray, "revision": pgScalar, "deleted_at": pgScalar,
+	}}
+	customersTable = &pgTable{name: "customers", text: customerSearchVector, columns: map[string]int{
+		"name": pgScalar, "name_lower": pgScalar, "email": pgScalar, "external_ref": pgScalar,
+		"status": pgScalar, "billing_email": pgScalar, "billing_address": pgJSON, "tax_id": pgScalar,
+		"currency": pgScalar, "contacts": pgJSON, "metadata": pgJSON, "revision": pgScalar, "deleted_at": pgScalar,
+	}}
+	pricingRulesTable = &pgTable{name: "pricing_rules", columns: map[string]int{
+		"customer_id": pgScalar, "product_code": pgScalar, "type": pgScalar,
+		"deal_buy": pgScalar, "deal_priceof": pgScalar, "discount_buy": pgScalar,
+		"discount_price": pgScalar, "revision": pgScalar, "deleted_at": pgScalar,
+	}}
+)
+
+type (
+	// postgresProductRepository keeps products in postgres
+	postgresProductRepository struct {
+		db *sql.DB
+	}
+
+	// postgresCustomerRepository keeps customers in postgres
+	postgresCustomerRepository struct {
+		db *sql.DB
+	}
+
+	// postgresPricingRuleRepository keeps pricing rules in postgres
+	postgresPricingRuleRepository struct {
+		db *sql.DB
+	}
+
+	// scanner is a row or the current row of rows
+	scanner interface {
+		Scan(dest ...interface{}) error
+	}
+
+	// querier runs queries in or out of a transaction
+	querier interface {
+		QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+		QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	}
+)
+
+func scanProduct(row scanner, extra ...interface{}) (*Product, error) {
+	p := new(Product)
+	var id string
+	err := row.Scan(append([]interface{}{
+		&id, &p.Code, &p.Name, &p.Description, &p.Price, &p.DurationDays, pq.Array(&p.Features),
+		&p.Status, &p.DisplayOrder, pq.Array(&p.Tags), &p.Revision, &p.DeletedAt,
+	}, extra...)...)
+	if err != nil {
+		return nil, pgError(err)
+	}
+	p.ID = bson.ObjectIdHex(id)
+	return p, nil
+}
+
+func productValues(p *Product) []interface{} {
+	return []interface{}{
+		p.ID.Hex(), p.Code, p.Name, p.Description, p.Price, p.DurationDays, pq.Array(p.Features),
+		p.Status, p.DisplayOrder, pq.Array(p.Tags), p.Revision, p.DeletedAt,
+	}
+}
+
+func scanCustomer(row scanner, extra ...interface{}) (*Customer, error) {
+	c := new(Customer)
+	var id string
+	var address, contacts, metadata []byte
+	err := row.Scan(append([]interface{}{
+		&id, &c.Name, &c.NameLower, &c.Email, &c.ExternalRef, &c.Status, &c.BillingEmail,
+		&address, &c.TaxID, &c.Currency, &contacts, &metadata, &c.Revision, &c.DeletedAt,
+	}, extra...)...)
+	if err != nil {
+		return nil, pgError(err)
+	}
+	c.ID = bson.ObjectIdHex(id)
+	for _, column := range []struct {
+		raw []byte
+		v   interface{}
+	}{{address, &c.BillingAddress}, {contacts, &c.Contacts}, {metadata, &c.Metadata}} {
+		if column.raw == nil {
+			continue
+		}
+		if err = json.Unmarshal(column.raw, column.v); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func customerValues(c *Customer) ([]interface{}, error) {
+	values := []interface{}{
+		c.ID.Hex(), c.Name, c.NameLower, c.Email, c.ExternalRef, c.Status, c.BillingEmail,
+		nil, c.TaxID, c.Currency, nil, nil, c.Revision, c.DeletedAt,
+	}
+	for i, v := range map[int]interface{}{7: c.BillingAddress, 10: c.Contacts, 11: c.Metadata} {
+		if isNil(v) {
+			continue
+		}
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		// as text, pq would send bytes as bytea
+		values[i] = string(raw)
+	}
+	return values, nil
+}
+
+func scanPricingRules(row scanner) (*PricingRules, error) {
+	r := new(PricingRules)
+	var id string
+	err := row.Scan(
+		&id, &r.CustomerID, &r.ProductCode, &r.Type, &r.DealBuy, &r.DealPriceOf,
+		&r.DiscountBuy, &r.DiscountPrice, &r.Revision, &r.DeletedAt,
+	)
+	if err != nil {
+		return nil, pgError(err)
+	}
+	r.ID = bson.ObjectIdHex(id)
+	return r, nil
+}
+
+func pricingRulesValues(r *PricingRules) []interface{} {
+	return []interface{}{
+		r.ID.Hex(), r.CustomerID, r.ProductCode, r.Type, r.DealBuy, r.DealPriceOf,
+		r.DiscountBuy, r.DiscountPrice, r.Revision, r.DeletedAt,
+	}
+}
+
+// isNil tells whether v holds no value, even as a typed nil
+func isNil(v interface{}) bool {
+	switch x := v.(type) {
+	case *Address:
+		return x == nil
+	case []Contact:
+		return x == nil
+	case map[string]string:
+		return x == nil
+	}
+	return v == nil
+}
+
+// placeholders $1 to $n
+func placeholders(n int) string {
+	list := make([]string, n)
+	for i := range list {
+		list[i] = "$" + strconv.Itoa(i+1)
+	}
+	return strings.Join(list, ", ")
+}
+
+// assignments of columns to $2 onwards, $1 being the id
+func assignments(columns string) string {
+	names := strings.Split(columns, ", ")[1:]
+	for i, name := range names {
+		names[i] = name + " = $" + strconv.Itoa(i+2)
+	}
+	return strings.Join(names, ", ")
+}
+
+// lockRevision reads the revision of the live row id of table, locked for
+// the rest of the transaction
+func lockRevision(ctx context.Context, tx *sql.Tx, table string, id bson.ObjectId) (revision int, err error) {
+	err = tx.QueryRowContext(ctx, `SELECT revision FROM `+table+` WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`, id.Hex()).Scan(&revision)
+	return revision, pgError(err)
+}
+
+// pgDelete flags the live row id of table as deleted at revision & closes
+// its version
+func pgDelete(ctx context.Context, db *sql.DB, table string, versions string, id bson.ObjectId, revision int) error {
+	return inTx(ctx, db, func(tx *sql.Tx) error {
+		current, err := lockRevision(ctx, tx, table, id)
+		if err != nil {
+			return err
+		}
+		if err = checkRevision(revision, current); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		_, err = tx.ExecContext(ctx, `UPDATE `+table+` SET deleted_at = $2, revision = revision + 1 WHERE id = $1`, id.Hex(), now)
+		if err != nil || versions == "" {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE `+versions+` SET effective_to = $2 WHERE entity_id = $1 AND effective_to IS NULL`, id.Hex(), now)
+		return err
+	})
+}
+
+// pgRestore brings the deleted row id of table back
+func pgRestore(ctx context.Context, tx *sql.Tx, table string, id bson.ObjectId, notDeleted string) error {
+	var deletedAt *time.Time
+	err := tx.QueryRowContext(ctx, `SELECT deleted_at FROM `+table+` WHERE id = $1 FOR UPDATE`, id.Hex()).Scan(&deletedAt)
+	if err != nil {
+		return err
+	}
+	if deletedAt == nil {
+		return errors.New(notDeleted)
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE `+table+` SET deleted_at = NULL, revision = revision + 1 WHERE id = $1`, id.Hex())
+	return err
+}
+
+// pgPurge removes the row id of table for good, its versions go with it
+func pgPurge(ctx context.Context, db *sql.DB, table string, id bson.ObjectId) error {
+	return inTx(ctx, db, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE id = $1`, id.Hex())
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil || n == 0 {
+			return mgo.ErrNotFound
+		}
+		return nil
+	})
+}
+
+// pgAppendVersion closes the version of id currently in effect & stores
+// doc as the next one, effective from at
+func pgAppendVersion(ctx context.Context, tx *sql.Tx, versions string, id bson.ObjectId, doc interface{}, at time.Time) error {
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE `+versions+` SET effective_to = $2 WHERE entity_id = $1 AND effective_to IS NULL`, id.Hex(), at)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO `+versions+` (`+versionColumns+`)
+		SELECT $1::text, $2::text, COALESCE(MAX(version), 0) + 1, $3::timestamptz, NULL::timestamptz, $4::jsonb
+		FROM `+versions+` WHERE entity_id = $2`,
+		bson.NewObjectId().Hex(), id.Hex(), at, string(raw))
+	return err
+}
+
+// pgVersions reads the versions matching where, decoding each document
+// into the value doc returns for it
+func pgVersions(ctx context.Context, db querier, versions string, where string, args []interface{}, read func(v *pgVersion) error) error {
+	rows, err := db.QueryContext(ctx, `SELECT `+versionColumns+` FROM `+versions+` WHERE `+where+` ORDER BY version, id`, args...)
+	if err != nil {
+		return pgError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		v := new(pgVersion)
+		var id, entityID string
+		if err = rows.Scan(&id, &entityID, &v.Version, &v.EffectiveFrom, &v.EffectiveTo, &v.document); err != nil {
+			return pgError(err)
+		}
+		v.ID, v.EntityID = bson.ObjectIdHex(id), bson.ObjectIdHex(entityID)
+		if err = read(v); err != nil {
+			return err
+		}
+	}
+	return pgError(rows.Err())
+}
+
+// pgVersion is a version row before its document is decoded
+type pgVersion struct {
+	ID            bson.ObjectId
+	EntityID      bson.ObjectId
+	Version       int
+	EffectiveFrom time.Time
+	EffectiveTo   *time.Time
+	document      []byte
+}
+
+// asOfSQL matches the versions that were in effect at $1
+const asOfSQL = `effective_from <= $1 AND (effective_to IS NULL OR effective_to > $1)`
+
+// Create a product, codes are unique among deleted products too
+func (r postgresProductRepository) Create(ctx context.Context, product *Product) error {
+	if err := validateFeatures(product.Features); err != nil {
+		return err
+	}
+	if product.ID == "" {
+		product.ID = bson.NewObjectId()
+	}
+
+	return inTx(ctx, r.db, func(tx *sql.Tx) error {
+		var deletedAt *time.Time
+		err := tx.QueryRowContext(ctx, `SELECT deleted_at FROM products WHERE code = $1`, product.Code).Scan(&deletedAt)
+		if err == nil && deletedAt != nil {
+			return errors.New("Product Code belongs to a deleted product, restore it instead")
+		}
+		if err == nil {
+			return errors.New("Product Code already exists")
+		}
+		if err != sql.ErrNoRows {
+			return err
+		}
+
+		product.Revision = 1
+		_, err = tx.ExecContext(ctx, `INSERT INTO products (`+productColumns+`) VALUES (`+placeholders(12)+`)`, productValues(product)...)
+		if err != nil {
+			return err
+		}
+
+		return pgAppendVersion(ctx, tx, "product_versions", product.ID, product, time.Now())
+	})
+}
+
+// List live products
+func (r postgresProductRepository) List(ctx context.Context) ([]*Product, error) {
+	return r.query(ctx, `SELECT `+productColumns+` FROM products WHERE deleted_at IS NULL ORDER BY display_order, code`)
+}
+
+func (r postgresProductRepository) query(ctx context.Context, query string, args ...interface{}) (results []*Product, err error) {
+	rows, err := pgConn(ctx, r.db).QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, pgError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		product, err := scanProduct(rows)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, product)
+	}
+	return results, pgError(rows.Err())
+}
+
+// Search a page of products
+func (r postgresProductRepository) Search(ctx context.Context, q *Query, includeDeleted bool) (results []*Product, page *Page, err error) {
+	q.Filter = withDeleted(q.Filter, includeDeleted)
+	p, err := pgPageQuery(productsTable, productColumns, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	page, err = p.read(ctx, pgConn(ctx, r.db), q, func(rows *sql.Rows, _ bool) (interface{}, error) {
+		product, err := scanProduct(rows)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, product)
+		return product, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return results, page, nil
+}
+
+// SelectByID a live product
+func (r postgresProductRepository) SelectByID(ctx context.Context, id bson.ObjectId) (*Product, error) {
+	return scanProduct(pgConn(ctx, r.db).QueryRowContext(ctx, `SELECT `+productColumns+` FROM products WHERE id = $1 AND deleted_at IS NULL`, id.Hex()))
+}
+
+// SelectByCode a live product
+func (r postgresProductRepository) SelectByCode(ctx context.Context, code string) (*Product, error) {
+	return scanProduct(pgConn(ctx, r.db).QueryRowContext(ctx, `SELECT `+productColumns+` FROM products WHERE code = $1 AND deleted_at IS NULL`, code))
+}
+
+// Update a product at revision
+func (r postgresProductRepository) Update(ctx context.Context, id bson.ObjectId, update *Product, revision int) (*Product, error) {
+	if err := validateFeatures(update.Features); err != nil {
+		return nil, err
+	}
+
+	err := inTx(ctx, r.db, func(tx *sql.Tx) error {
+		current, err := lockRevision(ctx, tx, "products", id)
+		if err != nil {
+			return err
+		}
+		if err = checkRevision(revision, current); err != nil {
+			return err
+		}
+
+		update.ID = id
+		update.Revision = current + 1
+		update.DeletedAt = nil
+		_, err = tx.ExecContext(ctx, `UPDATE products SET `+assignments(productColumns)+` WHERE id = $1`, productValues(update)...)
+		if err != nil {
+			return err
+		}
+
+		return pgAppendVersion(ctx, tx, "product_versions", id, update, time.Now())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.SelectByID(ctx, id)
+}
+
+// Delete a product at revision
+func (r postgresProductRepository) Delete(ctx context.Context, id bson.ObjectId, revision int) error {
+	return pgDelete(ctx, r.db, "products", "product_versions", id, revision)
+}
+
+// Restore a deleted product
+func (r postgresProductRepository) Restore(ctx context.Context, id bson.ObjectId) (*Product, error) {
+	err := inTx(ctx, r.db, func(tx *sql.Tx) error {
+		if err := pgRestore(ctx, tx, "products", id, "Product is not deleted"); err != nil {
+			return err
+		}
+		restored, err := scanProduct(tx.QueryRowContext(ctx, `SELECT `+productColumns+` FROM products WHERE id = $1`, id.Hex()))
+		if err != nil {
+			return err
+		}
+		return pgAppendVersion(ctx, tx, "product_versions", id, restored, time.Now())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.SelectByID(ctx, id)
+}
+
+// transaction runs the writes of an import at once
+func (r postgresProductRepository) transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return pgTransaction(ctx, r.db, fn)
+}
+
+// Purge a product & its versions
+func (r postgresProductRepository) Purge(ctx context.Context, id bson.ObjectId) error {
+	return pgPurge(ctx, r.db, "products", id)
+}
+
+// ListVersions of a product
+func (r postgresProductRepository) ListVersions(ctx context.Context, id bson.ObjectId) (results []*ProductVersion, err error) {
+	err = pgVersions(ctx, pgConn(ctx, r.db), "product_versions", `entity_id = $1`, []interface{}{id.Hex()}, func(v *pgVersion) error {
+		version := &ProductVersion{ID: v.ID, ProductID: v.EntityID, Version: v.Version, EffectiveFrom: v.EffectiveFrom, EffectiveTo: v.EffectiveTo}
+		results = append(results, version)
+		return json.Unmarshal(v.document, &version.Product)
+	})
+	return results, err
+}
+
+// SelectAsOf a product as it was at
+func (r postgresProductRepository) SelectAsOf(ctx context.Context, id bson.ObjectId, at time.Time) (*Product, error) {
+	results, err := r.asOf(ctx, asOfSQL+` AND entity_id = $2`, at, id.Hex())
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, mgo.ErrNotFound
+	}
+	return results[0], nil
+}
+
+// ListAsOf the products as they were at
+func (r postgresProductRepository) ListAsOf(ctx context.Context, at time.Time) ([]*Product, error) {
+	return r.asOf(ctx, asOfSQL, at)
+}
+
+func (r postgresProductRepository) asOf(ctx context.Context, where string, args ...interface{}) (results []*Product, err error) {
+	err = pgVersions(ctx, pgConn(ctx, r.db), "product_versions", where, args, func(v *pgVersion) error {
+		product := new(Product)
+		results = append(results, product)
+		return json.Unmarshal(v.document, product)
+	})
+	return results, err
+}
+
+// Create a customer, names are unique among deleted customers too
+func (r postgresCustomerRepository) Create(ctx context.Context, customer *Customer) error {
+	if err := customer.validateProfile(); err != nil {
+		return err
+	}
+	customer.normalize()
+	if customer.Status == "" {
+		customer.Status = CustomerActive
+	}
+	if customer.ID == "" {
+		customer.ID = bson.NewObjectId()
+	}
+
+	return inTx(ctx, r.db, func(tx *sql.Tx) error {
+		var deletedAt *time.Time
+		err := tx.QueryRowContext(ctx, `SELECT deleted_at FROM customers WHERE name = $1`, customer.Name).Scan(&deletedAt)
+		if err == nil && deletedAt != nil {
+			return errors.New("Customer belongs to a deleted customer, restore it instead")
+		}
+		if err == nil {
+			return errors.New("Customer already exists")
+		}
+		if err != sql.ErrNoRows {
+			return err
+		}
+
+		customer.Revision = 1
+		values, err := customerValues(customer)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO customers (`+customerColumns+`) VALUES (`+placeholders(14)+`)`, values...)
+		return err
+	})
+}
+
+// List live customers
+func (r postgresCustomerRepository) List(ctx context.Context) ([]*Customer, error) {
+	return r.query(ctx, pgConn(ctx, r.db), `SELECT `+customerColumns+` FROM customers WHERE deleted_at IS NULL ORDER BY id`)
+}
+
+func (r postgresCustomerRepository) query(ctx context.Context, db querier, query string, args ...interface{}) (results []*Customer, err error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, pgError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		customer, err := scanCustomer(rows)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, customer)
+	}
+	return results, pgError(rows.Err())
+}
+
+// Search a page of customers, scored when searched by relevance
+func (r postgresCustomerRepository) Search(ctx context.Context, q *Query, includeDeleted bool) (results []*Customer, page *Page, err error) {
+	q.Filter = withDeleted(q.Filter, includeDeleted)
+	p, err := pgPageQuery(customersTable, customerColumns, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	page, err = p.read(ctx, pgConn(ctx, r.db), q, func(rows *sql.Rows, relevance bool) (interface{}, error) {
+		var score float32
+		var extra []interface{}
+		if relevance {
+			extra = append(extra, &score)
+		}
+		customer, err := scanCustomer(rows, extra...)
+		if err != nil {
+			return nil, err
+		}
+		customer.Score = float64(score)
+		results = append(results, customer)
+		return customer, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return results, page, nil
+}
+
+// FuzzySearch a page of customers by a misspelt name, closest first. only
+// names are read to measure them, whole rows only for the page
+func (r postgresCustomerRepository) FuzzySearch(ctx context.Context, q *Query, name string, includeDeleted bool) ([]*Customer, *Page, error) {
+	query, maxDistance, err := fuzzyName(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	where := `deleted_at IS NULL`
+	if includeDeleted {
+		where = `TRUE`
+	}
+	rows, err := pgConn(ctx, r.db).QueryContext(ctx, `SELECT id, name_lower FROM customers WHERE `+where)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var matches []fuzzyMatch
+	for rows.Next() {
+		var id, nameLower string
+		if err = rows.Scan(&id, &nameLower); err != nil {
+			return nil, nil, err
+		}
+		if d := nameDistance(query, nameLower); d <= maxDistance {
+			matches = append(matches, fuzzyMatch{id: bson.ObjectIdHex(id), distance: d})
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	matches, page, err := pageMatches(matches, q)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ids := make([]bson.ObjectId, len(matches))
+	for i, m := range matches {
+		ids[i] = m.id
+	}
+	customers, err := r.query(ctx, pgConn(ctx, r.db), `SELECT `+customerColumns+` FROM customers WHERE id = ANY($1)`, pgStrings(ids))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return scoreMatches(matches, customers), page, nil
+}
+
+// SelectByID a live customer
+func (r postgresCustomerRepository) SelectByID(ctx context.Context, id bson.ObjectId) (*Customer, error) {
+	return scanCustomer(pgConn(ctx, r.db).QueryRowContext(ctx, `SELECT `+customerColumns+` FROM customers WHERE id = $1 AND deleted_at IS NULL`, id.Hex()))
+}
+
+// SelectByIDs the live customers among ids
+func (r postgresCustomerRepository) SelectByIDs(ctx context.Context, ids []bson.ObjectId) ([]*Customer, error) {
+	return r.query(ctx, pgConn(ctx, r.db), `SELECT `+customerColumns+` FROM customers WHERE id = ANY($1) AND deleted_at IS NULL ORDER BY id`, pgStrings(ids))
+}
+
+// SelectByNaturalKey a live customer by external reference, an unknown
+// reference falls back to the name of a customer that has none yet
+func (r postgresCustomerRepository) SelectByNaturalKey(ctx context.Context, externalRef string, name string) (*Customer, error) {
+	where := `name = $1 AND deleted_at IS NULL`
+	if externalRef != "" {
+		customer, err := scanCustomer(pgConn(ctx, r.db).QueryRowContext(ctx, `SELECT `+customerColumns+` FROM customers WHERE external_ref = $1 AND deleted_at IS NULL ORDER BY id LIMIT 1`, externalRef))
+		if err != mgo.ErrNotFound || name == "" {
+			return customer, err
+		}
+		where += ` AND external_ref = ''`
+	}
+	return scanCustomer(pgConn(ctx, r.db).QueryRowContext(ctx, `SELECT `+customerColumns+` FROM customers WHERE `+where, name))
+}
+
+// Update a customer at revision
+func (r postgresCustomerRepository) Update(ctx context.Context, id bson.ObjectId, update *Customer, revision int) (*Customer, error) {
+	err := inTx(ctx, r.db, func(tx *sql.Tx) error {
+		current, err := scanCustomer(tx.QueryRowContext(ctx, `SELECT `+customerColumns+` FROM customers WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`, id.Hex()))
+		if err != nil {
+			return err
+		}
+		if err = checkRevision(revision, current.Revision); err != nil {
+			return err
+		}
+		if err = update.validateProfile(); err != nil {
+			return err
+		}
+
+		update.normalize()
+		if update.Status == "" {
+			update.Status = current.Status
+		}
+		update.ID = id
+		update.Revision = current.Revision + 1
+		update.DeletedAt = nil
+		values, err := customerValues(update)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE customers SET `+assignments(customerColumns)+` WHERE id = $1`, values...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.SelectByID(ctx, id)
+}
+
+// Delete a customer at revision
+func (r postgresCustomerRepository) Delete(ctx context.Context, id bson.ObjectId, revision int) error {
+	return pgDelete(ctx, r.db, "customers", "", id, revision)
+}
+
+// Restore a deleted customer
+func (r postgresCustomerRepository) Restore(ctx context.Context, id bson.ObjectId) (*Customer, error) {
+	err := inTx(ctx, r.db, func(tx *sql.Tx) error {
+		return pgRestore(ctx, tx, "customers", id, "Customer is not deleted")
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.SelectByID(ctx, id)
+}
+
+// transaction runs the writes of an import at once
+func (r postgresCustomerRepository) transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return pgTransaction(ctx, r.db, fn)
+}
+
+// Purge a customer, its rules & their versions cascade
+func (r postgresCustomerRepository) Purge(ctx context.Context, id bson.ObjectId) error {
+	return pgPurge(ctx, r.db, "customers", id)
+}
+
+// liveRuleExists fails when customerID already has a live rule for productCode
+func liveRuleExists(ctx context.Context, tx *sql.Tx, customerID string, productCode string) error {
+	var exists bool
+	err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM pricing_rules WHERE customer_id = $1 AND product_code = $2 AND deleted_at IS NULL)`,
+		customerID, productCode).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errors.New("Rules already exists for the same customer & product_code")
+	}
+	return nil
+}
+
+// Create a rule, a customer has one live rule per product. the customer's
+// row stays locked until the rule is in so its rules are created one at a
+// time
+func (r postgresPricingRuleRepository) Create(ctx context.Context, rules *PricingRules) error {
+	if err := rules.validateTerms(); err != nil {
+		return err
+	}
+	if rules.ID == "" {
+		rules.ID = bson.NewObjectId()
+	}
+
+	return inTx(ctx, r.db, func(tx *sql.Tx) error {
+		var customerID string
+		err := tx.QueryRowContext(ctx, `SELECT id FROM customers WHERE id = $1 FOR UPDATE`, rules.CustomerID).Scan(&customerID)
+		if err == sql.ErrNoRows {
+			return errors.New("Customer does not exist")
+		}
+		if err != nil {
+			return err
+		}
+		if err = liveRuleExists(ctx, tx, rules.CustomerID, rules.ProductCode); err != nil {
+			return err
+		}
+
+		rules.Revision = 1
+		_, err = tx.ExecContext(ctx, `INSERT INTO pricing_rules (`+pricingRulesColumns+`) VALUES (`+placeholders(10)+`)`, pricingRulesValues(rules)...)
+		if err != nil {
+			return err
+		}
+
+		return pgAppendVersion(ctx, tx, "pricing_rules_versions", rules.ID, rules, time.Now())
+	})
+}
+
+func (r postgresPricingRuleRepository) query(ctx context.Context, query string, args ...interface{}) (results []*PricingRules, err error) {
+	rows, err := pgConn(ctx, r.db).QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, pgError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		rule, err := scanPricingRules(rows)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, rule)
+	}
+	return results, pgError(rows.Err())
+}
+
+// List a page of rules
+func (r postgresPricingRuleRepository) List(ctx context.Context, q *Query, includeDeleted bool) (results []*PricingRules, page *Page, err error) {
+	q.Filter = withDeleted(q.Filter, includeDeleted)
+	p, err := pgPageQuery(pricingRulesTable, pricingRulesColumns, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	page, err = p.read(ctx, pgConn(ctx, r.db), q, func(rows *sql.Rows, _ bool) (interface{}, error) {
+		rule, err := scanPricingRules(rows)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, rule)
+		return rule, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return results, page, nil
+}
+
+// Export every live rule, grouped by customer
+func (r postgresPricingRuleRepository) Export(ctx context.Context) ([]*PricingRules, error) {
+	return r.query(ctx, `SELECT `+pricingRulesColumns+` FROM pricing_rules WHERE deleted_at IS NULL ORDER BY customer_id, product_code`)
+}
+
+// SelectByID a live rule
+func (r postgresPricingRuleRepository) SelectByID(ctx context.Context, id bson.ObjectId) (*PricingRules, error) {
+	return scanPricingRules(pgConn(ctx, r.db).QueryRowContext(ctx, `SELECT `+pricingRulesColumns+` FROM pricing_rules WHERE id = $1 AND deleted_at IS NULL`, id.Hex()))
+}
+
+// SelectByCustomerID the live rules of a customer
+func (r postgresPricingRuleRepository) SelectByCustomerID(ctx context.Context, id string) ([]*PricingRules, error) {
+	return r.query(ctx, `SELECT `+pricingRulesColumns+` FROM pricing_rules WHERE customer_id = $1 AND deleted_at IS NULL ORDER BY id`, id)
+}
+
+// SelectByCustomerIDs the live rules of many customers
+func (r postgresPricingRuleRepository) SelectByCustomerIDs(ctx context.Context, ids []string) ([]*PricingRules, error) {
+	return r.query(ctx, `SELECT `+pricingRulesColumns+` FROM pricing_rules WHERE customer_id = ANY($1) AND deleted_at IS NULL ORDER BY id`, pq.Array(ids))
+}
+
+// Update a rule at revision
+func (r postgresPricingRuleRepository) Update(ctx context.Context, id bson.ObjectId, update *PricingRules, revision int) (*PricingRules, error) {
+	if err := update.validateTerms(); err != nil {
+		return nil, err
+	}
+	err := inTx(ctx, r.db, func(tx *sql.Tx) error {
+		current, err := lockRevision(ctx, tx, "pricing_rules", id)
+		if err != nil {
+			return err
+		}
+		if err = checkRevision(revision, current); err != nil {
+			return err
+		}
+
+		update.ID = id
+		update.Revision = current + 1
+		update.DeletedAt = nil
+		_, err = tx.ExecContext(ctx, `UPDATE pricing_rules SET `+assignments(pricingRulesColumns)+` WHERE id = $1`, pricingRulesValues(update)...)
+		if err != nil {
+			return err
+		}
+
+		return pgAppendVersion(ctx, tx, "pricing_rules_versions", id, update, time.Now())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.SelectByID(ctx, id)
+}
+
+// Delete a rule at revision
+func (r postgresPricingRuleRepository) Delete(ctx context.Context, id bson.ObjectId, revision int) error {
+	return pgDelete(ctx, r.db, "pricing_rules", "pricing_rules_versions", id, revision)
+}
+
+// Restore a deleted rule, unless a new rule has taken its place since
+func (r postgresPricingRuleRepository) Restore(ctx context.Context, id bson.ObjectId) (*PricingRules, error) {
+	err := inTx(ctx, r.db, func(tx *sql.Tx) error {
+		if err := pgRestore(ctx, tx, "pricing_rules", id, "Rules is not deleted"); err != nil {
+			return err
+		}
+		restored, err := scanPricingRules(tx.QueryRowContext(ctx, `SELECT `+pricingRulesColumns+` FROM pricing_rules WHERE id = $1`, id.Hex()))
+		if err != nil {
+			return err
+		}
+		return pgAppendVersion(ctx, tx, "pricing_rules_versions", id, restored, time.Now())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.SelectByID(ctx, id)
+}
+
+// transaction runs the writes of an import at once
+func (r postgresPricingRuleRepository) transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return pgTransaction(ctx, r.db, fn)
+}
+
+// Purge a rule & its versions
+func (r postgresPricingRuleRepository) Purge(ctx context.Context, id bson.ObjectId) error {
+	return pgPurge(ctx, r.db, "pricing_rules", id)
+}
+
+// ListVersions of a rule
+func (r postgresPricingRuleRepository) ListVersions(ctx context.Context, id bson.ObjectId) (results []*PricingRulesVersion, err error) {
+	err = pgVersions(ctx, pgConn(ctx, r.db), "pricing_rules_versions", `entity_id = $1`, []interface{}{id.Hex()}, func(v *pgVersion) error {
+		version := &PricingRulesVersion{ID: v.ID, RuleID: v.EntityID, Version: v.Version, EffectiveFrom: v.EffectiveFrom, EffectiveTo: v.EffectiveTo}
+		results = append(results, version)
+		return json.Unmarshal(v.document, &version.Rule)
+	})
+	return results, err
+}
+
+// SelectAsOf a rule as it was at
+func (r postgresPricingRuleRepository) SelectAsOf(ctx context.Context, id bson.ObjectId, at time.Time) (*PricingRules, error) {
+	results, err := r.asOf(ctx, asOfSQL+` AND entity_id = $2`, at, id.Hex())
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, mgo.ErrNotFound
+	}
+	return results[0], nil
+}
+
+// SelectByCustomerIDAsOf a customer's rules as they were at
+func (r postgresPricingRuleRepository) SelectByCustomerIDAsOf(ctx context.Context, id string, at time.Time) ([]*PricingRules, error) {
+	return r.asOf(ctx, asOfSQL+` AND document ->> 'customer_id' = $2`, at, id)
+}
+
+// SelectByCustomerIDsAsOf many customers' rules as they were at
+func (r postgresPricingRuleRepository) SelectByCustomerIDsAsOf(ctx context.Context, ids []string, at time.Time) ([]*PricingRules, error) {
+	return r.asOf(ctx, asOfSQL+` AND document ->> 'customer_id' = ANY($2)`, at, pq.Array(ids))
+}
+
+func (r postgresPricingRuleRepository) asOf(ctx context.Context, where string, args ...interface{}) (results []*PricingRules, err error) {
+	err = pgVersions(ctx, pgConn(ctx, r.db), "pricing_rules_versions", where, args, func(v *pgVersion) error {
+		rule := new(PricingRules)
+		results = append(results, rule)
+		return json.Unmarshal(v.document, rule)
+	})
+	return results, err
+}
@@ -0,0 +1,38 @@
+package model_test
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	"../model"
+	"./repotest"
+	_ "github.com/lib/pq"
+)
+
+// TEST_POSTGRES_URL is a throwaway database, its public schema is dropped
+// so the repositories start empty
+func TestPostgres(t *testing.T) {
+	url := os.Getenv("TEST_POSTGRES_URL")
+	if url == "" {
+		t.Skip("TEST_POSTGRES_URL is not set")
+	}
+
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`DROP SCHEMA public CASCADE; CREATE SCHEMA public`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := model.OpenPostgres(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	repotest.Run(t, store.Products(), store.Customers(), store.Rules())
+}
@@ -1,8 +1,9 @@
 package model
 
 import (
+	"context"
 	"errors"
-	"log"
+	"time"
 
 	"../config"
 	"github.com/globalsign/mgo"
@@ -20,32 +21,53 @@ type (
 		DealPriceOf   int           `json:"deal_priceof" form:"deal_priceof" bson:"deal_priceof" valid:"-"`
 		DiscountBuy   int           `json:"discount_buy" form:"discount_buy" bson:"discount_buy" valid:"-"`
 		DiscountPrice int           `json:"discount_price" form:"discount_price" bson:"discount_price" valid:"-"`
+		Revision      int           `json:"revision" form:"-" bson:"revision" valid:"-"`
+		DeletedAt     *time.Time    `json:"deleted_at,omitempty" form:"-" bson:"deleted_at,omitempty" valid:"-"`
 	}
 )
 
+// validateTerms checks the terms the struct tags can't reach, a deal of 0
+// would divide by zero when priced
+func (rules *PricingRules) validateTerms() error {
+	if rules.Type == "deal" && rules.DealBuy <= 0 {
+		return errors.New("deal_buy must be greater than 0 for deal rules")
+	}
+	if rules.DealBuy < 0 || rules.DealPriceOf < 0 || rules.DiscountBuy < 0 || rules.DiscountPrice < 0 {
+		return errors.New("deal_buy, deal_priceof, discount_buy & discount_price cannot be negative")
+	}
+	return nil
+}
+
 // PricingRulesIndexing to create indices
 // ----------------------------------------------------------------------
-func PricingRulesIndexing() {
+func PricingRulesIndexing() error {
 	c := DB.Copy().DB(config.DbName).C(config.PricingRulesCollection)
 	err := c.EnsureIndex(mgo.Index{
 		Key:    []string{"customer_id", "product_code", "type"},
 		Unique: false,
 	})
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	return nil
 }
 
 // CreatePricingRules Crud
 // ----------------------------------------------------------------------
-func CreatePricingRules(rules *PricingRules) (err error) {
+func CreatePricingRules(ctx context.Context, rules *PricingRules) (err error) {
 	db := DB.Clone()
 	defer db.Close()
+	defer operation(ctx, config.PricingRulesCollection, "CreatePricingRules")(&err)
 	c := db.DB(config.DbName).C(config.PricingRulesCollection)
 
+	if err = rules.validateTerms(); err != nil {
+		return err
+	}
+
 	numRows, err := c.Find(bson.M{
 		"customer_id":  rules.CustomerID,
 		"product_code": rules.ProductCode,
+		"deleted_at":   nil,
 	}).Count()
 	if err != nil {
 		return err
@@ -54,36 +76,47 @@ func CreatePricingRules(rules *PricingRules) (err error) {
 		return errors.New("Rules already exists for the same customer & product_code")
 	}
 
+	rules.Revision = 1
 	if err = c.Insert(rules); err != nil {
 		return errors.New("Creating Rules failed")
 	}
 
-	return err
+	err = appendVersion(db, config.PricingRulesVersionsCollection, rules.ID, rules, time.Now())
+	if err != nil {
+		return err
+	}
+
+	writeAudit(ctx, db, config.PricingRulesCollection, AuditCreate, rules.ID, nil, rules)
+
+	return nil
 }
 
 // ListPricingRules cRud
 // ----------------------------------------------------------------------
-func ListPricingRules() (results []*PricingRules, err error) {
+func ListPricingRules(ctx context.Context, q *Query, includeDeleted bool) (results []*PricingRules, page *Page, err error) {
 	db := DB.Clone()
 	defer db.Close()
+	defer operation(ctx, config.PricingRulesCollection, "ListPricingRules")(&err)
 	c := db.DB(config.DbName).C(config.PricingRulesCollection)
 
-	err = c.Find(nil).All(&results)
+	q.Filter = withDeleted(q.Filter, includeDeleted)
+	page, err = paginate(c, q, &results)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return results, err
+	return results, page, err
 }
 
 // SelectPricingRulesByID cRud
 // ----------------------------------------------------------------------
-func SelectPricingRulesByID(id bson.ObjectId) (result *PricingRules, err error) {
+func SelectPricingRulesByID(ctx context.Context, id bson.ObjectId) (result *PricingRules, err error) {
 	db := DB.Clone()
 	defer db.Close()
+	defer operation(ctx, config.PricingRulesCollection, "SelectPricingRulesByID")(&err)
 	c := db.DB(config.DbName).C(config.PricingRulesCollection)
 
-	err = c.FindId(id).One(&result)
+	err = c.Find(alive(id)).One(&result)
 	if err != nil {
 		return nil, err
 	}
@@ -93,12 +126,51 @@ func SelectPricingRulesByID(id bson.ObjectId) (result *PricingRules, err error)
 
 // SelectPricingRulesByCustomerID cRud
 // ----------------------------------------------------------------------
-func SelectPricingRulesByCustomerID(id string) (results []*PricingRules, err error) {
+func SelectPricingRulesByCustomerID(ctx context.Context, id string) (results []*PricingRules, err error) {
 	db := DB.Clone()
 	defer db.Close()
+	defer operation(ctx, config.PricingRulesCollection, "SelectPricingRulesByCustomerID")(&err)
 	c := db.DB(config.DbName).C(config.PricingRulesCollection)
 
-	err = c.Find(bson.M{"customer_id": id}).All(&results)
+	err = c.Find(bson.M{"customer_id": id, "deleted_at": nil}).All(&results)
+	if err != nil {
+		return nil, err
+	}
+	return results, err
+}
+
+// SelectPricingRulesIDsByCustomerID cRud
+// every rule of a customer, deleted ones included, by id only
+// ----------------------------------------------------------------------
+func SelectPricingRulesIDsByCustomerID(ctx context.Context, id string) (ids []bson.ObjectId, err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.PricingRulesCollection, "SelectPricingRulesIDsByCustomerID")(&err)
+	c := db.DB(config.DbName).C(config.PricingRulesCollection)
+
+	var docs []struct {
+		ID bson.ObjectId `bson:"_id"`
+	}
+	err = c.Find(bson.M{"customer_id": id}).Select(bson.M{"_id": 1}).All(&docs)
+	if err != nil {
+		return nil, err
+	}
+	for _, doc := range docs {
+		ids = append(ids, doc.ID)
+	}
+	return ids, err
+}
+
+// SelectPricingRulesByCustomerIDs cRud
+// the rules of many customers in one read
+// ----------------------------------------------------------------------
+func SelectPricingRulesByCustomerIDs(ctx context.Context, ids []string) (results []*PricingRules, err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.PricingRulesCollection, "SelectPricingRulesByCustomerIDs")(&err)
+	c := db.DB(config.DbName).C(config.PricingRulesCollection)
+
+	err = c.Find(bson.M{"customer_id": bson.M{"$in": ids}, "deleted_at": nil}).All(&results)
 	if err != nil {
 		return nil, err
 	}
@@ -107,12 +179,36 @@ func SelectPricingRulesByCustomerID(id string) (results []*PricingRules, err err
 
 // UpdatePricingRules crUd
 // ----------------------------------------------------------------------
-func UpdatePricingRules(id bson.ObjectId, update *PricingRules) (result *PricingRules, err error) {
+func UpdatePricingRules(ctx context.Context, id bson.ObjectId, update *PricingRules, revision int) (result *PricingRules, err error) {
 	db := DB.Clone()
 	defer db.Close()
+	defer operation(ctx, config.PricingRulesCollection, "UpdatePricingRules")(&err)
 	c := db.DB(config.DbName).C(config.PricingRulesCollection)
 
-	err = c.UpdateId(id, bson.M{"$set": update})
+	if err = update.validateTerms(); err != nil {
+		return nil, err
+	}
+
+	var current *PricingRules
+	err = c.Find(alive(id)).One(&current)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkRevision(revision, current.Revision); err != nil {
+		return nil, err
+	}
+	err = ensureVersioned(db, config.PricingRulesVersionsCollection, id, current)
+	if err != nil {
+		return nil, err
+	}
+
+	// only write over the revision that was checked
+	update.Revision = current.Revision + 1
+	update.DeletedAt = nil
+	err = c.Update(atRevision(id, current.Revision), bson.M{"$set": update})
+	if err == mgo.ErrNotFound {
+		return nil, ErrRevisionMismatch
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -122,20 +218,119 @@ func UpdatePricingRules(id bson.ObjectId, update *PricingRules) (result *Pricing
 		return nil, err
 	}
 
-	return result, err
+	err = appendVersion(db, config.PricingRulesVersionsCollection, id, result, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	writeAudit(ctx, db, config.PricingRulesCollection, AuditUpdate, id, current, result)
+
+	return result, nil
 }
 
 // DeletePricingRules cruD
 // ----------------------------------------------------------------------
-func DeletePricingRules(id bson.ObjectId) (err error) {
+func DeletePricingRules(ctx context.Context, id bson.ObjectId, revision int) (err error) {
 	db := DB.Clone()
 	defer db.Close()
+	defer operation(ctx, config.PricingRulesCollection, "DeletePricingRules")(&err)
 	c := db.DB(config.DbName).C(config.PricingRulesCollection)
 
-	err = c.RemoveId(id)
+	var current *PricingRules
+	err = c.Find(alive(id)).One(&current)
+	if err != nil {
+		return err
+	}
+	if err = checkRevision(revision, current.Revision); err != nil {
+		return err
+	}
+	err = ensureVersioned(db, config.PricingRulesVersionsCollection, id, current)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	err = markDeleted(c, id, current.Revision, now)
 	if err != nil {
 		return err
 	}
 
-	return err
+	err = closeVersion(db, config.PricingRulesVersionsCollection, id, now)
+	if err != nil {
+		return err
+	}
+
+	deleted := *current
+	deleted.Revision++
+	deleted.DeletedAt = &now
+	writeAudit(ctx, db, config.PricingRulesCollection, AuditDelete, id, current, &deleted)
+
+	return nil
+}
+
+// RestorePricingRules crUd
+// ----------------------------------------------------------------------
+func RestorePricingRules(ctx context.Context, id bson.ObjectId) (result *PricingRules, err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.PricingRulesCollection, "RestorePricingRules")(&err)
+	c := db.DB(config.DbName).C(config.PricingRulesCollection)
+
+	var current *PricingRules
+	err = c.FindId(id).One(&current)
+	if err != nil {
+		return nil, err
+	}
+	if current.DeletedAt == nil {
+		return nil, errors.New("Rules is not deleted")
+	}
+
+	// a new rule may have taken its place since
+	numRows, err := c.Find(bson.M{
+		"customer_id":  current.CustomerID,
+		"product_code": current.ProductCode,
+		"deleted_at":   nil,
+	}).Count()
+	if err != nil {
+		return nil, err
+	}
+	if numRows > 0 {
+		return nil, errors.New("Rules already exists for the same customer & product_code")
+	}
+
+	err = unmarkDeleted(c, id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.FindId(id).One(&result)
+	if err != nil {
+		return nil, err
+	}
+
+	err = appendVersion(db, config.PricingRulesVersionsCollection, id, result, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	writeAudit(ctx, db, config.PricingRulesCollection, AuditRestore, id, current, result)
+
+	return result, nil
+}
+
+// ExportPricingRules cRud
+// every live rule, grouped by customer
+// ----------------------------------------------------------------------
+func ExportPricingRules(ctx context.Context) (results []*PricingRules, err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.PricingRulesCollection, "ExportPricingRules")(&err)
+	c := db.DB(config.DbName).C(config.PricingRulesCollection)
+
+	err = c.Find(bson.M{"deleted_at": nil}).Sort("customer_id", "product_code").All(&results)
+	if err != nil {
+		return nil, err
+	}
+
+	return results, err
 }
@@ -1,67 +1,181 @@
 package model
 
 import (
+	"context"
 	"errors"
-	"log"
+	"time"
 
 	"../config"
 	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 )
 
+// ad features a product can grant
+const (
+	FeatureLogo         = "logo"
+	FeatureHighlight    = "highlight"
+	FeatureTopPlacement = "top_placement"
+)
+
+// product statuses
+const (
+	ProductActive  = "active"
+	ProductRetired = "retired"
+)
+
 type (
 	// Product struct
 	Product struct {
-		ID    bson.ObjectId `json:"id,omitempty" form:"id,omitempty" bson:"_id,omitempty"`
-		Code  string        `json:"code" form:"code" bson:"code" valid:"required"`
-		Name  string        `json:"name" form:"name" bson:"name" valid:"required"`
-		Price int           `json:"price" form:"price" bson:"price" valid:"int,required"`
+		ID           bson.ObjectId `json:"id,omitempty" form:"id,omitempty" bson:"_id,omitempty"`
+		Code         string        `json:"code" form:"code" bson:"code" valid:"required"`
+		Name         string        `json:"name" form:"name" bson:"name" valid:"required"`
+		Description  string        `json:"description" form:"description" bson:"description" valid:"-"`
+		Price        int           `json:"price" form:"price" bson:"price" valid:"int,required"`
+		DurationDays int           `json:"duration_days" form:"duration_days" bson:"duration_days" valid:"-"`
+		Features     []string      `json:"features" form:"features" bson:"features" valid:"-"`
+		Status       string        `json:"status" form:"status" bson:"status" valid:"required,in(active|retired)"`
+		DisplayOrder int           `json:"display_order" form:"display_order" bson:"display_order" valid:"-"`
+		Tags         []string      `json:"tags" form:"tags" bson:"tags" valid:"-"`
+		Revision     int           `json:"revision" form:"-" bson:"revision" valid:"-"`
+		DeletedAt    *time.Time    `json:"deleted_at,omitempty" form:"-" bson:"deleted_at,omitempty" valid:"-"`
 	}
 )
 
+// IsRetired retired products stay on historical orders but can't be bought
+func (p *Product) IsRetired() bool {
+	return p.Status == ProductRetired
+}
+
+// AdRank is search ranking of ads posted with this product, top placement
+// outranks highlighting which outranks plain ads
+func (p *Product) AdRank() int {
+	rank := 1
+	for _, f := range p.Features {
+		if f == FeatureTopPlacement && rank < 3 {
+			rank = 3
+		}
+		if f == FeatureHighlight && rank < 2 {
+			rank = 2
+		}
+	}
+	return rank
+}
+
+// validateFeatures to reject features the job ads don't know about
+func validateFeatures(features []string) error {
+	for _, f := range features {
+		switch f {
+		case FeatureLogo, FeatureHighlight, FeatureTopPlacement:
+		default:
+			return errors.New("Unknown product feature " + f)
+		}
+	}
+	return nil
+}
+
+// legacyDurationDays is how long ads of products created before durations
+// existed run
+const legacyDurationDays = 30
+
+// legacyFeatures granted by the products sold before features existed,
+// others had none
+var legacyFeatures = map[string][]string{
+	"classic":  {},
+	"standout": {FeatureLogo, FeatureHighlight},
+	"premium":  {FeatureLogo, FeatureHighlight, FeatureTopPlacement},
+}
+
 // ProductIndexing to create indices
 // ----------------------------------------------------------------------
-func ProductIndexing() {
+func ProductIndexing() error {
 	c := DB.Copy().DB(config.DbName).C(config.ProductsCollection)
 	err := c.EnsureIndex(mgo.Index{
 		Key:    []string{"code"},
 		Unique: true,
 	})
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	err = c.EnsureIndex(mgo.Index{
+		Key:    []string{"status", "display_order"},
+		Unique: false,
+	})
+	if err != nil {
+		return err
+	}
+
+	// products created before ads had a duration & features, so they can
+	// still be posted & rank as they were sold
+	var product *Product
+	iter := c.Find(bson.M{"duration_days": bson.M{"$exists": false}}).Iter()
+	for iter.Next(&product) {
+		set := bson.M{"duration_days": legacyDurationDays}
+		if product.Features == nil {
+			features, ok := legacyFeatures[product.Code]
+			if !ok {
+				features = []string{}
+			}
+			set["features"] = features
+		}
+		err = c.UpdateId(product.ID, bson.M{"$set": set})
+		if err != nil {
+			return err
+		}
 	}
+	if err = iter.Close(); err != nil {
+		return err
+	}
+	return nil
 }
 
 // CreateProduct Crud
 // ----------------------------------------------------------------------
-func CreateProduct(product *Product) (err error) {
+func CreateProduct(ctx context.Context, product *Product) (err error) {
 	db := DB.Clone()
 	defer db.Close()
+	defer operation(ctx, config.ProductsCollection, "CreateProduct")(&err)
 	c := db.DB(config.DbName).C(config.ProductsCollection)
 
-	numRows, err := c.Find(bson.M{"code": product.Code}).Count()
-	if err != nil {
+	if err = validateFeatures(product.Features); err != nil {
 		return err
 	}
-	if numRows > 0 {
+
+	var existing *Product
+	err = c.Find(bson.M{"code": product.Code}).One(&existing)
+	if err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	if existing != nil && existing.DeletedAt != nil {
+		return errors.New("Product Code belongs to a deleted product, restore it instead")
+	}
+	if existing != nil {
 		return errors.New("Product Code already exists")
 	}
 
+	product.Revision = 1
 	if err = c.Insert(product); err != nil {
 		return errors.New("Creating Product failed")
 	}
 
-	return err
+	err = appendVersion(db, config.ProductVersionsCollection, product.ID, product, time.Now())
+	if err != nil {
+		return err
+	}
+
+	writeAudit(ctx, db, config.ProductsCollection, AuditCreate, product.ID, nil, product)
+
+	return nil
 }
 
 // ListProduct cRud
 // ----------------------------------------------------------------------
-func ListProduct() (results []*Product, err error) {
+func ListProduct(ctx context.Context) (results []*Product, err error) {
 	db := DB.Clone()
 	defer db.Close()
+	defer operation(ctx, config.ProductsCollection, "ListProduct")(&err)
 	c := db.DB(config.DbName).C(config.ProductsCollection)
 
-	err = c.Find(nil).All(&results)
+	err = c.Find(bson.M{"deleted_at": nil}).Sort("display_order", "code").All(&results)
 	if err != nil {
 		return nil, err
 	}
@@ -69,14 +183,48 @@ func ListProduct() (results []*Product, err error) {
 	return results, err
 }
 
+// SearchProduct cRud
+// ----------------------------------------------------------------------
+func SearchProduct(ctx context.Context, q *Query, includeDeleted bool) (results []*Product, page *Page, err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.ProductsCollection, "SearchProduct")(&err)
+	c := db.DB(config.DbName).C(config.ProductsCollection)
+
+	q.Filter = withDeleted(q.Filter, includeDeleted)
+	page, err = paginate(c, q, &results)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return results, page, err
+}
+
 // SelectProductByID cRud
 // ----------------------------------------------------------------------
-func SelectProductByID(id bson.ObjectId) (result *Product, err error) {
+func SelectProductByID(ctx context.Context, id bson.ObjectId) (result *Product, err error) {
 	db := DB.Clone()
 	defer db.Close()
+	defer operation(ctx, config.ProductsCollection, "SelectProductByID")(&err)
 	c := db.DB(config.DbName).C(config.ProductsCollection)
 
-	err = c.FindId(id).One(&result)
+	err = c.Find(alive(id)).One(&result)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, err
+}
+
+// SelectProductByCode cRud
+// ----------------------------------------------------------------------
+func SelectProductByCode(ctx context.Context, code string) (result *Product, err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.ProductsCollection, "SelectProductByCode")(&err)
+	c := db.DB(config.DbName).C(config.ProductsCollection)
+
+	err = c.Find(bson.M{"code": code, "deleted_at": nil}).One(&result)
 	if err != nil {
 		return nil, err
 	}
@@ -86,12 +234,36 @@ func SelectProductByID(id bson.ObjectId) (result *Product, err error) {
 
 // UpdateProduct crUd
 // ----------------------------------------------------------------------
-func UpdateProduct(id bson.ObjectId, update *Product) (result *Product, err error) {
+func UpdateProduct(ctx context.Context, id bson.ObjectId, update *Product, revision int) (result *Product, err error) {
 	db := DB.Clone()
 	defer db.Close()
+	defer operation(ctx, config.ProductsCollection, "UpdateProduct")(&err)
 	c := db.DB(config.DbName).C(config.ProductsCollection)
 
-	err = c.UpdateId(id, bson.M{"$set": update})
+	if err = validateFeatures(update.Features); err != nil {
+		return nil, err
+	}
+
+	var current *Product
+	err = c.Find(alive(id)).One(&current)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkRevision(revision, current.Revision); err != nil {
+		return nil, err
+	}
+	err = ensureVersioned(db, config.ProductVersionsCollection, id, current)
+	if err != nil {
+		return nil, err
+	}
+
+	// only write over the revision that was checked
+	update.Revision = current.Revision + 1
+	update.DeletedAt = nil
+	err = c.Update(atRevision(id, current.Revision), bson.M{"$set": update})
+	if err == mgo.ErrNotFound {
+		return nil, ErrRevisionMismatch
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -101,20 +273,89 @@ func UpdateProduct(id bson.ObjectId, update *Product) (result *Product, err erro
 		return nil, err
 	}
 
-	return result, err
+	err = appendVersion(db, config.ProductVersionsCollection, id, result, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	writeAudit(ctx, db, config.ProductsCollection, AuditUpdate, id, current, result)
+
+	return result, nil
 }
 
 // DeleteProduct cruD
 // ----------------------------------------------------------------------
-func DeleteProduct(id bson.ObjectId) (err error) {
+func DeleteProduct(ctx context.Context, id bson.ObjectId, revision int) (err error) {
 	db := DB.Clone()
 	defer db.Close()
+	defer operation(ctx, config.ProductsCollection, "DeleteProduct")(&err)
 	c := db.DB(config.DbName).C(config.ProductsCollection)
 
-	err = c.RemoveId(id)
+	var current *Product
+	err = c.Find(alive(id)).One(&current)
+	if err != nil {
+		return err
+	}
+	if err = checkRevision(revision, current.Revision); err != nil {
+		return err
+	}
+	err = ensureVersioned(db, config.ProductVersionsCollection, id, current)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	err = markDeleted(c, id, current.Revision, now)
+	if err != nil {
+		return err
+	}
+
+	err = closeVersion(db, config.ProductVersionsCollection, id, now)
 	if err != nil {
 		return err
 	}
 
-	return err
+	deleted := *current
+	deleted.Revision++
+	deleted.DeletedAt = &now
+	writeAudit(ctx, db, config.ProductsCollection, AuditDelete, id, current, &deleted)
+
+	return nil
+}
+
+// RestoreProduct crUd
+// ----------------------------------------------------------------------
+func RestoreProduct(ctx context.Context, id bson.ObjectId) (result *Product, err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.ProductsCollection, "RestoreProduct")(&err)
+	c := db.DB(config.DbName).C(config.ProductsCollection)
+
+	var current *Product
+	err = c.FindId(id).One(&current)
+	if err != nil {
+		return nil, err
+	}
+	if current.DeletedAt == nil {
+		return nil, errors.New("Product is not deleted")
+	}
+
+	err = unmarkDeleted(c, id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.FindId(id).One(&result)
+	if err != nil {
+		return nil, err
+	}
+
+	err = appendVersion(db, config.ProductVersionsCollection, id, result, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	writeAudit(ctx, db, config.ProductsCollection, AuditRestore, id, current, result)
+
+	return result, nil
 }
@@ -13,4 +13,19 @@ type (
 		Premium    int           `json:"premium" form:"premium" bson:"premium" valid:"int,optional"`
 		Total      int           `json:"total,omitempty" form:"total,omitempty" bson:"total,omitempty"`
 	}
+
+	// BatchPurchase struct, either priced items each with their own
+	// customer, or one basket priced for every customer listed
+	BatchPurchase struct {
+		Items       []*Purchase `json:"items" valid:"-"`
+		Basket      *Purchase   `json:"basket,omitempty" valid:"-"`
+		CustomerIDs []string    `json:"customer_ids" valid:"-"`
+	}
+
+	// PurchaseResult struct, one priced item of a batch
+	PurchaseResult struct {
+		Index int `json:"index"`
+		*Purchase
+		Error string `json:"error,omitempty"`
+	}
 )
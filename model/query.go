@@ -0,0 +1,228 @@
+package model
+
+import (
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// SortRelevance orders full-text matches by score, best first
+const SortRelevance = "$textScore"
+
+// SortDistance orders fuzzy matches by edit distance, closest first
+const SortDistance = "$distance"
+
+// ErrInvalidCursor when a cursor was not issued by a previous page
+var ErrInvalidCursor = errors.New("cursor is invalid")
+
+type (
+	// Query struct, which page of a listing to read
+	Query struct {
+		Filter    bson.M
+		Sort      string
+		Limit     int
+		Cursor    string
+		WithTotal bool
+	}
+
+	// Page struct, where a listing page ends
+	Page struct {
+		NextCursor string
+		Total      int
+	}
+
+	// cursor struct, position after the last document of a page in the
+	// order of Sort
+	cursor struct {
+		Sort  string        `bson:"s"`
+		Value interface{}   `bson:"v"`
+		ID    bson.ObjectId `bson:"id"`
+	}
+)
+
+// sortField splits "-price" into price & descending
+func sortField(sort string) (field string, desc bool) {
+	if sort == "" {
+		return "_id", false
+	}
+	if strings.HasPrefix(sort, "-") {
+		return sort[1:], true
+	}
+	return sort, false
+}
+
+// encodeCursor to hand out a position in the order of sort, opaque to
+// clients
+func encodeCursor(sort string, value interface{}, id bson.ObjectId) (string, error) {
+	raw, err := bson.Marshal(cursor{Sort: sort, Value: value, ID: id})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// decodeCursor reads back a position handed out by encodeCursor for the
+// same sort. clients hold cursors, so the value must be a plain scalar: a
+// document would go into the query as operators
+func decodeCursor(s string, sort string) (*cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	cur := new(cursor)
+	if err = bson.Unmarshal(raw, cur); err != nil || !cur.ID.Valid() || cur.Sort != sort {
+		return nil, ErrInvalidCursor
+	}
+	switch cur.Value.(type) {
+	case nil, string, bool, int, int64, float64, time.Time, bson.ObjectId:
+		return cur, nil
+	}
+	return nil, ErrInvalidCursor
+}
+
+// after matches documents sorted after the cursor, ties broken by _id
+func after(field string, desc bool, cur *cursor) bson.M {
+	op := "$gt"
+	if desc {
+		op = "$lt"
+	}
+	if field == "_id" {
+		return bson.M{"_id": bson.M{op: cur.ID}}
+	}
+	return bson.M{"$or": []bson.M{
+		{field: bson.M{op: cur.Value}},
+		{field: cur.Value, "_id": bson.M{op: cur.ID}},
+	}}
+}
+
+// paginate reads one page of q from c into results, a pointer to a slice
+// of document pointers, with keyset pagination on the sort field & _id
+func paginate(c *mgo.Collection, q *Query, results interface{}) (page *Page, err error) {
+	field, desc := sortField(q.Sort)
+	page = &Page{Total: -1}
+
+	if q.WithTotal {
+		if page.Total, err = c.Find(q.Filter).Count(); err != nil {
+			return nil, err
+		}
+	}
+
+	if q.Sort == SortRelevance {
+		return paginateRelevance(c, q, page, results)
+	}
+
+	filter := q.Filter
+	if q.Cursor != "" {
+		cur, err := decodeCursor(q.Cursor, q.Sort)
+		if err != nil {
+			return nil, err
+		}
+		filter = bson.M{"$and": []bson.M{q.Filter, after(field, desc, cur)}}
+	}
+
+	sort := []string{field, "_id"}
+	if desc {
+		sort = []string{"-" + field, "-_id"}
+	}
+
+	// one extra to know whether there is a next page
+	var raws []bson.Raw
+	err = c.Find(filter).Sort(sort...).Limit(q.Limit + 1).All(&raws)
+	if err != nil {
+		return nil, err
+	}
+	more := len(raws) > q.Limit
+	if more {
+		raws = raws[:q.Limit]
+	}
+
+	if err = fill(raws, results); err != nil {
+		return nil, err
+	}
+
+	if more {
+		var last bson.M
+		if err = raws[len(raws)-1].Unmarshal(&last); err != nil {
+			return nil, err
+		}
+		id, _ := last["_id"].(bson.ObjectId)
+		if page.NextCursor, err = encodeCursor(q.Sort, last[field], id); err != nil {
+			return nil, err
+		}
+	}
+
+	return page, nil
+}
+
+// paginateRelevance reads one page of a full-text query ordered by score,
+// scores aren't unique so its cursor holds an offset instead of a key
+func paginateRelevance(c *mgo.Collection, q *Query, page *Page, results interface{}) (*Page, error) {
+	offset := 0
+	if q.Cursor != "" {
+		cur, err := decodeCursor(q.Cursor, q.Sort)
+		if err != nil {
+			return nil, err
+		}
+		switch v := cur.Value.(type) {
+		case int:
+			offset = v
+		case int64:
+			offset = int(v)
+		default:
+			return nil, ErrInvalidCursor
+		}
+	}
+
+	var raws []bson.Raw
+	err := c.Find(q.Filter).
+		Select(bson.M{"score": bson.M{"$meta": "textScore"}}).
+		Sort("$textScore:score").
+		Skip(offset).
+		Limit(q.Limit + 1).
+		All(&raws)
+	if err != nil {
+		return nil, err
+	}
+	more := len(raws) > q.Limit
+	if more {
+		raws = raws[:q.Limit]
+	}
+
+	if err = fill(raws, results); err != nil {
+		return nil, err
+	}
+
+	if more {
+		var last struct {
+			ID bson.ObjectId `bson:"_id"`
+		}
+		if err = raws[len(raws)-1].Unmarshal(&last); err != nil {
+			return nil, err
+		}
+		if page.NextCursor, err = encodeCursor(q.Sort, offset+q.Limit, last.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	return page, nil
+}
+
+// fill decodes raws into results, a pointer to a slice of document pointers
+func fill(raws []bson.Raw, results interface{}) error {
+	slice := reflect.ValueOf(results).Elem()
+	elemType := slice.Type().Elem().Elem()
+	slice.Set(reflect.MakeSlice(slice.Type(), 0, len(raws)))
+	for _, raw := range raws {
+		elem := reflect.New(elemType)
+		if err := raw.Unmarshal(elem.Interface()); err != nil {
+			return err
+		}
+		slice.Set(reflect.Append(slice, elem))
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package model
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestDecodeCursorRoundTrip(t *testing.T) {
+	id := bson.NewObjectId()
+	at := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	values := []interface{}{nil, "classic", 42, 3.5, true, at, bson.NewObjectId()}
+	for _, value := range values {
+		s, err := encodeCursor("-price", value, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cur, err := decodeCursor(s, "-price")
+		if err != nil {
+			t.Fatalf("%v: %v", value, err)
+		}
+		if cur.ID != id {
+			t.Errorf("%v: id %v, want %v", value, cur.ID, id)
+		}
+		if v, ok := cur.Value.(time.Time); ok {
+			if !v.Equal(at) {
+				t.Errorf("value %v, want %v", v, at)
+			}
+		} else if cur.Value != value {
+			t.Errorf("value %v, want %v", cur.Value, value)
+		}
+	}
+}
+
+func TestDecodeCursorOtherSort(t *testing.T) {
+	s, err := encodeCursor("price", 10, bson.NewObjectId())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = decodeCursor(s, "-price"); err != ErrInvalidCursor {
+		t.Errorf("got %v, want %v", err, ErrInvalidCursor)
+	}
+}
+
+func TestDecodeCursorRejectsDocuments(t *testing.T) {
+	// a client crafting a cursor whose value is an operator document
+	values := []interface{}{
+		bson.M{"$gt": ""},
+		[]interface{}{"a", "b"},
+	}
+	for _, value := range values {
+		s, err := encodeCursor("name", value, bson.NewObjectId())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = decodeCursor(s, "name"); err != ErrInvalidCursor {
+			t.Errorf("%v: got %v, want %v", value, err, ErrInvalidCursor)
+		}
+	}
+}
+
+func TestDecodeCursorMalformed(t *testing.T) {
+	noID, err := bson.Marshal(bson.M{"s": "name", "v": "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursors := []string{
+		"",
+		"not base64!",
+		base64.RawURLEncoding.EncodeToString([]byte("not bson")),
+		base64.RawURLEncoding.EncodeToString(noID),
+	}
+	for _, s := range cursors {
+		if _, err := decodeCursor(s, "name"); err != ErrInvalidCursor {
+			t.Errorf("%q: got %v, want %v", s, err, ErrInvalidCursor)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"../config"
+	"../limiter"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// rateLimitAttempts bounds retries when instances race on one bucket
+const rateLimitAttempts = 5
+
+type (
+	// RateLimitStore shares rate limit buckets across instances through mongo
+	RateLimitStore struct{}
+
+	rateLimitBucket struct {
+		Key            string `bson:"_id"`
+		limiter.Bucket `bson:",inline"`
+	}
+)
+
+// RateLimitIndexing to create indices
+// ----------------------------------------------------------------------
+func RateLimitIndexing() error {
+	c := DB.Copy().DB(config.DbName).C(config.RateLimitsCollection)
+	// idle buckets have long refilled, mongo drops them
+	err := c.EnsureIndex(mgo.Index{
+		Key:         []string{"updated_at"},
+		ExpireAfter: time.Hour,
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Take a token from key's bucket, the bucket is only written over the state
+// it was read at so concurrent takes on other instances are never lost
+func (RateLimitStore) Take(ctx context.Context, key string, limit limiter.Limit) (result *limiter.Result, err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.RateLimitsCollection, "RateLimitStore.Take")(&err)
+	c := db.DB(config.DbName).C(config.RateLimitsCollection)
+
+	for attempt := 0; attempt < rateLimitAttempts; attempt++ {
+		// mongo keeps milliseconds, so compare against what it stores
+		now := time.Now().Truncate(time.Millisecond)
+
+		var bucket rateLimitBucket
+		err := c.FindId(key).One(&bucket)
+		if err == mgo.ErrNotFound {
+			bucket.Key = key
+			result := bucket.Take(limit, now)
+			err = c.Insert(&bucket)
+			if mgo.IsDup(err) {
+				continue
+			}
+			return result, err
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		read := bucket.UpdatedAt
+		result := bucket.Take(limit, now)
+		err = c.Update(bson.M{"_id": key, "updated_at": read}, bson.M{"$set": bson.M{
+			"tokens":     bucket.Tokens,
+			"updated_at": bucket.UpdatedAt,
+		}})
+		if err == mgo.ErrNotFound {
+			continue
+		}
+		return result, err
+	}
+
+	return nil, errors.New("Rate limit bucket " + key + " is too contended")
+}
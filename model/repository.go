@@ -0,0 +1,62 @@
+package model
+
+import (
+	"context"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+type (
+	// ProductRepository is where products are kept
+	ProductRepository interface {
+		Create(ctx context.Context, product *Product) error
+		List(ctx context.Context) ([]*Product, error)
+		Search(ctx context.Context, q *Query, includeDeleted bool) ([]*Product, *Page, error)
+		SelectByID(ctx context.Context, id bson.ObjectId) (*Product, error)
+		SelectByCode(ctx context.Context, code string) (*Product, error)
+		Update(ctx context.Context, id bson.ObjectId, update *Product, revision int) (*Product, error)
+		Delete(ctx context.Context, id bson.ObjectId, revision int) error
+		Restore(ctx context.Context, id bson.ObjectId) (*Product, error)
+		// Purge removes a product for good, history included
+		Purge(ctx context.Context, id bson.ObjectId) error
+		ListVersions(ctx context.Context, id bson.ObjectId) ([]*ProductVersion, error)
+		SelectAsOf(ctx context.Context, id bson.ObjectId, at time.Time) (*Product, error)
+		ListAsOf(ctx context.Context, at time.Time) ([]*Product, error)
+	}
+
+	// CustomerRepository is where customers are kept
+	CustomerRepository interface {
+		Create(ctx context.Context, customer *Customer) error
+		List(ctx context.Context) ([]*Customer, error)
+		Search(ctx context.Context, q *Query, includeDeleted bool) ([]*Customer, *Page, error)
+		FuzzySearch(ctx context.Context, q *Query, name string, includeDeleted bool) ([]*Customer, *Page, error)
+		SelectByID(ctx context.Context, id bson.ObjectId) (*Customer, error)
+		SelectByIDs(ctx context.Context, ids []bson.ObjectId) ([]*Customer, error)
+		SelectByNaturalKey(ctx context.Context, externalRef string, name string) (*Customer, error)
+		Update(ctx context.Context, id bson.ObjectId, update *Customer, revision int) (*Customer, error)
+		Delete(ctx context.Context, id bson.ObjectId, revision int) error
+		Restore(ctx context.Context, id bson.ObjectId) (*Customer, error)
+		// Purge removes a customer for good, its pricing rules along
+		Purge(ctx context.Context, id bson.ObjectId) error
+	}
+
+	// PricingRuleRepository is where customer pricing rules are kept
+	PricingRuleRepository interface {
+		Create(ctx context.Context, rules *PricingRules) error
+		List(ctx context.Context, q *Query, includeDeleted bool) ([]*PricingRules, *Page, error)
+		Export(ctx context.Context) ([]*PricingRules, error)
+		SelectByID(ctx context.Context, id bson.ObjectId) (*PricingRules, error)
+		SelectByCustomerID(ctx context.Context, id string) ([]*PricingRules, error)
+		SelectByCustomerIDs(ctx context.Context, ids []string) ([]*PricingRules, error)
+		Update(ctx context.Context, id bson.ObjectId, update *PricingRules, revision int) (*PricingRules, error)
+		Delete(ctx context.Context, id bson.ObjectId, revision int) error
+		Restore(ctx context.Context, id bson.ObjectId) (*PricingRules, error)
+		// Purge removes a rule for good, history included
+		Purge(ctx context.Context, id bson.ObjectId) error
+		ListVersions(ctx context.Context, id bson.ObjectId) ([]*PricingRulesVersion, error)
+		SelectAsOf(ctx context.Context, id bson.ObjectId, at time.Time) (*PricingRules, error)
+		SelectByCustomerIDAsOf(ctx context.Context, id string, at time.Time) ([]*PricingRules, error)
+		SelectByCustomerIDsAsOf(ctx context.Context, ids []string, at time.Time) ([]*PricingRules, error)
+	}
+)
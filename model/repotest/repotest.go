@@ -0,0 +1,525 @@
+// Package repotest checks that a storage backend keeps products, customers &
+// pricing rules the way the mongo one does. the tests of every backend call
+// Run, the repositories handed to it have to be empty
+package repotest
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"../../model"
+	"github.com/globalsign/mgo/bson"
+)
+
+// Run every check against the repositories as a subtest of t, a check stops
+// at the first thing that doesn't hold & the ones after it build on it so
+// they are skipped
+func Run(t *testing.T, products model.ProductRepository, customers model.CustomerRepository, rules model.PricingRuleRepository) {
+	t.Helper()
+	checks := []struct {
+		name string
+		fn   func() error
+	}{
+		{"products", func() error { return checkProducts(products) }},
+		{"product listing", func() error { return checkProductListing(products) }},
+		{"customers", func() error { return checkCustomers(customers) }},
+		{"pricing rules", func() error { return checkPricingRules(customers, rules) }},
+	}
+	for _, check := range checks {
+		fn := check.fn
+		if !t.Run(check.name, func(t *testing.T) {
+			if err := fn(); err != nil {
+				t.Fatal(err)
+			}
+		}) {
+			t.FailNow()
+		}
+	}
+}
+
+// fail with got & want shown side by side
+func fail(what string, got interface{}, want interface{}) error {
+	return errors.New(what + ": got " + show(got) + ", want " + show(want))
+}
+
+func show(v interface{}) string {
+	switch s := v.(type) {
+	case string:
+		return strconv.Quote(s)
+	case int:
+		return strconv.Itoa(s)
+	case bool:
+		return strconv.FormatBool(s)
+	case error:
+		if s == nil {
+			return "no error"
+		}
+		return s.Error()
+	case nil:
+		return "nil"
+	}
+	return "?"
+}
+
+func checkProducts(products model.ProductRepository) error {
+	ctx := context.Background()
+
+	classic := &model.Product{ID: bson.NewObjectId(), Code: "classic", Name: "Classic Ad", Price: 26999, Status: model.ProductActive}
+	if err := products.Create(ctx, classic); err != nil {
+		return err
+	}
+	if classic.Revision != 1 {
+		return fail("revision after create", classic.Revision, 1)
+	}
+	created := time.Now()
+
+	found, err := products.SelectByCode(ctx, "classic")
+	if err != nil {
+		return err
+	}
+	if found.ID != classic.ID || found.Name != "Classic Ad" {
+		return fail("select by code", found.Name, "Classic Ad")
+	}
+	if err = products.Create(ctx, &model.Product{ID: bson.NewObjectId(), Code: "classic", Name: "Copy", Price: 1, Status: model.ProductActive}); err == nil {
+		return fail("duplicate code", err, "an error")
+	}
+	if err = products.Create(ctx, &model.Product{ID: bson.NewObjectId(), Code: "badge", Name: "Badge", Price: 1, Status: model.ProductActive, Features: []string{"sparkles"}}); err == nil {
+		return fail("unknown feature", err, "an error")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	update := *classic
+	update.Name = "Classic"
+	if _, err = products.Update(ctx, classic.ID, &update, 7); err != model.ErrRevisionMismatch {
+		return fail("update at a stale revision", err, model.ErrRevisionMismatch)
+	}
+	updated, err := products.Update(ctx, classic.ID, &update, 1)
+	if err != nil {
+		return err
+	}
+	if updated.Revision != 2 || updated.Name != "Classic" {
+		return fail("name after update", updated.Name, "Classic")
+	}
+
+	standout := &model.Product{ID: bson.NewObjectId(), Code: "standout", Name: "Standout Ad", Price: 32299, Status: model.ProductActive}
+	if err = products.Create(ctx, standout); err != nil {
+		return err
+	}
+	taken := *standout
+	taken.Code = "classic"
+	if _, err = products.Update(ctx, standout.ID, &taken, model.AnyRevision); err == nil {
+		return fail("update to a taken code", err, "an error")
+	}
+
+	versions, err := products.ListVersions(ctx, classic.ID)
+	if err != nil {
+		return err
+	}
+	if len(versions) != 2 || versions[0].Version != 1 || versions[1].Version != 2 {
+		return fail("versions", len(versions), 2)
+	}
+	before, err := products.SelectAsOf(ctx, classic.ID, created)
+	if err != nil {
+		return err
+	}
+	if before.Name != "Classic Ad" {
+		return fail("name as of before update", before.Name, "Classic Ad")
+	}
+	asOf, err := products.ListAsOf(ctx, created)
+	if err != nil {
+		return err
+	}
+	if len(asOf) != 1 {
+		return fail("products as of before standout", len(asOf), 1)
+	}
+
+	if err = products.Delete(ctx, classic.ID, 1); err != model.ErrRevisionMismatch {
+		return fail("delete at a stale revision", err, model.ErrRevisionMismatch)
+	}
+	if err = products.Delete(ctx, classic.ID, 2); err != nil {
+		return err
+	}
+	if _, err = products.SelectByID(ctx, classic.ID); err == nil {
+		return fail("select deleted", err, "an error")
+	}
+	if err = products.Create(ctx, &model.Product{ID: bson.NewObjectId(), Code: "classic", Name: "Copy", Price: 1, Status: model.ProductActive}); err == nil {
+		return fail("code of a deleted product", err, "an error")
+	}
+	live, err := products.List(ctx)
+	if err != nil {
+		return err
+	}
+	if len(live) != 1 || live[0].Code != "standout" {
+		return fail("live products", len(live), 1)
+	}
+	restored, err := products.Restore(ctx, classic.ID)
+	if err != nil {
+		return err
+	}
+	if restored.DeletedAt != nil || restored.Revision != 4 {
+		return fail("revision after restore", restored.Revision, 4)
+	}
+	if _, err = products.Restore(ctx, classic.ID); err == nil {
+		return fail("restore a live product", err, "an error")
+	}
+
+	for _, id := range []bson.ObjectId{classic.ID, standout.ID} {
+		if err = products.Purge(ctx, id); err != nil {
+			return err
+		}
+	}
+	if _, err = products.SelectByID(ctx, classic.ID); err == nil {
+		return fail("select purged", err, "an error")
+	}
+	if versions, err = products.ListVersions(ctx, classic.ID); err != nil || len(versions) != 0 {
+		return fail("versions after purge", len(versions), 0)
+	}
+
+	return nil
+}
+
+func checkProductListing(products model.ProductRepository) error {
+	ctx := context.Background()
+
+	for i := 1; i <= 7; i++ {
+		product := &model.Product{
+			ID:           bson.NewObjectId(),
+			Code:         "p" + strconv.Itoa(i),
+			Name:         "Product " + strconv.Itoa(i),
+			Price:        1000 * (i % 4),
+			Status:       model.ProductActive,
+			DisplayOrder: i,
+			Tags:         []string{"all"},
+		}
+		if i%2 == 0 {
+			product.Status = model.ProductRetired
+			product.Tags = append(product.Tags, "even")
+		}
+		if err := products.Create(ctx, product); err != nil {
+			return err
+		}
+	}
+
+	// prices 1000 2000 3000 0 1000 2000 3000, ties broken by creation
+	var codes []string
+	q := &model.Query{Filter: bson.M{}, Sort: "-price", Limit: 3, WithTotal: true}
+	for pages := 0; pages < 5; pages++ {
+		results, page, err := products.Search(ctx, q, false)
+		if err != nil {
+			return err
+		}
+		if page.Total != 7 {
+			return fail("total", page.Total, 7)
+		}
+		for _, p := range results {
+			codes = append(codes, p.Code)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		q = &model.Query{Filter: bson.M{}, Sort: "-price", Limit: 3, Cursor: page.NextCursor, WithTotal: true}
+	}
+	want := "p7 p3 p6 p2 p5 p1 p4"
+	if got := strings.Join(codes, " "); got != want {
+		return fail("pages sorted by -price", got, want)
+	}
+
+	filters := []struct {
+		name   string
+		filter bson.M
+		want   string
+	}{
+		{"status $ne", bson.M{"status": bson.M{"$ne": model.ProductRetired}}, "p1 p3 p5 p7"},
+		{"tag", bson.M{"tags": "even"}, "p2 p4 p6"},
+		{"price range", bson.M{"price": bson.M{"$gte": 1000, "$lte": 2000}}, "p1 p2 p5 p6"},
+		{"$in", bson.M{"code": bson.M{"$in": []string{"p1", "p4"}}}, "p1 p4"},
+	}
+	for _, f := range filters {
+		results, _, err := products.Search(ctx, &model.Query{Filter: f.filter, Sort: "display_order", Limit: 10}, false)
+		if err != nil {
+			return err
+		}
+		codes = nil
+		for _, p := range results {
+			codes = append(codes, p.Code)
+		}
+		if got := strings.Join(codes, " "); got != f.want {
+			return fail(f.name, got, f.want)
+		}
+	}
+
+	if _, _, err := products.Search(ctx, &model.Query{Filter: bson.M{}, Limit: 1, Cursor: "nonsense"}, false); err != model.ErrInvalidCursor {
+		return fail("invalid cursor", err, model.ErrInvalidCursor)
+	}
+
+	return nil
+}
+
+func checkCustomers(customers model.CustomerRepository) error {
+	ctx := context.Background()
+
+	unilever := &model.Customer{ID: bson.NewObjectId(), Name: "Unilever Asia", Email: " Billing@Unilever.com ", ExternalRef: "CRM-1"}
+	if err := customers.Create(ctx, unilever); err != nil {
+		return err
+	}
+	if unilever.Status != model.CustomerActive || unilever.Email != "billing@unilever.com" {
+		return fail("normalized email", unilever.Email, "billing@unilever.com")
+	}
+	if err := customers.Create(ctx, &model.Customer{ID: bson.NewObjectId(), Name: "Unilever Asia"}); err == nil {
+		return fail("duplicate name", err, "an error")
+	}
+	apple := &model.Customer{ID: bson.NewObjectId(), Name: "Apple"}
+	nike := &model.Customer{ID: bson.NewObjectId(), Name: "Nike", Metadata: map[string]string{"tier": "gold"}}
+	for _, customer := range []*model.Customer{apple, nike} {
+		if err := customers.Create(ctx, customer); err != nil {
+			return err
+		}
+	}
+	if err := customers.Create(ctx, &model.Customer{ID: bson.NewObjectId(), Name: "Bad", Metadata: map[string]string{"$where": "x"}}); err == nil {
+		return fail("metadata key starting with $", err, "an error")
+	}
+
+	found, err := customers.SelectByNaturalKey(ctx, "CRM-1", "")
+	if err != nil || found.ID != unilever.ID {
+		return fail("by external ref", err, nil)
+	}
+	if found, err = customers.SelectByNaturalKey(ctx, "CRM-9", "Apple"); err != nil || found.ID != apple.ID {
+		return fail("by name without a ref", err, nil)
+	}
+	if _, err = customers.SelectByNaturalKey(ctx, "CRM-9", "Unilever Asia"); err == nil {
+		return fail("by name of a customer with another ref", err, "an error")
+	}
+
+	fuzzy, fuzzyPage, err := customers.FuzzySearch(ctx, &model.Query{Sort: model.SortDistance, Limit: 10, WithTotal: true}, "unilevr", false)
+	if err != nil {
+		return err
+	}
+	if len(fuzzy) != 1 || fuzzy[0].ID != unilever.ID || fuzzy[0].Score <= 0 {
+		return fail("fuzzy matches", len(fuzzy), 1)
+	}
+	if fuzzyPage.Total != 1 || fuzzyPage.NextCursor != "" {
+		return fail("fuzzy page", fuzzyPage.Total, 1)
+	}
+	if _, _, err = customers.FuzzySearch(ctx, &model.Query{Sort: model.SortDistance, Limit: 10}, strings.Repeat("u", 65), false); err == nil {
+		return fail("fuzzy search by an overlong name", err, "an error")
+	}
+
+	searches := []struct {
+		name  string
+		query *model.Query
+		want  string
+	}{
+		{"name prefix", &model.Query{Filter: bson.M{"name_lower": bson.RegEx{Pattern: "^ni"}}, Limit: 10}, "Nike"},
+		{"email", &model.Query{Filter: bson.M{"email": "billing@unilever.com"}, Limit: 10}, "Unilever Asia"},
+		{"text", &model.Query{Filter: bson.M{"$text": bson.M{"$search": "asia"}}, Sort: model.SortRelevance, Limit: 10}, "Unilever Asia"},
+		{"metadata", &model.Query{Filter: bson.M{"metadata.tier": "gold"}, Limit: 10}, "Nike"},
+		{"sorted by name", &model.Query{Filter: bson.M{}, Sort: "-name_lower", Limit: 10}, "Unilever Asia Nike Apple"},
+	}
+	for _, s := range searches {
+		results, _, err := customers.Search(ctx, s.query, false)
+		if err != nil {
+			return errors.New(s.name + ": " + err.Error())
+		}
+		var names []string
+		for _, customer := range results {
+			names = append(names, customer.Name)
+		}
+		if got := strings.Join(names, " "); got != s.want {
+			return fail(s.name, got, s.want)
+		}
+	}
+
+	update := *apple
+	update.Name = "Nike"
+	if _, err = customers.Update(ctx, apple.ID, &update, 1); err == nil {
+		return fail("rename to a taken name", err, "an error")
+	}
+	update.Name = "Apple Inc"
+	update.Status = ""
+	updated, err := customers.Update(ctx, apple.ID, &update, 1)
+	if err != nil {
+		return err
+	}
+	if updated.NameLower != "apple inc" || updated.Status != model.CustomerActive || updated.Revision != 2 {
+		return fail("name_lower after update", updated.NameLower, "apple inc")
+	}
+
+	if err = customers.Delete(ctx, nike.ID, 1); err != nil {
+		return err
+	}
+	byIDs, err := customers.SelectByIDs(ctx, []bson.ObjectId{unilever.ID, nike.ID})
+	if err != nil {
+		return err
+	}
+	if len(byIDs) != 1 || byIDs[0].ID != unilever.ID {
+		return fail("live customers by ids", len(byIDs), 1)
+	}
+	if err = customers.Create(ctx, &model.Customer{ID: bson.NewObjectId(), Name: "Nike"}); err == nil {
+		return fail("name of a deleted customer", err, "an error")
+	}
+	if _, err = customers.Restore(ctx, nike.ID); err != nil {
+		return err
+	}
+
+	for _, customer := range []*model.Customer{unilever, apple, nike} {
+		if err = customers.Purge(ctx, customer.ID); err != nil {
+			return err
+		}
+	}
+	all, err := customers.List(ctx)
+	if err != nil {
+		return err
+	}
+	if len(all) != 0 {
+		return fail("customers after purge", len(all), 0)
+	}
+
+	return nil
+}
+
+// checkPricingRules on rules of customers of its own, backends may refuse
+// rules of unknown customers
+func checkPricingRules(customers model.CustomerRepository, rules model.PricingRuleRepository) error {
+	ctx := context.Background()
+	owners := []*model.Customer{
+		{ID: bson.NewObjectId(), Name: "Ford"},
+		{ID: bson.NewObjectId(), Name: "Toyota"},
+	}
+	for _, customer := range owners {
+		if err := customers.Create(ctx, customer); err != nil {
+			return err
+		}
+	}
+	customerID := owners[0].ID.Hex()
+	otherID := owners[1].ID.Hex()
+
+	deal := &model.PricingRules{ID: bson.NewObjectId(), CustomerID: customerID, ProductCode: "classic", Type: "deal", DealBuy: 3, DealPriceOf: 2}
+	if err := rules.Create(ctx, deal); err != nil {
+		return err
+	}
+	created := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	if err := rules.Create(ctx, &model.PricingRules{ID: bson.NewObjectId(), CustomerID: customerID, ProductCode: "classic", Type: "discount"}); err == nil {
+		return fail("second live rule for a product", err, "an error")
+	}
+	if err := rules.Create(ctx, &model.PricingRules{ID: bson.NewObjectId(), CustomerID: otherID, ProductCode: "classic", Type: "deal", DealPriceOf: 2}); err == nil {
+		return fail("deal of 0", err, "an error")
+	}
+	if err := rules.Create(ctx, &model.PricingRules{ID: bson.NewObjectId(), CustomerID: otherID, ProductCode: "classic", Type: "discount", DiscountBuy: 1, DiscountPrice: -1}); err == nil {
+		return fail("negative discount price", err, "an error")
+	}
+	badDeal := *deal
+	badDeal.DealBuy = 0
+	if _, err := rules.Update(ctx, deal.ID, &badDeal, model.AnyRevision); err == nil {
+		return fail("update to a deal of 0", err, "an error")
+	}
+	other := &model.PricingRules{ID: bson.NewObjectId(), CustomerID: otherID, ProductCode: "classic", Type: "discount", DiscountBuy: 1, DiscountPrice: 29999}
+	if err := rules.Create(ctx, other); err != nil {
+		return err
+	}
+
+	if err := rules.Delete(ctx, deal.ID, 1); err != nil {
+		return err
+	}
+	replacement := &model.PricingRules{ID: bson.NewObjectId(), CustomerID: customerID, ProductCode: "classic", Type: "discount", DiscountBuy: 1, DiscountPrice: 25000}
+	if err := rules.Create(ctx, replacement); err != nil {
+		return err
+	}
+	if _, err := rules.Restore(ctx, deal.ID); err == nil {
+		return fail("restore over a live rule", err, "an error")
+	}
+
+	live, err := rules.SelectByCustomerIDs(ctx, []string{customerID, otherID})
+	if err != nil {
+		return err
+	}
+	if len(live) != 2 {
+		return fail("live rules of both customers", len(live), 2)
+	}
+	mine, err := rules.SelectByCustomerID(ctx, customerID)
+	if err != nil {
+		return err
+	}
+	if len(mine) != 1 || mine[0].ID != replacement.ID {
+		return fail("live rules of a customer", len(mine), 1)
+	}
+
+	then, err := rules.SelectByCustomerIDAsOf(ctx, customerID, created)
+	if err != nil {
+		return err
+	}
+	if len(then) != 1 || then[0].ID != deal.ID {
+		return fail("rules as of before delete", len(then), 1)
+	}
+	thenBoth, err := rules.SelectByCustomerIDsAsOf(ctx, []string{customerID, otherID}, created)
+	if err != nil {
+		return err
+	}
+	if len(thenBoth) != 1 {
+		return fail("rules of both customers as of before the other's", len(thenBoth), 1)
+	}
+	old, err := rules.SelectAsOf(ctx, deal.ID, created)
+	if err != nil {
+		return err
+	}
+	if old.Type != "deal" {
+		return fail("rule as of before delete", old.Type, "deal")
+	}
+
+	update := *other
+	update.DiscountPrice = 28999
+	updated, err := rules.Update(ctx, other.ID, &update, 1)
+	if err != nil {
+		return err
+	}
+	if updated.DiscountPrice != 28999 || updated.Revision != 2 {
+		return fail("discount price after update", updated.DiscountPrice, 28999)
+	}
+	versions, err := rules.ListVersions(ctx, other.ID)
+	if err != nil {
+		return err
+	}
+	if len(versions) != 2 {
+		return fail("versions", len(versions), 2)
+	}
+
+	exported, err := rules.Export(ctx)
+	if err != nil {
+		return err
+	}
+	if len(exported) != 2 {
+		return fail("exported rules", len(exported), 2)
+	}
+	listed, page, err := rules.List(ctx, &model.Query{Filter: bson.M{"customer_id": customerID}, Limit: 10, WithTotal: true}, true)
+	if err != nil {
+		return err
+	}
+	if len(listed) != 2 || page.Total != 2 {
+		return fail("rules listed with deleted ones", len(listed), 2)
+	}
+
+	for _, id := range []bson.ObjectId{deal.ID, other.ID} {
+		if err = rules.Purge(ctx, id); err != nil {
+			return err
+		}
+	}
+	// the rules left go with their customer
+	for _, customer := range owners {
+		if err = customers.Purge(ctx, customer.ID); err != nil {
+			return err
+		}
+	}
+	if listed, _, err = rules.List(ctx, &model.Query{Filter: bson.M{}, Limit: 10}, true); err != nil || len(listed) != 0 {
+		return fail("rules after purge", len(listed), 0)
+	}
+	if versions, err := rules.ListVersions(ctx, replacement.ID); err != nil || len(versions) != 0 {
+		return fail("versions of a rule purged with its customer", len(versions), 0)
+	}
+
+	return nil
+}
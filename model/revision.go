@@ -0,0 +1,33 @@
+package model
+
+import (
+	"errors"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// AnyRevision skips the revision check on update & delete
+const AnyRevision = -1
+
+// ErrRevisionMismatch when a document was changed since the caller read it
+var ErrRevisionMismatch = errors.New("Document has been modified since it was read")
+
+// atRevision matches a live document at the given revision, documents
+// written before revisions existed are at revision 0
+func atRevision(id bson.ObjectId, revision int) bson.M {
+	selector := alive(id)
+	if revision == 0 {
+		selector["revision"] = bson.M{"$in": []interface{}{0, nil}}
+	} else {
+		selector["revision"] = revision
+	}
+	return selector
+}
+
+// checkRevision compares the revision the caller read with the current one
+func checkRevision(expected int, current int) error {
+	if expected != AnyRevision && expected != current {
+		return ErrRevisionMismatch
+	}
+	return nil
+}
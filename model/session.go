@@ -1,23 +1,76 @@
 package model
 
 import (
-	"log"
+	"errors"
+	"time"
 
-	"../config"
 	"github.com/globalsign/mgo"
 )
 
-// DB global session
+// DB global session, nil until Connect & when the storage backend isn't mongo
 var DB *mgo.Session
 
-func init() {
-	var err error
-	DB, err = mgo.Dial(config.DbHost)
+// indexed once Indexing has ensured every index
+var indexed bool
+
+// Connect to mongo as info says, the session is kept as DB
+func Connect(info *mgo.DialInfo) error {
+	session, err := mgo.DialWithInfo(info)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	DB = session
+	return nil
+}
+
+// Disconnect from mongo
+func Disconnect() error {
+	if DB != nil {
+		DB.Close()
+		DB = nil
+	}
+	return nil
+}
+
+// Indexing creates the indices of every collection, migrating documents
+// older than them on the way
+func Indexing() error {
+	indexings := []func() error{
+		ProductIndexing,
+		CustomerIndexing,
+		PricingRulesIndexing,
+		JobAdIndexing,
+		CreditIndexing,
+		OrderIndexing,
+		VersionIndexing,
+		AuditIndexing,
+		APIKeyIndexing,
+		RateLimitIndexing,
+		IdempotencyIndexing,
+	}
+	for _, indexing := range indexings {
+		if err := indexing(); err != nil {
+			return err
+		}
 	}
+	indexed = true
+	return nil
+}
 
-	ProductIndexing()
-	CustomerIndexing()
-	PricingRulesIndexing()
+// Ping mongo, giving up after timeout, & check its indices were ensured
+func Ping(timeout time.Duration) error {
+	if DB == nil {
+		return errors.New("Not connected to mongo")
+	}
+	session := DB.Copy()
+	defer session.Close()
+	session.SetSyncTimeout(timeout)
+	session.SetSocketTimeout(timeout)
+	if err := session.Ping(); err != nil {
+		return err
+	}
+	if !indexed {
+		return errors.New("Indices are not ensured yet")
+	}
+	return nil
 }
@@ -0,0 +1,113 @@
+package model
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"../config"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// softDeletable collections, their deleted documents get purged
+var softDeletable = []string{
+	config.ProductsCollection,
+	config.CustomersCollection,
+	config.PricingRulesCollection,
+}
+
+// alive matches a single document that has not been deleted
+func alive(id bson.ObjectId) bson.M {
+	return bson.M{"_id": id, "deleted_at": nil}
+}
+
+// withDeleted adds the deleted filter to params unless deleted ones are asked
+func withDeleted(params bson.M, includeDeleted bool) bson.M {
+	filter := bson.M{}
+	for k, v := range params {
+		filter[k] = v
+	}
+	if !includeDeleted {
+		filter["deleted_at"] = nil
+	}
+	return filter
+}
+
+// markDeleted flags a document as deleted instead of removing it
+func markDeleted(c *mgo.Collection, id bson.ObjectId, revision int, at time.Time) (err error) {
+	err = c.Update(atRevision(id, revision), bson.M{"$set": bson.M{
+		"deleted_at": at,
+		"revision":   revision + 1,
+	}})
+	if err == mgo.ErrNotFound {
+		return ErrRevisionMismatch
+	}
+	return err
+}
+
+// unmarkDeleted brings a deleted document back
+func unmarkDeleted(c *mgo.Collection, id bson.ObjectId) (err error) {
+	return c.Update(bson.M{
+		"_id":        id,
+		"deleted_at": bson.M{"$ne": nil},
+	}, bson.M{
+		"$unset": bson.M{"deleted_at": ""},
+		"$inc":   bson.M{"revision": 1},
+	})
+}
+
+// PurgeDeleted to remove for good documents deleted longer than retention
+// ----------------------------------------------------------------------
+func PurgeDeleted(ctx context.Context, retention time.Duration) (purged int, err error) {
+	db := DB.Clone()
+	defer db.Close()
+
+	cutoff := time.Now().Add(-retention)
+	for _, collection := range softDeletable {
+		c := db.DB(config.DbName).C(collection)
+
+		var docs []bson.M
+		err = c.Find(bson.M{"deleted_at": bson.M{"$lte": cutoff}}).All(&docs)
+		if err != nil {
+			return purged, err
+		}
+
+		for _, doc := range docs {
+			id, ok := doc["_id"].(bson.ObjectId)
+			if !ok {
+				continue
+			}
+			err = c.Remove(bson.M{"_id": id, "deleted_at": bson.M{"$lte": cutoff}})
+			if err == mgo.ErrNotFound {
+				// restored in the meantime
+				continue
+			}
+			if err != nil {
+				return purged, err
+			}
+			writeAudit(ctx, db, collection, AuditPurge, id, doc, nil)
+			purged++
+		}
+	}
+
+	return purged, nil
+}
+
+// DeletedPurge runs PurgeDeleted on every tick, meant to run as goroutine
+// ----------------------------------------------------------------------
+func DeletedPurge(interval time.Duration, retention time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		purged, err := PurgeDeleted(context.Background(), retention)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if purged > 0 {
+			log.Printf("%d deleted documents purged", purged)
+		}
+	}
+}
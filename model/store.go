@@ -0,0 +1,430 @@
+package model
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// errReadOnly when a view transaction tries to write
+var errReadOnly = errors.New("Store transaction is read only")
+
+type (
+	// Store keeps products, customers & rules outside mongo, in memory or in
+	// a single bolt file. it holds the same documents & versions as the
+	// mongo collections & enforces the same unique keys, but changes aren't
+	// audited since the audit log lives in mongo
+	Store struct {
+		kv kvStore
+	}
+
+	// kvStore is where a Store's documents are kept, by collection & id
+	kvStore interface {
+		view(fn func(tx kvTx) error) error
+		// update commits every write of fn or, when it fails, none
+		update(fn func(tx kvTx) error) error
+		close() error
+	}
+
+	// kvTx reads & writes bson documents within one transaction
+	kvTx interface {
+		// get is nil when collection has no document id
+		get(collection string, id bson.ObjectId) ([]byte, error)
+		put(collection string, id bson.ObjectId, doc []byte) error
+		remove(collection string, id bson.ObjectId) error
+		// each walks the documents of collection in id order
+		each(collection string, fn func(doc []byte) error) error
+	}
+
+	// storeDoc is a document read for a query, decoded to match & sort it
+	storeDoc struct {
+		m     bson.M
+		raw   []byte
+		score float64
+	}
+)
+
+// Close releases the file the store is kept in
+func (s *Store) Close() error {
+	return s.kv.close()
+}
+
+// Products kept in the store
+func (s *Store) Products() ProductRepository {
+	return storeProductRepository{s}
+}
+
+// Customers kept in the store
+func (s *Store) Customers() CustomerRepository {
+	return storeCustomerRepository{s}
+}
+
+// Rules kept in the store
+func (s *Store) Rules() PricingRuleRepository {
+	return storePricingRuleRepository{s}
+}
+
+// load decodes the document id of collection into result
+func load(tx kvTx, collection string, id bson.ObjectId, result interface{}) error {
+	raw, err := tx.get(collection, id)
+	if err != nil {
+		return err
+	}
+	if raw == nil {
+		return mgo.ErrNotFound
+	}
+	return bson.Unmarshal(raw, result)
+}
+
+// save encodes doc as the document id of collection, over any previous one
+func save(tx kvTx, collection string, id bson.ObjectId, doc interface{}) error {
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return tx.put(collection, id, raw)
+}
+
+// insert saves doc unless collection already has a document id, like the
+// unique _id index does
+func insert(tx kvTx, collection string, id bson.ObjectId, doc interface{}) error {
+	raw, err := tx.get(collection, id)
+	if err != nil {
+		return err
+	}
+	if raw != nil {
+		return errors.New("Document " + id.Hex() + " already exists")
+	}
+	return save(tx, collection, id, doc)
+}
+
+// match reads the documents of collection matching filter, sorted by
+// fields with an optional "-" prefix each
+func match(tx kvTx, collection string, filter bson.M, fields ...string) (docs []storeDoc, err error) {
+	m := newMatcher(collection)
+	err = tx.each(collection, func(raw []byte) error {
+		var doc bson.M
+		if err := bson.Unmarshal(raw, &doc); err != nil {
+			return err
+		}
+		ok, err := m.matches(doc, filter)
+		if err != nil || !ok {
+			return err
+		}
+		docs = append(docs, storeDoc{m: doc, raw: raw})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(fields) > 0 {
+		sort.SliceStable(docs, func(i, j int) bool {
+			for _, field := range fields {
+				desc := field[0] == '-'
+				if desc {
+					field = field[1:]
+				}
+				a, _ := lookup(docs[i].m, field)
+				b, _ := lookup(docs[j].m, field)
+				if c := compareOrder(a, b); c != 0 {
+					return (c < 0) != desc
+				}
+			}
+			return false
+		})
+	}
+
+	return docs, nil
+}
+
+// find decodes the documents of collection matching filter into results,
+// a pointer to a slice of document pointers
+func find(tx kvTx, collection string, filter bson.M, results interface{}, fields ...string) error {
+	docs, err := match(tx, collection, filter, fields...)
+	if err != nil {
+		return err
+	}
+	return fill(raws(docs), results)
+}
+
+// findOne decodes the first document of collection matching filter
+func findOne(tx kvTx, collection string, filter bson.M, result interface{}) error {
+	docs, err := match(tx, collection, filter)
+	if err != nil {
+		return err
+	}
+	if len(docs) == 0 {
+		return mgo.ErrNotFound
+	}
+	return bson.Unmarshal(docs[0].raw, result)
+}
+
+// raws of docs, to be decoded by fill
+func raws(docs []storeDoc) []bson.Raw {
+	results := make([]bson.Raw, len(docs))
+	for i, doc := range docs {
+		results[i] = bson.Raw{Kind: 0x03, Data: doc.raw}
+	}
+	return results
+}
+
+// paginateStore reads one page of q from collection into results, keyset
+// paginated the same way paginate reads a mongo collection
+func paginateStore(tx kvTx, collection string, q *Query, results interface{}) (page *Page, err error) {
+	field, desc := sortField(q.Sort)
+	page = &Page{Total: -1}
+
+	if q.Sort == SortRelevance {
+		return paginateStoreRelevance(tx, collection, q, page, results)
+	}
+
+	filter := q.Filter
+	if q.Cursor != "" {
+		cur, err := decodeCursor(q.Cursor, q.Sort)
+		if err != nil {
+			return nil, err
+		}
+		filter = bson.M{"$and": []bson.M{q.Filter, after(field, desc, cur)}}
+	}
+
+	if q.WithTotal {
+		all, err := match(tx, collection, q.Filter)
+		if err != nil {
+			return nil, err
+		}
+		page.Total = len(all)
+	}
+
+	fields := []string{field, "_id"}
+	if desc {
+		fields = []string{"-" + field, "-_id"}
+	}
+	docs, err := match(tx, collection, filter, fields...)
+	if err != nil {
+		return nil, err
+	}
+	more := len(docs) > q.Limit
+	if more {
+		docs = docs[:q.Limit]
+	}
+
+	if err = fill(raws(docs), results); err != nil {
+		return nil, err
+	}
+
+	if more {
+		last := docs[len(docs)-1].m
+		id, _ := last["_id"].(bson.ObjectId)
+		if page.NextCursor, err = encodeCursor(q.Sort, last[field], id); err != nil {
+			return nil, err
+		}
+	}
+
+	return page, nil
+}
+
+// paginateStoreRelevance reads one page of a full-text query ordered by
+// score, setting each document's score as mongo's textScore would
+func paginateStoreRelevance(tx kvTx, collection string, q *Query, page *Page, results interface{}) (*Page, error) {
+	offset := 0
+	if q.Cursor != "" {
+		cur, err := decodeCursor(q.Cursor, q.Sort)
+		if err != nil {
+			return nil, err
+		}
+		switch v := cur.Value.(type) {
+		case int:
+			offset = v
+		case int64:
+			offset = int(v)
+		default:
+			return nil, ErrInvalidCursor
+		}
+	}
+
+	docs, err := match(tx, collection, q.Filter, "_id")
+	if err != nil {
+		return nil, err
+	}
+	if q.WithTotal {
+		page.Total = len(docs)
+	}
+
+	m := newMatcher(collection)
+	for i := range docs {
+		if docs[i].score, err = m.textScore(docs[i].m, q.Filter["$text"]); err != nil {
+			return nil, err
+		}
+		docs[i].m["score"] = docs[i].score
+		if docs[i].raw, err = bson.Marshal(docs[i].m); err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(docs, func(i, j int) bool {
+		return docs[i].score > docs[j].score
+	})
+
+	if offset > len(docs) {
+		offset = len(docs)
+	}
+	docs = docs[offset:]
+	more := len(docs) > q.Limit
+	if more {
+		docs = docs[:q.Limit]
+	}
+
+	if err = fill(raws(docs), results); err != nil {
+		return nil, err
+	}
+
+	if more {
+		id, _ := docs[len(docs)-1].m["_id"].(bson.ObjectId)
+		if page.NextCursor, err = encodeCursor(q.Sort, offset+q.Limit, id); err != nil {
+			return nil, err
+		}
+	}
+
+	return page, nil
+}
+
+// softDelete flags the live document id as deleted at revision
+func softDelete(tx kvTx, collection string, versions string, id bson.ObjectId, revision int, at time.Time) error {
+	var doc bson.M
+	if err := findOne(tx, collection, alive(id), &doc); err != nil {
+		return err
+	}
+	current := intValue(doc["revision"])
+	if err := checkRevision(revision, current); err != nil {
+		return err
+	}
+
+	doc["deleted_at"] = at
+	doc["revision"] = current + 1
+	if err := save(tx, collection, id, doc); err != nil {
+		return err
+	}
+
+	if versions == "" {
+		return nil
+	}
+	return storeCloseVersion(tx, versions, id, at)
+}
+
+// restore brings the deleted document id back as a new version
+func restore(tx kvTx, collection string, versions string, id bson.ObjectId, notDeleted string) error {
+	var doc bson.M
+	if err := load(tx, collection, id, &doc); err != nil {
+		return err
+	}
+	if doc["deleted_at"] == nil {
+		return errors.New(notDeleted)
+	}
+
+	delete(doc, "deleted_at")
+	doc["revision"] = intValue(doc["revision"]) + 1
+	if err := save(tx, collection, id, doc); err != nil {
+		return err
+	}
+
+	if versions == "" {
+		return nil
+	}
+	return storeAppendVersion(tx, versions, id, doc, time.Now())
+}
+
+// purge removes the document id & its versions for good
+func purge(tx kvTx, collection string, versions string, id bson.ObjectId) error {
+	var doc bson.M
+	if err := load(tx, collection, id, &doc); err != nil {
+		return err
+	}
+	if err := tx.remove(collection, id); err != nil {
+		return err
+	}
+
+	if versions == "" {
+		return nil
+	}
+	docs, err := match(tx, versions, bson.M{"entity_id": id})
+	if err != nil {
+		return err
+	}
+	for _, v := range docs {
+		if err = tx.remove(versions, v.m["_id"].(bson.ObjectId)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unique fails when a document of collection other than id has value at
+// field, where mongo keeps a unique index
+func unique(tx kvTx, collection string, id bson.ObjectId, field string, value interface{}, message string) error {
+	docs, err := match(tx, collection, bson.M{field: value, "_id": bson.M{"$ne": id}})
+	if err != nil {
+		return err
+	}
+	if len(docs) > 0 {
+		return errors.New(message)
+	}
+	return nil
+}
+
+// storeAppendVersion closes the version currently in effect & stores doc
+// as the next one, effective from at, like appendVersion
+func storeAppendVersion(tx kvTx, collection string, id bson.ObjectId, doc interface{}, at time.Time) error {
+	if err := storeCloseVersion(tx, collection, id, at); err != nil {
+		return err
+	}
+
+	docs, err := match(tx, collection, bson.M{"entity_id": id}, "-version")
+	if err != nil {
+		return err
+	}
+	last := 0
+	if len(docs) > 0 {
+		last = intValue(docs[0].m["version"])
+	}
+
+	versionID := bson.NewObjectId()
+	return insert(tx, collection, versionID, bson.M{
+		"_id":            versionID,
+		"entity_id":      id,
+		"version":        last + 1,
+		"effective_from": at,
+		"effective_to":   nil,
+		"document":       doc,
+	})
+}
+
+// storeCloseVersion ends the version currently in effect, eg. on delete
+func storeCloseVersion(tx kvTx, collection string, id bson.ObjectId, at time.Time) error {
+	docs, err := match(tx, collection, bson.M{"entity_id": id, "effective_to": nil})
+	if err != nil {
+		return err
+	}
+	for _, v := range docs {
+		v.m["effective_to"] = at
+		if err = save(tx, collection, v.m["_id"].(bson.ObjectId), v.m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// intValue of a decoded bson number, 0 when missing
+func intValue(v interface{}) int {
+	switch n := v.(type) {
+	case int:
+		return n
+	case int64:
+		return int(n)
+	case float64:
+		return int(n)
+	}
+	return 0
+}
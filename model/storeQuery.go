@@ -0,0 +1,418 @@
+package model
+
+import (
+	"errors"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"../config"
+	"github.com/globalsign/mgo/bson"
+)
+
+// textWeights mirror the text indices of the mongo collections
+var textWeights = map[string]map[string]float64{
+	config.CustomersCollection: {"name": 10, "email": 2, "external_ref": 2},
+}
+
+// matcher evaluates the part of mongo's query language the controllers &
+// models build: equality, $ne, $gt, $gte, $lt, $lte, $in, $nin, $exists,
+// regular expressions, $and, $or & $text
+type matcher struct {
+	weights map[string]float64
+	regexps map[bson.RegEx]*regexp.Regexp
+}
+
+func newMatcher(collection string) *matcher {
+	return &matcher{
+		weights: textWeights[collection],
+		regexps: map[bson.RegEx]*regexp.Regexp{},
+	}
+}
+
+// matches tells whether doc satisfies every condition of filter
+func (m *matcher) matches(doc bson.M, filter bson.M) (bool, error) {
+	for key, cond := range filter {
+		var ok bool
+		var err error
+		switch key {
+		case "$and", "$or":
+			ok, err = m.logical(doc, key, cond)
+		case "$text":
+			var score float64
+			score, err = m.textScore(doc, cond)
+			ok = score > 0
+		default:
+			if strings.HasPrefix(key, "$") {
+				return false, errors.New("Unsupported query operator " + key)
+			}
+			value, exists := lookup(doc, key)
+			ok, err = m.condition(value, exists, cond)
+		}
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// logical evaluates the filters of an $and or an $or
+func (m *matcher) logical(doc bson.M, op string, cond interface{}) (bool, error) {
+	var filters []bson.M
+	switch list := cond.(type) {
+	case []bson.M:
+		filters = list
+	case []interface{}:
+		for _, item := range list {
+			filter, ok := item.(bson.M)
+			if !ok {
+				return false, errors.New(op + " needs a list of filters")
+			}
+			filters = append(filters, filter)
+		}
+	default:
+		return false, errors.New(op + " needs a list of filters")
+	}
+
+	for _, filter := range filters {
+		ok, err := m.matches(doc, filter)
+		if err != nil {
+			return false, err
+		}
+		if ok == (op == "$or") {
+			return ok, nil
+		}
+	}
+	return op == "$and", nil
+}
+
+// condition tells whether a field's value satisfies cond, a value to be
+// equal to, a regular expression or operators
+func (m *matcher) condition(value interface{}, exists bool, cond interface{}) (bool, error) {
+	switch c := cond.(type) {
+	case bson.RegEx:
+		return m.regex(value, c)
+	case bson.M:
+		if !operators(c) {
+			return equal(value, c), nil
+		}
+		for op, arg := range c {
+			ok, err := m.operator(value, exists, op, arg)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+	return equal(value, cond), nil
+}
+
+// operator applies a single query operator to a field's value
+func (m *matcher) operator(value interface{}, exists bool, op string, arg interface{}) (bool, error) {
+	switch op {
+	case "$eq":
+		return equal(value, arg), nil
+	case "$ne":
+		return !equal(value, arg), nil
+	case "$in", "$nin":
+		if !isSlice(arg) {
+			return false, errors.New(op + " needs a list of values")
+		}
+		list := reflect.ValueOf(arg)
+		found := false
+		for i := 0; i < list.Len() && !found; i++ {
+			found = equal(value, list.Index(i).Interface())
+		}
+		return found == (op == "$in"), nil
+	case "$exists":
+		want, _ := arg.(bool)
+		return exists == want, nil
+	case "$gt", "$gte", "$lt", "$lte":
+		return anyValue(value, func(v interface{}) bool {
+			c, ok := compareValues(v, arg)
+			if !ok {
+				return false
+			}
+			switch op {
+			case "$gt":
+				return c > 0
+			case "$gte":
+				return c >= 0
+			case "$lt":
+				return c < 0
+			}
+			return c <= 0
+		}), nil
+	}
+	return false, errors.New("Unsupported query operator " + op)
+}
+
+// regex matches a string value, or any string of a list
+func (m *matcher) regex(value interface{}, re bson.RegEx) (bool, error) {
+	compiled, ok := m.regexps[re]
+	if !ok {
+		flags := ""
+		for _, option := range re.Options {
+			if strings.ContainsRune("ims", option) {
+				flags += string(option)
+			}
+		}
+		pattern := re.Pattern
+		if flags != "" {
+			pattern = "(?" + flags + ")" + pattern
+		}
+		var err error
+		if compiled, err = regexp.Compile(pattern); err != nil {
+			return false, err
+		}
+		m.regexps[re] = compiled
+	}
+
+	return anyValue(value, func(v interface{}) bool {
+		s, ok := v.(string)
+		return ok && compiled.MatchString(s)
+	}), nil
+}
+
+// textScore weighs the search terms found in the text fields of doc, 0
+// when none is found or a negated "-term" is
+func (m *matcher) textScore(doc bson.M, cond interface{}) (float64, error) {
+	if m.weights == nil {
+		return 0, errors.New("text index required for $text query")
+	}
+	search, ok := cond.(bson.M)
+	if !ok {
+		return 0, errors.New("$text needs a $search")
+	}
+	terms, ok := search["$search"].(string)
+	if !ok {
+		return 0, errors.New("$text needs a $search")
+	}
+
+	var include, exclude []string
+	for _, word := range strings.Fields(terms) {
+		if strings.HasPrefix(word, "-") {
+			exclude = append(exclude, textTokens(word)...)
+		} else {
+			include = append(include, textTokens(word)...)
+		}
+	}
+
+	score := 0.0
+	for field, weight := range m.weights {
+		value, _ := lookup(doc, field)
+		text, _ := value.(string)
+		for _, token := range textTokens(text) {
+			for _, term := range exclude {
+				if token == term {
+					return 0, nil
+				}
+			}
+			for _, term := range include {
+				if token == term {
+					score += weight
+				}
+			}
+		}
+	}
+	return score, nil
+}
+
+// textTokens splits text into lower case words
+func textTokens(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// operators tells whether every key of cond is a query operator
+func operators(cond bson.M) bool {
+	for key := range cond {
+		if !strings.HasPrefix(key, "$") {
+			return false
+		}
+	}
+	return len(cond) > 0
+}
+
+// lookup reads a dotted path of doc
+func lookup(doc bson.M, path string) (interface{}, bool) {
+	var value interface{} = doc
+	for _, key := range strings.Split(path, ".") {
+		var ok bool
+		switch sub := value.(type) {
+		case bson.M:
+			value, ok = sub[key]
+		case map[string]interface{}:
+			value, ok = sub[key]
+		}
+		if !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// anyValue applies test to value, or to each element when it's a list
+func anyValue(value interface{}, test func(v interface{}) bool) bool {
+	if list, ok := value.([]interface{}); ok {
+		for _, v := range list {
+			if test(v) {
+				return true
+			}
+		}
+		return false
+	}
+	return test(value)
+}
+
+// isSlice tells whether v is a list of values rather than a single one
+func isSlice(v interface{}) bool {
+	if v == nil {
+		return false
+	}
+	kind := reflect.TypeOf(v).Kind()
+	return kind == reflect.Slice || kind == reflect.Array
+}
+
+// equal tells whether a field's value matches want, a list field matches
+// when any of its elements does & nil matches a missing field
+func equal(value interface{}, want interface{}) bool {
+	if want == nil {
+		return value == nil
+	}
+	if list, ok := value.([]interface{}); ok && !isSlice(want) {
+		for _, v := range list {
+			if equal(v, want) {
+				return true
+			}
+		}
+		return false
+	}
+	c, ok := compareValues(value, want)
+	return ok && c == 0
+}
+
+// compareValues orders two values of the same kind, ok is false when
+// they can't be compared
+func compareValues(a interface{}, b interface{}) (c int, ok bool) {
+	if a == nil || b == nil {
+		return 0, a == nil && b == nil
+	}
+	if x, ok := number(a); ok {
+		y, ok := number(b)
+		if !ok {
+			return 0, false
+		}
+		return compareFloat(x, y), true
+	}
+
+	switch x := a.(type) {
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	case bson.ObjectId:
+		if y, ok := b.(bson.ObjectId); ok {
+			return strings.Compare(string(x), string(y)), true
+		}
+	case time.Time:
+		if y, ok := b.(time.Time); ok {
+			switch {
+			case x.Before(y):
+				return -1, true
+			case x.After(y):
+				return 1, true
+			}
+			return 0, true
+		}
+	case bool:
+		if y, ok := b.(bool); ok {
+			if x == y {
+				return 0, true
+			}
+			if !x {
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+
+	if isSlice(a) && isSlice(b) {
+		x, y := reflect.ValueOf(a), reflect.ValueOf(b)
+		if x.Len() != y.Len() {
+			return 0, false
+		}
+		for i := 0; i < x.Len(); i++ {
+			if c, ok := compareValues(x.Index(i).Interface(), y.Index(i).Interface()); !ok || c != 0 {
+				return 0, false
+			}
+		}
+		return 0, true
+	}
+	if reflect.DeepEqual(a, b) {
+		return 0, true
+	}
+	return 0, false
+}
+
+// compareOrder sorts any two values the way mongo does, by kind first
+func compareOrder(a interface{}, b interface{}) int {
+	if ra, rb := sortRank(a), sortRank(b); ra != rb {
+		return ra - rb
+	}
+	c, _ := compareValues(a, b)
+	return c
+}
+
+// sortRank is mongo's order of bson types
+func sortRank(v interface{}) int {
+	if v == nil {
+		return 1
+	}
+	if _, ok := number(v); ok {
+		return 2
+	}
+	switch v.(type) {
+	case string:
+		return 3
+	case bson.M, map[string]interface{}:
+		return 4
+	case bson.ObjectId:
+		return 7
+	case bool:
+		return 8
+	case time.Time:
+		return 9
+	}
+	if isSlice(v) {
+		return 5
+	}
+	return 10
+}
+
+// number reads any numeric kind as float64
+func number(v interface{}) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
+
+func compareFloat(x float64, y float64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,599 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"../config"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+type (
+	// storeProductRepository keeps products in a Store
+	storeProductRepository struct {
+		store *Store
+	}
+
+	// storeCustomerRepository keeps customers in a Store
+	storeCustomerRepository struct {
+		store *Store
+	}
+
+	// storePricingRuleRepository keeps pricing rules in a Store
+	storePricingRuleRepository struct {
+		store *Store
+	}
+)
+
+// Create a product, codes are unique among deleted products too
+func (r storeProductRepository) Create(ctx context.Context, product *Product) error {
+	if err := validateFeatures(product.Features); err != nil {
+		return err
+	}
+	if product.ID == "" {
+		product.ID = bson.NewObjectId()
+	}
+
+	return r.store.kv.update(func(tx kvTx) error {
+		existing := new(Product)
+		err := findOne(tx, config.ProductsCollection, bson.M{"code": product.Code}, existing)
+		if err == nil && existing.DeletedAt != nil {
+			return errors.New("Product Code belongs to a deleted product, restore it instead")
+		}
+		if err == nil {
+			return errors.New("Product Code already exists")
+		}
+		if err != mgo.ErrNotFound {
+			return err
+		}
+
+		product.Revision = 1
+		if err = insert(tx, config.ProductsCollection, product.ID, product); err != nil {
+			return err
+		}
+
+		return storeAppendVersion(tx, config.ProductVersionsCollection, product.ID, product, time.Now())
+	})
+}
+
+// List live products
+func (r storeProductRepository) List(ctx context.Context) (results []*Product, err error) {
+	err = r.store.kv.view(func(tx kvTx) error {
+		return find(tx, config.ProductsCollection, bson.M{"deleted_at": nil}, &results, "display_order", "code")
+	})
+	return results, err
+}
+
+// Search a page of products
+func (r storeProductRepository) Search(ctx context.Context, q *Query, includeDeleted bool) (results []*Product, page *Page, err error) {
+	q.Filter = withDeleted(q.Filter, includeDeleted)
+	err = r.store.kv.view(func(tx kvTx) error {
+		page, err = paginateStore(tx, config.ProductsCollection, q, &results)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return results, page, nil
+}
+
+// SelectByID a live product
+func (r storeProductRepository) SelectByID(ctx context.Context, id bson.ObjectId) (result *Product, err error) {
+	result = new(Product)
+	err = r.store.kv.view(func(tx kvTx) error {
+		return findOne(tx, config.ProductsCollection, alive(id), result)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// SelectByCode a live product
+func (r storeProductRepository) SelectByCode(ctx context.Context, code string) (result *Product, err error) {
+	result = new(Product)
+	err = r.store.kv.view(func(tx kvTx) error {
+		return findOne(tx, config.ProductsCollection, bson.M{"code": code, "deleted_at": nil}, result)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Update a product at revision
+func (r storeProductRepository) Update(ctx context.Context, id bson.ObjectId, update *Product, revision int) (result *Product, err error) {
+	if err = validateFeatures(update.Features); err != nil {
+		return nil, err
+	}
+
+	err = r.store.kv.update(func(tx kvTx) error {
+		current := new(Product)
+		if err := findOne(tx, config.ProductsCollection, alive(id), current); err != nil {
+			return err
+		}
+		if err := checkRevision(revision, current.Revision); err != nil {
+			return err
+		}
+		err := unique(tx, config.ProductsCollection, id, "code", update.Code, "Product Code already exists")
+		if err != nil {
+			return err
+		}
+
+		update.ID = id
+		update.Revision = current.Revision + 1
+		update.DeletedAt = nil
+		if err = save(tx, config.ProductsCollection, id, update); err != nil {
+			return err
+		}
+
+		return storeAppendVersion(tx, config.ProductVersionsCollection, id, update, time.Now())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.SelectByID(ctx, id)
+}
+
+// Delete a product at revision
+func (r storeProductRepository) Delete(ctx context.Context, id bson.ObjectId, revision int) error {
+	return r.store.kv.update(func(tx kvTx) error {
+		return softDelete(tx, config.ProductsCollection, config.ProductVersionsCollection, id, revision, time.Now())
+	})
+}
+
+// Restore a deleted product
+func (r storeProductRepository) Restore(ctx context.Context, id bson.ObjectId) (*Product, error) {
+	err := r.store.kv.update(func(tx kvTx) error {
+		return restore(tx, config.ProductsCollection, config.ProductVersionsCollection, id, "Product is not deleted")
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.SelectByID(ctx, id)
+}
+
+// Purge a product & its versions
+func (r storeProductRepository) Purge(ctx context.Context, id bson.ObjectId) error {
+	return r.store.kv.update(func(tx kvTx) error {
+		return purge(tx, config.ProductsCollection, config.ProductVersionsCollection, id)
+	})
+}
+
+// ListVersions of a product
+func (r storeProductRepository) ListVersions(ctx context.Context, id bson.ObjectId) (results []*ProductVersion, err error) {
+	err = r.store.kv.view(func(tx kvTx) error {
+		return find(tx, config.ProductVersionsCollection, bson.M{"entity_id": id}, &results, "version")
+	})
+	return results, err
+}
+
+// SelectAsOf a product as it was at
+func (r storeProductRepository) SelectAsOf(ctx context.Context, id bson.ObjectId, at time.Time) (*Product, error) {
+	filter := asOf(at)
+	filter["entity_id"] = id
+
+	version := new(ProductVersion)
+	err := r.store.kv.view(func(tx kvTx) error {
+		return findOne(tx, config.ProductVersionsCollection, filter, version)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &version.Product, nil
+}
+
+// ListAsOf the products as they were at
+func (r storeProductRepository) ListAsOf(ctx context.Context, at time.Time) (results []*Product, err error) {
+	var versions []*ProductVersion
+	err = r.store.kv.view(func(tx kvTx) error {
+		return find(tx, config.ProductVersionsCollection, asOf(at), &versions)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range versions {
+		product := v.Product
+		results = append(results, &product)
+	}
+	return results, nil
+}
+
+// Create a customer, names are unique among deleted customers too
+func (r storeCustomerRepository) Create(ctx context.Context, customer *Customer) error {
+	if err := customer.validateProfile(); err != nil {
+		return err
+	}
+	customer.normalize()
+	if customer.Status == "" {
+		customer.Status = CustomerActive
+	}
+	if customer.ID == "" {
+		customer.ID = bson.NewObjectId()
+	}
+
+	return r.store.kv.update(func(tx kvTx) error {
+		existing := new(Customer)
+		err := findOne(tx, config.CustomersCollection, bson.M{"name": customer.Name}, existing)
+		if err == nil && existing.DeletedAt != nil {
+			return errors.New("Customer belongs to a deleted customer, restore it instead")
+		}
+		if err == nil {
+			return errors.New("Customer already exists")
+		}
+		if err != mgo.ErrNotFound {
+			return err
+		}
+
+		customer.Revision = 1
+		return insert(tx, config.CustomersCollection, customer.ID, customer)
+	})
+}
+
+// List live customers
+func (r storeCustomerRepository) List(ctx context.Context) (results []*Customer, err error) {
+	err = r.store.kv.view(func(tx kvTx) error {
+		return find(tx, config.CustomersCollection, bson.M{"deleted_at": nil}, &results)
+	})
+	return results, err
+}
+
+// Search a page of customers
+func (r storeCustomerRepository) Search(ctx context.Context, q *Query, includeDeleted bool) (results []*Customer, page *Page, err error) {
+	q.Filter = withDeleted(q.Filter, includeDeleted)
+	err = r.store.kv.view(func(tx kvTx) error {
+		page, err = paginateStore(tx, config.CustomersCollection, q, &results)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return results, page, nil
+}
+
+// FuzzySearch a page of customers by a misspelt name, closest first
+func (r storeCustomerRepository) FuzzySearch(ctx context.Context, q *Query, name string, includeDeleted bool) ([]*Customer, *Page, error) {
+	query, maxDistance, err := fuzzyName(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var customers []*Customer
+	err = r.store.kv.view(func(tx kvTx) error {
+		return find(tx, config.CustomersCollection, withDeleted(nil, includeDeleted), &customers)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var matches []fuzzyMatch
+	for _, customer := range customers {
+		if d := nameDistance(query, customer.NameLower); d <= maxDistance {
+			matches = append(matches, fuzzyMatch{id: customer.ID, distance: d})
+		}
+	}
+	matches, page, err := pageMatches(matches, q)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return scoreMatches(matches, customers), page, nil
+}
+
+// SelectByID a live customer
+func (r storeCustomerRepository) SelectByID(ctx context.Context, id bson.ObjectId) (result *Customer, err error) {
+	result = new(Customer)
+	err = r.store.kv.view(func(tx kvTx) error {
+		return findOne(tx, config.CustomersCollection, alive(id), result)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// SelectByIDs the live customers among ids
+func (r storeCustomerRepository) SelectByIDs(ctx context.Context, ids []bson.ObjectId) (results []*Customer, err error) {
+	err = r.store.kv.view(func(tx kvTx) error {
+		return find(tx, config.CustomersCollection, bson.M{"_id": bson.M{"$in": ids}, "deleted_at": nil}, &results)
+	})
+	return results, err
+}
+
+// SelectByNaturalKey a live customer by external reference, an unknown
+// reference falls back to the name of a customer that has none yet
+func (r storeCustomerRepository) SelectByNaturalKey(ctx context.Context, externalRef string, name string) (result *Customer, err error) {
+	result = new(Customer)
+	err = r.store.kv.view(func(tx kvTx) error {
+		filter := bson.M{"name": name, "deleted_at": nil}
+		if externalRef != "" {
+			err := findOne(tx, config.CustomersCollection, bson.M{"external_ref": externalRef, "deleted_at": nil}, result)
+			if err != mgo.ErrNotFound || name == "" {
+				return err
+			}
+			filter["external_ref"] = bson.M{"$in": []interface{}{"", nil}}
+		}
+		return findOne(tx, config.CustomersCollection, filter, result)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Update a customer at revision
+func (r storeCustomerRepository) Update(ctx context.Context, id bson.ObjectId, update *Customer, revision int) (result *Customer, err error) {
+	err = r.store.kv.update(func(tx kvTx) error {
+		current := new(Customer)
+		if err := findOne(tx, config.CustomersCollection, alive(id), current); err != nil {
+			return err
+		}
+		if err := checkRevision(revision, current.Revision); err != nil {
+			return err
+		}
+		if err := update.validateProfile(); err != nil {
+			return err
+		}
+
+		update.normalize()
+		if update.Status == "" {
+			update.Status = current.Status
+		}
+		err := unique(tx, config.CustomersCollection, id, "name", update.Name, "Customer already exists")
+		if err != nil {
+			return err
+		}
+
+		update.ID = id
+		update.Revision = current.Revision + 1
+		update.DeletedAt = nil
+		return save(tx, config.CustomersCollection, id, update)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.SelectByID(ctx, id)
+}
+
+// Delete a customer at revision
+func (r storeCustomerRepository) Delete(ctx context.Context, id bson.ObjectId, revision int) error {
+	return r.store.kv.update(func(tx kvTx) error {
+		return softDelete(tx, config.CustomersCollection, "", id, revision, time.Now())
+	})
+}
+
+// Restore a deleted customer
+func (r storeCustomerRepository) Restore(ctx context.Context, id bson.ObjectId) (*Customer, error) {
+	err := r.store.kv.update(func(tx kvTx) error {
+		return restore(tx, config.CustomersCollection, "", id, "Customer is not deleted")
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.SelectByID(ctx, id)
+}
+
+// Purge a customer, its rules & their versions go with it
+func (r storeCustomerRepository) Purge(ctx context.Context, id bson.ObjectId) error {
+	return r.store.kv.update(func(tx kvTx) error {
+		docs, err := match(tx, config.PricingRulesCollection, bson.M{"customer_id": id.Hex()})
+		if err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			ruleID, _ := doc.m["_id"].(bson.ObjectId)
+			if err = purge(tx, config.PricingRulesCollection, config.PricingRulesVersionsCollection, ruleID); err != nil {
+				return err
+			}
+		}
+		return purge(tx, config.CustomersCollection, "", id)
+	})
+}
+
+// liveRule fails when customerID already has a live rule for productCode
+func liveRule(tx kvTx, customerID string, productCode string) error {
+	docs, err := match(tx, config.PricingRulesCollection, bson.M{
+		"customer_id":  customerID,
+		"product_code": productCode,
+		"deleted_at":   nil,
+	})
+	if err != nil {
+		return err
+	}
+	if len(docs) > 0 {
+		return errors.New("Rules already exists for the same customer & product_code")
+	}
+	return nil
+}
+
+// Create a rule, a customer has one live rule per product
+func (r storePricingRuleRepository) Create(ctx context.Context, rules *PricingRules) error {
+	if err := rules.validateTerms(); err != nil {
+		return err
+	}
+	if rules.ID == "" {
+		rules.ID = bson.NewObjectId()
+	}
+
+	return r.store.kv.update(func(tx kvTx) error {
+		if err := liveRule(tx, rules.CustomerID, rules.ProductCode); err != nil {
+			return err
+		}
+
+		rules.Revision = 1
+		if err := insert(tx, config.PricingRulesCollection, rules.ID, rules); err != nil {
+			return err
+		}
+
+		return storeAppendVersion(tx, config.PricingRulesVersionsCollection, rules.ID, rules, time.Now())
+	})
+}
+
+// List a page of rules
+func (r storePricingRuleRepository) List(ctx context.Context, q *Query, includeDeleted bool) (results []*PricingRules, page *Page, err error) {
+	q.Filter = withDeleted(q.Filter, includeDeleted)
+	err = r.store.kv.view(func(tx kvTx) error {
+		page, err = paginateStore(tx, config.PricingRulesCollection, q, &results)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return results, page, nil
+}
+
+// Export every live rule, grouped by customer
+func (r storePricingRuleRepository) Export(ctx context.Context) (results []*PricingRules, err error) {
+	err = r.store.kv.view(func(tx kvTx) error {
+		return find(tx, config.PricingRulesCollection, bson.M{"deleted_at": nil}, &results, "customer_id", "product_code")
+	})
+	return results, err
+}
+
+// SelectByID a live rule
+func (r storePricingRuleRepository) SelectByID(ctx context.Context, id bson.ObjectId) (result *PricingRules, err error) {
+	result = new(PricingRules)
+	err = r.store.kv.view(func(tx kvTx) error {
+		return findOne(tx, config.PricingRulesCollection, alive(id), result)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// SelectByCustomerID the live rules of a customer
+func (r storePricingRuleRepository) SelectByCustomerID(ctx context.Context, id string) (results []*PricingRules, err error) {
+	err = r.store.kv.view(func(tx kvTx) error {
+		return find(tx, config.PricingRulesCollection, bson.M{"customer_id": id, "deleted_at": nil}, &results)
+	})
+	return results, err
+}
+
+// SelectByCustomerIDs the live rules of many customers
+func (r storePricingRuleRepository) SelectByCustomerIDs(ctx context.Context, ids []string) (results []*PricingRules, err error) {
+	err = r.store.kv.view(func(tx kvTx) error {
+		return find(tx, config.PricingRulesCollection, bson.M{"customer_id": bson.M{"$in": ids}, "deleted_at": nil}, &results)
+	})
+	return results, err
+}
+
+// Update a rule at revision
+func (r storePricingRuleRepository) Update(ctx context.Context, id bson.ObjectId, update *PricingRules, revision int) (result *PricingRules, err error) {
+	if err = update.validateTerms(); err != nil {
+		return nil, err
+	}
+	err = r.store.kv.update(func(tx kvTx) error {
+		current := new(PricingRules)
+		if err := findOne(tx, config.PricingRulesCollection, alive(id), current); err != nil {
+			return err
+		}
+		if err := checkRevision(revision, current.Revision); err != nil {
+			return err
+		}
+
+		update.ID = id
+		update.Revision = current.Revision + 1
+		update.DeletedAt = nil
+		if err := save(tx, config.PricingRulesCollection, id, update); err != nil {
+			return err
+		}
+
+		return storeAppendVersion(tx, config.PricingRulesVersionsCollection, id, update, time.Now())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.SelectByID(ctx, id)
+}
+
+// Delete a rule at revision
+func (r storePricingRuleRepository) Delete(ctx context.Context, id bson.ObjectId, revision int) error {
+	return r.store.kv.update(func(tx kvTx) error {
+		return softDelete(tx, config.PricingRulesCollection, config.PricingRulesVersionsCollection, id, revision, time.Now())
+	})
+}
+
+// Restore a deleted rule, unless a new rule has taken its place since
+func (r storePricingRuleRepository) Restore(ctx context.Context, id bson.ObjectId) (*PricingRules, error) {
+	err := r.store.kv.update(func(tx kvTx) error {
+		current := new(PricingRules)
+		if err := load(tx, config.PricingRulesCollection, id, current); err != nil {
+			return err
+		}
+		if current.DeletedAt != nil {
+			if err := liveRule(tx, current.CustomerID, current.ProductCode); err != nil {
+				return err
+			}
+		}
+		return restore(tx, config.PricingRulesCollection, config.PricingRulesVersionsCollection, id, "Rules is not deleted")
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.SelectByID(ctx, id)
+}
+
+// Purge a rule & its versions
+func (r storePricingRuleRepository) Purge(ctx context.Context, id bson.ObjectId) error {
+	return r.store.kv.update(func(tx kvTx) error {
+		return purge(tx, config.PricingRulesCollection, config.PricingRulesVersionsCollection, id)
+	})
+}
+
+// ListVersions of a rule
+func (r storePricingRuleRepository) ListVersions(ctx context.Context, id bson.ObjectId) (results []*PricingRulesVersion, err error) {
+	err = r.store.kv.view(func(tx kvTx) error {
+		return find(tx, config.PricingRulesVersionsCollection, bson.M{"entity_id": id}, &results, "version")
+	})
+	return results, err
+}
+
+// SelectAsOf a rule as it was at
+func (r storePricingRuleRepository) SelectAsOf(ctx context.Context, id bson.ObjectId, at time.Time) (*PricingRules, error) {
+	filter := asOf(at)
+	filter["entity_id"] = id
+
+	version := new(PricingRulesVersion)
+	err := r.store.kv.view(func(tx kvTx) error {
+		return findOne(tx, config.PricingRulesVersionsCollection, filter, version)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &version.Rule, nil
+}
+
+// SelectByCustomerIDAsOf a customer's rules as they were at
+func (r storePricingRuleRepository) SelectByCustomerIDAsOf(ctx context.Context, id string, at time.Time) ([]*PricingRules, error) {
+	filter := asOf(at)
+	filter["document.customer_id"] = id
+	return r.rulesAsOf(filter)
+}
+
+// SelectByCustomerIDsAsOf many customers' rules as they were at
+func (r storePricingRuleRepository) SelectByCustomerIDsAsOf(ctx context.Context, ids []string, at time.Time) ([]*PricingRules, error) {
+	filter := asOf(at)
+	filter["document.customer_id"] = bson.M{"$in": ids}
+	return r.rulesAsOf(filter)
+}
+
+// rulesAsOf reads the rules of the versions matching filter
+func (r storePricingRuleRepository) rulesAsOf(filter bson.M) (results []*PricingRules, err error) {
+	var versions []*PricingRulesVersion
+	err = r.store.kv.view(func(tx kvTx) error {
+		return find(tx, config.PricingRulesVersionsCollection, filter, &versions)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range versions {
+		rule := v.Rule
+		results = append(results, &rule)
+	}
+	return results, nil
+}
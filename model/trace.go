@@ -0,0 +1,37 @@
+package model
+
+import (
+	"context"
+	"time"
+
+	"../config"
+	"../metrics"
+	"../tracing"
+	"github.com/globalsign/mgo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// operation starts a mongo operation on collection, in a span under the
+// one of ctx, the returned func ends it with the error it gave & records
+// its latency. meant to be deferred as the operation begins
+func operation(ctx context.Context, collection string, name string) func(err *error) {
+	start := time.Now()
+	_, span := tracing.Tracer().Start(ctx, "mongo "+collection+"."+name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "mongodb"),
+			attribute.String("db.name", config.DbName),
+			attribute.String("db.mongodb.collection", collection),
+			attribute.String("db.operation", name),
+		))
+
+	return func(err *error) {
+		// not finding a document is an answer, not a failure
+		if err != nil && *err != nil && *err != mgo.ErrNotFound {
+			tracing.Fail(span, *err)
+		}
+		span.End()
+		metrics.MongoOperation(collection, name, start)
+	}
+}
@@ -0,0 +1,328 @@
+package model
+
+import (
+	"context"
+	"time"
+
+	"../config"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+type (
+	// ProductVersion struct
+	ProductVersion struct {
+		ID            bson.ObjectId `json:"id,omitempty" bson:"_id,omitempty"`
+		ProductID     bson.ObjectId `json:"product_id" bson:"entity_id"`
+		Version       int           `json:"version" bson:"version"`
+		EffectiveFrom time.Time     `json:"effective_from" bson:"effective_from"`
+		EffectiveTo   *time.Time    `json:"effective_to" bson:"effective_to"`
+		Product       Product       `json:"product" bson:"document"`
+	}
+
+	// PricingRulesVersion struct
+	PricingRulesVersion struct {
+		ID            bson.ObjectId `json:"id,omitempty" bson:"_id,omitempty"`
+		RuleID        bson.ObjectId `json:"rule_id" bson:"entity_id"`
+		Version       int           `json:"version" bson:"version"`
+		EffectiveFrom time.Time     `json:"effective_from" bson:"effective_from"`
+		EffectiveTo   *time.Time    `json:"effective_to" bson:"effective_to"`
+		Rule          PricingRules  `json:"rule" bson:"document"`
+	}
+)
+
+// VersionIndexing to create indices
+// ----------------------------------------------------------------------
+func VersionIndexing() error {
+	for _, collection := range []string{config.ProductVersionsCollection, config.PricingRulesVersionsCollection} {
+		c := DB.Copy().DB(config.DbName).C(collection)
+		err := c.EnsureIndex(mgo.Index{
+			Key:    []string{"entity_id", "version"},
+			Unique: true,
+		})
+		if err != nil {
+			return err
+		}
+		err = c.EnsureIndex(mgo.Index{
+			Key:    []string{"effective_from", "effective_to"},
+			Unique: false,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	c := DB.Copy().DB(config.DbName).C(config.PricingRulesVersionsCollection)
+	err := c.EnsureIndex(mgo.Index{
+		Key:    []string{"document.customer_id", "effective_from"},
+		Unique: false,
+	})
+	if err != nil {
+		return err
+	}
+
+	// documents left unchanged since before history was kept have no
+	// version, they would be missing from every as of read
+	versioned := map[string]string{
+		config.ProductsCollection:     config.ProductVersionsCollection,
+		config.PricingRulesCollection: config.PricingRulesVersionsCollection,
+	}
+	for collection, versions := range versioned {
+		if err = backfillVersions(DB.Copy(), collection, versions); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillVersions gives every document of collection without a version a
+// first one, in effect from its creation until its deletion if any
+func backfillVersions(db *mgo.Session, collection string, versions string) (err error) {
+	defer db.Close()
+	c := db.DB(config.DbName).C(versions)
+
+	var ids []bson.ObjectId
+	if err = c.Find(nil).Distinct("entity_id", &ids); err != nil {
+		return err
+	}
+	has := map[bson.ObjectId]bool{}
+	for _, id := range ids {
+		has[id] = true
+	}
+
+	var doc bson.M
+	iter := db.DB(config.DbName).C(collection).Find(nil).Iter()
+	for iter.Next(&doc) {
+		id, ok := doc["_id"].(bson.ObjectId)
+		if !ok || has[id] {
+			continue
+		}
+		var to *time.Time
+		if deletedAt, ok := doc["deleted_at"].(time.Time); ok {
+			to = &deletedAt
+		}
+		err = c.Insert(bson.M{
+			"entity_id":      id,
+			"version":        1,
+			"effective_from": id.Time(),
+			"effective_to":   to,
+			"document":       doc,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+// asOf matches the versions that were in effect at the given time
+func asOf(at time.Time) bson.M {
+	return bson.M{
+		"effective_from": bson.M{"$lte": at},
+		"$or": []bson.M{
+			{"effective_to": nil},
+			{"effective_to": bson.M{"$gt": at}},
+		},
+	}
+}
+
+// appendVersion closes the version currently in effect & stores doc as
+// the next one, effective from at. versions are never modified otherwise
+func appendVersion(db *mgo.Session, collection string, id bson.ObjectId, doc interface{}, at time.Time) (err error) {
+	c := db.DB(config.DbName).C(collection)
+
+	if err = closeVersion(db, collection, id, at); err != nil {
+		return err
+	}
+
+	var last struct {
+		Version int `bson:"version"`
+	}
+	err = c.Find(bson.M{"entity_id": id}).Sort("-version").One(&last)
+	if err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+
+	return c.Insert(bson.M{
+		"entity_id":      id,
+		"version":        last.Version + 1,
+		"effective_from": at,
+		"effective_to":   nil,
+		"document":       doc,
+	})
+}
+
+// closeVersion ends the version currently in effect, eg. on delete
+func closeVersion(db *mgo.Session, collection string, id bson.ObjectId, at time.Time) (err error) {
+	c := db.DB(config.DbName).C(collection)
+
+	_, err = c.UpdateAll(bson.M{
+		"entity_id":    id,
+		"effective_to": nil,
+	}, bson.M{"$set": bson.M{"effective_to": at}})
+
+	return err
+}
+
+// ensureVersioned backfills a first version for documents created before
+// history was kept, effective from the document's creation time
+func ensureVersioned(db *mgo.Session, collection string, id bson.ObjectId, doc interface{}) (err error) {
+	c := db.DB(config.DbName).C(collection)
+
+	numRows, err := c.Find(bson.M{"entity_id": id}).Count()
+	if err != nil || numRows > 0 {
+		return err
+	}
+
+	return c.Insert(bson.M{
+		"entity_id":      id,
+		"version":        1,
+		"effective_from": id.Time(),
+		"effective_to":   nil,
+		"document":       doc,
+	})
+}
+
+// ListProductVersions cRud
+// ----------------------------------------------------------------------
+func ListProductVersions(ctx context.Context, id bson.ObjectId) (results []*ProductVersion, err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.ProductVersionsCollection, "ListProductVersions")(&err)
+	c := db.DB(config.DbName).C(config.ProductVersionsCollection)
+
+	err = c.Find(bson.M{"entity_id": id}).Sort("version").All(&results)
+	if err != nil {
+		return nil, err
+	}
+
+	return results, err
+}
+
+// SelectProductAsOf cRud
+// ----------------------------------------------------------------------
+func SelectProductAsOf(ctx context.Context, id bson.ObjectId, at time.Time) (result *Product, err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.ProductVersionsCollection, "SelectProductAsOf")(&err)
+	c := db.DB(config.DbName).C(config.ProductVersionsCollection)
+
+	filter := asOf(at)
+	filter["entity_id"] = id
+
+	var version *ProductVersion
+	err = c.Find(filter).One(&version)
+	if err != nil {
+		return nil, err
+	}
+
+	return &version.Product, err
+}
+
+// ListProductAsOf cRud
+// ----------------------------------------------------------------------
+func ListProductAsOf(ctx context.Context, at time.Time) (results []*Product, err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.ProductVersionsCollection, "ListProductAsOf")(&err)
+	c := db.DB(config.DbName).C(config.ProductVersionsCollection)
+
+	var versions []*ProductVersion
+	err = c.Find(asOf(at)).All(&versions)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range versions {
+		product := v.Product
+		results = append(results, &product)
+	}
+
+	return results, err
+}
+
+// ListPricingRulesVersions cRud
+// ----------------------------------------------------------------------
+func ListPricingRulesVersions(ctx context.Context, id bson.ObjectId) (results []*PricingRulesVersion, err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.PricingRulesVersionsCollection, "ListPricingRulesVersions")(&err)
+	c := db.DB(config.DbName).C(config.PricingRulesVersionsCollection)
+
+	err = c.Find(bson.M{"entity_id": id}).Sort("version").All(&results)
+	if err != nil {
+		return nil, err
+	}
+
+	return results, err
+}
+
+// SelectPricingRulesAsOf cRud
+// ----------------------------------------------------------------------
+func SelectPricingRulesAsOf(ctx context.Context, id bson.ObjectId, at time.Time) (result *PricingRules, err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.PricingRulesVersionsCollection, "SelectPricingRulesAsOf")(&err)
+	c := db.DB(config.DbName).C(config.PricingRulesVersionsCollection)
+
+	filter := asOf(at)
+	filter["entity_id"] = id
+
+	var version *PricingRulesVersion
+	err = c.Find(filter).One(&version)
+	if err != nil {
+		return nil, err
+	}
+
+	return &version.Rule, err
+}
+
+// SelectPricingRulesByCustomerIDAsOf cRud
+// ----------------------------------------------------------------------
+func SelectPricingRulesByCustomerIDAsOf(ctx context.Context, id string, at time.Time) (results []*PricingRules, err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.PricingRulesVersionsCollection, "SelectPricingRulesByCustomerIDAsOf")(&err)
+	c := db.DB(config.DbName).C(config.PricingRulesVersionsCollection)
+
+	filter := asOf(at)
+	filter["document.customer_id"] = id
+
+	var versions []*PricingRulesVersion
+	err = c.Find(filter).All(&versions)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range versions {
+		rule := v.Rule
+		results = append(results, &rule)
+	}
+
+	return results, err
+}
+
+// SelectPricingRulesByCustomerIDsAsOf cRud
+// ----------------------------------------------------------------------
+func SelectPricingRulesByCustomerIDsAsOf(ctx context.Context, ids []string, at time.Time) (results []*PricingRules, err error) {
+	db := DB.Clone()
+	defer db.Close()
+	defer operation(ctx, config.PricingRulesVersionsCollection, "SelectPricingRulesByCustomerIDsAsOf")(&err)
+	c := db.DB(config.DbName).C(config.PricingRulesVersionsCollection)
+
+	filter := asOf(at)
+	filter["document.customer_id"] = bson.M{"$in": ids}
+
+	var versions []*PricingRulesVersion
+	err = c.Find(filter).All(&versions)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range versions {
+		rule := v.Rule
+		results = append(results, &rule)
+	}
+
+	return results, err
+}
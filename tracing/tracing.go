@@ -0,0 +1,90 @@
+// Package tracing sets up opentelemetry: spans are sent to an OTLP
+// collector or written to stdout & trace context is propagated the W3C way
+package tracing
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// name of the instrumentation, the service is named by Setup
+const name = "github.com/kayrules/jobads-api"
+
+// shutdownTimeout bounds flushing the spans still buffered on Close
+const shutdownTimeout = 5 * time.Second
+
+// Tracer of the service, its spans go nowhere until Setup
+func Tracer() trace.Tracer {
+	return otel.Tracer(name)
+}
+
+// Propagator reads & writes the W3C traceparent, tracestate & baggage
+// headers
+func Propagator() propagation.TextMapPropagator {
+	return otel.GetTextMapPropagator()
+}
+
+// Setup exports the spans of service at version: "otlp" sends them to
+// endpoint, "stdout" prints them & "none" drops them. ratio of new traces
+// are sampled, traces begun upstream follow the caller's decision. the
+// returned func flushes the spans still buffered
+func Setup(exporter string, endpoint string, ratio float64, service string, version string) (func() error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var spans sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case "none":
+		return func() error { return nil }, nil
+	case "otlp":
+		spans, err = otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	case "stdout":
+		spans, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, errors.New("Unknown tracing exporter " + exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", service),
+		attribute.String("service.version", version),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spans),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		return provider.Shutdown(ctx)
+	}, nil
+}
+
+// Fail marks span as failed with err
+func Fail(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}